@@ -59,7 +59,7 @@ func BenchmarkLibmqttClient(b *testing.B) {
 	})
 
 	b.ResetTimer()
-	client.Connect(func(server string, code byte, err error) {
+	client.Connect(func(server string, code lib.ReasonCode, err error) {
 		if err != nil {
 			b.Error(err)
 		} else if code != lib.CodeSuccess {
@@ -137,7 +137,7 @@ func Libmqtt_handle(client C.int, topic *C.char, h C.libmqtt_topic_handler) {
 //export Libmqtt_connect
 func Libmqtt_connect(client C.int, h C.libmqtt_conn_handler) {
 	if c, ok := clients[int(client)]; ok {
-		c.Connect(func(server string, code byte, err error) {
+		c.Connect(func(server string, code mqtt.ReasonCode, err error) {
 			var er *C.char
 			if err != nil {
 				er = C.CString(err.Error())
@@ -21,15 +21,23 @@ import (
 	"context"
 	"crypto/tls"
 	"errors"
-	"math"
+	"io"
 	"net"
+	"reflect"
+	"sort"
+	"strings"
 	"sync"
+	"sync/atomic"
 	"time"
 )
 
 var (
 	// ErrTimeOut connection timeout error
-	ErrTimeOut = errors.New("connection timeout ")
+	ErrTimeOut = newKindError(ErrNetwork, "connection timeout ")
+
+	// ErrPacketInFlight is the error happened when publishing a packet
+	// which is still being published
+	ErrPacketInFlight = errors.New("packet already in flight ")
 )
 
 // Client type for *AsyncClient
@@ -50,6 +58,79 @@ func NewClient(options ...Option) (Client, error) {
 		return nil, errors.New("no server provided, won't work ")
 	}
 
+	c.log = newFieldLogger(c.options.logger, "client_id", c.options.clientID)
+	c.persistErrC = make(chan error, persistErrChanSize)
+
+	// errors happened in Load and Range of persist methods
+	reportPersistErrors(c.persist, c.notifyPersistErr)
+	if c.offline != nil {
+		reportPersistErrors(c.offline.persist, c.notifyPersistErr)
+	}
+
+	// persist in the namespace of the session
+	session := c.session()
+	if session.ClientID == "" && c.persists() {
+		c.log.w("CLI empty client id, persisted session is shared with other clients without client id")
+	}
+
+	c.persist = newSessionPersist(c.persist, session)
+	if err := adoptUnscoped(c.persist); err != nil {
+		c.log.w("CLI move persisted packets into session failed", "err", err)
+	}
+
+	// persist methods of offline queue and retained cache are wrapped
+	// first and set once, packets are restored with the final method
+	var offline, retained PersistMethod
+	if c.offline != nil {
+		offline = newSessionPersist(c.offline.persist, session)
+		if err := adoptUnscoped(offline); err != nil {
+			c.log.w("CLI move persisted packets into session failed", "err", err)
+		}
+	}
+	if c.retained != nil {
+		retained = newSessionPersist(c.retained.persist, session)
+	}
+
+	if c.options.cleanSession {
+		// discard session state persisted in previous run
+		if err := cleanSessionState(c.persist); err != nil {
+			c.log.w("CLI clean session state failed", "err", err)
+		}
+	}
+
+	if _, ok := c.metrics.(noneMetrics); !ok {
+		c.persist = newMetricsPersist(c.persist, c.metrics)
+		offline = newMetricsPersist(offline, c.metrics)
+		c.idGen.onChange = c.metrics.InFlight
+	}
+
+	if c.persist != NonePersist {
+		c.persistQ = newPersistQueue(c.ctx, c.persist, c.options.persistQueueSize, c.options.persistPolicy, c.notifyPersistErr)
+		c.persist = c.persistQ
+		go c.persistQ.run()
+	}
+
+	if c.offline != nil {
+		if offline != NonePersist {
+			c.offlineQ = newPersistQueue(c.ctx, offline, c.options.persistQueueSize, c.options.persistPolicy, c.notifyPersistErr)
+			offline = c.offlineQ
+			go c.offlineQ.run()
+		}
+		c.offline.setPersist(offline)
+	}
+
+	if c.retained != nil {
+		if retained != NonePersist {
+			c.retainedQ = newPersistQueue(c.ctx, retained, c.options.persistQueueSize, c.options.persistPolicy, c.notifyPersistErr)
+			retained = c.retainedQ
+			go c.retainedQ.run()
+		}
+		c.retained.setPersist(retained)
+	}
+	if c.persists() {
+		go c.closePersist()
+	}
+
 	c.sendC = make(chan Packet, c.options.sendChanSize)
 	c.recvC = make(chan *PublishPacket, c.options.recvChanSize)
 
@@ -65,8 +146,25 @@ type AsyncClient struct {
 	idGen   *idGenerator        // Packet id generator
 	router  TopicRouter         // Topic router
 	persist PersistMethod       // Persist method
+	offline *offlineQueue       // publish queue used when no connection alive
+	online  int32               // count of connections alive
+	tokens  *sync.Map           // completion tokens of packets sent
+	conns   *sync.Map           // connections alive, server -> *clientConn
+	states  *connStates         // connection states of servers
 	workers *sync.WaitGroup     // Workers (goroutines)
-	log     *logger             // client logger
+	log     *fieldLogger        // client logger
+	metrics Metrics             // client metrics
+	tracer  Tracer              // client tracer
+	spans   *sync.Map           // trace spans of packets sent
+
+	persistQ    *persistQueue  // queue of persist operations, nil if not persisted
+	offlineQ    *persistQueue  // queue of offline queue persist operations, nil if not persisted
+	retainedQ   *persistQueue  // queue of retained cache persist operations, nil if not persisted
+	persistErrC chan error     // persist errors to report
+	retained    *retainedCache // cache of retained messages, nil if not enabled
+
+	inbound  interceptorChain // interceptors for packets received
+	outbound interceptorChain // interceptors for packets to send
 
 	// success/error handlers
 	pubHandler     PubHandler
@@ -74,11 +172,15 @@ type AsyncClient struct {
 	unSubHandler   UnSubHandler
 	netHandler     NetHandler
 	persistHandler PersistHandler
+	stateHandler   StateHandler
 
 	ctx  context.Context    // closure of this channel will signal all client worker to stop
 	exit context.CancelFunc // called when client exit
 }
 
+// persistErrChanSize is the size of buffered persist errors to report
+const persistErrChanSize = 64
+
 // create a client with default options
 func defaultClient() *AsyncClient {
 	ctx, cancel := context.WithCancel(context.TODO())
@@ -92,6 +194,7 @@ func defaultClient() *AsyncClient {
 			dialTimeout:      20 * time.Second,
 			keepalive:        2 * time.Minute,
 			keepaliveFactor:  1.5,
+			keepaliveMissed:  1,
 			protoVersion:     V311,
 			protoCompromise:  false,
 			defaultTlsConfig: &tls.Config{},
@@ -103,25 +206,143 @@ func defaultClient() *AsyncClient {
 		idGen:   newIDGenerator(),
 		workers: &sync.WaitGroup{},
 		persist: NonePersist,
+		tokens:  &sync.Map{},
+		conns:   &sync.Map{},
+		states:  newConnStates(),
+		metrics: noneMetrics{},
+		spans:   &sync.Map{},
 	}
 }
 
-// Handle register subscription message route
+// Handle register subscription message route, with StandardRouter
+// (the default is TextRouter), topic not a valid topic filter
+// (see ValidateTopicFilter) is logged and ignored
 func (c *AsyncClient) Handle(topic string, h TopicHandler) {
-	if h != nil {
-		c.log.d("HDL registered topic handler, topic =", topic)
-		c.router.Handle(topic, h)
+	if h == nil {
+		return
+	}
+
+	if _, ok := c.router.(*StandardRouter); ok {
+		if err := ValidateTopicFilter(topic); err != nil {
+			c.log.e("HDL topic handler rejected", "topic", topic, "err", err)
+			return
+		}
+	}
+
+	c.log.d("HDL registered topic handler", "topic", topic)
+	c.router.Handle(topic, h)
+}
+
+// session returns the session of the client persisted in
+func (c *AsyncClient) session() Session {
+	servers := append(append([]string(nil), c.options.servers...), c.options.secureServers...)
+	// reordering servers keeps the session
+	sort.Strings(servers)
+	return Session{Server: strings.Join(servers, ","), ClientID: c.options.clientID}
+}
+
+// closePersist closes persist methods implementing io.Closer after the
+// client exited and pending persist operations are done
+func (c *AsyncClient) closePersist() {
+	<-c.ctx.Done()
+	for _, q := range []*persistQueue{c.persistQ, c.offlineQ, c.retainedQ} {
+		if q != nil {
+			<-q.done
+		}
+	}
+
+	methods := []PersistMethod{c.persist}
+	if c.offline != nil {
+		methods = append(methods, c.offline.persist)
+	}
+	if c.retained != nil {
+		methods = append(methods, c.retained.persist)
+	}
+
+	var closed []io.Closer
+	for _, m := range methods {
+		closer, ok := unwrapPersist(m).(io.Closer)
+		if !ok || containsCloser(closed, closer) {
+			continue
+		}
+
+		closed = append(closed, closer)
+		if err := closer.Close(); err != nil {
+			c.log.w("CLI close persist method failed", "err", err)
+		}
 	}
 }
 
+// unwrapPersist returns the persist method provided in options
+func unwrapPersist(method PersistMethod) PersistMethod {
+	for {
+		switch m := method.(type) {
+		case *persistQueue:
+			method = m.method
+		case *sessionPersist:
+			method = m.method
+		case *metricsPersist:
+			method = m.PersistMethod
+		default:
+			return method
+		}
+	}
+}
+
+// containsCloser checks whether closer is in closers, closers
+// not comparable are never contained
+func containsCloser(closers []io.Closer, closer io.Closer) bool {
+	if !reflect.TypeOf(closer).Comparable() {
+		return false
+	}
+
+	for _, c := range closers {
+		if c == closer {
+			return true
+		}
+	}
+	return false
+}
+
+// persists checks whether any session state is persisted
+func (c *AsyncClient) persists() bool {
+	return c.persist != NonePersist ||
+		(c.offline != nil && c.offline.persist != NonePersist) ||
+		(c.retained != nil && c.retained.persist != NonePersist)
+}
+
+// Retained returns the latest message of the topic in the retained message
+// cache (see WithRetainedCache), the message should not be modified
+//
+// messages expired (see MessageExpiryInterval) are not returned
+func (c *AsyncClient) Retained(topic string) (*PublishPacket, bool) {
+	if c.retained == nil {
+		return nil, false
+	}
+
+	return c.retained.get(topic)
+}
+
+// RangeRetained ranges messages of topics matching the topic filter in the
+// retained message cache (see WithRetainedCache) in topic order, all
+// messages are ranged if the filter is empty, ranging stops when f
+// returns false
+func (c *AsyncClient) RangeRetained(filter string, f func(p *PublishPacket) bool) {
+	if c.retained == nil || f == nil {
+		return
+	}
+
+	c.retained.rangeMsgs(filter, f)
+}
+
 // ConnectAndWait connect to servers and wait for results
 func (c *AsyncClient) ConnectAndWait(h ConnHandler) {
-	// c.log.d("CLI connect to server, handle =", h)
+	// c.log.d("CLI connect to server")
 }
 
 // Connect to all designated server
 func (c *AsyncClient) Connect(h ConnHandler) {
-	c.log.d("CLI connect to server, handler =", h)
+	c.log.d("CLI connect to server", "servers", c.options.servers, "secure_servers", c.options.secureServers)
 
 	for _, s := range c.options.servers {
 		c.workers.Add(1)
@@ -133,65 +354,431 @@ func (c *AsyncClient) Connect(h ConnHandler) {
 		go c.connect(s, true, h, c.options.protoVersion, c.options.firstDelay)
 	}
 
-	c.workers.Add(2)
+	c.workers.Add(3)
 	go c.handleTopicMsg()
 	go c.handleMsg()
+	go c.handlePersistErr()
 }
 
 // Publish message(s) to topic(s), one to one
+//
+// if offline queue enabled (see WithOfflineQueue), message(s) published
+// when no connection alive will be queued and sent after connected
 func (c *AsyncClient) Publish(msg ...*PublishPacket) {
 	if c.isClosing() {
 		return
 	}
 
 	for _, m := range msg {
+		c.publish(context.Background(), m, true)
+	}
+}
+
+// TryPublish is the non-blocking version of Publish, it returns
+// ErrQueueFull at the first message can not be sent or queued
+// without blocking, message(s) after that one won't be published
+func (c *AsyncClient) TryPublish(msg ...*PublishPacket) error {
+	if c.isClosing() {
+		return ErrClientClosed
+	}
+
+	for _, m := range msg {
+		if err := c.publish(context.Background(), m, false); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// PublishAsync publish message(s) to topic(s), one to one, and returns
+// the completion token of each message, in the same order of messages,
+// a message still in flight is not published again and its token fails
+// with ErrPacketInFlight
+//
+// ctx is passed to Tracer.StartPublish as the parent of publish spans
+// (see WithTracer), cancelling it doesn't cancel the publish
+func (c *AsyncClient) PublishAsync(ctx context.Context, msg ...*PublishPacket) []*Token {
+	tokens := make([]*Token, len(msg))
+	for i, m := range msg {
 		if m == nil {
+			tokens[i] = newToken(c.ctx)
+			tokens[i].finish(nil, ErrEncodeBadPacket)
 			continue
 		}
 
-		p := m
-		if p.Qos > Qos2 {
-			p.Qos = Qos2
+		if c.pubInFlight(m) {
+			tokens[i] = newToken(c.ctx)
+			tokens[i].finish(nil, ErrPacketInFlight)
+			continue
 		}
 
-		if p.Qos != Qos0 {
-			if p.PacketID == 0 {
-				p.PacketID = c.idGen.next(p)
-				if err := c.persist.Store(sendKey(p.PacketID), p); err != nil {
-					notifyPersistMsg(c.msgC, err)
-				}
+		var ok bool
+		if tokens[i], ok = c.track(m); !ok {
+			continue
+		}
+
+		if c.isClosing() {
+			c.finishToken(m, nil, ErrClientClosed)
+			continue
+		}
+
+		if err := c.publish(ctx, m, true); err != nil {
+			c.finishToken(m, nil, err)
+		}
+	}
+
+	return tokens
+}
+
+// PublishSync publish message(s) to topic(s), one to one, and wait until
+// all of them are done or ctx is done, returns the first error occurred
+//
+// ctx is also the parent of publish spans, the same as PublishAsync
+func (c *AsyncClient) PublishSync(ctx context.Context, msg ...*PublishPacket) error {
+	return waitTokens(ctx, c.PublishAsync(ctx, msg...))
+}
+
+func (c *AsyncClient) publish(ctx context.Context, p *PublishPacket, block bool) error {
+	if p == nil {
+		return nil
+	}
+
+	if err := checkPubTopic(p); err != nil {
+		c.log.w("CLI publish packet rejected", "packet_type", "Publish", "topic", p.TopicName, "err", err)
+		c.finishToken(p, nil, err)
+		if block {
+			go notifyPubMsg(c.msgC, p.TopicName, err)
+		}
+		return err
+	}
+
+	if p.Qos > Qos2 {
+		p.Qos = Qos2
+	}
+
+	if c.pubInFlight(p) {
+		// the token and span belong to the publish in flight
+		c.log.w("CLI publish packet rejected", "packet_type", "Publish", "packet_id", p.PacketID, "topic", p.TopicName, "err", ErrPacketInFlight)
+		if block {
+			go notifyPubMsg(c.msgC, p.TopicName, ErrPacketInFlight)
+		}
+		return ErrPacketInFlight
+	}
+
+	if c.tracer != nil {
+		// trace context is injected when sent with MQTT 5 connection
+		span, t := c.tracer.StartPublish(ctx, p.TopicName, ExtractTrace(p))
+		c.spans.Store(p, &pubSpan{span: span, trace: t})
+	}
+
+	if p.Qos != Qos0 {
+		// packet id of previous publish (if any) has been released,
+		// queued packet gets a new one when flushed
+		p.PacketID = 0
+	}
+
+	if c.offline != nil {
+		queued, dropped, err := c.offline.offer(c.ctx, p, atomic.LoadInt32(&c.online) > 0, block)
+		if dropped != nil {
+			// oldest or newest packet dropped
+			c.log.w("CLI offline queue full, dropped packet", "packet_type", "Publish", "topic", dropped.TopicName)
+			c.dropPub(dropped, ErrQueueFull)
+			go notifyPubMsg(c.msgC, dropped.TopicName, ErrQueueFull)
+		}
+
+		if queued {
+			c.log.v("CLI queued publish packet", "packet_type", "Publish", "topic", p.TopicName)
+			c.notifyPersistErr(err)
+			return nil
+		}
+
+		if dropped == p {
+			return nil
+		}
+
+		if err != nil {
+			c.log.w("CLI publish packet rejected", "packet_type", "Publish", "topic", p.TopicName, "err", err)
+			c.dropPub(p, err)
+			if block {
+				go notifyPubMsg(c.msgC, p.TopicName, err)
 			}
+			return err
 		}
-		c.sendC <- p
 	}
+
+	if p.Qos != Qos0 {
+		p.PacketID = c.idGen.next(p)
+		if err := c.storePub(p); err != nil {
+			c.log.w("CLI publish packet rejected", "packet_type", "Publish", "packet_id", p.PacketID, "topic", p.TopicName, "err", err)
+			c.dropPub(p, err)
+			if block {
+				go notifyPubMsg(c.msgC, p.TopicName, err)
+			}
+			return err
+		}
+	}
+
+	if block {
+		select {
+		case <-c.ctx.Done():
+			c.finishToken(p, nil, ErrClientClosed)
+			return ErrClientClosed
+		case c.sendC <- p:
+			return nil
+		}
+	}
+
+	select {
+	case c.sendC <- p:
+		return nil
+	default:
+		c.dropPub(p, ErrQueueFull)
+		return ErrQueueFull
+	}
+}
+
+// storePub persists the publish packet to send, the error is returned
+// when the publish should fail according to the PersistPolicy
+func (c *AsyncClient) storePub(p *PublishPacket) error {
+	key := sendKey(p.PacketID)
+	if c.persistQ == nil {
+		c.notifyPersistErr(c.persist.Store(key, p))
+		return nil
+	}
+
+	err := c.persistQ.storePub(key, p)
+	if c.options.persistPolicy != PersistFailPublish {
+		c.notifyPersistErr(err)
+		return nil
+	}
+	return err
+}
+
+// notifyPersistErr reports the persist error to the PersistHandler without
+// blocking, errors are dropped when the handler can't keep up with them
+func (c *AsyncClient) notifyPersistErr(err error) {
+	if err == nil {
+		return
+	}
+
+	select {
+	case c.persistErrC <- err:
+	default:
+		c.log.w("CLI persist error dropped", "err", err)
+	}
+}
+
+func (c *AsyncClient) handlePersistErr() {
+	defer c.workers.Done()
+
+	for {
+		select {
+		case <-c.ctx.Done():
+			return
+		case err := <-c.persistErrC:
+			if c.persistHandler != nil {
+				c.persistHandler(err)
+			}
+		}
+	}
+}
+
+// dropPub release the packet id and persisted data of
+// the publish packet which won't be sent
+func (c *AsyncClient) dropPub(p *PublishPacket, err error) {
+	c.finishToken(p, nil, err)
+	if p.Qos == Qos0 {
+		return
+	}
+
+	if originPkt, ok := c.idGen.getExtra(p.PacketID); ok && originPkt == p {
+		c.idGen.free(p.PacketID)
+		c.notifyPersistErr(c.persist.Delete(sendKey(p.PacketID)))
+	}
+}
+
+// rejectPkt fails the publish, subscribe or unsubscribe packet
+// rejected before sending
+func (c *AsyncClient) rejectPkt(pkt Packet, err error) {
+	switch p := pkt.(type) {
+	case *PublishPacket:
+		c.dropPub(p, err)
+		notifyPubMsg(c.msgC, p.TopicName, err)
+	case *SubscribePacket:
+		c.finishToken(p, nil, err)
+		c.idGen.free(p.PacketID)
+		c.notifyPersistErr(c.persist.Delete(sendKey(p.PacketID)))
+		notifySubMsg(c.msgC, p.Topics, err)
+	case *UnSubPacket:
+		c.finishToken(p, nil, err)
+		c.idGen.free(p.PacketID)
+		c.notifyPersistErr(c.persist.Delete(sendKey(p.PacketID)))
+		notifyUnSubMsg(c.msgC, p.TopicNames, err)
+	}
+}
+
+// checkPubTopic validates the topic name of the publish packet,
+// empty topic name is allowed with topic alias in MQTT 5
+func checkPubTopic(p *PublishPacket) error {
+	if p.TopicName == "" && p.Props != nil && p.Props.TopicAlias != 0 {
+		return nil
+	}
+	return ValidateTopicName(p.TopicName)
 }
 
 // Subscribe topic(s)
+//
+// invalid topic filters (see ValidateTopicFilter) are only reported to the
+// SubHandler asynchronously, use SubscribeAsync or SubscribeSync to get
+// the error from the call
 func (c *AsyncClient) Subscribe(topics ...*Topic) {
 	if c.isClosing() {
 		return
 	}
 
-	c.log.d("CLI subscribe, topic(s) =", topics)
+	c.subscribe(&SubscribePacket{Topics: topics})
+}
 
+// SubscribeAsync subscribe topic(s) and returns the completion token,
+// granted QoS (or failure code) per topic can be found in Token.Codes,
+// the token is already failed when returned if any topic filter is invalid
+func (c *AsyncClient) SubscribeAsync(topics ...*Topic) *Token {
 	s := &SubscribePacket{Topics: topics}
-	s.PacketID = c.idGen.next(s)
+	t, _ := c.track(s)
+	if c.isClosing() {
+		c.finishToken(s, nil, ErrClientClosed)
+		return t
+	}
+
+	if err := c.subscribe(s); err != nil {
+		c.finishToken(s, nil, err)
+	}
+	return t
+}
+
+// SubscribeSync subscribe topic(s) and wait until subscribed or ctx is done
+func (c *AsyncClient) SubscribeSync(ctx context.Context, topics ...*Topic) error {
+	return c.SubscribeAsync(topics...).Wait(ctx)
+}
+
+func (c *AsyncClient) subscribe(s *SubscribePacket) error {
+	c.log.d("CLI subscribe", "packet_type", "Subscribe", "packet_id", s.PacketID, "topics", s.Topics)
+
+	for _, t := range s.Topics {
+		if err := ValidateTopicFilter(t.Name); err != nil {
+			c.log.w("CLI subscribe packet rejected", "packet_type", "Subscribe", "topic", t.Name, "err", err)
+			go notifySubMsg(c.msgC, s.Topics, err)
+			return err
+		}
+	}
 
-	c.sendC <- s
+	s.PacketID = c.idGen.next(s)
+	select {
+	case <-c.ctx.Done():
+		c.idGen.free(s.PacketID)
+		return ErrClientClosed
+	case c.sendC <- s:
+		return nil
+	}
 }
 
 // UnSubscribe topic(s)
+//
+// invalid topic filters (see ValidateTopicFilter) are only reported to the
+// UnSubHandler asynchronously, use UnSubscribeAsync or UnSubscribeSync to
+// get the error from the call
 func (c *AsyncClient) UnSubscribe(topics ...string) {
 	if c.isClosing() {
 		return
 	}
 
-	c.log.d("CLI unsubscribe topic(s) =", topics)
+	c.unSubscribe(&UnSubPacket{TopicNames: topics})
+}
 
+// UnSubscribeAsync unsubscribe topic(s) and returns the completion token,
+// the token is already failed when returned if any topic filter is invalid
+func (c *AsyncClient) UnSubscribeAsync(topics ...string) *Token {
 	u := &UnSubPacket{TopicNames: topics}
+	t, _ := c.track(u)
+	if c.isClosing() {
+		c.finishToken(u, nil, ErrClientClosed)
+		return t
+	}
+
+	if err := c.unSubscribe(u); err != nil {
+		c.finishToken(u, nil, err)
+	}
+	return t
+}
+
+// UnSubscribeSync unsubscribe topic(s) and wait until unsubscribed or ctx is done
+func (c *AsyncClient) UnSubscribeSync(ctx context.Context, topics ...string) error {
+	return c.UnSubscribeAsync(topics...).Wait(ctx)
+}
+
+func (c *AsyncClient) unSubscribe(u *UnSubPacket) error {
+	c.log.d("CLI unsubscribe", "packet_type", "UnSub", "packet_id", u.PacketID, "topics", u.TopicNames)
+
+	for _, t := range u.TopicNames {
+		if err := ValidateTopicFilter(t); err != nil {
+			c.log.w("CLI unsubscribe packet rejected", "packet_type", "UnSub", "topic", t, "err", err)
+			go notifyUnSubMsg(c.msgC, u.TopicNames, err)
+			return err
+		}
+	}
+
 	u.PacketID = c.idGen.next(u)
+	select {
+	case <-c.ctx.Done():
+		c.idGen.free(u.PacketID)
+		return ErrClientClosed
+	case c.sendC <- u:
+		return nil
+	}
+}
+
+// track creates the completion token for the packet, a packet already
+// tracked is not tracked again, and its token fails with ErrPacketInFlight
+func (c *AsyncClient) track(p Packet) (*Token, bool) {
+	t := newToken(c.ctx)
+	if _, loaded := c.tokens.LoadOrStore(p, t); loaded {
+		t.finish(nil, ErrPacketInFlight)
+		return t, false
+	}
+	return t, true
+}
+
+// pubInFlight reports whether the publish packet is still being published,
+// either queued, waiting for acknowledgement or traced
+func (c *AsyncClient) pubInFlight(p *PublishPacket) bool {
+	if _, ok := c.spans.Load(p); ok {
+		return true
+	}
+
+	if c.offline != nil && c.offline.contains(p) {
+		return true
+	}
+
+	if p.Qos == Qos0 || p.PacketID == 0 {
+		return false
+	}
 
-	c.sendC <- u
+	originPkt, ok := c.idGen.getExtra(p.PacketID)
+	return ok && originPkt == p
+}
+
+// finishToken finish the completion token and trace span of the packet (if any),
+// err should be derived from ack with the negotiated protocol version
+func (c *AsyncClient) finishToken(p Packet, ack Packet, err error) {
+	if t, ok := c.tokens.Load(p); ok {
+		c.tokens.Delete(p)
+		t.(*Token).finish(ack, err)
+	}
+
+	if s, ok := c.spans.LoadAndDelete(p); ok {
+		s.(*pubSpan).span.End(err)
+	}
 }
 
 // Wait will wait for all connection to exit
@@ -207,7 +794,7 @@ func (c *AsyncClient) Wait() {
 // Destroy will disconnect form all server
 // If force is true, then close connection without sending a DisConnPacket
 func (c *AsyncClient) Destroy(force bool) {
-	c.log.d("CLI destroying client with force =", force)
+	c.log.d("CLI destroying client", "force", force)
 	if force {
 		c.exit()
 	} else {
@@ -239,6 +826,31 @@ func (c *AsyncClient) HandleNet(h NetHandler) {
 	c.netHandler = h
 }
 
+// HandleState register handler for connection state change
+func (c *AsyncClient) HandleState(h StateHandler) {
+	c.log.d("CLI registered state handler")
+	c.stateHandler = h
+}
+
+// State of connection to the server, the server should be
+// one of the servers provided in client creation call
+func (c *AsyncClient) State(server string) ConnState {
+	return c.states.get(server)
+}
+
+// setState change connection state of server and notify state handler
+func (c *AsyncClient) setState(server string, to ConnState) {
+	from, changed := c.states.set(server, to)
+	if !changed {
+		return
+	}
+
+	c.log.d("CLI connection state changed", "server", server, "from", from, "to", to)
+	if c.stateHandler != nil {
+		c.stateHandler(server, from, to)
+	}
+}
+
 // HandlePersist register handler for net error
 func (c *AsyncClient) HandlePersist(h PersistHandler) {
 	c.log.d("CLI registered persist handler")
@@ -247,7 +859,14 @@ func (c *AsyncClient) HandlePersist(h PersistHandler) {
 
 // connect to one server and start mqtt logic
 func (c *AsyncClient) connect(server string, secure bool, h ConnHandler, version ProtoVersion, reconnectDelay time.Duration) {
-	defer c.workers.Done()
+	defer func() {
+		if c.isClosing() {
+			c.setState(server, StateClosed)
+		}
+		c.workers.Done()
+	}()
+
+	c.setState(server, StateConnecting)
 
 	var (
 		conn net.Conn
@@ -263,28 +882,30 @@ func (c *AsyncClient) connect(server string, secure bool, h ConnHandler, version
 		// with tls
 		conn, err = tls.DialWithDialer(&net.Dialer{Timeout: c.options.dialTimeout}, "tcp", server, tlsConfig)
 		if err != nil {
-			c.log.e("CLI connect with tls failed, err =", err, "server =", server, "secure_server =", secure)
+			c.log.e("CLI connect with tls failed", "server", server, "secure_server", secure, "err", err)
 			if h != nil {
-				go h(server, math.MaxUint8, err)
+				go h(server, CodeUnspecifiedError, wrapNetErr(server, err))
 			}
 
 			if c.options.autoReconnect && !c.isClosing() {
 				goto reconnect
 			}
+			c.setState(server, StateDisconnected)
 			return
 		}
 	} else {
 		// without tls
 		conn, err = net.DialTimeout("tcp", server, c.options.dialTimeout)
 		if err != nil {
-			c.log.e("CLI connect failed, err =", err, "server =", server)
+			c.log.e("CLI connect failed", "server", server, "err", err)
 			if h != nil {
-				go h(server, math.MaxUint8, err)
+				go h(server, CodeUnspecifiedError, wrapNetErr(server, err))
 			}
 
 			if c.options.autoReconnect && !c.isClosing() {
 				goto reconnect
 			}
+			c.setState(server, StateDisconnected)
 			return
 		}
 	}
@@ -298,18 +919,28 @@ func (c *AsyncClient) connect(server string, secure bool, h ConnHandler, version
 			protoVersion: version,
 			parent:       c,
 			name:         server,
+			log:          c.log.with("server", server),
 			conn:         conn,
-			connRW:       bufio.NewReadWriter(bufio.NewReader(conn), bufio.NewWriter(conn)),
-			keepaliveC:   make(chan int),
+			connRW:       &countReadWriter{ReadWriter: bufio.NewReadWriter(bufio.NewReader(conn), bufio.NewWriter(conn))},
 			logicSendC:   make(chan Packet),
+			sendExit:     make(chan struct{}),
 			netRecvC:     make(chan Packet),
 		}
+		connImpl.decoder = NewDecoder(version, connImpl.connRW)
+		connImpl.decoder.SetMaxPacketSize(int(c.options.maxPacketSize))
+		connImpl.decoder.SetStrict(c.options.strictDecoding)
 		connImpl.ctx, connImpl.exit = context.WithCancel(c.ctx)
+		c.setState(server, StateAuthenticating)
 
 		c.workers.Add(2)
 		go connImpl.handleSend()
 		go connImpl.handleRecv()
 
+		var connProps *ConnProps
+		if c.options.maxPacketSize > 0 {
+			connProps = &ConnProps{MaxPacketSize: c.options.maxPacketSize}
+		}
+
 		connImpl.send(&ConnPacket{
 			Username:     c.options.username,
 			Password:     c.options.password,
@@ -321,6 +952,7 @@ func (c *AsyncClient) connect(server string, secure bool, h ConnHandler, version
 			WillMessage:  c.options.willPayload,
 			WillRetain:   c.options.willRetain,
 			Keepalive:    uint16(c.options.keepalive / time.Second),
+			Props:        connProps,
 		})
 
 		dialTimer := time.NewTimer(c.options.dialTimeout)
@@ -331,9 +963,12 @@ func (c *AsyncClient) connect(server string, secure bool, h ConnHandler, version
 		case pkt, more := <-connImpl.netRecvC:
 			if !more {
 				if h != nil {
-					go h(server, math.MaxUint8, ErrDecodeBadPacket)
+					// decode, io, keepalive or interceptor error
+					err := connImpl.lostErr()
+					go h(server, reasonCodeOf(err), err)
 				}
 				close(connImpl.logicSendC)
+				c.setState(server, StateDisconnected)
 				return
 			}
 
@@ -349,44 +984,68 @@ func (c *AsyncClient) connect(server string, secure bool, h ConnHandler, version
 					}
 
 					if h != nil {
-						go h(server, p.Code, nil)
+						go h(server, p.Code, reasonErrorOf(version, p))
 					}
+					c.setState(server, StateDisconnected)
 					return
 				}
+
+				if p.Props != nil && p.Props.MaxPacketSize > 0 {
+					atomic.StoreInt64(&connImpl.maxSendSize, int64(p.Props.MaxPacketSize))
+				}
 			} else {
 				close(connImpl.logicSendC)
 				if h != nil {
-					go h(server, math.MaxUint8, ErrDecodeBadPacket)
+					go h(server, CodeProtoError, ErrDecodeBadPacket)
 				}
+				c.setState(server, StateDisconnected)
 				return
 			}
 		case <-dialTimer.C:
 			close(connImpl.logicSendC)
 			if h != nil {
-				go h(server, math.MaxUint8, ErrTimeOut)
+				go h(server, CodeUnspecifiedError, ErrTimeOut)
 			}
+			c.setState(server, StateDisconnected)
 			return
 		}
 
-		c.log.i("CLI connected to server =", server)
+		c.log.i("CLI connected to server", "server", server)
+		c.setState(server, StateConnected)
 		if h != nil {
 			go h(server, CodeSuccess, nil)
 		}
 
+		atomic.AddInt32(&c.online, 1)
+		c.conns.Store(server, connImpl)
+		if c.offline != nil {
+			c.workers.Add(1)
+			go c.flushOffline(connImpl.ctx)
+		}
+
 		// login success, start mqtt logic
 		connImpl.logic()
+		connImpl.exit()
+		c.conns.Delete(server)
+		atomic.AddInt32(&c.online, -1)
 
 		if c.isClosing() {
 			return
 		}
+
+		err = connImpl.lostErr()
+		c.log.e("CLI connection lost", "server", server, "err", err)
+		go notifyNetMsg(c.msgC, server, err)
 	}
 reconnect:
 	// reconnect
-	c.log.e("CLI reconnecting to server =", server, "delay =", reconnectDelay)
-	time.Sleep(reconnectDelay)
-
-	if c.isClosing() {
+	c.setState(server, StateReconnecting)
+	c.metrics.Reconnect(server)
+	c.log.e("CLI reconnecting to server", "server", server, "delay", reconnectDelay)
+	select {
+	case <-c.ctx.Done():
 		return
+	case <-time.After(reconnectDelay):
 	}
 
 	reconnectDelay = time.Duration(float64(reconnectDelay) * c.options.backOffFactor)
@@ -398,6 +1057,42 @@ reconnect:
 	go c.connect(server, secure, h, version, reconnectDelay)
 }
 
+// Ping sends PingReqPacket to all servers connected and waits for responses,
+// returns the longest round trip time
+func (c *AsyncClient) Ping(ctx context.Context) (time.Duration, error) {
+	var conns []*clientConn
+	c.conns.Range(func(key, value interface{}) bool {
+		conns = append(conns, value.(*clientConn))
+		return true
+	})
+
+	if len(conns) == 0 {
+		return 0, ErrNotConnected
+	}
+
+	var max time.Duration
+	for _, conn := range conns {
+		rtt, err := conn.pingWait(ctx)
+		if err != nil {
+			return 0, err
+		}
+
+		if rtt > max {
+			max = rtt
+		}
+	}
+	return max, nil
+}
+
+// RTT returns the round trip time of the last ping to server,
+// 0 if not connected or no ping finished
+func (c *AsyncClient) RTT(server string) time.Duration {
+	if conn, ok := c.conns.Load(server); ok {
+		return time.Duration(atomic.LoadInt64(&conn.(*clientConn).rtt))
+	}
+	return 0
+}
+
 func (c *AsyncClient) isClosing() bool {
 	select {
 	case <-c.ctx.Done():
@@ -407,6 +1102,64 @@ func (c *AsyncClient) isClosing() bool {
 	}
 }
 
+// flushOffline send queued publish packets in order, stop when
+// the connection lost and restart with another connection alive
+func (c *AsyncClient) flushOffline(ctx context.Context) {
+	defer c.workers.Done()
+
+	if !c.offline.startFlush() {
+		return
+	}
+
+	for p, key := c.offline.next(); p != nil; p, key = c.offline.next() {
+		if p.Qos != Qos0 {
+			// packet id is allocated when leaving the queue
+			p.PacketID = c.idGen.next(p)
+			if err := c.storePub(p); err != nil {
+				c.log.w("CLI queued publish packet rejected", "packet_type", "Publish", "packet_id", p.PacketID, "topic", p.TopicName, "err", err)
+				c.dropPub(p, err)
+				c.notifyPersistErr(c.offline.deleteKey(key))
+				continue
+			}
+		}
+
+		select {
+		case <-ctx.Done():
+			if p.Qos != Qos0 {
+				// packet id allocated again when flushed next time
+				c.idGen.free(p.PacketID)
+				c.notifyPersistErr(c.persist.Delete(sendKey(p.PacketID)))
+				p.PacketID = 0
+			}
+			c.offline.abort(p, key)
+			c.restartFlush()
+			return
+		case c.sendC <- p:
+			c.log.v("CLI flushed offline publish packet", "packet_type", "Publish", "packet_id", p.PacketID, "topic", p.TopicName)
+			c.notifyPersistErr(c.offline.deleteKey(key))
+		}
+	}
+}
+
+// restartFlush flushes the offline queue with any connection alive,
+// queued packets are kept until connected if there is none
+func (c *AsyncClient) restartFlush() {
+	if c.isClosing() {
+		return
+	}
+
+	c.conns.Range(func(key, value interface{}) bool {
+		conn := value.(*clientConn)
+		if conn.ctx.Err() != nil {
+			return true
+		}
+
+		c.workers.Add(1)
+		go c.flushOffline(conn.ctx)
+		return false
+	})
+}
+
 func (c *AsyncClient) handleTopicMsg() {
 	defer c.workers.Done()
 
@@ -419,7 +1172,22 @@ func (c *AsyncClient) handleTopicMsg() {
 				return
 			}
 
+			var span Span
+			if c.tracer != nil {
+				span = c.tracer.StartReceive(pkt.TopicName, ExtractTrace(pkt))
+			}
+
+			if c.retained != nil {
+				c.notifyPersistErr(c.retained.record(pkt))
+			}
+
+			start := time.Now()
 			c.router.Dispatch(pkt)
+			c.metrics.DispatchLatency(time.Since(start))
+
+			if span != nil {
+				span.End(nil)
+			}
 		}
 	}
 }
@@ -453,10 +1221,6 @@ func (c *AsyncClient) handleMsg() {
 				if c.netHandler != nil {
 					go c.netHandler(m.msg, m.err)
 				}
-			case persistMsg:
-				if c.persistHandler != nil {
-					go c.persistHandler(m.err)
-				}
 			}
 		}
 	}
@@ -17,32 +17,79 @@
 package libmqtt
 
 import (
-	"bufio"
 	"context"
+	"errors"
 	"net"
+	"sync"
+	"sync/atomic"
 	"time"
 )
 
+var (
+	// ErrKeepaliveTimeout is the error happened when no PingRespPacket
+	// received from server in time
+	ErrKeepaliveTimeout = newKindError(ErrNetwork, "keepalive timeout ")
+
+	// ErrConnLost is the error happened when connection lost
+	// without a certain reason
+	ErrConnLost = newKindError(ErrNetwork, "connection lost ")
+
+	// ErrNotConnected is the error happened when no connection alive
+	ErrNotConnected = newKindError(ErrNetwork, "not connected ")
+)
+
 // clientConn is the wrapper of connection to server
 // tend to actual packet send and receive
 type clientConn struct {
 	protoVersion ProtoVersion       // mqtt protocol version
 	parent       Client             // client which created this connection
 	name         string             // server addr info
+	log          *fieldLogger       // logger with server info
 	conn         net.Conn           // connection to server
-	connRW       *bufio.ReadWriter  // make buffered connection
+	connRW       *countReadWriter   // make buffered connection
+	decoder      *Decoder           // packet decoder reading from connRW
 	logicSendC   chan Packet        // logic send channel
+	sendExit     chan struct{}      // closed when send handler exited
 	netRecvC     chan Packet        // received packet from server
-	keepaliveC   chan int           // keepalive packet
 	ctx          context.Context    // context for single connection
 	exit         context.CancelFunc // terminate this connection if necessary
+	errOnce      sync.Once          // make sure only the first error recorded
+	err          error              // error caused connection lost
+	lastSent     int64              // unix nano time of last packet sent, accessed atomically
+	rtt          int64              // round trip time of last ping, accessed atomically
+	maxSendSize  int64              // max packet size accepted by server, accessed atomically
+	pingMu       sync.Mutex         // guards pings
+	pings        []*pingReq         // pings waiting for PingRespPacket, in order of sending
+}
+
+// pingReq is a PingReqPacket waiting for response
+type pingReq struct {
+	sentAt time.Time
+	done   chan time.Duration
+}
+
+// closeWith terminate this connection with the error caused it
+func (c *clientConn) closeWith(err error) {
+	c.errOnce.Do(func() {
+		c.err = err
+	})
+	c.exit()
+}
+
+// lostErr is the error caused connection lost, no more error will be
+// recorded after this call
+func (c *clientConn) lostErr() error {
+	c.errOnce.Do(func() {
+		c.err = ErrConnLost
+	})
+	return c.err
 }
 
 // start mqtt logic
 func (c *clientConn) logic() {
 	defer func() {
 		c.conn.Close()
-		c.parent.log.e("NET exit logic for server =", c.name)
+		c.log.e("NET exit logic")
 	}()
 
 	// start keepalive if required
@@ -63,7 +110,7 @@ func (c *clientConn) logic() {
 			switch pkt.(type) {
 			case *SubAckPacket:
 				p := pkt.(*SubAckPacket)
-				c.parent.log.v("NET received SubAck, id =", p.PacketID)
+				c.log.v("NET received SubAck", "packet_type", "SubAck", "packet_id", p.PacketID)
 
 				if originPkt, ok := c.parent.idGen.getExtra(p.PacketID); ok {
 					switch originPkt.(type) {
@@ -75,81 +122,86 @@ func (c *clientConn) logic() {
 								v.Qos = p.Codes[i]
 							}
 						}
-						c.parent.log.d("NET subscribed topics =", originSub.Topics)
-						notifySubMsg(c.parent.msgC, originSub.Topics, nil)
+						c.log.d("NET subscribed", "packet_type", "SubAck", "packet_id", p.PacketID, "topics", originSub.Topics)
+						err := reasonErrorOf(c.protoVersion, p)
+						c.parent.finishToken(originSub, p, err)
+						notifySubMsg(c.parent.msgC, originSub.Topics, err)
 						c.parent.idGen.free(p.PacketID)
 
-						notifyPersistMsg(c.parent.msgC, c.parent.persist.Delete(sendKey(p.PacketID)))
+						c.parent.notifyPersistErr(c.parent.persist.Delete(sendKey(p.PacketID)))
 					}
 				}
 			case *UnSubAckPacket:
 				p := pkt.(*UnSubAckPacket)
-				c.parent.log.v("NET received UnSubAck, id =", p.PacketID)
+				c.log.v("NET received UnSubAck", "packet_type", "UnSubAck", "packet_id", p.PacketID)
 
 				if originPkt, ok := c.parent.idGen.getExtra(p.PacketID); ok {
 					switch originPkt.(type) {
 					case *UnSubPacket:
 						originUnSub := originPkt.(*UnSubPacket)
-						c.parent.log.d("NET unSubscribed topics", originUnSub.TopicNames)
-						notifyUnSubMsg(c.parent.msgC, originUnSub.TopicNames, nil)
+						c.log.d("NET unSubscribed", "packet_type", "UnSubAck", "packet_id", p.PacketID, "topics", originUnSub.TopicNames)
+						err := reasonErrorOf(c.protoVersion, p)
+						c.parent.finishToken(originUnSub, p, err)
+						notifyUnSubMsg(c.parent.msgC, originUnSub.TopicNames, err)
 						c.parent.idGen.free(p.PacketID)
 
-						notifyPersistMsg(c.parent.msgC, c.parent.persist.Delete(sendKey(p.PacketID)))
+						c.parent.notifyPersistErr(c.parent.persist.Delete(sendKey(p.PacketID)))
 					}
 				}
 			case *PublishPacket:
 				p := pkt.(*PublishPacket)
-				c.parent.log.v("NET received publish, topic =", p.TopicName, "id =", p.PacketID, "QoS =", p.Qos)
+				c.log.v("NET received publish", "packet_type", "Publish", "packet_id", p.PacketID, "topic", p.TopicName, "qos", p.Qos)
 				// received server publish, send to client
 				c.parent.recvC <- p
 
-				// tend to QoS
-				switch p.Qos {
-				case Qos1:
-					c.parent.log.d("NET send PubAck for Publish, id =", p.PacketID)
-					c.send(&PubAckPacket{PacketID: p.PacketID})
-
-					notifyPersistMsg(c.parent.msgC, c.parent.persist.Store(recvKey(p.PacketID), pkt))
-				case Qos2:
-					c.parent.log.d("NET send PubRecv for Publish, id =", p.PacketID)
-					c.send(&PubRecvPacket{PacketID: p.PacketID})
-
-					notifyPersistMsg(c.parent.msgC, c.parent.persist.Store(recvKey(p.PacketID), pkt))
-				}
+				c.ackPublish(p)
 			case *PubAckPacket:
 				p := pkt.(*PubAckPacket)
-				c.parent.log.v("NET received PubAck, id =", p.PacketID)
+				c.log.v("NET received PubAck", "packet_type", "PubAck", "packet_id", p.PacketID)
 
 				if originPkt, ok := c.parent.idGen.getExtra(p.PacketID); ok {
 					switch originPkt.(type) {
 					case *PublishPacket:
 						originPub := originPkt.(*PublishPacket)
 						if originPub.Qos == Qos1 {
-							c.parent.log.d("NET published qos1 packet, topic =", originPub.TopicName)
-							notifyPubMsg(c.parent.msgC, originPub.TopicName, nil)
+							c.log.d("NET published qos1 packet", "packet_type", "PubAck", "packet_id", p.PacketID, "topic", originPub.TopicName)
+							err := reasonErrorOf(c.protoVersion, p)
+							c.parent.finishToken(originPub, p, err)
+							notifyPubMsg(c.parent.msgC, originPub.TopicName, err)
 							c.parent.idGen.free(p.PacketID)
 
-							notifyPersistMsg(c.parent.msgC, c.parent.persist.Delete(sendKey(p.PacketID)))
+							c.parent.notifyPersistErr(c.parent.persist.Delete(sendKey(p.PacketID)))
 						}
 					}
 				}
 			case *PubRecvPacket:
 				p := pkt.(*PubRecvPacket)
-				c.parent.log.v("NET received PubRec, id =", p.PacketID)
+				c.log.v("NET received PubRecv", "packet_type", "PubRecv", "packet_id", p.PacketID)
 
 				if originPkt, ok := c.parent.idGen.getExtra(p.PacketID); ok {
 					switch originPkt.(type) {
 					case *PublishPacket:
 						originPub := originPkt.(*PublishPacket)
 						if originPub.Qos == Qos2 {
+							if err := reasonErrorOf(c.protoVersion, p); err != nil {
+								// publish failed, no PubRel should be sent
+								c.log.e("NET publish qos2 packet failed", "packet_type", "PubRecv", "packet_id", p.PacketID, "topic", originPub.TopicName, "err", err)
+								c.parent.finishToken(originPub, p, err)
+								notifyPubMsg(c.parent.msgC, originPub.TopicName, err)
+								c.parent.idGen.free(p.PacketID)
+
+								c.parent.notifyPersistErr(c.parent.persist.Delete(sendKey(p.PacketID)))
+								break
+							}
+
 							c.send(&PubRelPacket{PacketID: p.PacketID})
-							c.parent.log.d("NET send PubRel, id =", p.PacketID)
+							c.log.d("NET send PubRel", "packet_type", "PubRel", "packet_id", p.PacketID)
 						}
 					}
 				}
 			case *PubRelPacket:
 				p := pkt.(*PubRelPacket)
-				c.parent.log.v("NET send PubRel, id =", p.PacketID)
+				c.log.v("NET received PubRel", "packet_type", "PubRel", "packet_id", p.PacketID)
 
 				if originPkt, ok := c.parent.idGen.getExtra(p.PacketID); ok {
 					switch originPkt.(type) {
@@ -157,15 +209,15 @@ func (c *clientConn) logic() {
 						originPub := originPkt.(*PublishPacket)
 						if originPub.Qos == Qos2 {
 							c.send(&PubCompPacket{PacketID: p.PacketID})
-							c.parent.log.d("NET send PubComp, id =", p.PacketID)
+							c.log.d("NET send PubComp", "packet_type", "PubComp", "packet_id", p.PacketID)
 
-							notifyPersistMsg(c.parent.msgC, c.parent.persist.Store(recvKey(p.PacketID), pkt))
+							c.parent.notifyPersistErr(c.parent.persist.Store(recvKey(p.PacketID), pkt))
 						}
 					}
 				}
 			case *PubCompPacket:
 				p := pkt.(*PubCompPacket)
-				c.parent.log.v("NET received PubComp, id =", p.PacketID)
+				c.log.v("NET received PubComp", "packet_type", "PubComp", "packet_id", p.PacketID)
 
 				if originPkt, ok := c.parent.idGen.getExtra(p.PacketID); ok {
 					switch originPkt.(type) {
@@ -173,96 +225,267 @@ func (c *clientConn) logic() {
 						originPub := originPkt.(*PublishPacket)
 						if originPub.Qos == Qos2 {
 							c.send(&PubRelPacket{PacketID: p.PacketID})
-							c.parent.log.d("NET send PubRel, id =", p.PacketID)
-							c.parent.log.d("NET published qos2 packet, topic =", originPub.TopicName)
-							notifyPubMsg(c.parent.msgC, originPub.TopicName, nil)
+							c.log.d("NET send PubRel", "packet_type", "PubRel", "packet_id", p.PacketID)
+							c.log.d("NET published qos2 packet", "packet_type", "PubComp", "packet_id", p.PacketID, "topic", originPub.TopicName)
+							err := reasonErrorOf(c.protoVersion, p)
+							c.parent.finishToken(originPub, p, err)
+							notifyPubMsg(c.parent.msgC, originPub.TopicName, err)
 							c.parent.idGen.free(p.PacketID)
 
-							notifyPersistMsg(c.parent.msgC, c.parent.persist.Delete(sendKey(p.PacketID)))
+							c.parent.notifyPersistErr(c.parent.persist.Delete(sendKey(p.PacketID)))
 						}
 					}
 				}
+			case *DisConnPacket:
+				p := pkt.(*DisConnPacket)
+				c.log.i("NET received DisConn", "packet_type", "DisConn", "code", p.Code)
+
+				if err := reasonErrorOf(c.protoVersion, p); err != nil {
+					c.closeWith(err)
+				}
 			default:
-				c.parent.log.v("NET received packet, type =", pkt.Type())
+				c.log.v("NET received packet", "packet_type", ctrlTypeName(pkt.Type()))
 			}
 		}
 	}
 }
 
-// keepalive with server
+// tend to QoS of publish packet received
+func (c *clientConn) ackPublish(p *PublishPacket) {
+	switch p.Qos {
+	case Qos1:
+		c.log.d("NET send PubAck for Publish", "packet_type", "PubAck", "packet_id", p.PacketID)
+		c.send(&PubAckPacket{PacketID: p.PacketID})
+
+		c.parent.notifyPersistErr(c.parent.persist.Store(recvKey(p.PacketID), p))
+	case Qos2:
+		c.log.d("NET send PubRecv for Publish", "packet_type", "PubRecv", "packet_id", p.PacketID)
+		c.send(&PubRecvPacket{PacketID: p.PacketID})
+
+		c.parent.notifyPersistErr(c.parent.persist.Store(recvKey(p.PacketID), p))
+	}
+}
+
+// keepalive with server, ping only when no packet sent in the interval
 func (c *clientConn) keepalive() {
-	c.parent.log.d("NET start keepalive")
+	c.log.d("NET start keepalive")
 
-	t := time.NewTicker(c.parent.options.keepalive * 3 / 4)
+	interval := c.parent.options.keepalive * 3 / 4
 	timeout := time.Duration(float64(c.parent.options.keepalive) * c.parent.options.keepaliveFactor)
-	timeoutTimer := time.NewTimer(timeout)
+	idleTimer := time.NewTimer(interval)
+
+	var (
+		pong      <-chan time.Duration // response of the ping in progress
+		pingTimer *time.Timer          // timeout of the ping in progress
+		missed    int                  // count of continuous missed pings
+	)
+
+	stopPing := func() {
+		if pingTimer != nil {
+			pingTimer.Stop()
+		}
+		pong, pingTimer = nil, nil
+	}
+
+	startPing := func() bool {
+		var err error
+		if pong, err = c.ping(c.ctx); err != nil {
+			return false
+		}
+		pingTimer = time.NewTimer(timeout)
+		return true
+	}
 
 	defer func() {
-		t.Stop()
-		timeoutTimer.Stop()
-		c.parent.log.d("NET stop keepalive for server =", c.name)
+		idleTimer.Stop()
+		stopPing()
+		c.log.d("NET stop keepalive")
 		c.parent.workers.Done()
 	}()
 
 	for {
+		var pingTimeout <-chan time.Time
+		if pingTimer != nil {
+			pingTimeout = pingTimer.C
+		}
+
 		select {
 		case <-c.ctx.Done():
 			return
-		case <-t.C:
-			c.send(PingReqPacket)
+		case <-idleTimer.C:
+			if idle := time.Since(time.Unix(0, atomic.LoadInt64(&c.lastSent))); idle < interval {
+				idleTimer.Reset(interval - idle)
+				continue
+			}
+			idleTimer.Reset(interval)
 
-			select {
-			case <-c.ctx.Done():
+			if pong == nil && !startPing() {
 				return
-			case _, more := <-c.keepaliveC:
-				if !more {
-					return
-				}
-
-				timeoutTimer.Reset(timeout)
-			case <-timeoutTimer.C:
-				c.parent.log.i("NET keepalive timeout")
+			}
+		case <-pong:
+			missed = 0
+			stopPing()
+		case <-pingTimeout:
+			missed++
+			// the response (if any) is matched to the next ping
+			c.dropPing(pong)
+			stopPing()
+
+			if missed >= c.parent.options.keepaliveMissed {
+				c.log.i("NET keepalive timeout", "missed", missed)
 				// exit client connection
-				c.exit()
+				c.closeWith(ErrKeepaliveTimeout)
+				return
+			}
+
+			c.log.w("NET keepalive ping missed", "missed", missed)
+			if !startPing() {
 				return
 			}
 		}
 	}
 }
 
+// ping sends PingReqPacket to server, the round trip time will be
+// sent to the returned channel when PingRespPacket received
+func (c *clientConn) ping(ctx context.Context) (<-chan time.Duration, error) {
+	req := &pingReq{sentAt: time.Now(), done: make(chan time.Duration, 1)}
+
+	// server responds pings in order
+	c.pingMu.Lock()
+	c.pings = append(c.pings, req)
+	c.pingMu.Unlock()
+
+	var err error
+	select {
+	case <-c.ctx.Done():
+		err = c.lostErr()
+	case <-ctx.Done():
+		err = ctx.Err()
+	case c.logicSendC <- PingReqPacket:
+		return req.done, nil
+	}
+
+	// not sent, no response for it
+	c.dropPing(req.done)
+	return nil, err
+}
+
+// dropPing removes the ping waiting for response, so PingRespPacket
+// received later won't be matched to it
+func (c *clientConn) dropPing(pong <-chan time.Duration) {
+	c.pingMu.Lock()
+	for i, r := range c.pings {
+		if r.done == pong {
+			c.pings = append(c.pings[:i], c.pings[i+1:]...)
+			break
+		}
+	}
+	c.pingMu.Unlock()
+}
+
+// pingWait sends PingReqPacket to server and waits for the response
+func (c *clientConn) pingWait(ctx context.Context) (time.Duration, error) {
+	pong, err := c.ping(ctx)
+	if err != nil {
+		return 0, err
+	}
+
+	select {
+	case <-c.ctx.Done():
+		return 0, c.lostErr()
+	case <-ctx.Done():
+		return 0, ctx.Err()
+	case rtt := <-pong:
+		return rtt, nil
+	}
+}
+
+// pong tends to PingRespPacket received
+func (c *clientConn) pong() {
+	c.pingMu.Lock()
+	if len(c.pings) == 0 {
+		c.pingMu.Unlock()
+		c.log.w("NET unexpected PingResp", "packet_type", "PingResp")
+		return
+	}
+	req := c.pings[0]
+	c.pings = c.pings[1:]
+	c.pingMu.Unlock()
+
+	rtt := time.Since(req.sentAt)
+	atomic.StoreInt64(&c.rtt, int64(rtt))
+	c.parent.metrics.KeepaliveRTT(c.name, rtt)
+	req.done <- rtt
+}
+
 // handle mqtt logic control packet send
 func (c *clientConn) handleSend() {
-	c.parent.log.v("NET start send handle for server = ", c.name)
+	c.log.v("NET start send handler")
 
 	defer func() {
+		close(c.sendExit)
 		c.parent.workers.Done()
-		c.parent.log.e("NET exit send handler for server =", c.name)
+		c.log.e("NET exit send handler")
 	}()
 
 	for {
 		select {
 		case <-c.ctx.Done():
 			return
-		case pkt, more := <-c.parent.sendC:
+		case origin, more := <-c.parent.sendC:
 			if !more {
 				return
 			}
 
+			out := origin
+			if p, ok := origin.(*PublishPacket); ok {
+				out = c.injectTrace(p)
+			}
+
+			pkt, err := c.parent.outbound.apply(c.name, out)
+			if err != nil {
+				if !droppable(origin) {
+					c.rejectCtrl(origin, err)
+					if origin.Type() == CtrlDisConn {
+						// client exit anyway
+						c.parent.exit()
+					}
+					return
+				}
+
+				c.log.w("NET outbound packet rejected", "packet_type", ctrlTypeName(origin.Type()), "err", err)
+				c.parent.rejectPkt(origin, err)
+				continue
+			}
+
+			c.stampVersion(pkt)
+			if err := c.checkSize(pkt); err != nil {
+				c.log.w("NET outbound packet too large", "packet_type", ctrlTypeName(pkt.Type()), "err", err)
+				c.parent.rejectPkt(origin, err)
+				continue
+			}
+
 			if err := pkt.WriteTo(c.connRW); err != nil {
-				c.parent.log.e("NET encode error", err)
+				c.log.e("NET encode error", "packet_type", ctrlTypeName(pkt.Type()), "err", err)
+				c.closeWith(wrapNetErr(c.name, err))
 				return
 			}
 
 			if err := c.connRW.Flush(); err != nil {
-				c.parent.log.e("NET flush error", err)
+				c.log.e("NET flush error", "packet_type", ctrlTypeName(pkt.Type()), "err", err)
+				c.closeWith(wrapNetErr(c.name, err))
 				return
 			}
+			c.parent.metrics.PacketSent(c.name, pkt.Type(), c.connRW.resetWritten())
+			atomic.StoreInt64(&c.lastSent, time.Now().UnixNano())
 
 			switch pkt.Type() {
 			case CtrlPublish:
-				p := pkt.(*PublishPacket)
+				p := origin.(*PublishPacket)
 				if p.Qos == 0 {
-					c.parent.log.d("NET published qos0 packet, topic =", p.TopicName)
+					c.log.d("NET published qos0 packet", "packet_type", "Publish", "topic", p.TopicName)
+					c.parent.finishToken(p, nil, nil)
 					notifyPubMsg(c.parent.msgC, p.TopicName, nil)
 				}
 			case CtrlDisConn:
@@ -275,25 +498,42 @@ func (c *clientConn) handleSend() {
 				return
 			}
 
+			var err error
+			origin := pkt
+			if pkt, err = c.parent.outbound.apply(c.name, origin); err != nil {
+				c.rejectCtrl(origin, err)
+				return
+			}
+
+			c.stampVersion(pkt)
+			if err := c.checkSize(pkt); err != nil {
+				c.log.w("NET outbound packet too large", "packet_type", ctrlTypeName(pkt.Type()), "err", err)
+				continue
+			}
+
 			if err := pkt.WriteTo(c.connRW); err != nil {
-				c.parent.log.e("NET encode error", err)
+				c.log.e("NET encode error", "packet_type", ctrlTypeName(pkt.Type()), "err", err)
+				c.closeWith(wrapNetErr(c.name, err))
 				return
 			}
 
 			if err := c.connRW.Flush(); err != nil {
-				c.parent.log.e("NET flush error", err)
+				c.log.e("NET flush error", "packet_type", ctrlTypeName(pkt.Type()), "err", err)
+				c.closeWith(wrapNetErr(c.name, err))
 				return
 			}
+			c.parent.metrics.PacketSent(c.name, pkt.Type(), c.connRW.resetWritten())
+			atomic.StoreInt64(&c.lastSent, time.Now().UnixNano())
 
 			switch pkt.Type() {
 			case CtrlPubRel:
-				notifyPersistMsg(c.parent.msgC,
+				c.parent.notifyPersistErr(
 					c.parent.persist.Store(sendKey(pkt.(*PubRelPacket).PacketID), pkt))
 			case CtrlPubAck:
-				notifyPersistMsg(c.parent.msgC,
+				c.parent.notifyPersistErr(
 					c.parent.persist.Delete(sendKey(pkt.(*PubAckPacket).PacketID)))
 			case CtrlPubComp:
-				notifyPersistMsg(c.parent.msgC,
+				c.parent.notifyPersistErr(
 					c.parent.persist.Delete(sendKey(pkt.(*PubCompPacket).PacketID)))
 			case CtrlDisConn:
 				// disconnect to server
@@ -307,9 +547,8 @@ func (c *clientConn) handleSend() {
 // handle all message receive
 func (c *clientConn) handleRecv() {
 	defer func() {
-		c.parent.log.e("NET exit recv handler for server =", c.name)
+		c.log.e("NET exit recv handler")
 		close(c.netRecvC)
-		close(c.keepaliveC)
 
 		c.parent.workers.Done()
 	}()
@@ -319,20 +558,45 @@ func (c *clientConn) handleRecv() {
 		case <-c.ctx.Done():
 			return
 		default:
-			pkt, err := Decode(c.protoVersion, c.connRW)
+			pkt, err := c.decoder.Decode()
 			if err != nil {
-				c.parent.log.e("NET connection broken, server =", c.name, "err =", err)
-
-				// TODO send proper net error to net handler
+				c.log.e("NET connection broken", "err", err)
+
+				if c.protoVersion == V5 {
+					var protoErr *ProtocolError
+					if errors.Is(err, ErrPacketTooLarge) {
+						c.sendDisConn(CodePacketTooLarge)
+					} else if errors.As(err, &protoErr) {
+						c.sendDisConn(protoErr.Code)
+					}
+				}
 
 				// exit client connection
-				c.exit()
+				c.closeWith(wrapNetErr(c.name, err))
 				return
 			}
+			c.parent.metrics.PacketReceived(c.name, pkt.Type(), c.connRW.resetRead())
+
+			// received packets are persisted in the version decoded
+			c.stampVersion(pkt)
+
+			origin := pkt
+			if pkt, err = c.parent.inbound.apply(c.name, origin); err != nil {
+				p, ok := origin.(*PublishPacket)
+				if !ok {
+					c.rejectCtrl(origin, err)
+					return
+				}
+
+				c.log.w("NET inbound packet rejected", "packet_type", ctrlTypeName(origin.Type()), "err", err)
+				// acknowledge to avoid redelivery
+				c.ackPublish(p)
+				continue
+			}
 
 			if pkt == PingRespPacket {
-				c.parent.log.d("NET received keepalive message")
-				c.keepaliveC <- 1
+				c.log.d("NET received keepalive message", "packet_type", "PingResp")
+				c.pong()
 			} else {
 				c.netRecvC <- pkt
 			}
@@ -340,11 +604,90 @@ func (c *clientConn) handleRecv() {
 	}
 }
 
+// injectTrace returns the publish packet to send with the trace context
+// of p (if any) propagated, only when MQTT 5 is in use for this connection,
+// trace context set by user is kept
+//
+// the trace context is injected into a copy of p, p is owned by user and
+// may be published again with another trace context
+func (c *clientConn) injectTrace(p *PublishPacket) *PublishPacket {
+	if c.protoVersion != V5 {
+		return p
+	}
+
+	if p.Props != nil {
+		if _, ok := p.Props.UserProps[TraceParentKey]; ok {
+			return p
+		}
+	}
+
+	s, ok := c.parent.spans.Load(p)
+	if !ok {
+		return p
+	}
+
+	cp := *p
+	InjectTrace(&cp, s.(*pubSpan).trace)
+	return &cp
+}
+
+// rejectCtrl closes the connection when interceptors rejected a packet
+// which can not be dropped
+func (c *clientConn) rejectCtrl(pkt Packet, err error) {
+	c.log.e("NET control packet rejected, closing connection", "packet_type", ctrlTypeName(pkt.Type()), "err", err)
+	c.closeWith(&InterceptError{PacketType: pkt.Type(), Err: err})
+	c.conn.Close()
+}
+
+// stampVersion makes the packet encoded in the protocol version of this connection
+func (c *clientConn) stampVersion(pkt Packet) {
+	if pkt == PingReqPacket || pkt == PingRespPacket {
+		// shared instance, encoded the same in all versions
+		return
+	}
+
+	if p, ok := pkt.(versionSetter); ok {
+		p.setVersion(c.protoVersion)
+	}
+}
+
+// checkSize checks the packet against the max packet size accepted by server
+func (c *clientConn) checkSize(pkt Packet) error {
+	max := atomic.LoadInt64(&c.maxSendSize)
+	if max <= 0 {
+		return nil
+	}
+
+	size, err := encodedSize(pkt)
+	if err != nil {
+		// leave it to the real encoding
+		return nil
+	}
+
+	if int64(size) > max {
+		return &PacketSizeError{PacketType: pkt.Type(), Size: size, Max: int(max)}
+	}
+	return nil
+}
+
+// sendDisConn tells server the reason before closing this connection,
+// it returns after the send handler exited
+func (c *clientConn) sendDisConn(code ReasonCode) {
+	select {
+	case <-c.ctx.Done():
+	case c.logicSendC <- &DisConnPacket{Code: code}:
+		<-c.sendExit
+	}
+}
+
 // send mqtt logic packet
 func (c *clientConn) send(pkt Packet) {
 	if c.parent.isClosing() {
 		return
 	}
 
-	c.logicSendC <- pkt
+	select {
+	case <-c.ctx.Done():
+	case c.logicSendC <- pkt:
+	}
 }
@@ -0,0 +1,361 @@
+/*
+ * Copyright Go-IIoT (https://github.com/goiiot)
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package libmqtt
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"net"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// testPingBroker counts PingReqPacket received, responds them if respond is true
+func testPingBroker(respond bool, pings *int32) func(rw *bufio.ReadWriter) {
+	return func(rw *bufio.ReadWriter) {
+		for {
+			pkt, err := Decode(V311, rw)
+			if err != nil {
+				return
+			}
+
+			if pkt == PingReqPacket {
+				atomic.AddInt32(pings, 1)
+				if respond {
+					PingRespPacket.WriteTo(rw)
+					rw.Flush()
+				}
+			}
+		}
+	}
+}
+
+func testConnect(t *testing.T, options ...Option) Client {
+	c, err := NewClient(options...)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	testConnectClient(t, c)
+	return c
+}
+
+// testConnectClient connects c and waits for the first connect result,
+// handlers should be registered before calling it
+func testConnectClient(t *testing.T, c Client) {
+	connected := make(chan struct{})
+	c.Connect(func(server string, code ReasonCode, err error) {
+		close(connected)
+	})
+
+	select {
+	case <-connected:
+	case <-time.After(time.Second):
+		t.Fatal("connect timeout")
+	}
+}
+
+func TestKeepalive_Ping(t *testing.T) {
+	pings := int32(0)
+	l := testBrokerWith(t, testPingBroker(true, &pings))
+	defer l.Close()
+
+	c, err := NewClient(WithServer(l.Addr().String()))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := c.Ping(context.Background()); !errors.Is(err, ErrNotConnected) {
+		t.Error("ping without connection should fail, err =", err)
+	}
+
+	c = testConnect(t, WithServer(l.Addr().String()))
+	defer c.Destroy(true)
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+
+	rtt, err := c.Ping(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if rtt <= 0 || c.RTT(l.Addr().String()) != rtt {
+		t.Error("rtt mismatch, rtt =", rtt, "recorded =", c.RTT(l.Addr().String()))
+	}
+
+	if atomic.LoadInt32(&pings) != 1 {
+		t.Error("ping count mismatch, pings =", atomic.LoadInt32(&pings))
+	}
+}
+
+func TestKeepalive_Idle(t *testing.T) {
+	pings := int32(0)
+	l := testBrokerWith(t, testPingBroker(true, &pings))
+	defer l.Close()
+
+	c := testConnect(t, WithServer(l.Addr().String()), WithKeepalive(1, 1.5))
+	defer c.Destroy(true)
+
+	// no ping when packets sent in the interval
+	for i := 0; i < 8; i++ {
+		c.Publish(&PublishPacket{TopicName: "foo"})
+		time.Sleep(200 * time.Millisecond)
+	}
+
+	if n := atomic.LoadInt32(&pings); n != 0 {
+		t.Error("ping sent when not idle, pings =", n)
+	}
+
+	time.Sleep(time.Second)
+	if n := atomic.LoadInt32(&pings); n == 0 {
+		t.Error("no ping sent when idle")
+	}
+}
+
+func TestKeepalive_Timeout(t *testing.T) {
+	pings := int32(0)
+	l := testBrokerWith(t, testPingBroker(false, &pings))
+	defer l.Close()
+
+	c, err := NewClient(WithServer(l.Addr().String()), WithKeepalive(1, 1.2),
+		WithKeepaliveMaxMissed(2), WithAutoReconnect(false))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Destroy(true)
+
+	netErrC := make(chan error, 1)
+	c.HandleNet(func(server string, err error) {
+		netErrC <- err
+	})
+	c.Connect(nil)
+
+	select {
+	case err := <-netErrC:
+		if !errors.Is(err, ErrKeepaliveTimeout) {
+			t.Error("error should be keepalive timeout, err =", err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("keepalive not timeout")
+	}
+
+	if n := atomic.LoadInt32(&pings); n != 2 {
+		t.Error("ping count mismatch, pings =", n)
+	}
+}
+
+func TestKeepalive_Missed(t *testing.T) {
+	pings := int32(0)
+	l := testBrokerWith(t, func(rw *bufio.ReadWriter) {
+		for {
+			pkt, err := Decode(V311, rw)
+			if err != nil {
+				return
+			}
+
+			// the first ping is missed
+			if pkt == PingReqPacket && atomic.AddInt32(&pings, 1) > 1 {
+				PingRespPacket.WriteTo(rw)
+				rw.Flush()
+			}
+		}
+	})
+	defer l.Close()
+
+	c, err := NewClient(WithServer(l.Addr().String()), WithKeepalive(1, 1.2),
+		WithKeepaliveMaxMissed(2), WithAutoReconnect(false))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Destroy(true)
+
+	netErrC := make(chan error, 1)
+	c.HandleNet(func(server string, err error) {
+		netErrC <- err
+	})
+	testConnectClient(t, c)
+
+	select {
+	case err := <-netErrC:
+		t.Fatal("missed ping should not fail the next one, err =", err)
+	case <-time.After(3 * time.Second):
+	}
+
+	if n := atomic.LoadInt32(&pings); n < 2 {
+		t.Error("ping count mismatch, pings =", n)
+	}
+
+	// rtt of the answered ping, not since the missed one
+	if rtt := c.RTT(l.Addr().String()); rtt <= 0 || rtt > time.Second {
+		t.Error("rtt mismatch, rtt =", rtt)
+	}
+}
+
+// testV5Broker accepts one MQTT 5 connection, responds connAck and calls fn
+// with the connection and the ConnPacket received before closing it
+func testV5Broker(t *testing.T, connAck *ConnAckPacket, fn func(rw *bufio.ReadWriter, p *ConnPacket)) net.Listener {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	go func() {
+		conn, err := l.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+
+		rw := bufio.NewReadWriter(bufio.NewReader(conn), bufio.NewWriter(conn))
+		pkt, err := Decode(V5, rw)
+		if err != nil {
+			t.Error("decode connect packet failed, err =", err)
+			return
+		}
+
+		connAck.WriteTo(rw)
+		rw.Flush()
+		fn(rw, pkt.(*ConnPacket))
+	}()
+
+	return l
+}
+
+func TestMaxPacketSize_Send(t *testing.T) {
+	pubC := make(chan *PublishPacket, 1)
+	l := testV5Broker(t, &ConnAckPacket{
+		BasePacket: BasePacket{ProtoVersion: V5},
+		Props:      &ConnAckProps{MaxPacketSize: 64},
+	}, func(rw *bufio.ReadWriter, _ *ConnPacket) {
+		for {
+			pkt, err := Decode(V5, rw)
+			if err != nil {
+				return
+			}
+
+			if p, ok := pkt.(*PublishPacket); ok {
+				pubC <- p
+			}
+		}
+	})
+	defer l.Close()
+
+	c, err := NewClient(WithServer(l.Addr().String()), WithVersion(V5, false))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Destroy(true)
+
+	errC := make(chan error, 2)
+	c.HandlePub(func(topic string, err error) {
+		errC <- err
+	})
+	testConnectClient(t, c)
+
+	c.Publish(&PublishPacket{TopicName: "large", Payload: make([]byte, 64)})
+	select {
+	case err := <-errC:
+		var sizeErr *PacketSizeError
+		if !errors.As(err, &sizeErr) || sizeErr.Max != 64 || sizeErr.PacketType != CtrlPublish {
+			t.Fatal("oversized publish not failed, err =", err)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("oversized publish not handled")
+	}
+
+	// connection still usable
+	c.Publish(&PublishPacket{TopicName: "small", Payload: []byte("foo")})
+	select {
+	case err := <-errC:
+		if err != nil {
+			t.Error("publish failed, err =", err)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("publish not handled")
+	}
+
+	select {
+	case p := <-pubC:
+		if p.TopicName != "small" {
+			t.Error("oversized publish sent, topic =", p.TopicName)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("publish not received by server")
+	}
+}
+
+func TestMaxPacketSize_Recv(t *testing.T) {
+	disConnC := make(chan *DisConnPacket, 1)
+	l := testV5Broker(t, &ConnAckPacket{BasePacket: BasePacket{ProtoVersion: V5}}, func(rw *bufio.ReadWriter, p *ConnPacket) {
+		if p.Props == nil || p.Props.MaxPacketSize != 64 {
+			t.Error("max packet size not advertised, props =", p.Props)
+		}
+
+		(&PublishPacket{
+			BasePacket: BasePacket{ProtoVersion: V5},
+			TopicName:  "large",
+			Payload:    make([]byte, 64),
+		}).WriteTo(rw)
+		rw.Flush()
+
+		for {
+			pkt, err := Decode(V5, rw)
+			if err != nil {
+				return
+			}
+
+			if p, ok := pkt.(*DisConnPacket); ok {
+				disConnC <- p
+				return
+			}
+		}
+	})
+	defer l.Close()
+
+	c, err := NewClient(WithServer(l.Addr().String()), WithVersion(V5, false), WithMaxPacketSize(64))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Destroy(true)
+
+	netErrC := make(chan error, 1)
+	c.HandleNet(func(server string, err error) {
+		netErrC <- err
+	})
+	testConnectClient(t, c)
+
+	select {
+	case p := <-disConnC:
+		if p.Code != CodePacketTooLarge {
+			t.Error("disconnect code mismatch, code =", p.Code)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("no disconnect sent for oversized packet")
+	}
+
+	select {
+	case err := <-netErrC:
+		if !errors.Is(err, ErrPacketTooLarge) {
+			t.Error("connection lost with unexpected error, err =", err)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("connection not closed")
+	}
+}
@@ -0,0 +1,279 @@
+/*
+ * Copyright Go-IIoT (https://github.com/goiiot)
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package libmqtt
+
+import (
+	"context"
+	"errors"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+var (
+	// ErrQueueFull is the error happened when a publish packet can not be
+	// queued without blocking, or was rejected by the OfflinePolicy
+	ErrQueueFull = errors.New("publish queue is full ")
+
+	// ErrClientClosed is the error happened when publishing with a
+	// destroyed client
+	ErrClientClosed = errors.New("client already closed ")
+)
+
+// OfflinePolicy defines how to tackle with publish packets
+// when the offline queue is full
+type OfflinePolicy byte
+
+const (
+	// OfflineBlock blocks the Publish call until there is room in queue
+	OfflineBlock OfflinePolicy = iota
+	// OfflineDropOldest drops the oldest packet in queue to make room
+	OfflineDropOldest
+	// OfflineDropNewest drops the packet being published, the drop is
+	// reported with ErrQueueFull through PubHandler and the completion
+	// token only, the Publish call doesn't fail
+	OfflineDropNewest
+	// OfflineError rejects the packet being published with ErrQueueFull
+	OfflineError
+)
+
+// offlineQueue is the bounded queue holding publish packets
+// while there is no connection alive, packets are flushed
+// in order once connected to server
+type offlineQueue struct {
+	mu       sync.Mutex
+	pkts     []*PublishPacket
+	keys     []string
+	seq      uint64
+	size     int
+	policy   OfflinePolicy
+	persist  PersistMethod
+	space    chan struct{} // closed when packet removed from queue
+	flushing bool          // whether the queue is being flushed
+}
+
+func newOfflineQueue(size int, policy OfflinePolicy, method PersistMethod) *offlineQueue {
+	if size < 1 {
+		size = 1
+	}
+
+	if method == nil {
+		method = NonePersist
+	}
+
+	return &offlineQueue{
+		size:    size,
+		policy:  policy,
+		persist: method,
+	}
+}
+
+// setPersist replaces the persist method and restores packets persisted
+// with it, packets in queue are discarded
+func (q *offlineQueue) setPersist(method PersistMethod) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	q.persist, q.pkts, q.keys, q.seq = method, nil, nil, 0
+	q.restore()
+}
+
+// contains checks whether the packet is in queue
+func (q *offlineQueue) contains(p *PublishPacket) bool {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	for _, pkt := range q.pkts {
+		if pkt == p {
+			return true
+		}
+	}
+	return false
+}
+
+// restore packets persisted in previous run, q.mu must be held
+func (q *offlineQueue) restore() {
+	type entry struct {
+		seq uint64
+		key string
+		pkt *PublishPacket
+	}
+
+	entries := make([]entry, 0)
+	q.persist.Range(func(key string, p Packet) bool {
+		if !strings.HasPrefix(key, queueKeyPrefix) {
+			return true
+		}
+
+		seq, err := strconv.ParseUint(key[len(queueKeyPrefix):], 10, 64)
+		if err != nil {
+			return true
+		}
+
+		if pub, ok := p.(*PublishPacket); ok {
+			// packet id is allocated when flushed
+			pub.PacketID = 0
+			entries = append(entries, entry{seq: seq, key: key, pkt: pub})
+		}
+		return true
+	})
+
+	sort.Slice(entries, func(i, j int) bool { return entries[i].seq < entries[j].seq })
+	for _, e := range entries {
+		q.pkts = append(q.pkts, e.pkt)
+		q.keys = append(q.keys, e.key)
+		if e.seq >= q.seq {
+			q.seq = e.seq + 1
+		}
+	}
+}
+
+// offer the packet to the queue, the packet is queued when not online,
+// or the queue is not empty or being flushed (to keep packets in order)
+//
+// dropped packet (if any) is returned, it's p itself when dropped by
+// OfflineDropNewest, when block is false, OfflineBlock policy behaves
+// like OfflineError
+//
+// packet id of queued packets is allocated when flushed
+func (q *offlineQueue) offer(ctx context.Context, p *PublishPacket, online, block bool) (queued bool, dropped *PublishPacket, err error) {
+	var droppedKey string
+
+	q.mu.Lock()
+	if online && !q.flushing && len(q.pkts) == 0 {
+		q.mu.Unlock()
+		return false, nil, nil
+	}
+
+	for len(q.pkts) >= q.size {
+		switch q.policy {
+		case OfflineBlock:
+			if !block {
+				q.mu.Unlock()
+				return false, nil, ErrQueueFull
+			}
+
+			if q.space == nil {
+				q.space = make(chan struct{})
+			}
+			space := q.space
+			q.mu.Unlock()
+
+			select {
+			case <-ctx.Done():
+				return false, nil, ErrClientClosed
+			case <-space:
+			}
+			q.mu.Lock()
+		case OfflineDropOldest:
+			dropped, droppedKey = q.popLocked()
+		case OfflineDropNewest:
+			q.mu.Unlock()
+			return false, p, nil
+		default:
+			// OfflineError
+			q.mu.Unlock()
+			return false, nil, ErrQueueFull
+		}
+	}
+
+	key := queueKey(q.seq)
+	q.seq++
+	q.pkts = append(q.pkts, p)
+	q.keys = append(q.keys, key)
+	q.mu.Unlock()
+
+	if dropped != nil {
+		if err = q.deleteKey(droppedKey); err != nil {
+			return true, dropped, err
+		}
+	}
+
+	if err = q.persist.Store(key, p); err != nil {
+		return true, dropped, newPersistError("store", key, p, err)
+	}
+	return true, dropped, nil
+}
+
+// deleteKey deletes the persisted packet with key
+func (q *offlineQueue) deleteKey(key string) error {
+	if err := q.persist.Delete(key); err != nil {
+		return newPersistError("delete", key, nil, err)
+	}
+	return nil
+}
+
+// startFlush marks the queue as being flushed,
+// return false if already in flushing
+func (q *offlineQueue) startFlush() bool {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	if q.flushing {
+		return false
+	}
+
+	q.flushing = true
+	return true
+}
+
+// next packet to flush, flushing finished when no packet returned
+func (q *offlineQueue) next() (*PublishPacket, string) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	p, key := q.popLocked()
+	if p == nil {
+		q.flushing = false
+	}
+	return p, key
+}
+
+// abort flushing, put the packet can not be sent back to the queue head
+func (q *offlineQueue) abort(p *PublishPacket, key string) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	q.pkts = append([]*PublishPacket{p}, q.pkts...)
+	q.keys = append([]string{key}, q.keys...)
+	q.flushing = false
+}
+
+func (q *offlineQueue) popLocked() (*PublishPacket, string) {
+	if len(q.pkts) == 0 {
+		return nil, ""
+	}
+
+	p, key := q.pkts[0], q.keys[0]
+	q.pkts[0] = nil
+	q.pkts, q.keys = q.pkts[1:], q.keys[1:]
+
+	if q.space != nil {
+		close(q.space)
+		q.space = nil
+	}
+
+	return p, key
+}
+
+func (q *offlineQueue) len() int {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	return len(q.pkts)
+}
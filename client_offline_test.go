@@ -0,0 +1,379 @@
+/*
+ * Copyright Go-IIoT (https://github.com/goiiot)
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package libmqtt
+
+import (
+	"context"
+	"strconv"
+	"testing"
+	"time"
+)
+
+func testOfflinePackets(n int) []*PublishPacket {
+	pkts := make([]*PublishPacket, n)
+	for i := range pkts {
+		pkts[i] = &PublishPacket{TopicName: strconv.Itoa(i), Payload: []byte(strconv.Itoa(i))}
+	}
+	return pkts
+}
+
+func testOfflineQueueContent(q *offlineQueue, target []*PublishPacket, t *testing.T) {
+	if q.len() != len(target) {
+		t.Error("queue length mismatch, len =", q.len(), "target =", len(target))
+		return
+	}
+
+	for i, p := range q.pkts {
+		if p != target[i] {
+			t.Error("queue content mismatch at", i, "topic =", p.TopicName, "target =", target[i].TopicName)
+		}
+	}
+}
+
+func TestOfflineQueue_Policy(t *testing.T) {
+	ctx := context.TODO()
+	pkts := testOfflinePackets(3)
+
+	// drop oldest
+	q := newOfflineQueue(2, OfflineDropOldest, nil)
+	for i, p := range pkts {
+		queued, dropped, err := q.offer(ctx, p, false, true)
+		if !queued || err != nil {
+			t.Error("packet not queued, err =", err)
+		}
+
+		if i < 2 && dropped != nil {
+			t.Error("packet dropped when queue not full")
+		} else if i == 2 && dropped != pkts[0] {
+			t.Error("oldest packet not dropped")
+		}
+	}
+	testOfflineQueueContent(q, pkts[1:], t)
+
+	// drop newest and error
+	for _, policy := range []OfflinePolicy{OfflineDropNewest, OfflineError} {
+		q = newOfflineQueue(2, policy, nil)
+		for i, p := range pkts {
+			queued, dropped, err := q.offer(ctx, p, false, true)
+			if i < 2 && (!queued || err != nil) {
+				t.Error("packet not queued, err =", err)
+			} else if i == 2 && policy == OfflineDropNewest && (queued || dropped != p || err != nil) {
+				t.Error("newest packet not dropped, err =", err)
+			} else if i == 2 && policy == OfflineError && (queued || dropped != nil || err != ErrQueueFull) {
+				t.Error("newest packet not rejected, err =", err)
+			}
+		}
+		testOfflineQueueContent(q, pkts[:2], t)
+	}
+
+	// block
+	q = newOfflineQueue(2, OfflineBlock, nil)
+	for _, p := range pkts[:2] {
+		q.offer(ctx, p, false, true)
+	}
+
+	if _, _, err := q.offer(ctx, pkts[2], false, false); err != ErrQueueFull {
+		t.Error("non-blocking offer should fail when queue full")
+	}
+
+	done := make(chan struct{})
+	go func() {
+		q.offer(ctx, pkts[2], false, true)
+		close(done)
+	}()
+
+	select {
+	case <-done:
+		t.Error("blocking offer returned when queue full")
+	case <-time.After(100 * time.Millisecond):
+	}
+
+	if p, _ := q.next(); p != pkts[0] {
+		t.Error("packet out of order")
+	}
+
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Error("blocking offer not released")
+	}
+	testOfflineQueueContent(q, pkts[1:], t)
+}
+
+func TestOfflineQueue_Flush(t *testing.T) {
+	ctx := context.TODO()
+	pkts := testOfflinePackets(3)
+	q := newOfflineQueue(len(pkts), OfflineError, nil)
+
+	// online and empty queue, packet should not be queued
+	if queued, _, _ := q.offer(ctx, pkts[0], true, true); queued {
+		t.Error("packet queued when online")
+	}
+
+	for _, p := range pkts[:2] {
+		q.offer(ctx, p, false, true)
+	}
+
+	if !q.startFlush() || q.startFlush() {
+		t.Error("flush state mismatch")
+	}
+
+	// packets must be queued in flushing to keep them in order
+	if queued, _, _ := q.offer(ctx, pkts[2], true, true); !queued {
+		t.Error("packet not queued when flushing")
+	}
+
+	p, key := q.next()
+	if p != pkts[0] {
+		t.Error("packet out of order")
+	}
+	q.abort(p, key)
+	testOfflineQueueContent(q, pkts, t)
+
+	q.startFlush()
+	for i := range pkts {
+		if p, _ := q.next(); p != pkts[i] {
+			t.Error("packet out of order")
+		}
+	}
+
+	if p, _ := q.next(); p != nil || q.flushing {
+		t.Error("flush not finished")
+	}
+}
+
+func TestOfflineQueue_Restore(t *testing.T) {
+	ctx := context.TODO()
+	pkts := testOfflinePackets(12)
+	persist := NewMemPersist(nil)
+
+	q := newOfflineQueue(len(pkts), OfflineError, persist)
+	q.setPersist(persist)
+	for _, p := range pkts {
+		q.offer(ctx, p, false, true)
+	}
+
+	// flushed packet should be deleted
+	p, key := q.next()
+	persist.Delete(key)
+
+	q = newOfflineQueue(len(pkts), OfflineError, persist)
+	q.setPersist(persist)
+	testOfflineQueueContent(q, pkts[1:], t)
+
+	if q.offer(ctx, p, false, true); q.keys[len(q.keys)-1] != queueKey(uint64(len(pkts))) {
+		t.Error("queue key sequence not restored")
+	}
+}
+
+func TestOfflineQueue_RestorePacketID(t *testing.T) {
+	persist := NewMemPersist(nil)
+	newClient := func() Client {
+		c, err := NewClient(WithServer("localhost:1883"), WithClientID("restore"),
+			WithOfflineQueue(2, OfflineError, persist))
+		if err != nil {
+			t.Fatal(err)
+		}
+		return c
+	}
+
+	c := newClient()
+	restored := &PublishPacket{TopicName: "restored", Qos: Qos1}
+	if err := c.TryPublish(restored); err != nil {
+		t.Fatal(err)
+	}
+	c.Destroy(true)
+	<-c.offlineQ.done
+
+	// restart
+	c = newClient()
+	defer c.Destroy(true)
+	if p := c.offline.pkts[0]; p.TopicName != restored.TopicName || p.PacketID != 0 {
+		t.Fatal("restored packet id not reset, id =", p.PacketID)
+	}
+
+	pub := &PublishPacket{TopicName: "new", Qos: Qos1}
+	if err := c.TryPublish(pub); err != nil {
+		t.Fatal(err)
+	}
+
+	c.workers.Add(1)
+	go c.flushOffline(c.ctx)
+
+	ids := make(map[uint16]bool)
+	for range []string{"restored", "new"} {
+		p := (<-c.sendC).(*PublishPacket)
+		if extra, ok := c.idGen.getExtra(p.PacketID); !ok || extra != p {
+			t.Error("packet id not reserved, topic =", p.TopicName, "id =", p.PacketID)
+		}
+		if ids[p.PacketID] {
+			t.Error("packet id collision, id =", p.PacketID)
+		}
+		ids[p.PacketID] = true
+	}
+}
+
+func TestClient_TryPublish(t *testing.T) {
+	pkts := testOfflinePackets(3)
+
+	c, err := NewClient(WithServer("localhost:1883"), WithBuf(1, 1))
+	if err != nil {
+		t.Error(err)
+		return
+	}
+
+	if err := c.TryPublish(pkts...); err != ErrQueueFull {
+		t.Error("send buffer should be full, err =", err)
+	}
+	c.Destroy(true)
+
+	c, err = NewClient(WithServer("localhost:1883"), WithOfflineQueue(2, OfflineBlock, nil))
+	if err != nil {
+		t.Error(err)
+		return
+	}
+
+	if err := c.TryPublish(pkts...); err != ErrQueueFull {
+		t.Error("offline queue should be full, err =", err)
+	}
+	testOfflineQueueContent(c.offline, pkts[:2], t)
+	c.Destroy(true)
+
+	if err := c.TryPublish(pkts...); err != ErrClientClosed {
+		t.Error("client should be closed, err =", err)
+	}
+}
+
+func TestClient_OfflinePacketID(t *testing.T) {
+	persist := NewMemPersist(nil)
+	c, err := NewClient(WithServer("localhost:1883"), WithClientID("offline"),
+		WithPersist(persist), WithOfflineQueue(2, OfflineError, persist))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Destroy(true)
+
+	p := &PublishPacket{TopicName: "queued", Qos: Qos1, PacketID: 10}
+	if err := c.TryPublish(p); err != nil {
+		t.Fatal(err)
+	}
+
+	// no packet id allocated or in-flight packet persisted while queued
+	testPersistWait(t, NewSessionStore(persist).Persist(c.session()), queueKey(0), true)
+	keys := make(map[string]bool)
+	NewSessionStore(persist).Range(c.session(), func(key string, r *PersistRecord) bool {
+		keys[key] = true
+		return true
+	})
+	if p.PacketID != 0 || len(keys) != 1 || !keys[queueKey(0)] {
+		t.Error("queued packet allocated packet id, id =", p.PacketID, "keys =", keys)
+	}
+
+	if err := c.TryPublish(p); err != ErrPacketInFlight {
+		t.Error("queued packet published again, err =", err)
+	}
+}
+
+func TestClient_OfflineDropNewest(t *testing.T) {
+	c, err := NewClient(WithServer("localhost:1883"), WithOfflineQueue(1, OfflineDropNewest, nil))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Destroy(true)
+
+	queued, dropped := &PublishPacket{TopicName: "queued"}, &PublishPacket{TopicName: "dropped"}
+	if err := c.TryPublish(queued); err != nil {
+		t.Fatal(err)
+	}
+
+	// drop is only reported through PubHandler and the token
+	if err := c.TryPublish(dropped); err != nil {
+		t.Error("publish failed when newest packet dropped, err =", err)
+	}
+
+	tk := c.PublishAsync(context.TODO(), dropped)[0]
+	if err := tk.Err(); err != ErrQueueFull {
+		t.Error("token of dropped packet not failed, err =", err)
+	}
+	testOfflineQueueContent(c.offline, []*PublishPacket{queued}, t)
+}
+
+func TestClient_OfflinePersistQueue(t *testing.T) {
+	method := newTestFailPersist(0)
+	c, err := NewClient(WithServer("localhost:1883"), WithOfflineQueue(2, OfflineError, method))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Destroy(true)
+
+	method.block()
+	published := make(chan error, 1)
+	go func() {
+		published <- c.TryPublish(&PublishPacket{TopicName: "queued", Qos: Qos1})
+	}()
+
+	// slow persist method doesn't block publish
+	select {
+	case err := <-published:
+		if err != nil {
+			t.Fatal(err)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("publish blocked by offline queue persist method")
+	}
+
+	method.unblock()
+	testPersistWait(t, c.offline.persist, queueKey(0), true)
+	testPersistWait(t, NewSessionStore(method).Persist(c.session()), queueKey(0), true)
+}
+
+func TestClient_OfflineFlushRestart(t *testing.T) {
+	c, err := NewClient(WithServer("localhost:1883"), WithBuf(1, 1), WithOfflineQueue(2, OfflineError, nil))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Destroy(true)
+
+	queued := &PublishPacket{TopicName: "queued"}
+	if err := c.TryPublish(queued); err != nil {
+		t.Fatal(err)
+	}
+
+	lost, cancelLost := context.WithCancel(context.Background())
+	cancelLost()
+	alive, cancelAlive := context.WithCancel(context.Background())
+	defer cancelAlive()
+	c.conns.Store("lost", &clientConn{ctx: lost})
+	c.conns.Store("alive", &clientConn{ctx: alive})
+	defer c.conns.Delete("lost")
+	defer c.conns.Delete("alive")
+
+	// send buffer is full, flush is aborted when the connection lost
+	c.sendC <- &PublishPacket{TopicName: "filler"}
+	c.workers.Add(1)
+	c.flushOffline(lost)
+	<-c.sendC
+
+	select {
+	case p := <-c.sendC:
+		if p != queued {
+			t.Error("flushed packet mismatch, packet =", p)
+		}
+	case <-time.After(time.Second):
+		t.Error("flush not restarted with the connection alive")
+	}
+}
@@ -28,6 +28,10 @@ import (
 type Option func(*AsyncClient) error
 
 // WithPersist defines the persist method to be used
+//
+// persist methods implementing io.Closer (e.g. NewWALPersist) are closed
+// when the client exited (see Client.Destroy), after pending persist
+// operations are done
 func WithPersist(method PersistMethod) Option {
 	return func(c *AsyncClient) error {
 		if method != nil {
@@ -37,6 +41,22 @@ func WithPersist(method PersistMethod) Option {
 	}
 }
 
+// WithPersistQueue defines the bounded queue running persist operations
+// of the persist method (see WithPersist) in background, so the client
+// is not blocked by slow persist methods, persist methods of the offline
+// queue and the retained cache have their own queues defined by it
+//
+// size is the max count of operations in queue, default value is 64,
+// policy defines the behavior when persist operation failed or the
+// queue is full, default value is PersistReport
+func WithPersistQueue(size int, policy PersistPolicy) Option {
+	return func(c *AsyncClient) error {
+		c.options.persistQueueSize = size
+		c.options.persistPolicy = policy
+		return nil
+	}
+}
+
 // WithCleanSession will set clean flag in connect packet
 func WithCleanSession(f bool) Option {
 	return func(c *AsyncClient) error {
@@ -67,6 +87,17 @@ func WithKeepalive(keepalive uint16, factor float64) Option {
 	}
 }
 
+// WithKeepaliveMaxMissed set how many continuous keepalive pings without
+// response are tolerated before closing the connection (default 1)
+func WithKeepaliveMaxMissed(n int) Option {
+	return func(c *AsyncClient) error {
+		if n > 0 {
+			c.options.keepaliveMissed = n
+		}
+		return nil
+	}
+}
+
 // WithAutoReconnect set client to auto reconnect to server when connection failed
 func WithAutoReconnect(autoReconnect bool) Option {
 	return func(c *AsyncClient) error {
@@ -103,6 +134,9 @@ func WithBackoffStrategy(firstDelay, maxDelay time.Duration, factor float64) Opt
 }
 
 // WithClientID set the client id for connection
+//
+// session state persisted (see WithPersist) is scoped to the client id,
+// clients without client id share the same persisted session
 func WithClientID(clientID string) Option {
 	return func(c *AsyncClient) error {
 		c.options.clientID = clientID
@@ -241,6 +275,51 @@ func WithBuf(sendBuf, recvBuf int) Option {
 	}
 }
 
+// WithOfflineQueue enables a bounded queue for publish packets
+// when there is no connection alive, queued packets will be
+// flushed in order after (re)connected to server
+//
+// size is the max count of packets in queue,
+// policy defines the behavior when queue is full,
+// method is the persist method to keep queued packets,
+// if no persist method provided (nil), queued packets are kept in memory,
+// it's closed with the client if it implements io.Closer (see WithPersist),
+// its operations run in background like the persist method (see WithPersistQueue)
+func WithOfflineQueue(size int, policy OfflinePolicy, method PersistMethod) Option {
+	return func(c *AsyncClient) error {
+		c.offline = newOfflineQueue(size, policy, method)
+		return nil
+	}
+}
+
+// WithRetainedCache enables a cache of the latest message of topics
+// received, queried with Client.Retained and Client.RangeRetained
+//
+// retained messages are always cached, and messages of topics matching
+// filters are also cached, topics cached are updated by later messages
+// even if not retained, cached messages expire according to their
+// MessageExpiryInterval (MQTT 5)
+//
+// cached messages are persisted in the persist queue (see WithPersistQueue)
+//
+// size is the max count of topics cached, the message received earliest
+// is evicted when the cache is full,
+// method is the persist method to keep cached messages across restarts,
+// if no persist method provided (nil), messages are kept in memory,
+// it's closed with the client if it implements io.Closer (see WithPersist)
+func WithRetainedCache(size int, method PersistMethod, filters ...string) Option {
+	return func(c *AsyncClient) error {
+		for _, f := range filters {
+			if err := ValidateTopicFilter(f); err != nil {
+				return err
+			}
+		}
+
+		c.retained = newRetainedCache(size, method, filters)
+		return nil
+	}
+}
+
 // WithRouter set the router for topic dispatch
 func WithRouter(r TopicRouter) Option {
 	return func(c *AsyncClient) error {
@@ -251,10 +330,73 @@ func WithRouter(r TopicRouter) Option {
 	}
 }
 
+// WithMetrics set the Metrics to collect client metrics,
+// e.g. a MetricsRegistry created by NewMetricsRegistry
+func WithMetrics(m Metrics) Option {
+	return func(c *AsyncClient) error {
+		if m != nil {
+			c.metrics = m
+		}
+		return nil
+	}
+}
+
+// WithOutboundInterceptor adds an Interceptor for packets to send,
+// interceptors are applied in the order of registration
+//
+// types are the packet types to intercept, all types when not provided,
+// rejected publish, subscribe and unsubscribe packets are reported
+// to handlers and tokens with the error, rejecting other packets closes
+// the connection with InterceptError
+func WithOutboundInterceptor(i Interceptor, types ...CtrlType) Option {
+	return func(c *AsyncClient) error {
+		if i != nil {
+			c.outbound = c.outbound.add(i, types)
+		}
+		return nil
+	}
+}
+
+// WithInboundInterceptor adds an Interceptor for packets received,
+// interceptors are applied in the order of registration
+//
+// types are the packet types to intercept, all types when not provided,
+// rejected publish packets are acknowledged but not dispatched, rejecting
+// other packets closes the connection with InterceptError
+func WithInboundInterceptor(i Interceptor, types ...CtrlType) Option {
+	return func(c *AsyncClient) error {
+		if i != nil {
+			c.inbound = c.inbound.add(i, types)
+		}
+		return nil
+	}
+}
+
+// WithTracer set the Tracer to trace publishing and receiving,
+// W3C trace context is propagated with user properties when using MQTT 5
+func WithTracer(t Tracer) Option {
+	return func(c *AsyncClient) error {
+		c.tracer = t
+		return nil
+	}
+}
+
 // WithLog will create basic logger for the client
 func WithLog(l LogLevel) Option {
 	return func(c *AsyncClient) error {
-		c.log = newLogger(l)
+		c.options.logger = NewStdLogger(l)
+		return nil
+	}
+}
+
+// WithLogger will use the provided Logger for the client,
+// nil Logger means no log
+//
+// fields "client_id" and "server" are attached to log lines,
+// and "packet_type", "packet_id" when logging packets
+func WithLogger(l Logger) Option {
+	return func(c *AsyncClient) error {
+		c.options.logger = l
 		return nil
 	}
 }
@@ -268,6 +410,30 @@ func WithVersion(version ProtoVersion, compromise bool) Option {
 	}
 }
 
+// WithMaxPacketSize set the maximum size of packets accepted from server,
+// the limit is advertised to server with ConnProps.MaxPacketSize in MQTT 5,
+// the connection is closed when an oversized packet is received
+// (with DisConnPacket of CodePacketTooLarge in MQTT 5)
+//
+// size 0 means no limit (default)
+func WithMaxPacketSize(size uint32) Option {
+	return func(c *AsyncClient) error {
+		c.options.maxPacketSize = size
+		return nil
+	}
+}
+
+// WithStrictDecoding set whether to validate packets received strictly
+// according to the MQTT specification (see Decoder.SetStrict), the
+// connection is closed when a violation found (with DisConnPacket of
+// the reason code in MQTT 5)
+func WithStrictDecoding(strict bool) Option {
+	return func(c *AsyncClient) error {
+		c.options.strictDecoding = strict
+		return nil
+	}
+}
+
 // clientOptions is the options for client to connect, reconnect, disconnect
 type clientOptions struct {
 	protoVersion     ProtoVersion  // mqtt protocol ProtoVersion
@@ -282,6 +448,9 @@ type clientOptions struct {
 	password         string        // used by ConnPacket
 	keepalive        time.Duration // used by ConnPacket (time in second)
 	keepaliveFactor  float64       // used for reasonable amount time to close conn if no ping resp
+	keepaliveMissed  int           // max continuous missed pings before closing conn
+	maxPacketSize    uint32        // max size of packets received, used by ConnPacket
+	strictDecoding   bool          // validate packets received strictly
 	cleanSession     bool          // used by ConnPacket
 	isWill           bool          // used by ConnPacket
 	willTopic        string        // used by ConnPacket
@@ -294,4 +463,7 @@ type clientOptions struct {
 	backOffFactor    float64
 	autoReconnect    bool
 	defaultTlsConfig *tls.Config
+	logger           Logger        // client logger
+	persistQueueSize int           // size of persist queue
+	persistPolicy    PersistPolicy // policy of persist queue
 }
@@ -32,7 +32,7 @@ func TestClient_Reconnect(t *testing.T) {
 		startTime := time.Now()
 		once := &sync.Once{}
 		var retryCount int32
-		c.Connect(func(server string, code byte, err error) {
+		c.Connect(func(server string, code ReasonCode, err error) {
 			if err != nil {
 				t.Log("connect to server error", err)
 			}
@@ -0,0 +1,232 @@
+/*
+ * Copyright Go-IIoT (https://github.com/goiiot)
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package libmqtt
+
+import (
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// retainedCache keeps the latest message received of topics,
+// the message received earliest is evicted when the cache is full
+type retainedCache struct {
+	size    int           // max count of topics cached
+	filters []string      // topic filters of messages cached besides retained ones
+	persist PersistMethod // persist method of cached messages
+
+	mu   sync.RWMutex
+	msgs map[string]*retainedMsg // topic -> message
+}
+
+type retainedMsg struct {
+	pkt      *PublishPacket
+	received time.Time
+	expire   time.Time // zero if never expires
+}
+
+func newRetainedCache(size int, method PersistMethod, filters []string) *retainedCache {
+	if size < 1 {
+		size = 1
+	}
+
+	if method == nil {
+		method = NonePersist
+	}
+
+	return &retainedCache{
+		size:    size,
+		filters: filters,
+		persist: method,
+		msgs:    make(map[string]*retainedMsg),
+	}
+}
+
+// setPersist replaces the persist method and restores messages persisted
+// with it, messages cached are discarded
+func (c *retainedCache) setPersist(method PersistMethod) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.persist, c.msgs = method, make(map[string]*retainedMsg)
+
+	var keys []string
+	method.Range(func(key string, p Packet) bool {
+		if strings.HasPrefix(key, retainedKeyPrefix) {
+			keys = append(keys, key)
+		}
+		return true
+	})
+
+	now := time.Now()
+	for _, key := range keys {
+		r, ok := loadRecord(method, key)
+		if !ok {
+			continue
+		}
+
+		pub, ok := r.Packet.(*PublishPacket)
+		if !ok || retainedKey(pub.TopicName) != key {
+			continue
+		}
+
+		m := newRetainedMsg(pub, r.StoreTime)
+		if m.expired(now) {
+			method.Delete(key)
+			continue
+		}
+		c.msgs[pub.TopicName] = m
+	}
+
+	// the size may be reduced since persisted
+	for len(c.msgs) > c.size {
+		c.evictLocked()
+	}
+}
+
+// record the message if it's retained, matches the filters or the topic
+// is cached, an empty retained message removes the message cached
+//
+// the persist method is the persist queue of the client, errors returned
+// are *PersistError
+func (c *retainedCache) record(p *PublishPacket) error {
+	if p.TopicName == "" {
+		return nil
+	}
+
+	key := retainedKey(p.TopicName)
+	r := NewPersistRecord(p)
+
+	// persisted with the lock held to keep operations of topics in order
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	_, cached := c.msgs[p.TopicName]
+	switch {
+	case p.IsRetain && len(p.Payload) == 0:
+		delete(c.msgs, p.TopicName)
+		return c.persist.Delete(key)
+	case p.IsRetain || cached || c.match(p.TopicName):
+		var err error
+		if !cached && len(c.msgs) >= c.size {
+			err = c.evictLocked()
+		}
+
+		c.msgs[p.TopicName] = newRetainedMsg(p, r.StoreTime)
+		if storeErr := storeRecord(c.persist, key, r); storeErr != nil {
+			return storeErr
+		}
+		return err
+	}
+	return nil
+}
+
+// evictLocked removes the message received earliest, c.mu must be held
+func (c *retainedCache) evictLocked() error {
+	var oldest *retainedMsg
+	for _, m := range c.msgs {
+		if oldest == nil || m.received.Before(oldest.received) {
+			oldest = m
+		}
+	}
+
+	if oldest == nil {
+		return nil
+	}
+
+	delete(c.msgs, oldest.pkt.TopicName)
+	return c.persist.Delete(retainedKey(oldest.pkt.TopicName))
+}
+
+// get the message of topic, expired message is removed
+func (c *retainedCache) get(topic string) (*PublishPacket, bool) {
+	c.mu.RLock()
+	m, ok := c.msgs[topic]
+	c.mu.RUnlock()
+
+	if !ok {
+		return nil, false
+	}
+
+	if m.expired(time.Now()) {
+		c.remove(topic, m)
+		return nil, false
+	}
+	return m.pkt, true
+}
+
+// rangeMsgs ranges messages of topics matching the filter in topic order,
+// all messages are ranged if the filter is empty
+func (c *retainedCache) rangeMsgs(filter string, f func(p *PublishPacket) bool) {
+	c.mu.RLock()
+	msgs := make([]*retainedMsg, 0, len(c.msgs))
+	for topic, m := range c.msgs {
+		if filter == "" || MatchTopic(filter, topic) {
+			msgs = append(msgs, m)
+		}
+	}
+	c.mu.RUnlock()
+
+	sort.Slice(msgs, func(i, j int) bool { return msgs[i].pkt.TopicName < msgs[j].pkt.TopicName })
+
+	now := time.Now()
+	for _, m := range msgs {
+		if m.expired(now) {
+			c.remove(m.pkt.TopicName, m)
+			continue
+		}
+
+		if !f(m.pkt) {
+			return
+		}
+	}
+}
+
+// remove the expired message if not replaced
+func (c *retainedCache) remove(topic string, m *retainedMsg) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if c.msgs[topic] == m {
+		delete(c.msgs, topic)
+		c.persist.Delete(retainedKey(topic))
+	}
+}
+
+func (c *retainedCache) match(topic string) bool {
+	for _, f := range c.filters {
+		if MatchTopic(f, topic) {
+			return true
+		}
+	}
+	return false
+}
+
+// newRetainedMsg creates the cached message, which expires after the
+// MessageExpiryInterval since received
+func newRetainedMsg(p *PublishPacket, received time.Time) *retainedMsg {
+	m := &retainedMsg{pkt: p, received: received}
+	if p.Props != nil && p.Props.MessageExpiryInterval > 0 && !received.IsZero() {
+		m.expire = received.Add(time.Duration(p.Props.MessageExpiryInterval) * time.Second)
+	}
+	return m
+}
+
+func (m *retainedMsg) expired(now time.Time) bool {
+	return !m.expire.IsZero() && !now.Before(m.expire)
+}
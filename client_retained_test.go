@@ -0,0 +1,184 @@
+/*
+ * Copyright Go-IIoT (https://github.com/goiiot)
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package libmqtt
+
+import (
+	"strings"
+	"testing"
+	"time"
+)
+
+func testRetainedClient(t *testing.T, options ...Option) *AsyncClient {
+	c, err := NewClient(append([]Option{WithServer("localhost:1883"), WithClientID("foo"), WithRouter(NewStandardRouter())}, options...)...)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	c.workers.Add(1)
+	go c.handleTopicMsg()
+	return c
+}
+
+// testRetainedRecv dispatches packets received and waits for them recorded
+func testRetainedRecv(c *AsyncClient, pkts ...*PublishPacket) {
+	done := make(chan struct{})
+	c.Handle("#", func(topic string, qos QosLevel, msg []byte) {
+		done <- struct{}{}
+	})
+
+	for _, p := range pkts {
+		// stamped by the connection
+		p.setVersion(c.options.protoVersion)
+		c.recvC <- p
+		<-done
+	}
+}
+
+func testRetainedTopics(c *AsyncClient, filter string) string {
+	var topics []string
+	c.RangeRetained(filter, func(p *PublishPacket) bool {
+		topics = append(topics, p.TopicName)
+		return true
+	})
+	return strings.Join(topics, ",")
+}
+
+func TestClientRetained(t *testing.T) {
+	c := testRetainedClient(t, WithRetainedCache(10, nil, "sensors/+/temp"))
+	defer c.Destroy(true)
+
+	testRetainedRecv(c,
+		&PublishPacket{TopicName: "a/b", IsRetain: true, Payload: []byte("1")},
+		&PublishPacket{TopicName: "a/c", IsRetain: true, Payload: []byte("2")},
+		&PublishPacket{TopicName: "a/b", IsRetain: true, Payload: []byte("3")},
+		&PublishPacket{TopicName: "a/d", Payload: []byte("4")},
+		&PublishPacket{TopicName: "sensors/1/temp", Payload: []byte("5")},
+		&PublishPacket{TopicName: "sensors/1/humidity", Payload: []byte("6")},
+	)
+
+	if p, ok := c.Retained("a/b"); !ok || string(p.Payload) != "3" {
+		t.Error("retained message mismatch, packet =", p)
+	}
+
+	if topics := testRetainedTopics(c, ""); topics != "a/b,a/c,sensors/1/temp" {
+		t.Error("cached topics mismatch, topics =", topics)
+	}
+
+	if topics := testRetainedTopics(c, "a/#"); topics != "a/b,a/c" {
+		t.Error("cached topics of filter mismatch, topics =", topics)
+	}
+
+	// non-retained message updates the topic cached
+	testRetainedRecv(c, &PublishPacket{TopicName: "a/c", Payload: []byte("7")})
+	if p, ok := c.Retained("a/c"); !ok || string(p.Payload) != "7" {
+		t.Error("cached message not updated, packet =", p)
+	}
+
+	// empty retained message clears the cache
+	testRetainedRecv(c, &PublishPacket{TopicName: "a/b", IsRetain: true})
+	if _, ok := c.Retained("a/b"); ok {
+		t.Error("retained message not cleared")
+	}
+}
+
+func TestClientRetained_Expiry(t *testing.T) {
+	c := testRetainedClient(t, WithVersion(V5, false), WithRetainedCache(10, nil))
+	defer c.Destroy(true)
+
+	testRetainedRecv(c,
+		&PublishPacket{TopicName: "a", IsRetain: true, Payload: []byte("1"), Props: &PublishProps{MessageExpiryInterval: 1}},
+		&PublishPacket{TopicName: "b", IsRetain: true, Payload: []byte("2"), Props: &PublishProps{MessageExpiryInterval: 60}},
+	)
+
+	if topics := testRetainedTopics(c, ""); topics != "a,b" {
+		t.Fatal("cached topics mismatch, topics =", topics)
+	}
+
+	time.Sleep(time.Second)
+	if _, ok := c.Retained("a"); ok {
+		t.Error("expired message returned")
+	}
+
+	if topics := testRetainedTopics(c, ""); topics != "b" {
+		t.Error("expired message ranged, topics =", topics)
+	}
+}
+
+func TestClientRetained_Size(t *testing.T) {
+	method := NewMemPersist(nil)
+	c := testRetainedClient(t, WithRetainedCache(2, method, "a/#"))
+	testRetainedRecv(c,
+		&PublishPacket{TopicName: "a/b", Payload: []byte("1")},
+		&PublishPacket{TopicName: "a/c", IsRetain: true, Payload: []byte("2")},
+		&PublishPacket{TopicName: "a/b", Payload: []byte("3")},
+		&PublishPacket{TopicName: "a/d", Payload: []byte("4")},
+	)
+
+	// message received earliest is evicted
+	if topics := testRetainedTopics(c, ""); topics != "a/b,a/d" {
+		t.Error("cached topics mismatch, topics =", topics)
+	}
+	c.Destroy(true)
+	<-c.retainedQ.done
+
+	// fewer topics are restored with smaller size
+	c = testRetainedClient(t, WithRetainedCache(1, method))
+	defer c.Destroy(true)
+
+	if topics := testRetainedTopics(c, ""); topics != "a/d" {
+		t.Error("restored topics mismatch, topics =", topics)
+	}
+}
+
+func TestClientRetained_Persist(t *testing.T) {
+	method := NewFilePersist(t.TempDir(), &PersistStrategy{DuplicateReplace: true})
+	c := testRetainedClient(t, WithVersion(V5, false), WithRetainedCache(10, method))
+	testRetainedRecv(c,
+		&PublishPacket{TopicName: "a/b", IsRetain: true, Payload: []byte("1"), Props: &PublishProps{ContentType: "text/plain"}},
+		&PublishPacket{TopicName: "a/c", IsRetain: true, Payload: []byte("2"), Props: &PublishProps{MessageExpiryInterval: 1}},
+	)
+	c.Destroy(true)
+
+	// persisted in background
+	if _, ok := c.retained.persist.(*persistQueue); !ok {
+		t.Fatal("retained messages not persisted in persist queue")
+	}
+	<-c.retainedQ.done
+
+	time.Sleep(time.Second)
+
+	// restored after restart
+	c = testRetainedClient(t, WithRetainedCache(10, method))
+	defer c.Destroy(true)
+
+	p, ok := c.Retained("a/b")
+	if !ok || string(p.Payload) != "1" || p.Props == nil || p.Props.ContentType != "text/plain" {
+		t.Error("retained message not restored, packet =", p)
+	}
+
+	if topics := testRetainedTopics(c, ""); topics != "a/b" {
+		t.Error("expired message restored, topics =", topics)
+	}
+
+	// other clients don't share the cache
+	other := testRetainedClient(t, WithClientID("bar"), WithRetainedCache(10, method))
+	defer other.Destroy(true)
+
+	if _, ok := other.Retained("a/b"); ok {
+		t.Error("retained message of other session restored")
+	}
+}
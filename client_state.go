@@ -0,0 +1,88 @@
+/*
+ * Copyright Go-IIoT (https://github.com/goiiot)
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package libmqtt
+
+import (
+	"sync"
+)
+
+// ConnState is the state of connection to one server
+type ConnState byte
+
+const (
+	// StateDisconnected no connection to server and won't reconnect
+	StateDisconnected ConnState = iota
+	// StateConnecting dialing to server
+	StateConnecting
+	// StateAuthenticating connected to server, waiting for ConnAckPacket
+	StateAuthenticating
+	// StateConnected ConnAckPacket with success code received
+	StateConnected
+	// StateReconnecting connection lost or dial failed, waiting to reconnect
+	StateReconnecting
+	// StateClosed client destroyed, no more state change
+	StateClosed
+)
+
+var connStateNames = [...]string{
+	StateDisconnected:   "Disconnected",
+	StateConnecting:     "Connecting",
+	StateAuthenticating: "Authenticating",
+	StateConnected:      "Connected",
+	StateReconnecting:   "Reconnecting",
+	StateClosed:         "Closed",
+}
+
+func (s ConnState) String() string {
+	if int(s) < len(connStateNames) {
+		return connStateNames[s]
+	}
+	return "Unknown"
+}
+
+// connStates holds connection states of all servers
+type connStates struct {
+	mu     sync.RWMutex
+	states map[string]ConnState
+}
+
+func newConnStates() *connStates {
+	return &connStates{states: make(map[string]ConnState)}
+}
+
+func (s *connStates) get(server string) ConnState {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	// not present means StateDisconnected
+	return s.states[server]
+}
+
+// set the state of server, returns the previous state,
+// changed is false if state not changed or already closed
+func (s *connStates) set(server string, to ConnState) (from ConnState, changed bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	from = s.states[server]
+	if from == to || from == StateClosed {
+		return from, false
+	}
+
+	s.states[server] = to
+	return from, true
+}
@@ -0,0 +1,189 @@
+/*
+ * Copyright Go-IIoT (https://github.com/goiiot)
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package libmqtt
+
+import (
+	"bufio"
+	"errors"
+	"net"
+	"testing"
+	"time"
+)
+
+func TestConnStates(t *testing.T) {
+	s := newConnStates()
+	if s.get("foo") != StateDisconnected {
+		t.Error("unknown server should be disconnected")
+	}
+
+	if from, changed := s.set("foo", StateConnecting); from != StateDisconnected || !changed {
+		t.Error("state not changed")
+	}
+
+	if _, changed := s.set("foo", StateConnecting); changed {
+		t.Error("same state should not be changed")
+	}
+
+	s.set("foo", StateClosed)
+	if _, changed := s.set("foo", StateReconnecting); changed || s.get("foo") != StateClosed {
+		t.Error("closed state should not be changed")
+	}
+}
+
+// testBroker accepts one connection, responds ConnAck and close the connection
+func testBroker(t *testing.T) net.Listener {
+	return testBrokerWith(t, nil)
+}
+
+// testBrokerWith accepts one connection, responds ConnAck and calls fn
+// with the connection before closing it
+func testBrokerWith(t *testing.T, fn func(conn *bufio.ReadWriter)) net.Listener {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	go func() {
+		conn, err := l.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+
+		rw := bufio.NewReadWriter(bufio.NewReader(conn), bufio.NewWriter(conn))
+		if _, err := Decode(V311, rw); err != nil {
+			t.Error("decode connect packet failed, err =", err)
+			return
+		}
+
+		(&ConnAckPacket{}).WriteTo(rw)
+		rw.Flush()
+
+		if fn != nil {
+			fn(rw)
+		}
+	}()
+
+	return l
+}
+
+func TestConnState_NetHandler(t *testing.T) {
+	l := testBroker(t)
+	defer l.Close()
+
+	server := l.Addr().String()
+	c, err := NewClient(WithServer(server), WithBackoffStrategy(time.Second, time.Second, 1))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	stateC := make(chan ConnState, 10)
+	c.HandleState(func(s string, from, to ConnState) {
+		if s != server {
+			t.Error("server mismatch, server =", s)
+		}
+		stateC <- to
+	})
+
+	netErrC := make(chan error, 1)
+	c.HandleNet(func(s string, err error) {
+		netErrC <- err
+	})
+
+	c.Connect(nil)
+
+	for _, target := range []ConnState{StateConnecting, StateAuthenticating, StateConnected, StateReconnecting} {
+		select {
+		case s := <-stateC:
+			if s != target {
+				t.Error("state mismatch, state =", s, "target =", target)
+			}
+		case <-time.After(time.Second):
+			t.Fatal("state change timeout, target =", target)
+		}
+	}
+
+	select {
+	case err := <-netErrC:
+		if !errors.Is(err, ErrNetwork) {
+			t.Error("net error should be network error, err =", err)
+		}
+	case <-time.After(time.Second):
+		t.Error("net handler not called")
+	}
+
+	c.Destroy(true)
+	select {
+	case s := <-stateC:
+		if s != StateClosed || c.State(server) != StateClosed {
+			t.Error("client should be closed, state =", s)
+		}
+	case <-time.After(time.Second):
+		t.Error("client not closed")
+	}
+}
+
+func TestConnHandler_LostBeforeConnAck(t *testing.T) {
+	for _, resp := range [][]byte{nil, {0x00, 0x00}} {
+		l, err := net.Listen("tcp", "127.0.0.1:0")
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		go func() {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			defer conn.Close()
+
+			if _, err := Decode(V311, bufio.NewReader(conn)); err != nil {
+				t.Error("decode connect packet failed, err =", err)
+				return
+			}
+			conn.Write(resp)
+		}()
+
+		c, err := NewClient(WithServer(l.Addr().String()), WithAutoReconnect(false))
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		type result struct {
+			code ReasonCode
+			err  error
+		}
+		resultC := make(chan result, 1)
+		c.Connect(func(server string, code ReasonCode, err error) {
+			resultC <- result{code: code, err: err}
+		})
+
+		select {
+		case r := <-resultC:
+			if resp == nil && (r.code != CodeUnspecifiedError || !errors.Is(r.err, ErrNetwork)) {
+				t.Error("io error not reported, code =", r.code, "err =", r.err)
+			} else if resp != nil && (r.code != CodeMalformedPacket || !errors.Is(r.err, ErrDecodeBadPacket)) {
+				t.Error("decode error not reported, code =", r.code, "err =", r.err)
+			}
+		case <-time.After(time.Second):
+			t.Error("conn handler not called")
+		}
+
+		c.Destroy(true)
+		l.Close()
+	}
+}
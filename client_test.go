@@ -116,7 +116,7 @@ func initClient(c Client, exH *extraHandler, t *testing.T) {
 }
 
 func testConn(c Client, t *testing.T, afterConnSuccess func()) {
-	c.Connect(func(server string, code byte, err error) {
+	c.Connect(func(server string, code ReasonCode, err error) {
 		if err != nil {
 			t.Error(err)
 		}
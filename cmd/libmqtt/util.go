@@ -20,7 +20,7 @@ import (
 	mqtt "github.com/goiiot/libmqtt"
 )
 
-func connHandler(server string, code byte, err error) {
+func connHandler(server string, code mqtt.ReasonCode, err error) {
 	if err != nil {
 		println("\nconnect to server error:", err)
 	} else if code != mqtt.CodeSuccess {
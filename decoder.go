@@ -17,31 +17,84 @@
 package libmqtt
 
 import (
-	"errors"
 	"io"
 )
 
 var (
 	// ErrDecodeBadPacket is the error happened when trying to decode a none MQTT packet
-	ErrDecodeBadPacket = errors.New("try decoding none MQTT packet ")
+	ErrDecodeBadPacket = newKindError(ErrProtocol, "try decoding none MQTT packet ")
 
 	// ErrDecodeNoneV311Packet is the error happened when
 	// trying to decode mqtt 3.1.1 packet but got other mqtt packet ProtoVersion
-	ErrDecodeNoneV311Packet = errors.New("try decoding none MQTT v3.1.1 packet ")
+	ErrDecodeNoneV311Packet = newKindError(ErrProtocol, "try decoding none MQTT v3.1.1 packet ")
 
 	// ErrDecodeNoneV5Packet is the error happened when
 	// trying to decode mqtt 5 packet but got other mqtt packet ProtoVersion
-	ErrDecodeNoneV5Packet = errors.New("try decoding none MQTT v5 packet ")
+	ErrDecodeNoneV5Packet = newKindError(ErrProtocol, "try decoding none MQTT v5 packet ")
 )
 
 // Decode will decode one mqtt packet
+//
+// data of the packet is read into a newly allocated buffer owned by the
+// packet, use Decoder to decode packets continuously with less allocation
 func Decode(version ProtoVersion, r BufferedReader) (Packet, error) {
-	header, err := r.ReadByte()
+	d := &Decoder{r: r, version: version, noCopy: true}
+	return d.Decode()
+}
+
+// Decoder decodes packets from a reader, it reuses the read buffer
+// across Decode calls
+//
+// by default, all data of decoded packets are copied out of the read buffer,
+// thus they can be used freely after decoding
+//
+// when NoCopy enabled, Payload of PublishPacket and WillMessage of ConnPacket
+// reference the read buffer, they are only valid until the next Decode call,
+// copy them if they are required to be kept
+type Decoder struct {
+	r       BufferedReader
+	version ProtoVersion
+	buf     []byte
+	noCopy  bool
+	strict  bool
+	maxSize int
+}
+
+// NewDecoder creates a Decoder decoding packets of the protocol version from r
+func NewDecoder(version ProtoVersion, r BufferedReader) *Decoder {
+	return &Decoder{r: r, version: version}
+}
+
+// SetNoCopy set whether to reference the read buffer instead of copying
+// for payload of decoded packets
+func (d *Decoder) SetNoCopy(noCopy bool) {
+	d.noCopy = noCopy
+}
+
+// SetMaxPacketSize set the maximum size of packets to decode, packets
+// larger than it are rejected with *PacketSizeError before reading
+// the packet body, size <= 0 means no limit
+//
+// the body of the rejected packet is left unread, the reader is no longer
+// positioned at the packet boundary after the rejection
+func (d *Decoder) SetMaxPacketSize(size int) {
+	d.maxSize = size
+}
+
+// Decode decodes one packet
+func (d *Decoder) Decode() (Packet, error) {
+	header, err := d.r.ReadByte()
 	if err != nil {
 		return nil, err
 	}
 
-	bytesToRead, _ := getRemainLength(r)
+	bytesToRead, lenBytes := getRemainLength(d.r)
+	if d.strict {
+		if err := checkFixedHeader(header, lenBytes); err != nil {
+			return nil, err
+		}
+	}
+
 	if bytesToRead == 0 {
 		switch header >> 4 {
 		case CtrlPingReq:
@@ -49,7 +102,7 @@ func Decode(version ProtoVersion, r BufferedReader) (Packet, error) {
 		case CtrlPingResp:
 			return PingRespPacket, nil
 		case CtrlDisConn:
-			if version == V311 {
+			if d.version == V311 {
 				return &DisConnPacket{}, nil
 			} else {
 				return nil, ErrDecodeBadPacket
@@ -61,23 +114,51 @@ func Decode(version ProtoVersion, r BufferedReader) (Packet, error) {
 		return nil, ErrDecodeBadPacket
 	}
 
-	body := make([]byte, bytesToRead)
-	if _, err = io.ReadFull(r, body[:]); err != nil {
+	if d.maxSize > 0 {
+		if size := 1 + varIntLen(bytesToRead) + bytesToRead; size > d.maxSize {
+			return nil, &PacketSizeError{PacketType: header >> 4, Size: size, Max: d.maxSize}
+		}
+	}
+
+	if cap(d.buf) < bytesToRead {
+		d.buf = make([]byte, bytesToRead)
+	}
+
+	body := d.buf[:bytesToRead]
+	if _, err = io.ReadFull(d.r, body); err != nil {
 		return nil, err
 	}
 
-	switch version {
+	var pkt Packet
+	switch d.version {
 	case V311:
-		return decodeV311Packet(header, body)
+		pkt, err = d.decodeV311Packet(header, body)
 	case V5:
-		return decodeV5Packet(header, body)
+		pkt, err = d.decodeV5Packet(header, body)
 	default:
 		return nil, ErrUnsupportedVersion
 	}
+
+	if err == nil && d.strict {
+		err = checkPacket(d.version, pkt, body)
+	}
+
+	if err != nil {
+		return nil, err
+	}
+	return pkt, nil
+}
+
+// bytes returns data (or the copy of data) used by the decoded packet
+func (d *Decoder) bytes(data []byte) []byte {
+	if d.noCopy {
+		return data
+	}
+	return append(make([]byte, 0, len(data)), data...)
 }
 
 // decode mqtt v3.1.1 packets
-func decodeV311Packet(header byte, body []byte) (Packet, error) {
+func (d *Decoder) decodeV311Packet(header byte, body []byte) (Packet, error) {
 	var err error
 	switch header >> 4 {
 	case CtrlConn:
@@ -113,6 +194,7 @@ func decodeV311Packet(header byte, body []byte) (Packet, error) {
 		if pkt.IsWill {
 			pkt.WillTopic, body, err = getStringData(body)
 			pkt.WillMessage, body, err = getBinaryData(body)
+			pkt.WillMessage = d.bytes(pkt.WillMessage)
 		}
 
 		if hasUsername {
@@ -129,7 +211,7 @@ func decodeV311Packet(header byte, body []byte) (Packet, error) {
 
 		return pkt, nil
 	case CtrlConnAck:
-		return &ConnAckPacket{Present: body[0]&0x01 == 0x01, Code: body[1]}, nil
+		return &ConnAckPacket{Present: body[0]&0x01 == 0x01, Code: ReasonCode(body[1])}, nil
 	case CtrlPublish:
 		topicName, body, err := getStringData(body)
 		if err != nil {
@@ -152,7 +234,7 @@ func decodeV311Packet(header byte, body []byte) (Packet, error) {
 			body = body[2:]
 		}
 
-		pub.Payload = body
+		pub.Payload = d.bytes(body)
 		return pub, nil
 	case CtrlPubAck:
 		return &PubAckPacket{PacketID: getUint16(body)}, nil
@@ -209,9 +291,10 @@ func decodeV311Packet(header byte, body []byte) (Packet, error) {
 }
 
 // decode mqtt v5 packets
-func decodeV5Packet(header byte, body []byte) (Packet, error) {
+func (d *Decoder) decodeV5Packet(header byte, body []byte) (Packet, error) {
 	var err error
-	switch header >> 4 {
+	ctrl := header >> 4
+	switch ctrl {
 	case CtrlConn:
 		protocol, next, err := getStringData(body)
 		if err != nil {
@@ -240,12 +323,10 @@ func decodeV5Packet(header byte, body []byte) (Packet, error) {
 		pkt.ProtoVersion = ProtoVersion(body[0])
 
 		// read properties
-		var props map[byte][]byte
-		props, next, err = getRawProps(next[4:])
+		next, err = d.rangeProps(ctrl, next[4:], pkt.Props)
 		if err != nil {
 			return nil, err
 		}
-		pkt.Props.setProps(props)
 
 		if pkt.ClientID, next, err = getStringData(next); err != nil {
 			return nil, err
@@ -254,6 +335,7 @@ func decodeV5Packet(header byte, body []byte) (Packet, error) {
 		if pkt.IsWill {
 			pkt.WillTopic, next, err = getStringData(next)
 			pkt.WillMessage, next, err = getBinaryData(next)
+			pkt.WillMessage = d.bytes(pkt.WillMessage)
 		}
 
 		if hasUsername {
@@ -272,15 +354,13 @@ func decodeV5Packet(header byte, body []byte) (Packet, error) {
 	case CtrlConnAck:
 		pkt := &ConnAckPacket{
 			Present: body[0]&0x01 == 0x01,
-			Code:    body[1],
+			Code:    ReasonCode(body[1]),
 			Props:   &ConnAckProps{},
 		}
 
-		props, _, err := getRawProps(body[2:])
-		if err != nil {
+		if _, err := d.rangeProps(ctrl, body[2:], pkt.Props); err != nil {
 			return nil, err
 		}
-		pkt.Props.setProps(props)
 
 		return pkt, nil
 	case CtrlPublish:
@@ -307,14 +387,12 @@ func decodeV5Packet(header byte, body []byte) (Packet, error) {
 			body = body[2:]
 		}
 
-		var props map[byte][]byte
-		props, body, err = getRawProps(body)
+		body, err = d.rangeProps(ctrl, body, pub.Props)
 		if err != nil {
 			return nil, err
 		}
-		pub.Props.setProps(props)
 
-		pub.Payload = body
+		pub.Payload = d.bytes(body)
 		return pub, nil
 	case CtrlPubAck:
 		if len(body) < 3 {
@@ -323,15 +401,13 @@ func decodeV5Packet(header byte, body []byte) (Packet, error) {
 
 		pkt := &PubAckPacket{
 			PacketID: getUint16(body),
-			Code:     body[2],
+			Code:     ReasonCode(body[2]),
 			Props:    &PubAckProps{},
 		}
 
-		props, _, err := getRawProps(body[3:])
-		if err != nil {
+		if _, err := d.rangeProps(ctrl, body[3:], pkt.Props); err != nil {
 			return nil, err
 		}
-		pkt.Props.setProps(props)
 
 		return pkt, nil
 	case CtrlPubRecv:
@@ -341,15 +417,13 @@ func decodeV5Packet(header byte, body []byte) (Packet, error) {
 
 		pkt := &PubRecvPacket{
 			PacketID: getUint16(body),
-			Code:     body[2],
+			Code:     ReasonCode(body[2]),
 			Props:    &PubRecvProps{},
 		}
 
-		props, _, err := getRawProps(body[3:])
-		if err != nil {
+		if _, err := d.rangeProps(ctrl, body[3:], pkt.Props); err != nil {
 			return nil, err
 		}
-		pkt.Props.setProps(props)
 
 		return pkt, nil
 	case CtrlPubRel:
@@ -359,14 +433,12 @@ func decodeV5Packet(header byte, body []byte) (Packet, error) {
 
 		pkt := &PubRelPacket{
 			PacketID: getUint16(body),
-			Code:     body[2],
+			Code:     ReasonCode(body[2]),
 			Props:    &PubRelProps{},
 		}
-		props, _, err := getRawProps(body[3:])
-		if err != nil {
+		if _, err := d.rangeProps(ctrl, body[3:], pkt.Props); err != nil {
 			return nil, err
 		}
-		pkt.Props.setProps(props)
 
 		return pkt, nil
 	case CtrlPubComp:
@@ -376,15 +448,13 @@ func decodeV5Packet(header byte, body []byte) (Packet, error) {
 
 		pkt := &PubCompPacket{
 			PacketID: getUint16(body),
-			Code:     body[2],
+			Code:     ReasonCode(body[2]),
 			Props:    &PubCompProps{},
 		}
 
-		props, _, err := getRawProps(body[3:])
-		if err != nil {
+		if _, err := d.rangeProps(ctrl, body[3:], pkt.Props); err != nil {
 			return nil, err
 		}
-		pkt.Props.setProps(props)
 
 		return pkt, nil
 	case CtrlSubscribe:
@@ -393,11 +463,10 @@ func decodeV5Packet(header byte, body []byte) (Packet, error) {
 			Props:    &SubscribeProps{},
 		}
 
-		props, next, err := getRawProps(body[2:])
+		next, err := d.rangeProps(ctrl, body[2:], pkt.Props)
 		if err != nil {
 			return nil, err
 		}
-		pkt.Props.setProps(props)
 
 		for len(next) > 0 {
 			var name string
@@ -419,11 +488,10 @@ func decodeV5Packet(header byte, body []byte) (Packet, error) {
 			Props:    &SubAckProps{},
 		}
 
-		props, next, err := getRawProps(body[2:])
+		next, err := d.rangeProps(ctrl, body[2:], pkt.Props)
 		if err != nil {
 			return nil, err
 		}
-		pkt.Props.setProps(props)
 
 		for i := 0; i < len(next); i++ {
 			pkt.Codes = append(pkt.Codes, next[i])
@@ -435,11 +503,10 @@ func decodeV5Packet(header byte, body []byte) (Packet, error) {
 			Props:    &UnSubProps{},
 		}
 
-		props, next, err := getRawProps(body[2:])
+		next, err := d.rangeProps(ctrl, body[2:], pkt.Props)
 		if err != nil {
 			return nil, err
 		}
-		pkt.Props.setProps(props)
 
 		for len(next) > 0 {
 			var name string
@@ -456,37 +523,35 @@ func decodeV5Packet(header byte, body []byte) (Packet, error) {
 			Props:    &UnSubAckProps{},
 		}
 
-		props, _, err := getRawProps(body[2:])
+		next, err := d.rangeProps(ctrl, body[2:], pkt.Props)
 		if err != nil {
 			return nil, err
 		}
-		pkt.Props.setProps(props)
 
+		for i := 0; i < len(next); i++ {
+			pkt.Codes = append(pkt.Codes, next[i])
+		}
 		return pkt, nil
 	case CtrlDisConn:
 		pkt := &DisConnPacket{
-			Code:  body[0],
+			Code:  ReasonCode(body[0]),
 			Props: &DisConnProps{},
 		}
 
-		props, _, err := getRawProps(body[1:])
-		if err != nil {
+		if _, err := d.rangeProps(ctrl, body[1:], pkt.Props); err != nil {
 			return nil, err
 		}
-		pkt.Props.setProps(props)
 
 		return pkt, nil
 	case CtrlAuth:
 		pkt := &AuthPacket{
-			Code:  body[0],
+			Code:  ReasonCode(body[0]),
 			Props: &AuthProps{},
 		}
 
-		props, _, err := getRawProps(body[1:])
-		if err != nil {
+		if _, err := d.rangeProps(ctrl, body[1:], pkt.Props); err != nil {
 			return nil, err
 		}
-		pkt.Props.setProps(props)
 
 		return pkt, nil
 	default:
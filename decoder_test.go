@@ -18,6 +18,8 @@ package libmqtt
 
 import (
 	"bytes"
+	"errors"
+	"reflect"
 	"testing"
 )
 
@@ -105,3 +107,199 @@ func BenchmarkDecodeOnePacket(b *testing.B) {
 		}
 	}
 }
+
+func TestDecoder(t *testing.T) {
+	pkts := testV5Packets()
+	buf := &bytes.Buffer{}
+	for _, p := range pkts {
+		p.WriteTo(buf)
+	}
+
+	d := NewDecoder(V5, buf)
+	decoded := make([]Packet, 0, len(pkts))
+	for range pkts {
+		pkt, err := d.Decode()
+		if err != nil {
+			t.Fatal(err)
+		}
+		decoded = append(decoded, pkt)
+	}
+
+	// decoded packets must not be affected by later decoding
+	for i, pkt := range decoded {
+		setTestVersion(pkt, V5)
+		if bytes.Compare(pkt.Bytes(), pkts[i].Bytes()) != 0 {
+			t.Error("packet mismatch, packet =", ctrlTypeName(pkt.Type()))
+		}
+	}
+
+	if _, err := d.Decode(); err == nil {
+		t.Error("decode with no data should fail")
+	}
+}
+
+func TestDecoder_NoCopy(t *testing.T) {
+	buf := &bytes.Buffer{}
+	(&PublishPacket{TopicName: "foo", Payload: []byte("foo")}).WriteTo(buf)
+	(&PublishPacket{TopicName: "foo", Payload: []byte("bar")}).WriteTo(buf)
+
+	d := NewDecoder(V311, buf)
+	d.SetNoCopy(true)
+
+	first, err := d.Decode()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	payload := first.(*PublishPacket).Payload
+	if string(payload) != "foo" {
+		t.Fatal("payload mismatch, payload =", string(payload))
+	}
+
+	second, err := d.Decode()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// payload references the read buffer
+	if string(second.(*PublishPacket).Payload) != "bar" || string(payload) != "bar" {
+		t.Error("payload should reference the read buffer, payload =", string(payload))
+	}
+
+	if first.(*PublishPacket).TopicName != "foo" {
+		t.Error("topic name should be copied")
+	}
+}
+
+func TestRangeProps(t *testing.T) {
+	props := []byte{
+		propKeyReasonString, 0, 3, 'f', 'o', 'o',
+		propKeySubID, 0x80, 0x01,
+		propKeyUserProps, 0, 1, 'k', 0, 1, 'v',
+		propKeyUserProps, 0, 1, 'k', 0, 1, 'w',
+	}
+
+	buf := &bytes.Buffer{}
+	writeVarInt(len(props), buf)
+	buf.Write(props)
+	buf.WriteString("payload")
+
+	p := &PublishProps{}
+	next, err := rangeProps(buf.Bytes(), rawProps{})
+	if err != nil || string(next) != "payload" {
+		t.Error("range props failed, next =", string(next), "err =", err)
+	}
+
+	rangeProps(buf.Bytes(), p)
+	if len(p.SubIDs) != 1 || p.SubIDs[0] != 128 {
+		t.Error("sub id mismatch, ids =", p.SubIDs)
+	}
+
+	if v := p.UserProps["k"]; len(v) != 2 || v[0] != "v" || v[1] != "w" {
+		t.Error("user props mismatch, props =", p.UserProps)
+	}
+
+	// properties truncated in the middle of a property
+	for i := 1; i < len(props); i++ {
+		if i == 6 || i == 9 || i == 16 {
+			// property boundary
+			continue
+		}
+
+		buf.Reset()
+		writeVarInt(i, buf)
+		buf.Write(props[:i])
+
+		if _, err := rangeProps(buf.Bytes(), rawProps{}); !errors.Is(err, ErrDecodeBadPacket) {
+			t.Error("truncated props should fail, len =", i, "err =", err)
+		}
+	}
+
+	// unknown property
+	if _, err := rangeProps([]byte{2, 0xFF, 0}, rawProps{}); !errors.Is(err, ErrDecodeBadPacket) {
+		t.Error("unknown property should fail, err =", err)
+	}
+}
+
+func setTestVersion(pkt Packet, version ProtoVersion) {
+	reflect.ValueOf(pkt).Elem().FieldByName("ProtoVersion").Set(reflect.ValueOf(version))
+}
+
+func BenchmarkDecode(b *testing.B) {
+	pkts := []Packet{
+		&PublishPacket{TopicName: "foo/bar", Qos: Qos1, PacketID: testPacketID, Payload: make([]byte, 256)},
+		&PubAckPacket{PacketID: testPacketID},
+		&SubAckPacket{PacketID: testPacketID, Codes: []byte{SubOkMaxQos1}},
+	}
+
+	for _, p := range pkts {
+		data := p.Bytes()
+		name := ctrlTypeName(p.Type()) + "-V311"
+		benchmarkDecode(b, name, V311, data)
+	}
+
+	for _, p := range testV5Packets() {
+		benchmarkDecode(b, ctrlTypeName(p.Type())+"-V5", V5, p.Bytes())
+	}
+}
+
+func benchmarkDecode(b *testing.B, name string, version ProtoVersion, data []byte) {
+	r := bytes.NewReader(data)
+	b.Run(name+"/Decode", func(b *testing.B) {
+		b.ReportAllocs()
+		for i := 0; i < b.N; i++ {
+			r.Reset(data)
+			if _, err := Decode(version, r); err != nil {
+				b.Fatal(err)
+			}
+		}
+	})
+
+	for _, noCopy := range []bool{false, true} {
+		n := name + "/Decoder"
+		if noCopy {
+			n += "-NoCopy"
+		}
+
+		b.Run(n, func(b *testing.B) {
+			d := NewDecoder(version, r)
+			d.SetNoCopy(noCopy)
+
+			b.ReportAllocs()
+			for i := 0; i < b.N; i++ {
+				r.Reset(data)
+				if _, err := d.Decode(); err != nil {
+					b.Fatal(err)
+				}
+			}
+		})
+	}
+}
+
+func TestDecoder_MaxPacketSize(t *testing.T) {
+	pkt := &PublishPacket{TopicName: "foo", Payload: make([]byte, 100)}
+	size := len(pkt.Bytes())
+
+	d := NewDecoder(V311, bytes.NewBuffer(pkt.Bytes()))
+	d.SetMaxPacketSize(size)
+	if _, err := d.Decode(); err != nil {
+		t.Error("decode packet of max size failed, err =", err)
+	}
+
+	d = NewDecoder(V311, bytes.NewBuffer(pkt.Bytes()))
+	d.SetMaxPacketSize(size - 1)
+	_, err := d.Decode()
+	if !errors.Is(err, ErrPacketTooLarge) || !errors.Is(err, ErrProtocol) {
+		t.Fatal("oversized packet not rejected, err =", err)
+	}
+
+	var sizeErr *PacketSizeError
+	if !errors.As(err, &sizeErr) || sizeErr.PacketType != CtrlPublish ||
+		sizeErr.Size != size || sizeErr.Max != size-1 {
+		t.Error("size error mismatch, err =", err)
+	}
+
+	if d.buf != nil {
+		t.Error("buffer allocated for oversized packet, cap =", cap(d.buf))
+	}
+}
@@ -17,21 +17,139 @@
 package libmqtt
 
 import (
-	"errors"
+	"bytes"
+	"sync"
 )
 
 var (
 	// ErrUnsupportedVersion unsupported mqtt ProtoVersion
-	ErrUnsupportedVersion = errors.New("trying encode/decode packet with unsupported MQTT version ")
+	ErrUnsupportedVersion = newKindError(ErrProtocol, "trying encode/decode packet with unsupported MQTT version ")
 
 	// ErrEncodeBadPacket happens when trying to encode none MQTT packet
-	ErrEncodeBadPacket = errors.New("trying encode none MQTT packet ")
+	ErrEncodeBadPacket = newKindError(ErrProtocol, "trying encode none MQTT packet ")
 
 	// ErrEncodeLargePacket happens when MQTT packet is too large according to MQTT spec
-	ErrEncodeLargePacket = errors.New("MQTT packet too large")
+	ErrEncodeLargePacket = newKindError(ErrProtocol, "MQTT packet too large")
 )
 
 // Encode MQTT packet to bytes according to protocol ProtoVersion
 func Encode(packet Packet, w BufferedWriter) error {
 	return packet.WriteTo(w)
 }
+
+// buffers larger than this are not returned to the pool
+const maxPooledBufSize = 64 * 1024
+
+// encodeBufPool holds buffers used for encoding, properties are encoded
+// into them first since their length is written before them
+var encodeBufPool = sync.Pool{
+	New: func() interface{} {
+		return &bytes.Buffer{}
+	},
+}
+
+func getEncodeBuf() *bytes.Buffer {
+	return encodeBufPool.Get().(*bytes.Buffer)
+}
+
+func putEncodeBuf(buf *bytes.Buffer) {
+	if buf.Cap() > maxPooledBufSize {
+		return
+	}
+
+	buf.Reset()
+	encodeBufPool.Put(buf)
+}
+
+// propsWriter writes properties of a packet
+type propsWriter interface {
+	writeProps(w BufferedWriter)
+}
+
+// encodeProps encodes properties to a pooled buffer,
+// call putEncodeBuf with the buffer when done
+func encodeProps(p propsWriter) *bytes.Buffer {
+	buf := getEncodeBuf()
+	p.writeProps(buf)
+	return buf
+}
+
+// writeProps writes properties with the length prefix
+func writeProps(w BufferedWriter, props *bytes.Buffer) error {
+	if err := writeVarInt(props.Len(), w); err != nil {
+		return err
+	}
+
+	_, err := w.Write(props.Bytes())
+	return err
+}
+
+// propsLen is the length of properties including the length prefix
+func propsLen(props *bytes.Buffer) int {
+	return varIntLen(props.Len()) + props.Len()
+}
+
+// encodeBytes encodes the packet to a newly allocated slice of the exact size
+func encodeBytes(pkt Packet) []byte {
+	buf := getEncodeBuf()
+	defer putEncodeBuf(buf)
+
+	pkt.WriteTo(buf)
+	result := make([]byte, buf.Len())
+	copy(result, buf.Bytes())
+	return result
+}
+
+// writeAck writes ack packets consist of packet id, reason code and properties,
+// reason code and properties are only written in MQTT 5
+func writeAck(w BufferedWriter, version ProtoVersion, header byte, id uint16, code ReasonCode, p propsWriter) error {
+	switch version {
+	case 0, V311:
+		w.WriteByte(header)
+		w.WriteByte(2)
+		w.WriteByte(byte(id >> 8))
+		return w.WriteByte(byte(id))
+	case V5:
+		props := encodeProps(p)
+		defer putEncodeBuf(props)
+
+		w.WriteByte(header)
+		if err := writeVarInt(3+propsLen(props), w); err != nil {
+			return err
+		}
+
+		writeUint16(w, id)
+		w.WriteByte(byte(code))
+		return writeProps(w, props)
+	default:
+		return ErrUnsupportedVersion
+	}
+}
+
+// sizeCounter is a BufferedWriter discarding all data written
+// and counting the size
+type sizeCounter int
+
+func (c *sizeCounter) Write(p []byte) (int, error) {
+	*c += sizeCounter(len(p))
+	return len(p), nil
+}
+
+func (c *sizeCounter) WriteByte(byte) error {
+	*c++
+	return nil
+}
+
+func (c *sizeCounter) WriteString(s string) (int, error) {
+	*c += sizeCounter(len(s))
+	return len(s), nil
+}
+
+// encodedSize is the size of the packet once encoded
+func encodedSize(pkt Packet) (int, error) {
+	var c sizeCounter
+	if err := pkt.WriteTo(&c); err != nil {
+		return 0, err
+	}
+	return int(c), nil
+}
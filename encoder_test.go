@@ -17,7 +17,10 @@
 package libmqtt
 
 import (
+	"bufio"
 	"bytes"
+	"io/ioutil"
+	"reflect"
 	"testing"
 )
 
@@ -61,16 +64,254 @@ func TestEncodeRemainLength(t *testing.T) {
 	//}
 }
 
+func TestVarIntLen(t *testing.T) {
+	buf := &bytes.Buffer{}
+	for _, n := range []int{0, 127, 128, 16383, 16384, 2097151, 2097152, maxMsgSize} {
+		writeVarInt(n, buf)
+		if varIntLen(n) != buf.Len() {
+			t.Error("var int length mismatch, n =", n, "len =", varIntLen(n), "encoded =", buf.Len())
+		}
+		buf.Reset()
+	}
+}
+
 func TestEncodeOnePacket(t *testing.T) {
+	buf := &bytes.Buffer{}
+	for _, p := range testV5Packets() {
+		if err := Encode(p, buf); err != nil {
+			t.Error("encode failed, packet =", ctrlTypeName(p.Type()), "err =", err)
+		}
 
+		if bytes.Compare(buf.Bytes(), p.Bytes()) != 0 {
+			t.Error("encoded bytes mismatch, packet =", ctrlTypeName(p.Type()))
+		}
+		buf.Reset()
+	}
 }
 
 func TestEncodeOneV311Packet(t *testing.T) {
+	buf := &bytes.Buffer{}
+	for _, p := range testPubMsgs {
+		p.ProtoVersion = V311
+		if err := Encode(p, buf); err != nil {
+			t.Fatal(err)
+		}
+
+		pkt, err := Decode(V311, buf)
+		if err != nil {
+			t.Fatal(err)
+		}
 
+		pub := pkt.(*PublishPacket)
+		pub.ProtoVersion = V311
+		if bytes.Compare(pub.Bytes(), p.Bytes()) != 0 {
+			t.Error("publish packet mismatch after decoding, topic =", p.TopicName)
+		}
+	}
 }
 
 func TestEncodeOneV5Packet(t *testing.T) {
+	buf := &bytes.Buffer{}
+	for _, p := range testV5Packets() {
+		if err := Encode(p, buf); err != nil {
+			t.Fatal(err)
+		}
+
+		pkt, err := Decode(V5, buf)
+		if err != nil {
+			t.Error("decode failed, packet =", ctrlTypeName(p.Type()), "err =", err)
+			continue
+		}
 
+		if buf.Len() != 0 {
+			t.Error("remaining length mismatch, packet =", ctrlTypeName(p.Type()))
+			buf.Reset()
+		}
+
+		// decoded packets have no version set
+		setTestVersion(pkt, V5)
+		if bytes.Compare(pkt.Bytes(), p.Bytes()) != 0 {
+			t.Errorf("packet mismatch after decoding, packet = %s\nGenerated:%v\nTarget:%v",
+				ctrlTypeName(p.Type()), pkt.Bytes(), p.Bytes())
+		}
+	}
+}
+
+func TestEncodeV5Fields(t *testing.T) {
+	buf := &bytes.Buffer{}
+	for _, p := range testV5Packets() {
+		if err := Encode(p, buf); err != nil {
+			t.Fatal(err)
+		}
+
+		pkt, err := Decode(V5, buf)
+		if err != nil {
+			t.Error("decode failed, packet =", ctrlTypeName(p.Type()), "err =", err)
+			continue
+		}
+
+		// user properties and publish topic should not be lost
+		setTestVersion(pkt, V5)
+		if !reflect.DeepEqual(pkt, p) {
+			t.Errorf("packet mismatch after decoding, packet = %s\nDecoded:%+v\nTarget:%+v",
+				ctrlTypeName(p.Type()), pkt, p)
+		}
+	}
+}
+
+// testV5Packets are MQTT 5 packets with properties
+func testV5Packets() []Packet {
+	userProps := UserProps{"foo": []string{"bar"}}
+	return []Packet{
+		&ConnPacket{
+			BasePacket:  BasePacket{ProtoVersion: V5},
+			ProtoName:   "MQTT",
+			IsWill:      true,
+			WillQos:     Qos1,
+			WillTopic:   "will",
+			WillMessage: []byte("bye"),
+			Username:    "user",
+			Password:    "pass",
+			ClientID:    "client",
+			Keepalive:   60,
+			Props: &ConnProps{
+				SessionExpiryInterval: 10,
+				MaxRecv:               100,
+				MaxPacketSize:         1024,
+				MaxTopicAlias:         16,
+				ReqRespInfo:           true,
+				ReqProblemInfo:        true,
+				UserProps:             userProps,
+				AuthMethod:            "method",
+				AuthData:              []byte("data"),
+			},
+		},
+		&ConnAckPacket{
+			BasePacket: BasePacket{ProtoVersion: V5},
+			Present:    true,
+			Code:       CodeSuccess,
+			Props: &ConnAckProps{
+				MaxRecv:          100,
+				MaxQos:           Qos1,
+				MaxPacketSize:    1024,
+				AssignedClientID: "client",
+				Reason:           "ok",
+				UserProps:        userProps,
+				ServerKeepalive:  30,
+			},
+		},
+		&PublishPacket{
+			BasePacket: BasePacket{ProtoVersion: V5},
+			Qos:        Qos1,
+			TopicName:  "foo",
+			PacketID:   testPacketID,
+			Payload:    []byte("bar"),
+			Props: &PublishProps{
+				PayloadFormat:         1,
+				MessageExpiryInterval: 10,
+				TopicAlias:            1,
+				RespTopic:             "resp",
+				CorrelationData:       []byte("id"),
+				UserProps:             userProps,
+				SubIDs:                []int{1, 200},
+				ContentType:           "text/plain",
+			},
+		},
+		&PubAckPacket{
+			BasePacket: BasePacket{ProtoVersion: V5},
+			PacketID:   testPacketID,
+			Code:       CodeNoMatchingSubscribers,
+			Props:      &PubAckProps{Reason: "no sub", UserProps: userProps},
+		},
+		&PubRecvPacket{
+			BasePacket: BasePacket{ProtoVersion: V5},
+			PacketID:   testPacketID,
+			Code:       CodeQuotaExceeded,
+			Props:      &PubRecvProps{Reason: "quota"},
+		},
+		&PubRelPacket{
+			BasePacket: BasePacket{ProtoVersion: V5},
+			PacketID:   testPacketID,
+			Props:      &PubRelProps{},
+		},
+		&PubCompPacket{
+			BasePacket: BasePacket{ProtoVersion: V5},
+			PacketID:   testPacketID,
+			Props:      &PubCompProps{UserProps: userProps},
+		},
+		&SubscribePacket{
+			BasePacket: BasePacket{ProtoVersion: V5},
+			PacketID:   testPacketID,
+			Topics:     []*Topic{{Name: "foo", Qos: Qos1}, {Name: "bar/#", Qos: Qos2}},
+			Props:      &SubscribeProps{SubID: 200, UserProps: userProps},
+		},
+		&SubAckPacket{
+			BasePacket: BasePacket{ProtoVersion: V5},
+			PacketID:   testPacketID,
+			Codes:      []byte{SubOkMaxQos1, SubFail},
+			Props:      &SubAckProps{Reason: "sub"},
+		},
+		&UnSubPacket{
+			BasePacket: BasePacket{ProtoVersion: V5},
+			PacketID:   testPacketID,
+			TopicNames: []string{"foo", "bar/#"},
+			Props:      &UnSubProps{UserProps: userProps},
+		},
+		&UnSubAckPacket{
+			BasePacket: BasePacket{ProtoVersion: V5},
+			PacketID:   testPacketID,
+			Codes:      []byte{byte(CodeSuccess), byte(CodeNoSubscriptionExisted)},
+			Props:      &UnSubAckProps{Reason: "unsub"},
+		},
+		&DisConnPacket{
+			BasePacket: BasePacket{ProtoVersion: V5},
+			Code:       CodeServerBusy,
+			Props:      &DisConnProps{Reason: "busy", ServerRef: "other"},
+		},
+		&AuthPacket{
+			BasePacket: BasePacket{ProtoVersion: V5},
+			Code:       CodeContinueAuth,
+			Props:      &AuthProps{AuthMethod: "method", AuthData: []byte("data")},
+		},
+	}
+}
+
+func BenchmarkEncode(b *testing.B) {
+	pkts := append([]Packet{
+		&ConnPacket{ClientID: "client", Username: "user", Password: "pass", Keepalive: 60},
+		&PublishPacket{TopicName: "foo/bar", Qos: Qos1, PacketID: testPacketID, Payload: make([]byte, 256)},
+		&PubAckPacket{PacketID: testPacketID},
+		&SubscribePacket{PacketID: testPacketID, Topics: []*Topic{{Name: "foo/#", Qos: Qos1}}},
+		&UnSubPacket{PacketID: testPacketID, TopicNames: []string{"foo/#"}},
+		PingReqPacket,
+	}, testV5Packets()...)
+
+	for _, p := range pkts {
+		p := p
+		name := ctrlTypeName(p.Type()) + "-V311"
+		if p.Version() == V5 {
+			name = ctrlTypeName(p.Type()) + "-V5"
+		}
+
+		b.Run(name, func(b *testing.B) {
+			w := bufio.NewWriter(ioutil.Discard)
+			b.ReportAllocs()
+			for i := 0; i < b.N; i++ {
+				if err := p.WriteTo(w); err != nil {
+					b.Fatal(err)
+				}
+			}
+		})
+	}
+}
+
+func BenchmarkPacket_Bytes(b *testing.B) {
+	p := &PublishPacket{TopicName: "foo/bar", Qos: Qos1, PacketID: testPacketID, Payload: make([]byte, 256)}
+
+	b.ReportAllocs()
+	for i := 0; i < b.N; i++ {
+		p.Bytes()
+	}
 }
 
 func BenchmarkFuncDecode(b *testing.B) {
@@ -87,3 +328,16 @@ func BenchmarkFuncDecode(b *testing.B) {
 		}
 	}
 }
+
+func TestEncodedSize(t *testing.T) {
+	for _, pkt := range append(testV5Packets(), testPubMsgs[0], PingReqPacket) {
+		size, err := encodedSize(pkt)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if size != len(pkt.Bytes()) {
+			t.Errorf("%s size mismatch, target = %d, got = %d", ctrlTypeName(pkt.Type()), len(pkt.Bytes()), size)
+		}
+	}
+}
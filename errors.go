@@ -0,0 +1,378 @@
+/*
+ * Copyright Go-IIoT (https://github.com/goiiot)
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package libmqtt
+
+import (
+	"errors"
+	"strconv"
+)
+
+// error categories, errors returned or reported by this library can be
+// checked against them with errors.Is
+var (
+	// ErrNetwork is the category of errors happened in network io,
+	// the underlying net error can be retrieved with errors.Unwrap or errors.As
+	ErrNetwork = errors.New("network error ")
+
+	// ErrProtocol is the category of errors caused by MQTT protocol violation,
+	// e.g. malformed packet, unsupported MQTT version
+	ErrProtocol = errors.New("protocol error ")
+
+	// ErrAuth is the category of errors caused by authentication
+	// or authorization failure
+	ErrAuth = errors.New("auth error ")
+
+	// ErrQuota is the category of errors caused by server side limits,
+	// e.g. quota exceeded, message rate too high
+	ErrQuota = errors.New("quota exceeded ")
+
+	// ErrRejectedByServer is the category of all *ReasonError, it's the error
+	// happened when server responded the packet with a failure reason code
+	ErrRejectedByServer = errors.New("packet rejected by server ")
+)
+
+var reasonCodeNames = map[ReasonCode]string{
+	CodeSuccess:                             "Success",
+	CodeGrantedQos1:                         "GrantedQos1",
+	CodeGrantedQos2:                         "GrantedQos2",
+	CodeDisconnWithWill:                     "DisconnWithWill",
+	CodeNoMatchingSubscribers:               "NoMatchingSubscribers",
+	CodeNoSubscriptionExisted:               "NoSubscriptionExisted",
+	CodeContinueAuth:                        "ContinueAuth",
+	CodeReAuth:                              "ReAuth",
+	CodeUnspecifiedError:                    "UnspecifiedError",
+	CodeMalformedPacket:                     "MalformedPacket",
+	CodeProtoError:                          "ProtoError",
+	CodeImplementationSpecificError:         "ImplementationSpecificError",
+	CodeUnsupportedProtoVersion:             "UnsupportedProtoVersion",
+	CodeClientIdNotValid:                    "ClientIdNotValid",
+	CodeBadUserPass:                         "BadUserPass",
+	CodeNotAuthorized:                       "NotAuthorized",
+	CodeServerUnavail:                       "ServerUnavail",
+	CodeServerBusy:                          "ServerBusy",
+	CodeBanned:                              "Banned",
+	CodeServerShuttingDown:                  "ServerShuttingDown",
+	CodeBadAuthenticationMethod:             "BadAuthenticationMethod",
+	CodeKeepaliveTimeout:                    "KeepaliveTimeout",
+	CodeSessionTakenOver:                    "SessionTakenOver",
+	CodeTopicFilterInvalid:                  "TopicFilterInvalid",
+	CodeTopicNameInvalid:                    "TopicNameInvalid",
+	CodePacketIdentifierInUse:               "PacketIdentifierInUse",
+	CodePacketIdentifierNotFound:            "PacketIdentifierNotFound",
+	CodeReceiveMaxExceeded:                  "ReceiveMaxExceeded",
+	CodeTopicAliasInvalid:                   "TopicAliasInvalid",
+	CodePacketTooLarge:                      "PacketTooLarge",
+	CodeMessageRateTooHigh:                  "MessageRateTooHigh",
+	CodeQuotaExceeded:                       "QuotaExceeded",
+	CodeAdministrativeAction:                "AdministrativeAction",
+	CodePayloadFormatInvalid:                "PayloadFormatInvalid",
+	CodeRetainNotSupported:                  "RetainNotSupported",
+	CodeQosNoSupported:                      "QosNoSupported",
+	CodeUseAnotherServer:                    "UseAnotherServer",
+	CodeServerMoved:                         "ServerMoved",
+	CodeSharedSubscriptionNotSupported:      "SharedSubscriptionNotSupported",
+	CodeConnectionRateExceeded:              "ConnectionRateExceeded",
+	CodeMaxConnectTime:                      "MaxConnectTime",
+	CodeSubscriptionIdentifiersNotSupported: "SubscriptionIdentifiersNotSupported",
+	CodeWildcardSubscriptionNotSupported:    "WildcardSubscriptionNotSupported",
+}
+
+// String returns the name of the reason code, codes sharing the same value
+// (e.g. CodeSuccess and CodeNormalDisconn) have the same name
+func (c ReasonCode) String() string {
+	if name, ok := reasonCodeNames[c]; ok {
+		return name
+	}
+	return "ReasonCode(" + strconv.Itoa(int(c)) + ")"
+}
+
+// IsError reports whether the reason code indicates a failure
+// (value of 0x80 or greater)
+func (c ReasonCode) IsError() bool {
+	return c >= CodeUnspecifiedError
+}
+
+// category of the reason code, nil if not categorized
+func (c ReasonCode) category() error {
+	switch c {
+	case CodeBadUserPass, CodeNotAuthorized, CodeBanned, CodeBadAuthenticationMethod:
+		return ErrAuth
+	case CodeQuotaExceeded, CodeReceiveMaxExceeded, CodeMessageRateTooHigh,
+		CodeConnectionRateExceeded, CodePacketTooLarge, CodeServerBusy:
+		return ErrQuota
+	case CodeMalformedPacket, CodeProtoError, CodeUnsupportedProtoVersion, CodeClientIdNotValid,
+		CodeTopicFilterInvalid, CodeTopicNameInvalid, CodePacketIdentifierInUse,
+		CodePacketIdentifierNotFound, CodeTopicAliasInvalid, CodePayloadFormatInvalid,
+		CodeRetainNotSupported, CodeQosNoSupported, CodeSharedSubscriptionNotSupported,
+		CodeSubscriptionIdentifiersNotSupported, CodeWildcardSubscriptionNotSupported:
+		return ErrProtocol
+	case CodeKeepaliveTimeout:
+		return ErrNetwork
+	}
+	return nil
+}
+
+var ctrlTypeNames = [...]string{
+	CtrlConn:      "Connect",
+	CtrlConnAck:   "ConnAck",
+	CtrlPublish:   "Publish",
+	CtrlPubAck:    "PubAck",
+	CtrlPubRecv:   "PubRecv",
+	CtrlPubRel:    "PubRel",
+	CtrlPubComp:   "PubComp",
+	CtrlSubscribe: "Subscribe",
+	CtrlSubAck:    "SubAck",
+	CtrlUnSub:     "UnSub",
+	CtrlUnSubAck:  "UnSubAck",
+	CtrlPingReq:   "PingReq",
+	CtrlPingResp:  "PingResp",
+	CtrlDisConn:   "DisConn",
+	CtrlAuth:      "Auth",
+}
+
+func ctrlTypeName(t CtrlType) string {
+	if int(t) < len(ctrlTypeNames) && ctrlTypeNames[t] != "" {
+		return ctrlTypeNames[t]
+	}
+	return "CtrlType(" + strconv.Itoa(int(t)) + ")"
+}
+
+// ReasonError is the error happened when server responded with
+// a failure reason code (or return code in MQTT 3.1.1)
+//
+// ReasonError matches ErrRejectedByServer and the category of the code
+// (ErrAuth, ErrQuota, ErrProtocol or ErrNetwork) with errors.Is
+type ReasonError struct {
+	// Code is the failure reason code, return codes of ConnAck
+	// in MQTT 3.1.1 are converted to the equivalent MQTT 5 reason codes
+	Code ReasonCode
+
+	// PacketType is the type of packet carrying the reason code
+	PacketType CtrlType
+
+	// Reason is the reason string (MQTT 5 only)
+	Reason string
+
+	// UserProps is the user properties in the packet (MQTT 5 only)
+	UserProps UserProps
+}
+
+func (e *ReasonError) Error() string {
+	msg := ctrlTypeName(e.PacketType) + " failed, code = " + e.Code.String()
+	if e.Reason != "" {
+		msg += ", reason = " + e.Reason
+	}
+	return msg
+}
+
+// Is reports whether the error belongs to the target error category
+func (e *ReasonError) Is(target error) bool {
+	if target == ErrRejectedByServer {
+		return true
+	}
+
+	category := e.Code.category()
+	return category != nil && category == target
+}
+
+// reasonCodeOf returns the reason code describing the error caused
+// connection lost, CodeUnspecifiedError if no code matches
+func reasonCodeOf(err error) ReasonCode {
+	var (
+		reasonErr *ReasonError
+		protoErr  *ProtocolError
+	)
+	switch {
+	case errors.As(err, &reasonErr):
+		return reasonErr.Code
+	case errors.As(err, &protoErr):
+		return protoErr.Code
+	case errors.Is(err, ErrPacketTooLarge):
+		return CodePacketTooLarge
+	case errors.Is(err, ErrKeepaliveTimeout):
+		return CodeKeepaliveTimeout
+	case errors.Is(err, ErrDecodeBadPacket), errors.Is(err, ErrDecodeNoneV311Packet), errors.Is(err, ErrDecodeNoneV5Packet):
+		return CodeMalformedPacket
+	case errors.Is(err, ErrProtocol):
+		return CodeProtoError
+	}
+	return CodeUnspecifiedError
+}
+
+// ErrPacketTooLarge is the error happened when the size of a packet exceeds
+// the maximum packet size, all *PacketSizeError match it with errors.Is
+var ErrPacketTooLarge = newKindError(ErrProtocol, "packet too large ")
+
+// PacketSizeError is the error happened when the size of a packet exceeds
+// the maximum packet size accepted by the receiver
+//
+// PacketSizeError matches ErrPacketTooLarge and ErrProtocol with errors.Is
+type PacketSizeError struct {
+	// PacketType is the type of the oversized packet
+	PacketType CtrlType
+
+	// Size is the size of the whole packet in bytes
+	Size int
+
+	// Max is the maximum packet size in bytes
+	Max int
+}
+
+func (e *PacketSizeError) Error() string {
+	return ctrlTypeName(e.PacketType) + " packet too large, size = " +
+		strconv.Itoa(e.Size) + ", max = " + strconv.Itoa(e.Max)
+}
+
+// Is reports whether the error is ErrPacketTooLarge or belongs to the
+// target error category
+func (e *PacketSizeError) Is(target error) bool {
+	return target == ErrPacketTooLarge || target == ErrProtocol
+}
+
+// v311ConnAckCodes are MQTT 5 equivalents of MQTT 3.1.1 ConnAck return codes
+var v311ConnAckCodes = [...]ReasonCode{
+	1: CodeUnsupportedProtoVersion,
+	2: CodeClientIdNotValid,
+	3: CodeServerUnavail,
+	4: CodeBadUserPass,
+	5: CodeNotAuthorized,
+}
+
+// reasonErrorOf returns the *ReasonError if the packet carries
+// a failure reason code, or nil
+func reasonErrorOf(version ProtoVersion, pkt Packet) error {
+	e := &ReasonError{}
+	switch p := pkt.(type) {
+	case *ConnAckPacket:
+		e.Code = p.Code
+		if version == V311 && e.Code != CodeSuccess {
+			e.Code = CodeUnspecifiedError
+			if int(p.Code) < len(v311ConnAckCodes) {
+				e.Code = v311ConnAckCodes[p.Code]
+			}
+		}
+
+		if p.Props != nil {
+			e.Reason, e.UserProps = p.Props.Reason, p.Props.UserProps
+		}
+	case *PubAckPacket:
+		e.Code = p.Code
+		if p.Props != nil {
+			e.Reason, e.UserProps = p.Props.Reason, p.Props.UserProps
+		}
+	case *PubRecvPacket:
+		e.Code = p.Code
+		if p.Props != nil {
+			e.Reason, e.UserProps = p.Props.Reason, p.Props.UserProps
+		}
+	case *PubCompPacket:
+		e.Code = p.Code
+		if p.Props != nil {
+			e.Reason, e.UserProps = p.Props.Reason, p.Props.UserProps
+		}
+	case *SubAckPacket:
+		// first failure code
+		for _, c := range p.Codes {
+			if ReasonCode(c).IsError() {
+				e.Code = ReasonCode(c)
+				break
+			}
+		}
+
+		if p.Props != nil {
+			e.Reason, e.UserProps = p.Props.Reason, p.Props.UserProps
+		}
+	case *UnSubAckPacket:
+		// first failure code
+		for _, c := range p.Codes {
+			if ReasonCode(c).IsError() {
+				e.Code = ReasonCode(c)
+				break
+			}
+		}
+
+		if p.Props != nil {
+			e.Reason, e.UserProps = p.Props.Reason, p.Props.UserProps
+		}
+	case *DisConnPacket:
+		e.Code = p.Code
+		if p.Props != nil {
+			e.Reason, e.UserProps = p.Props.Reason, p.Props.UserProps
+		}
+	case *AuthPacket:
+		e.Code = p.Code
+		if p.Props != nil {
+			e.Reason, e.UserProps = p.Props.Reason, p.Props.UserProps
+		}
+	default:
+		return nil
+	}
+
+	if !e.Code.IsError() {
+		return nil
+	}
+
+	e.PacketType = pkt.Type()
+	return e
+}
+
+// kindError is the predefined error belongs to one error category
+type kindError struct {
+	kind error
+	msg  string
+}
+
+func newKindError(kind error, msg string) error {
+	return &kindError{kind: kind, msg: msg}
+}
+
+func (e *kindError) Error() string {
+	return e.msg
+}
+
+// Is reports whether the error belongs to the target error category
+func (e *kindError) Is(target error) bool {
+	return target == e.kind
+}
+
+// netError wraps the error happened in network io with server
+type netError struct {
+	server string
+	err    error
+}
+
+// wrapNetErr wraps the err as ErrNetwork, nil or errors already
+// in ErrNetwork or ErrProtocol category are returned directly
+func wrapNetErr(server string, err error) error {
+	if err == nil || errors.Is(err, ErrNetwork) || errors.Is(err, ErrProtocol) {
+		return err
+	}
+	return &netError{server: server, err: err}
+}
+
+func (e *netError) Error() string {
+	return "network error with server " + e.server + ": " + e.err.Error()
+}
+
+func (e *netError) Unwrap() error {
+	return e.err
+}
+
+// Is reports whether the error belongs to the target error category
+func (e *netError) Is(target error) bool {
+	return target == ErrNetwork
+}
@@ -0,0 +1,121 @@
+/*
+ * Copyright Go-IIoT (https://github.com/goiiot)
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package libmqtt
+
+import (
+	"errors"
+	"net"
+	"testing"
+)
+
+func TestReasonCode(t *testing.T) {
+	if CodeNotAuthorized.String() != "NotAuthorized" || ReasonCode(0x7f).String() != "ReasonCode(127)" {
+		t.Error("reason code name mismatch")
+	}
+
+	if CodeNoMatchingSubscribers.IsError() || !CodeUnspecifiedError.IsError() {
+		t.Error("reason code error state mismatch")
+	}
+}
+
+func TestReasonErrorOf(t *testing.T) {
+	for _, c := range []struct {
+		version  ProtoVersion
+		pkt      Packet
+		code     ReasonCode
+		category error
+	}{
+		{version: V5, pkt: &ConnAckPacket{Code: CodeSuccess}},
+		{version: V5, pkt: &PubAckPacket{Code: CodeNoMatchingSubscribers}},
+		{version: V5, pkt: PingRespPacket},
+		{version: V5, pkt: &ConnAckPacket{Code: CodeBanned}, code: CodeBanned, category: ErrAuth},
+		{version: V311, pkt: &ConnAckPacket{Code: 4}, code: CodeBadUserPass, category: ErrAuth},
+		{version: V311, pkt: &ConnAckPacket{Code: 1}, code: CodeUnsupportedProtoVersion, category: ErrProtocol},
+		{version: V5, pkt: &PubRecvPacket{Code: CodeQuotaExceeded}, code: CodeQuotaExceeded, category: ErrQuota},
+		{version: V5, pkt: &PubCompPacket{Code: CodePacketIdentifierNotFound}, code: CodePacketIdentifierNotFound, category: ErrProtocol},
+		{version: V5, pkt: &SubAckPacket{Codes: []byte{SubOkMaxQos0, SubFail}}, code: SubFail},
+		{version: V5, pkt: &DisConnPacket{Code: CodeKeepaliveTimeout}, code: CodeKeepaliveTimeout, category: ErrNetwork},
+	} {
+		err := reasonErrorOf(c.version, c.pkt)
+		if c.code == CodeSuccess {
+			if err != nil {
+				t.Error("packet should have no error, err =", err)
+			}
+			continue
+		}
+
+		var reasonErr *ReasonError
+		if !errors.As(err, &reasonErr) {
+			t.Error("error is not a *ReasonError, err =", err)
+			continue
+		}
+
+		if reasonErr.Code != c.code || reasonErr.PacketType != c.pkt.Type() {
+			t.Error("reason error mismatch, code =", reasonErr.Code, "type =", reasonErr.PacketType)
+		}
+
+		if !errors.Is(err, ErrRejectedByServer) {
+			t.Error("reason error should be rejected by server")
+		}
+
+		for _, category := range []error{ErrNetwork, ErrProtocol, ErrAuth, ErrQuota} {
+			if errors.Is(err, category) != (category == c.category) {
+				t.Error("reason error category mismatch, err =", err, "category =", category)
+			}
+		}
+	}
+}
+
+func TestErrorCategory(t *testing.T) {
+	opErr := &net.OpError{Op: "dial", Net: "tcp", Err: errors.New("refused")}
+	err := wrapNetErr("localhost:1883", opErr)
+
+	var target *net.OpError
+	if !errors.Is(err, ErrNetwork) || !errors.As(err, &target) || target != opErr {
+		t.Error("net error should be wrapped, err =", err)
+	}
+
+	if wrapNetErr("localhost:1883", err) != err || wrapNetErr("localhost:1883", nil) != nil {
+		t.Error("net error should not be wrapped twice")
+	}
+
+	for _, err := range []error{ErrDecodeBadPacket, ErrDecodeNoneV311Packet, ErrDecodeNoneV5Packet, ErrUnsupportedVersion} {
+		if !errors.Is(err, ErrProtocol) || errors.Is(err, ErrNetwork) {
+			t.Error("error should be protocol error, err =", err)
+		}
+	}
+
+	if !errors.Is(ErrTimeOut, ErrNetwork) {
+		t.Error("timeout should be network error")
+	}
+}
+
+func TestReasonCodeOf(t *testing.T) {
+	for err, code := range map[error]ReasonCode{
+		&ReasonError{Code: CodeBanned}:                  CodeBanned,
+		&PacketSizeError{Size: 10, Max: 5}:              CodePacketTooLarge,
+		newProtocolError(CtrlPublish, ErrDuplicateProp): CodeProtoError,
+		ErrKeepaliveTimeout:                             CodeKeepaliveTimeout,
+		ErrDecodeBadPacket:                              CodeMalformedPacket,
+		ErrInvalidTopic:                                 CodeProtoError,
+		ErrConnLost:                                     CodeUnspecifiedError,
+	} {
+		if c := reasonCodeOf(err); c != code {
+			t.Error("reason code mismatch, err =", err, "code =", c, "target =", code)
+		}
+	}
+}
@@ -106,7 +106,7 @@ func ExampleClient() {
 	}
 
 	// connect to server
-	client.Connect(func(server string, code byte, err error) {
+	client.Connect(func(server string, code libmqtt.ReasonCode, err error) {
 		if err != nil {
 			log.Printf("connect to server [%v] failed: %v", server, err)
 			return
@@ -18,22 +18,33 @@ package extension
 
 import (
 	"bytes"
+	"net/url"
+	"time"
 
-	"github.com/boltdb/bolt"
 	"github.com/coreos/etcd/clientv3"
 	"github.com/go-redis/redis"
+	bolt "go.etcd.io/bbolt"
 
 	mqtt "github.com/goiiot/libmqtt"
 )
 
-const defaultRedisKey = "libmqtt"
+const (
+	defaultRedisKey   = "libmqtt"
+	defaultBoltBucket = "libmqtt"
+	defaultEtcdPrefix = "libmqtt"
+)
 
 // NewRedisPersist creates a new redisPersist for session persist
 // with provided redis connection and mainKey,
 //
 // if mainKey is empty here, the default mainKey "libmqtt" will be used
+// if no strategy provided (nil), then the default strategy will be used,
+// the Interval of strategy is not applied, every action is persisted at once
 // if no redis client (nil) provided, will return nil
-func NewRedisPersist(conn *redis.Client, mainKey string) mqtt.PersistMethod {
+//
+// packets stored by previous versions in the hash of mainKey are
+// rewritten as records (see libmqtt.PersistRecord)
+func NewRedisPersist(conn *redis.Client, mainKey string, strategy *mqtt.PersistStrategy) mqtt.PersistMethod {
 	if conn == nil {
 		return nil
 	}
@@ -42,20 +53,99 @@ func NewRedisPersist(conn *redis.Client, mainKey string) mqtt.PersistMethod {
 		mainKey = defaultRedisKey
 	}
 
+	if strategy == nil {
+		strategy = defaultPersistStrategy
+	}
+
 	buf := &bytes.Buffer{}
-	return &redisPersist{
-		conn:    conn,
-		mainKey: mainKey,
-		buf:     buf,
+	p := &redisPersist{
+		conn:     conn,
+		mainKey:  mainKey,
+		buf:      buf,
+		strategy: strategy,
+	}
+
+	// rewrite packets stored by previous versions
+	p.migrate()
+	return p
+}
+
+// NewEtcdPersist creates a new EtcdPersist for session persist with provided
+// etcd client, packets are stored under the key prefix "{prefix}/{clientID}/",
+// clientID is path escaped (see url.PathEscape) so client ids containing "/"
+// won't overlap
+//
+// if prefix is empty here, the default prefix "libmqtt" will be used
+// if ttl is greater than 0, packets expire ttl (rounded up to seconds)
+// after this instance stopped keeping the lease alive
+// if no strategy provided (nil), then the default strategy will be used,
+// the Interval of strategy is not applied, every action is persisted at once
+// if no etcd client (nil) provided, will return nil
+//
+// the returned PersistMethod implements io.Closer, Close stops keeping the
+// lease alive and revokes it, the etcd client is not closed
+func NewEtcdPersist(client *clientv3.Client, prefix, clientID string, ttl time.Duration, strategy *mqtt.PersistStrategy) mqtt.PersistMethod {
+	if client == nil {
+		return nil
+	}
+
+	if prefix == "" {
+		prefix = defaultEtcdPrefix
+	}
+
+	if strategy == nil {
+		strategy = defaultPersistStrategy
+	}
+
+	return &EtcdPersist{
+		client:   client,
+		prefix:   prefix + "/" + url.PathEscape(clientID) + "/",
+		ttl:      ttl,
+		strategy: strategy,
 	}
 }
 
-// NewEtcdPersist creates a new EtcdPersist for session persist with provided etcd client
-func NewEtcdPersist(client *clientv3.Client) mqtt.PersistMethod {
-	return nil
+// defaultPersistStrategy is the same as the default strategy used in libmqtt
+var defaultPersistStrategy = &mqtt.PersistStrategy{
+	Interval:         time.Second,
+	DuplicateReplace: true,
 }
 
-// NewBoltPersist creates a new boltPersist for session persist with provided bucket
-func NewBoltPersist(bucket *bolt.Bucket) mqtt.PersistMethod {
-	return nil
+// NewBoltPersist creates a new boltPersist for session persist with provided
+// bolt database and bucket name, the bucket is created on first store
+//
+// if bucket is empty here, the default bucket name "libmqtt" will be used
+// if no strategy provided (nil), then the default strategy will be used
+// if no database (nil) provided, will return nil
+//
+// the returned PersistMethod implements io.Closer, Close flushes packets
+// batched by strategy.Interval, the database is not closed
+func NewBoltPersist(db *bolt.DB, bucket string, strategy *mqtt.PersistStrategy) mqtt.PersistMethod {
+	if db == nil {
+		return nil
+	}
+
+	if bucket == "" {
+		bucket = defaultBoltBucket
+	}
+
+	if strategy == nil {
+		strategy = defaultPersistStrategy
+	}
+
+	p := &boltPersist{
+		db:       db,
+		bucket:   []byte(bucket),
+		strategy: strategy,
+	}
+
+	// init packet count
+	db.View(func(tx *bolt.Tx) error {
+		if b := tx.Bucket(p.bucket); b != nil {
+			p.n = uint32(b.Stats().KeyN)
+		}
+		return nil
+	})
+
+	return p
 }
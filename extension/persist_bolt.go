@@ -1,18 +1,46 @@
+/*
+ * Copyright Go-IIoT (https://github.com/goiiot)
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
 package extension
 
 import (
-	"bytes"
+	"sync"
+	"time"
 
-	"github.com/boltdb/bolt"
+	bolt "go.etcd.io/bbolt"
 
 	mqtt "github.com/goiiot/libmqtt"
 )
 
+// boltPersist stores packets in a bolt bucket, every Store and Delete runs
+// in an update transaction, or batched into one transaction per
+// PersistStrategy.Interval
 type boltPersist struct {
-	bucket   *bolt.Bucket
+	db       *bolt.DB
+	bucket   []byte
 	strategy *mqtt.PersistStrategy
+
+	mu      sync.Mutex
+	n       uint32            // count of keys stored and pending
+	pending map[string][]byte // packets waiting for flush, nil value for deletion
+	timer   *time.Timer       // flush timer, nil if no flush scheduled
+	err     error             // error of the last batched flush
 }
 
+// Name of boltPersist is "boltPersist"
 func (b *boltPersist) Name() string {
 	if b == nil {
 		return "<nil>"
@@ -21,45 +49,288 @@ func (b *boltPersist) Name() string {
 	return "boltPersist"
 }
 
+// Store a packet with key, when batched, error of the previous flush
+// (if any) is returned
 func (b *boltPersist) Store(key string, p mqtt.Packet) error {
-	if b == nil {
+	if b == nil || p == nil {
 		return nil
 	}
 
-	b.bucket.Put([]byte(key), p.Bytes())
+	return b.StoreRecord(key, mqtt.NewPersistRecord(p))
+}
+
+// StoreRecord stores a record with key, when batched, error of the
+// previous flush (if any) is returned
+func (b *boltPersist) StoreRecord(key string, r *mqtt.PersistRecord) error {
+	if b == nil || r == nil || r.Packet == nil {
+		return nil
+	}
+
+	data := r.Bytes()
+	if data == nil {
+		return mqtt.ErrEncodeBadPacket
+	}
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	exists, err := b.exists(key)
+	if err != nil {
+		return err
+	}
+
+	if exists {
+		if !b.strategy.DuplicateReplace {
+			return nil
+		}
+	} else if b.strategy.MaxCount > 0 && b.n >= b.strategy.MaxCount && b.strategy.DropOnExceed {
+		// packet dropped
+		return mqtt.ErrPacketDroppedByStrategy
+	}
+
+	if err := b.write(key, data); err != nil {
+		return err
+	}
+
+	if !exists {
+		b.n++
+	}
 	return nil
 }
 
+// Load a packet with key, return nil, false when no packet found
 func (b *boltPersist) Load(key string) (mqtt.Packet, bool) {
+	if r, ok := b.LoadRecord(key); ok {
+		return r.Packet, true
+	}
+	return nil, false
+}
+
+// LoadRecord loads a record with key, return nil, false when no record found
+func (b *boltPersist) LoadRecord(key string) (*mqtt.PersistRecord, bool) {
 	if b == nil {
 		return nil, false
 	}
 
-	pkt, err := mqtt.Decode(mqtt.V311, bytes.NewReader(b.bucket.Get([]byte(key))))
-	if err != nil || pkt == nil {
+	b.mu.Lock()
+	data, ok := b.pending[key]
+	b.mu.Unlock()
+
+	if !ok {
+		b.db.View(func(tx *bolt.Tx) error {
+			if bucket := tx.Bucket(b.bucket); bucket != nil {
+				// data is only valid in the transaction
+				data = append([]byte(nil), bucket.Get([]byte(key))...)
+			}
+			return nil
+		})
+	}
+
+	if len(data) == 0 {
+		return nil, false
+	}
+
+	r, err := mqtt.DecodePersistRecord(data)
+	if err != nil {
 		return nil, false
 	}
-	return pkt, true
+	return r, true
 }
 
+// Range over all packet persisted, pending packets are flushed before
+// ranging, f is called outside of transactions
 func (b *boltPersist) Range(f func(string, mqtt.Packet) bool) {
-	if b == nil {
+	if b == nil || f == nil {
 		return
 	}
-	b.bucket.ForEach(func(k, v []byte) error {
-		pkt, err := mqtt.Decode(mqtt.V311, bytes.NewReader(v))
-		if err == nil {
-			f(string(k), pkt)
+
+	b.mu.Lock()
+	b.flushLocked()
+	b.mu.Unlock()
+
+	var keys []string
+	var values [][]byte
+	b.db.View(func(tx *bolt.Tx) error {
+		bucket := tx.Bucket(b.bucket)
+		if bucket == nil {
+			return nil
 		}
 
-		return nil
+		return bucket.ForEach(func(k, v []byte) error {
+			keys = append(keys, string(k))
+			values = append(values, append([]byte(nil), v...))
+			return nil
+		})
 	})
+
+	for i, k := range keys {
+		r, err := mqtt.DecodePersistRecord(values[i])
+		if err != nil {
+			continue
+		}
+
+		if !f(k, r.Packet) {
+			return
+		}
+	}
 }
 
+// Delete a persisted packet with key, when batched, error of the previous
+// flush (if any) is returned
 func (b *boltPersist) Delete(key string) error {
 	if b == nil {
 		return nil
 	}
 
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	exists, err := b.exists(key)
+	if err != nil || !exists {
+		return err
+	}
+
+	if err := b.write(key, nil); err != nil {
+		return err
+	}
+
+	b.n--
 	return nil
 }
+
+// Destroy all packets persisted by deleting the bucket
+func (b *boltPersist) Destroy() error {
+	if b == nil {
+		return nil
+	}
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if b.timer != nil {
+		b.timer.Stop()
+		b.timer = nil
+	}
+	b.pending, b.n, b.err = nil, 0, nil
+
+	return b.db.Update(func(tx *bolt.Tx) error {
+		if err := tx.DeleteBucket(b.bucket); err != nil && err != bolt.ErrBucketNotFound {
+			return err
+		}
+		return nil
+	})
+}
+
+// Flush writes pending packets (if any) to the database, returns the
+// error of flush not reported yet
+func (b *boltPersist) Flush() error {
+	if b == nil {
+		return nil
+	}
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	b.flushLocked()
+	err := b.err
+	b.err = nil
+	return err
+}
+
+// Close flushes pending packets, the database is not closed, it's still
+// owned by the caller
+func (b *boltPersist) Close() error {
+	return b.Flush()
+}
+
+// exists checks whether the key is stored or pending, b.mu must be held
+func (b *boltPersist) exists(key string) (bool, error) {
+	if data, ok := b.pending[key]; ok {
+		return data != nil, nil
+	}
+
+	var exists bool
+	err := b.db.View(func(tx *bolt.Tx) error {
+		if bucket := tx.Bucket(b.bucket); bucket != nil {
+			exists = bucket.Get([]byte(key)) != nil
+		}
+		return nil
+	})
+	return exists, err
+}
+
+// write stores data (or deletes the key if data is nil) immediately
+// or adds it to pending packets according to the strategy, b.mu must be held
+func (b *boltPersist) write(key string, data []byte) error {
+	if b.strategy.Interval <= 0 {
+		return b.db.Update(func(tx *bolt.Tx) error {
+			return putOrDelete(tx, b.bucket, key, data)
+		})
+	}
+
+	// report error of the previous flush
+	err := b.err
+	b.err = nil
+
+	if b.pending == nil {
+		b.pending = make(map[string][]byte)
+	}
+	b.pending[key] = data
+
+	if b.timer == nil {
+		b.timer = time.AfterFunc(b.strategy.Interval, b.flush)
+	}
+	return err
+}
+
+func (b *boltPersist) flush() {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	b.flushLocked()
+}
+
+// flushLocked writes all pending packets in one transaction, b.mu must be held
+func (b *boltPersist) flushLocked() {
+	if b.timer != nil {
+		b.timer.Stop()
+		b.timer = nil
+	}
+
+	if len(b.pending) == 0 {
+		return
+	}
+
+	pending := b.pending
+	b.pending = nil
+	b.err = b.db.Update(func(tx *bolt.Tx) error {
+		for k, v := range pending {
+			if err := putOrDelete(tx, b.bucket, k, v); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+
+	if b.err != nil {
+		// keep packets and retry
+		b.pending = pending
+		b.timer = time.AfterFunc(b.strategy.Interval, b.flush)
+	}
+}
+
+// putOrDelete puts data with key in bucket or delete the key if data is nil
+func putOrDelete(tx *bolt.Tx, bucket []byte, key string, data []byte) error {
+	if data == nil {
+		if b := tx.Bucket(bucket); b != nil {
+			return b.Delete([]byte(key))
+		}
+		return nil
+	}
+
+	b, err := tx.CreateBucketIfNotExists(bucket)
+	if err != nil {
+		return err
+	}
+	return b.Put([]byte(key), data)
+}
@@ -0,0 +1,111 @@
+/*
+ * Copyright Go-IIoT (https://github.com/goiiot)
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package extension
+
+import (
+	"io"
+	"path/filepath"
+	"testing"
+	"time"
+
+	bolt "go.etcd.io/bbolt"
+
+	mqtt "github.com/goiiot/libmqtt"
+	"github.com/goiiot/libmqtt/persisttest"
+)
+
+func testBoltDB(t *testing.T, path string) *bolt.DB {
+	db, err := bolt.Open(path, 0600, &bolt.Options{Timeout: time.Second})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return db
+}
+
+func TestBoltPersist(t *testing.T) {
+	persisttest.Run(t, func(t *testing.T, strategy *mqtt.PersistStrategy) mqtt.PersistMethod {
+		db := testBoltDB(t, filepath.Join(t.TempDir(), "test.db"))
+		t.Cleanup(func() { db.Close() })
+		return NewBoltPersist(db, "test", strategy)
+	}, nil)
+}
+
+func TestBoltPersist_Reopen(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "test.db")
+	strategy := &mqtt.PersistStrategy{Interval: time.Hour, MaxCount: 2, DropOnExceed: true, DuplicateReplace: true}
+
+	db := testBoltDB(t, path)
+	p := NewBoltPersist(db, "", strategy)
+
+	// bad packet is neither stored nor counted
+	if err := p.(mqtt.RecordPersistMethod).StoreRecord("bad", &mqtt.PersistRecord{Packet: (*mqtt.PublishPacket)(nil)}); err != mqtt.ErrEncodeBadPacket {
+		t.Error("bad packet should be rejected, err =", err)
+	}
+
+	persisttest.Store(t, p, "1", &mqtt.PubRelPacket{PacketID: 1})
+	persisttest.Store(t, p, "2", &mqtt.PubRelPacket{PacketID: 2})
+
+	// pending packets are flushed on close
+	if err := p.(io.Closer).Close(); err != nil {
+		t.Fatal(err)
+	}
+	db.Close()
+
+	db = testBoltDB(t, path)
+	defer db.Close()
+
+	p = NewBoltPersist(db, "", strategy)
+	persisttest.Load(t, p, "2", &mqtt.PubRelPacket{PacketID: 2})
+	if err := p.Store("3", &mqtt.PubRelPacket{PacketID: 3}); err != mqtt.ErrPacketDroppedByStrategy {
+		t.Error("packet count not restored, err =", err)
+	}
+
+	if NewBoltPersist(nil, "", nil) != nil {
+		t.Error("persist created without database")
+	}
+}
+
+func TestBoltPersist_FlushRetry(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "test.db")
+	testBoltDB(t, path).Close()
+
+	db, err := bolt.Open(path, 0600, &bolt.Options{Timeout: time.Second, ReadOnly: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+
+	p := NewBoltPersist(db, "", &mqtt.PersistStrategy{Interval: 10 * time.Millisecond}).(*boltPersist)
+	defer p.Destroy()
+
+	if err := p.Store("1", &mqtt.PubRelPacket{PacketID: 1}); err != nil {
+		t.Fatal(err)
+	}
+	time.Sleep(50 * time.Millisecond)
+
+	p.mu.Lock()
+	retry, pending := p.timer != nil, len(p.pending)
+	p.mu.Unlock()
+	if !retry || pending != 1 {
+		t.Error("failed flush should be retried, retry =", retry, "pending =", pending)
+	}
+
+	if err := p.Flush(); err == nil {
+		t.Error("flush error should be reported")
+	}
+	persisttest.Load(t, p, "1", &mqtt.PubRelPacket{PacketID: 1})
+}
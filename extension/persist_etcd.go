@@ -1,54 +1,386 @@
+/*
+ * Copyright Go-IIoT (https://github.com/goiiot)
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
 package extension
 
 import (
+	"context"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/coreos/etcd/clientv3"
+
 	mqtt "github.com/goiiot/libmqtt"
 )
 
+// etcdRequestTimeout is the timeout of every etcd request made by EtcdPersist
+const etcdRequestTimeout = 5 * time.Second
+
+// EtcdPersist stores packets of one client under the key prefix
+// "{prefix}/{clientID}/" (with clientID path escaped) in etcd, so another
+// instance using the same prefix and client id can take over the session
+//
+// when ttl is set, all keys are attached to a lease kept alive by this
+// instance, keys of abandoned sessions expire after ttl, keys attached to
+// other leases are taken over on first Store or Range
+//
+// EtcdPersist is scoped to the client id, the client doesn't namespace keys
+// by servers in it (see libmqtt.ClientScopedPersist), so a standby instance
+// connecting to other servers takes over the session as well
 type EtcdPersist struct {
+	client   *clientv3.Client
+	prefix   string
+	ttl      time.Duration
+	strategy *mqtt.PersistStrategy
+
+	mu      sync.Mutex
+	leaseID clientv3.LeaseID   // 0 if no lease granted
+	stop    context.CancelFunc // stops the lease keepalive
 }
 
-// Name of redisPersist is "EtcdPersist"
-func (r *EtcdPersist) Name() string {
-	if r == nil {
+// Name of EtcdPersist is "EtcdPersist"
+func (e *EtcdPersist) Name() string {
+	if e == nil {
 		return "<nil>"
 	}
 
 	return "EtcdPersist"
 }
 
-func (r *EtcdPersist) Store(key string, p mqtt.Packet) error {
-	if r == nil {
+// Store a packet with key, stored packet is kept unchanged using
+// compare-and-swap if DuplicateReplace is not set
+func (e *EtcdPersist) Store(key string, p mqtt.Packet) error {
+	if e == nil || p == nil {
 		return nil
 	}
 
-	return nil
+	return e.StoreRecord(key, mqtt.NewPersistRecord(p))
 }
 
-func (r *EtcdPersist) Load(key string) (mqtt.Packet, bool) {
-	if r == nil {
-		return nil, false
+// StoreRecord stores a record with key, the same as Store
+func (e *EtcdPersist) StoreRecord(key string, r *mqtt.PersistRecord) error {
+	if e == nil || r == nil || r.Packet == nil {
+		return nil
+	}
+
+	ctx, cancel := e.context()
+	defer cancel()
+
+	opts, err := e.lease(ctx)
+	if err != nil {
+		return err
 	}
 
+	k := e.prefix + key
+	put := clientv3.OpPut(k, string(r.Bytes()), opts...)
+	exists := clientv3.Compare(clientv3.CreateRevision(k), ">", 0)
+
+	for e.strategy.MaxCount > 0 && e.strategy.DropOnExceed {
+		resp, err := e.client.Get(ctx, e.prefix, clientv3.WithPrefix(), clientv3.WithCountOnly())
+		if err != nil {
+			return err
+		}
+
+		if resp.Count >= int64(e.strategy.MaxCount) {
+			// only packets stored can be replaced
+			var then []clientv3.Op
+			if e.strategy.DuplicateReplace {
+				then = append(then, put)
+			}
+
+			txn, err := e.client.Txn(ctx).If(exists).Then(then...).Commit()
+			if err != nil {
+				return err
+			}
+
+			if !txn.Succeeded {
+				// packet dropped
+				return mqtt.ErrPacketDroppedByStrategy
+			}
+			return nil
+		}
+
+		// the count is still valid if no key stored after it's counted,
+		// otherwise count again
+		cmps := []clientv3.Cmp{
+			clientv3.Compare(clientv3.ModRevision(e.prefix), "<", resp.Header.Revision+1).WithPrefix(),
+		}
+		if !e.strategy.DuplicateReplace {
+			cmps = append(cmps, clientv3.Compare(clientv3.CreateRevision(k), "=", 0))
+		}
+
+		txn, err := e.client.Txn(ctx).If(cmps...).Then(put).Else(clientv3.OpGet(k, clientv3.WithCountOnly())).Commit()
+		if err != nil {
+			return err
+		}
+
+		if txn.Succeeded || (!e.strategy.DuplicateReplace && txn.Responses[0].GetResponseRange().Count > 0) {
+			// stored, or kept unchanged
+			return nil
+		}
+	}
+
+	if !e.strategy.DuplicateReplace {
+		_, err = e.client.Txn(ctx).
+			If(clientv3.Compare(clientv3.CreateRevision(k), "=", 0)).
+			Then(put).
+			Commit()
+		return err
+	}
+
+	_, err = e.client.Do(ctx, put)
+	return err
+}
+
+// Load a packet with key, return nil, false when no packet found
+func (e *EtcdPersist) Load(key string) (mqtt.Packet, bool) {
+	if r, ok := e.LoadRecord(key); ok {
+		return r.Packet, true
+	}
 	return nil, false
 }
 
-func (r *EtcdPersist) Range(f func(string, mqtt.Packet) bool) {
-	if r == nil {
+// LoadRecord loads a record with key, return nil, false when no record found
+func (e *EtcdPersist) LoadRecord(key string) (*mqtt.PersistRecord, bool) {
+	if e == nil {
+		return nil, false
+	}
+
+	ctx, cancel := e.context()
+	defer cancel()
+
+	resp, err := e.client.Get(ctx, e.prefix+key)
+	if err != nil || len(resp.Kvs) == 0 {
+		return nil, false
+	}
+
+	r, err := mqtt.DecodePersistRecord(resp.Kvs[0].Value)
+	if err != nil {
+		return nil, false
+	}
+	return r, true
+}
+
+// Range over all packets stored by the client in key order
+func (e *EtcdPersist) Range(f func(string, mqtt.Packet) bool) {
+	if e == nil || f == nil {
 		return
 	}
+
+	ctx, cancel := e.context()
+	defer cancel()
+
+	// take over packets stored by previous instances
+	if _, err := e.lease(ctx); err != nil {
+		return
+	}
+
+	resp, err := e.client.Get(ctx, e.prefix, clientv3.WithPrefix(),
+		clientv3.WithSort(clientv3.SortByKey, clientv3.SortAscend))
+	if err != nil {
+		return
+	}
+
+	for _, kv := range resp.Kvs {
+		r, err := mqtt.DecodePersistRecord(kv.Value)
+		if err != nil {
+			continue
+		}
+
+		if !f(strings.TrimPrefix(string(kv.Key), e.prefix), r.Packet) {
+			return
+		}
+	}
+}
+
+// Delete a persisted packet with key
+func (e *EtcdPersist) Delete(key string) error {
+	if e == nil {
+		return nil
+	}
+
+	ctx, cancel := e.context()
+	defer cancel()
+
+	_, err := e.client.Delete(ctx, e.prefix+key)
+	return err
 }
 
-func (r *EtcdPersist) Delete(key string) error {
-	if r == nil {
+// Destroy all packets stored by the client and revoke the lease
+func (e *EtcdPersist) Destroy() error {
+	if e == nil {
 		return nil
 	}
 
+	ctx, cancel := e.context()
+	defer cancel()
+
+	e.mu.Lock()
+	leaseID := e.leaseID
+	if e.stop != nil {
+		e.stop()
+	}
+	e.leaseID, e.stop = 0, nil
+	e.mu.Unlock()
+
+	if _, err := e.client.Delete(ctx, e.prefix, clientv3.WithPrefix()); err != nil {
+		return err
+	}
+
+	if leaseID != 0 {
+		if _, err := e.client.Revoke(ctx, leaseID); err != nil {
+			return err
+		}
+	}
 	return nil
 }
 
-func (r *EtcdPersist) Destroy() error {
-	if r == nil {
+// ClientScoped is always true, EtcdPersist stores packets of one client id
+// (see libmqtt.ClientScopedPersist), so the session is taken over by
+// clients with the same client id whatever servers they connect to
+func (e *EtcdPersist) ClientScoped() bool {
+	return true
+}
+
+// Close stops keeping the lease alive and revokes it, packets stored are
+// attached to a new lease not kept alive, they expire after ttl unless
+// taken over by another instance
+func (e *EtcdPersist) Close() error {
+	if e == nil {
 		return nil
 	}
+
+	e.mu.Lock()
+	leaseID := e.leaseID
+	if e.stop != nil {
+		e.stop()
+	}
+	e.leaseID, e.stop = 0, nil
+	e.mu.Unlock()
+
+	if leaseID == 0 {
+		return nil
+	}
+
+	ctx, cancel := e.context()
+	defer cancel()
+
+	grant, err := e.client.Grant(ctx, e.ttlSeconds())
+	if err != nil {
+		return err
+	}
+
+	// packets taken over by other instances are kept unchanged
+	if err := e.takeover(ctx, grant.ID, leaseID); err != nil {
+		// packets expire with the revoked lease otherwise
+		e.client.Revoke(ctx, grant.ID)
+		return err
+	}
+
+	_, err = e.client.Revoke(ctx, leaseID)
+	return err
+}
+
+func (e *EtcdPersist) context() (context.Context, context.CancelFunc) {
+	return context.WithTimeout(e.client.Ctx(), etcdRequestTimeout)
+}
+
+// lease returns options to attach keys to the lease, the lease is granted
+// and kept alive on first call, and keys stored by previous instances are
+// taken over
+func (e *EtcdPersist) lease(ctx context.Context) ([]clientv3.OpOption, error) {
+	if e.ttl <= 0 {
+		return nil, nil
+	}
+
+	e.mu.Lock()
+	defer e.mu.Unlock()
+
+	if e.leaseID != 0 {
+		return []clientv3.OpOption{clientv3.WithLease(e.leaseID)}, nil
+	}
+
+	grant, err := e.client.Grant(ctx, e.ttlSeconds())
+	if err != nil {
+		return nil, err
+	}
+
+	keepaliveCtx, stop := context.WithCancel(e.client.Ctx())
+	ch, err := e.client.KeepAlive(keepaliveCtx, grant.ID)
+	if err != nil {
+		stop()
+		return nil, err
+	}
+
+	go e.keepalive(grant.ID, ch)
+
+	if err := e.takeover(ctx, grant.ID, 0); err != nil {
+		stop()
+		// keys taken over are taken over again by next call of lease
+		e.client.Revoke(ctx, grant.ID)
+		return nil, err
+	}
+
+	e.leaseID, e.stop = grant.ID, stop
+	return []clientv3.OpOption{clientv3.WithLease(grant.ID)}, nil
+}
+
+// ttlSeconds is the ttl in seconds, rounded up
+func (e *EtcdPersist) ttlSeconds() int64 {
+	return int64((e.ttl + time.Second - 1) / time.Second)
+}
+
+// keepalive drains keepalive responses, the lease is discarded when
+// keepalive halted (e.g. the lease expired), a new one will be granted
+// on next call of lease
+func (e *EtcdPersist) keepalive(id clientv3.LeaseID, ch <-chan *clientv3.LeaseKeepAliveResponse) {
+	for range ch {
+	}
+
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	if e.leaseID == id {
+		e.stop()
+		e.leaseID, e.stop = 0, nil
+	}
+}
+
+// takeover attaches keys stored with the lease from (or any other lease if
+// from is 0) to the lease id, keys modified concurrently are skipped
+func (e *EtcdPersist) takeover(ctx context.Context, id, from clientv3.LeaseID) error {
+	resp, err := e.client.Get(ctx, e.prefix, clientv3.WithPrefix())
+	if err != nil {
+		return err
+	}
+
+	for _, kv := range resp.Kvs {
+		lease := clientv3.LeaseID(kv.Lease)
+		if lease == id || (from != 0 && lease != from) {
+			continue
+		}
+
+		k := string(kv.Key)
+		_, err := e.client.Txn(ctx).
+			If(clientv3.Compare(clientv3.ModRevision(k), "=", kv.ModRevision)).
+			Then(clientv3.OpPut(k, string(kv.Value), clientv3.WithLease(id))).
+			Commit()
+		if err != nil {
+			return err
+		}
+	}
 	return nil
 }
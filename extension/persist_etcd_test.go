@@ -0,0 +1,268 @@
+/*
+ * Copyright Go-IIoT (https://github.com/goiiot)
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package extension
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/coreos/etcd/clientv3"
+
+	mqtt "github.com/goiiot/libmqtt"
+	"github.com/goiiot/libmqtt/persisttest"
+)
+
+// etcdEndpoint returns the endpoint of the etcd server at ETCD_ENDPOINT,
+// tests are skipped if not set
+func etcdEndpoint(t *testing.T) string {
+	endpoint := os.Getenv("ETCD_ENDPOINT")
+	if endpoint == "" {
+		t.Skip("ETCD_ENDPOINT not set")
+	}
+	return endpoint
+}
+
+// newEtcdPrefix returns a key prefix not used by other tests
+func newEtcdPrefix() string {
+	return fmt.Sprintf("libmqtt-test-%d-%d", time.Now().UnixNano(), atomic.AddInt32(&etcdPrefixID, 1))
+}
+
+var etcdPrefixID int32
+
+func newEtcdClient(t *testing.T, endpoint string) *clientv3.Client {
+	client, err := clientv3.New(clientv3.Config{
+		Endpoints:   []string{endpoint},
+		DialTimeout: 5 * time.Second,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return client
+}
+
+func TestEtcdPersist(t *testing.T) {
+	client := newEtcdClient(t, etcdEndpoint(t))
+	defer client.Close()
+	prefix := newEtcdPrefix()
+
+	var id int32
+	persisttest.Run(t, func(t *testing.T, strategy *mqtt.PersistStrategy) mqtt.PersistMethod {
+		// every persist method uses its own client id
+		clientID := "client-" + strconv.Itoa(int(atomic.AddInt32(&id, 1)))
+		return NewEtcdPersist(client, prefix, clientID, time.Minute, strategy)
+	}, nil)
+
+	if NewEtcdPersist(nil, "", "", 0, nil) != nil {
+		t.Error("persist created without etcd client")
+	}
+}
+
+func TestEtcdPersist_Takeover(t *testing.T) {
+	endpoint := etcdEndpoint(t)
+	prefix := newEtcdPrefix()
+	clientA, clientB := newEtcdClient(t, endpoint), newEtcdClient(t, endpoint)
+	client := newEtcdClient(t, endpoint)
+	defer client.Close()
+
+	pkt := &mqtt.PubRelPacket{PacketID: 1}
+	active := NewEtcdPersist(clientA, prefix, "device", time.Second, nil)
+	persisttest.Store(t, active, "1", pkt)
+
+	// another client id is not affected
+	other := NewEtcdPersist(clientA, prefix, "other", time.Second, nil)
+	if _, ok := other.Load("1"); ok {
+		t.Error("loaded packet of another client")
+	}
+
+	// standby instance takes over packets on range
+	standby := NewEtcdPersist(clientB, prefix, "device", time.Second, nil)
+	count := 0
+	standby.Range(func(key string, p mqtt.Packet) bool {
+		count++
+		return true
+	})
+	if count != 1 {
+		t.Fatal("packets of active instance not ranged, count =", count)
+	}
+
+	// lease of the active instance expires
+	leaseA := active.(*EtcdPersist).leaseID
+	clientA.Close()
+	if !waitEtcd(func() bool {
+		resp, err := client.TimeToLive(client.Ctx(), leaseA)
+		return err == nil && resp.TTL < 0
+	}) {
+		t.Fatal("lease of active instance not expired")
+	}
+	persisttest.Load(t, standby, "1", pkt)
+
+	// session abandoned, packets expire
+	clientB.Close()
+	if !waitEtcd(func() bool {
+		_, ok := NewEtcdPersist(client, prefix, "device", 0, nil).Load("1")
+		return !ok
+	}) {
+		t.Error("packet of abandoned session not expired")
+	}
+}
+
+func TestEtcdPersist_TakeoverServers(t *testing.T) {
+	endpoint := etcdEndpoint(t)
+	prefix := newEtcdPrefix()
+	clientA, clientB := newEtcdClient(t, endpoint), newEtcdClient(t, endpoint)
+	defer clientB.Close()
+
+	newClient := func(etcd *clientv3.Client, servers ...string) mqtt.Client {
+		c, err := mqtt.NewClient(mqtt.WithServer(servers...), mqtt.WithClientID("device"),
+			mqtt.WithOfflineQueue(1, mqtt.OfflineError, NewEtcdPersist(etcd, prefix, "device", time.Minute, nil)))
+		if err != nil {
+			t.Fatal(err)
+		}
+		return c
+	}
+
+	active := newClient(clientA, "a:1883")
+	if err := active.TryPublish(&mqtt.PublishPacket{TopicName: "queued", Qos: mqtt.Qos1}); err != nil {
+		t.Fatal(err)
+	}
+	active.Destroy(true)
+
+	// keys are not namespaced by servers, persisted in background
+	keys := map[string]bool{}
+	waitEtcd(func() bool {
+		keys = map[string]bool{}
+		NewEtcdPersist(clientB, prefix, "device", 0, nil).Range(func(key string, p mqtt.Packet) bool {
+			keys[key] = true
+			return true
+		})
+		return len(keys) != 0
+	})
+	if len(keys) != 1 || !keys["Q0"] {
+		t.Fatal("unexpected keys persisted, keys =", keys)
+	}
+
+	// standby instance connecting to other servers restores the queue
+	standby := newClient(clientB, "b:1883", "c:1883")
+	defer standby.Destroy(true)
+	if err := standby.TryPublish(&mqtt.PublishPacket{TopicName: "new", Qos: mqtt.Qos1}); err != mqtt.ErrQueueFull {
+		t.Error("queued packet not restored, err =", err)
+	}
+}
+
+func TestEtcdPersist_Close(t *testing.T) {
+	client := newEtcdClient(t, etcdEndpoint(t))
+	defer client.Close()
+	prefix := newEtcdPrefix()
+
+	pkt := &mqtt.PubRelPacket{PacketID: 1}
+	p := NewEtcdPersist(client, prefix, "device", time.Second, nil)
+	persisttest.Store(t, p, "1", pkt)
+
+	lease := p.(*EtcdPersist).leaseID
+	if err := p.(io.Closer).Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	if resp, err := client.TimeToLive(client.Ctx(), lease); err != nil || resp.TTL >= 0 {
+		t.Error("lease not revoked, err =", err)
+	}
+
+	// packets are kept until ttl expires
+	persisttest.Load(t, NewEtcdPersist(client, prefix, "device", 0, nil), "1", pkt)
+	if !waitEtcd(func() bool {
+		_, ok := NewEtcdPersist(client, prefix, "device", 0, nil).Load("1")
+		return !ok
+	}) {
+		t.Error("packet not expired after close")
+	}
+}
+
+// waitEtcd polls until cond is true, returns false on timeout
+func waitEtcd(cond func() bool) bool {
+	for deadline := time.Now().Add(10 * time.Second); time.Now().Before(deadline); {
+		if cond() {
+			return true
+		}
+		time.Sleep(50 * time.Millisecond)
+	}
+	return false
+}
+
+func TestEtcdPersist_ClientID(t *testing.T) {
+	client := newEtcdClient(t, etcdEndpoint(t))
+	defer client.Close()
+	prefix := newEtcdPrefix()
+
+	parent := NewEtcdPersist(client, prefix, "a", 0, nil)
+	child := NewEtcdPersist(client, prefix, "a/b", 0, nil)
+	persisttest.Store(t, parent, "1", &mqtt.PubRelPacket{PacketID: 1})
+	persisttest.Store(t, child, "2", &mqtt.PubRelPacket{PacketID: 2})
+
+	parent.Range(func(key string, p mqtt.Packet) bool {
+		if key != "1" {
+			t.Error("ranged packet of another client, key =", key)
+		}
+		return true
+	})
+
+	if err := parent.Destroy(); err != nil {
+		t.Fatal(err)
+	}
+	persisttest.Load(t, child, "2", &mqtt.PubRelPacket{PacketID: 2})
+}
+
+func TestEtcdPersist_MaxCount(t *testing.T) {
+	client := newEtcdClient(t, etcdEndpoint(t))
+	defer client.Close()
+	prefix := newEtcdPrefix()
+
+	const maxCount = 5
+	p := NewEtcdPersist(client, prefix, "client", 0,
+		&mqtt.PersistStrategy{MaxCount: maxCount, DropOnExceed: true, DuplicateReplace: true})
+
+	// concurrent stores must not exceed the limit
+	wg := &sync.WaitGroup{}
+	var stored int32
+	for i := 0; i < 4*maxCount; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			err := p.Store(strconv.Itoa(i), &mqtt.PubRelPacket{PacketID: uint16(i)})
+			if err == nil {
+				atomic.AddInt32(&stored, 1)
+			} else if err != mqtt.ErrPacketDroppedByStrategy {
+				t.Error("store failed, err =", err)
+			}
+		}(i)
+	}
+	wg.Wait()
+
+	count := 0
+	p.Range(func(string, mqtt.Packet) bool {
+		count++
+		return true
+	})
+	if count != maxCount || stored != maxCount {
+		t.Error("packet count mismatch, count =", count, "stored =", stored)
+	}
+}
@@ -2,7 +2,6 @@ package extension
 
 import (
 	"bytes"
-	"strings"
 
 	"github.com/go-redis/redis"
 	mqtt "github.com/goiiot/libmqtt"
@@ -10,9 +9,10 @@ import (
 
 // redisPersist defines the persist method with redis
 type redisPersist struct {
-	conn    *redis.Client
-	buf     *bytes.Buffer
-	mainKey string
+	conn     *redis.Client
+	buf      *bytes.Buffer
+	mainKey  string
+	strategy *mqtt.PersistStrategy
 }
 
 // Name of redisPersist is "redisPersist"
@@ -30,25 +30,86 @@ func (r *redisPersist) Store(key string, p mqtt.Packet) error {
 		return nil
 	}
 
-	if ok, err := r.conn.HSet(r.mainKey, key, p.Bytes()).Result(); !ok {
-		return err
+	return r.StoreRecord(key, mqtt.NewPersistRecord(p))
+}
+
+// StoreRecord stores a record with key, the count of packets is checked
+// in a transaction watching the hash if DropOnExceed is set
+func (r *redisPersist) StoreRecord(key string, rec *mqtt.PersistRecord) error {
+	if r == nil || r.conn == nil || rec == nil || rec.Packet == nil {
+		return nil
 	}
 
-	return nil
+	data := rec.Bytes()
+	if data == nil {
+		return mqtt.ErrEncodeBadPacket
+	}
+
+	if r.strategy.MaxCount == 0 || !r.strategy.DropOnExceed {
+		if !r.strategy.DuplicateReplace {
+			return r.conn.HSetNX(r.mainKey, key, data).Err()
+		}
+		return r.conn.HSet(r.mainKey, key, data).Err()
+	}
+
+	for {
+		err := r.conn.Watch(func(tx *redis.Tx) error {
+			exists, err := tx.HExists(r.mainKey, key).Result()
+			if err != nil {
+				return err
+			}
+
+			if exists && !r.strategy.DuplicateReplace {
+				return nil
+			}
+
+			if !exists {
+				n, err := tx.HLen(r.mainKey).Result()
+				if err != nil {
+					return err
+				}
+
+				if n >= int64(r.strategy.MaxCount) {
+					// packet dropped
+					return mqtt.ErrPacketDroppedByStrategy
+				}
+			}
+
+			// fails if the hash modified after watched
+			_, err = tx.Pipelined(func(pipe redis.Pipeliner) error {
+				pipe.HSet(r.mainKey, key, data)
+				return nil
+			})
+			return err
+		}, r.mainKey)
+
+		if err != redis.TxFailedErr {
+			return err
+		}
+	}
 }
 
 // Load a packet from stored data according to the key
 func (r *redisPersist) Load(key string) (mqtt.Packet, bool) {
+	if rec, ok := r.LoadRecord(key); ok {
+		return rec.Packet, true
+	}
+
+	return nil, false
+}
+
+// LoadRecord loads a record from stored data according to the key
+func (r *redisPersist) LoadRecord(key string) (*mqtt.PersistRecord, bool) {
 	if r == nil || r.conn == nil {
 		return nil, false
 	}
 
-	if rs, err := r.conn.HGet(r.mainKey, key).Result(); err != nil {
-		if pkt, err := mqtt.Decode(mqtt.V311, strings.NewReader(rs)); err != nil {
+	if rs, err := r.conn.HGet(r.mainKey, key).Result(); err == nil {
+		if rec, err := mqtt.DecodePersistRecord([]byte(rs)); err != nil {
 			// delete wrong packet
 			r.Delete(key)
 		} else {
-			return pkt, true
+			return rec, true
 		}
 	}
 
@@ -63,11 +124,11 @@ func (r *redisPersist) Range(f func(string, mqtt.Packet) bool) {
 
 	if set, err := r.conn.HGetAll(r.mainKey).Result(); err == nil {
 		for k, v := range set {
-			if pkt, err := mqtt.Decode(mqtt.V311, strings.NewReader(v)); err != nil {
+			if rec, err := mqtt.DecodePersistRecord([]byte(v)); err != nil {
 				r.Delete(k)
 				continue
 			} else {
-				if !f(k, pkt) {
+				if !f(k, rec.Packet) {
 					break
 				}
 			}
@@ -75,6 +136,30 @@ func (r *redisPersist) Range(f func(string, mqtt.Packet) bool) {
 	}
 }
 
+// migrate packets stored by previous versions to records
+func (r *redisPersist) migrate() error {
+	set, err := r.conn.HGetAll(r.mainKey).Result()
+	if err != nil {
+		return err
+	}
+
+	for k, v := range set {
+		if !mqtt.IsLegacyPersistRecord([]byte(v)) {
+			continue
+		}
+
+		rec, err := mqtt.DecodePersistRecord([]byte(v))
+		if err != nil {
+			continue
+		}
+
+		if err := r.conn.HSet(r.mainKey, k, rec.Bytes()).Err(); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
 // Delete a persisted packet with key
 func (r *redisPersist) Delete(key string) error {
 	if r == nil || r.conn == nil {
@@ -0,0 +1,304 @@
+/*
+ * Copyright Go-IIoT (https://github.com/goiiot)
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package extension
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/go-redis/redis"
+
+	mqtt "github.com/goiiot/libmqtt"
+	"github.com/goiiot/libmqtt/persisttest"
+)
+
+// newRedisClient connects to the redis server at REDIS_ADDR,
+// or to an in-process fake redis server if not set
+func newRedisClient(t *testing.T) *redis.Client {
+	addr := os.Getenv("REDIS_ADDR")
+	if addr == "" {
+		addr = startFakeRedis(t)
+	}
+
+	client := redis.NewClient(&redis.Options{Addr: addr})
+	t.Cleanup(func() { client.Close() })
+	if err := client.Ping().Err(); err != nil {
+		t.Fatal(err)
+	}
+	return client
+}
+
+// newRedisKey returns a main key not used by other tests
+func newRedisKey() string {
+	return fmt.Sprintf("libmqtt-test-%d-%d", time.Now().UnixNano(), atomic.AddInt32(&redisKeyID, 1))
+}
+
+var redisKeyID int32
+
+func TestRedisPersist(t *testing.T) {
+	client := newRedisClient(t)
+
+	persisttest.Run(t, func(t *testing.T, strategy *mqtt.PersistStrategy) mqtt.PersistMethod {
+		p := NewRedisPersist(client, newRedisKey(), strategy)
+		t.Cleanup(func() { p.Destroy() })
+		return p
+	}, nil)
+
+	if NewRedisPersist(nil, "", nil) != nil {
+		t.Error("persist created without redis client")
+	}
+}
+
+func TestRedisPersist_MaxCount(t *testing.T) {
+	client := newRedisClient(t)
+
+	const maxCount = 5
+	p := NewRedisPersist(client, newRedisKey(),
+		&mqtt.PersistStrategy{MaxCount: maxCount, DropOnExceed: true, DuplicateReplace: true})
+	defer p.Destroy()
+
+	// concurrent stores must not exceed the limit
+	wg := &sync.WaitGroup{}
+	var stored int32
+	for i := 0; i < 4*maxCount; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			err := p.Store(strconv.Itoa(i), &mqtt.PubRelPacket{PacketID: uint16(i)})
+			if err == nil {
+				atomic.AddInt32(&stored, 1)
+			} else if err != mqtt.ErrPacketDroppedByStrategy {
+				t.Error("store failed, err =", err)
+			}
+		}(i)
+	}
+	wg.Wait()
+
+	count := 0
+	p.Range(func(string, mqtt.Packet) bool {
+		count++
+		return true
+	})
+	if count != maxCount || stored != maxCount {
+		t.Errorf("stored %d packets, ranged %d, want %d", stored, count, maxCount)
+	}
+}
+
+// fakeRedis is a minimal redis server for hash commands and transactions
+type fakeRedis struct {
+	mu      sync.Mutex
+	hashes  map[string]map[string]string
+	version map[string]int
+}
+
+// startFakeRedis starts a fake redis server and returns its address
+func startFakeRedis(t *testing.T) string {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { l.Close() })
+
+	s := &fakeRedis{hashes: make(map[string]map[string]string), version: make(map[string]int)}
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			go s.serve(conn)
+		}
+	}()
+	return l.Addr().String()
+}
+
+func (s *fakeRedis) serve(conn net.Conn) {
+	defer conn.Close()
+
+	r, w := bufio.NewReader(conn), bufio.NewWriter(conn)
+	var (
+		watched map[string]int
+		queued  [][]string
+		multi   bool
+	)
+
+	for {
+		args, err := readRedisCommand(r)
+		if err != nil {
+			return
+		}
+
+		var reply string
+		switch cmd := strings.ToUpper(args[0]); {
+		case cmd == "WATCH":
+			s.mu.Lock()
+			if watched == nil {
+				watched = make(map[string]int)
+			}
+			for _, k := range args[1:] {
+				watched[k] = s.version[k]
+			}
+			s.mu.Unlock()
+			reply = "+OK\r\n"
+		case cmd == "UNWATCH":
+			watched, reply = nil, "+OK\r\n"
+		case cmd == "MULTI":
+			multi, queued, reply = true, nil, "+OK\r\n"
+		case cmd == "EXEC":
+			s.mu.Lock()
+			reply = fmt.Sprintf("*%d\r\n", len(queued))
+			for k, v := range watched {
+				if s.version[k] != v {
+					reply = "*-1\r\n"
+				}
+			}
+			if reply != "*-1\r\n" {
+				for _, q := range queued {
+					reply += s.exec(q)
+				}
+			}
+			s.mu.Unlock()
+			watched, queued, multi = nil, nil, false
+		case multi:
+			queued, reply = append(queued, args), "+QUEUED\r\n"
+		default:
+			s.mu.Lock()
+			reply = s.exec(args)
+			s.mu.Unlock()
+		}
+
+		if _, err := w.WriteString(reply); err != nil || w.Flush() != nil {
+			return
+		}
+	}
+}
+
+// exec executes a command with lock held
+func (s *fakeRedis) exec(args []string) string {
+	switch strings.ToUpper(args[0]) {
+	case "PING":
+		return "+PONG\r\n"
+	case "HSET", "HSETNX":
+		h := s.hashes[args[1]]
+		if h == nil {
+			h = make(map[string]string)
+			s.hashes[args[1]] = h
+		}
+		_, exists := h[args[2]]
+		if exists && strings.ToUpper(args[0]) == "HSETNX" {
+			return ":0\r\n"
+		}
+		h[args[2]] = args[3]
+		s.version[args[1]]++
+		if exists {
+			return ":0\r\n"
+		}
+		return ":1\r\n"
+	case "HGET":
+		v, ok := s.hashes[args[1]][args[2]]
+		if !ok {
+			return "$-1\r\n"
+		}
+		return redisBulk(v)
+	case "HGETALL":
+		h := s.hashes[args[1]]
+		reply := fmt.Sprintf("*%d\r\n", 2*len(h))
+		for k, v := range h {
+			reply += redisBulk(k) + redisBulk(v)
+		}
+		return reply
+	case "HEXISTS":
+		if _, ok := s.hashes[args[1]][args[2]]; ok {
+			return ":1\r\n"
+		}
+		return ":0\r\n"
+	case "HLEN":
+		return fmt.Sprintf(":%d\r\n", len(s.hashes[args[1]]))
+	case "HDEL":
+		n := 0
+		for _, f := range args[2:] {
+			if _, ok := s.hashes[args[1]][f]; ok {
+				delete(s.hashes[args[1]], f)
+				n++
+			}
+		}
+		if n > 0 {
+			s.version[args[1]]++
+		}
+		return fmt.Sprintf(":%d\r\n", n)
+	case "DEL":
+		n := 0
+		for _, k := range args[1:] {
+			if _, ok := s.hashes[k]; ok {
+				delete(s.hashes, k)
+				s.version[k]++
+				n++
+			}
+		}
+		return fmt.Sprintf(":%d\r\n", n)
+	}
+	return "-ERR unknown command '" + args[0] + "'\r\n"
+}
+
+func redisBulk(v string) string {
+	return fmt.Sprintf("$%d\r\n%s\r\n", len(v), v)
+}
+
+// readRedisCommand reads a command sent as array of bulk strings
+func readRedisCommand(r *bufio.Reader) ([]string, error) {
+	readLine := func(prefix byte) (int, error) {
+		line, err := r.ReadString('\n')
+		if err != nil {
+			return 0, err
+		}
+		if len(line) < 3 || line[0] != prefix {
+			return 0, fmt.Errorf("unexpected line %q", line)
+		}
+		return strconv.Atoi(strings.TrimSpace(line[1:]))
+	}
+
+	n, err := readLine('*')
+	if err != nil {
+		return nil, err
+	}
+	if n < 1 {
+		return nil, fmt.Errorf("empty command")
+	}
+
+	args := make([]string, n)
+	for i := range args {
+		size, err := readLine('$')
+		if err != nil {
+			return nil, err
+		}
+		buf := make([]byte, size+2)
+		if _, err := io.ReadFull(r, buf); err != nil {
+			return nil, err
+		}
+		args[i] = string(buf[:size])
+	}
+	return args, nil
+}
@@ -19,9 +19,13 @@ package libmqtt
 // ConnHandler is the handler which tend to the Connect result
 // server is the server address provided by user in client creation call
 // code is the ConnResult code
-// err is the error happened when connect to server, if a error happened,
-// the code value will max byte value (255)
-type ConnHandler func(server string, code byte, err error)
+// err is the error happened when connect to server, if the server rejected
+// the connection, err is a *ReasonError, otherwise err is the decode, io,
+// keepalive or interceptor error caused the connection lost, and the code
+// value will be derived from it, e.g. CodeUnspecifiedError (network failure
+// or timeout, matches ErrNetwork), CodeMalformedPacket or CodeProtoError
+// (matches ErrProtocol)
+type ConnHandler func(server string, code ReasonCode, err error)
 
 // TopicHandler handles topic sub message
 // topic is the client user provided topic
@@ -30,17 +34,28 @@ type TopicHandler func(topic string, qos QosLevel, msg []byte)
 
 // PubHandler handles the error occurred when publish some message
 // if err is not nil, that means a error occurred when sending pub msg
+// or a *ReasonError if the server rejected the message
 type PubHandler func(topic string, err error)
 
 // SubHandler handles the error occurred when subscribe some topic
 // if err is not nil, that means a error occurred when sending sub msg
+// or a *ReasonError if the server rejected any of the topics
 type SubHandler func(topics []*Topic, err error)
 
 // UnSubHandler handles the error occurred when publish some message
 type UnSubHandler func(topics []string, err error)
 
 // NetHandler handles the error occurred when net broken
+// err is the error caused the connection lost, which matches ErrNetwork
+// (io error, keepalive timeout), ErrProtocol (bad packet received)
+// or is a *ReasonError (DisConnPacket with failure code from server)
 type NetHandler func(server string, err error)
 
+// StateHandler handles the connection state change of server
+//
+// it's called synchronously in the order of state changes of the server,
+// so it should not block
+type StateHandler func(server string, from, to ConnState)
+
 // PersistHandler handles err happened when persist process has trouble
 type PersistHandler func(err error)
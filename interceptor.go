@@ -0,0 +1,104 @@
+/*
+ * Copyright Go-IIoT (https://github.com/goiiot)
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package libmqtt
+
+import (
+	"errors"
+)
+
+var (
+	// ErrPacketDropped is the error happened when an Interceptor
+	// returned no packet and no error
+	ErrPacketDropped = errors.New("packet dropped by interceptor ")
+)
+
+// Interceptor intercepts packets sent to or received from server
+//
+// it can observe the packet and return it as is, mutate it or return
+// a new packet of the same type to continue, or return an error to reject it
+//
+// only publish, subscribe and unsubscribe packets can be dropped, rejecting
+// any other packet (connect, acknowledgements, keepalive ...) closes the
+// connection with InterceptError, the protocol can not continue without it
+//
+// the packet id of the returned packet must not be changed
+type Interceptor func(server string, pkt Packet) (Packet, error)
+
+// InterceptError is the error closed the connection when an Interceptor
+// rejected a packet which can not be dropped
+type InterceptError struct {
+	// PacketType is the type of the rejected packet
+	PacketType CtrlType
+
+	// Err is the error returned by the Interceptor
+	Err error
+}
+
+func (e *InterceptError) Error() string {
+	return ctrlTypeName(e.PacketType) + " packet rejected by interceptor: " + e.Err.Error()
+}
+
+func (e *InterceptError) Unwrap() error {
+	return e.Err
+}
+
+// droppable reports whether the packet can be dropped by interceptors
+// without breaking the protocol
+func droppable(pkt Packet) bool {
+	switch pkt.Type() {
+	case CtrlPublish, CtrlSubscribe, CtrlUnSub:
+		return true
+	}
+	return false
+}
+
+type interceptorEntry struct {
+	types uint16 // bit mask of packet types, 0 means all types
+	fn    Interceptor
+}
+
+// interceptorChain applies interceptors in the order of registration
+type interceptorChain []interceptorEntry
+
+func (c interceptorChain) add(fn Interceptor, types []CtrlType) interceptorChain {
+	e := interceptorEntry{fn: fn}
+	for _, t := range types {
+		e.types |= 1 << t
+	}
+	return append(c, e)
+}
+
+// apply interceptors to the packet, returns the packet to continue
+// or error if the packet is rejected
+func (c interceptorChain) apply(server string, pkt Packet) (Packet, error) {
+	for _, e := range c {
+		if e.types != 0 && e.types&(1<<pkt.Type()) == 0 {
+			continue
+		}
+
+		p, err := e.fn(server, pkt)
+		if err != nil {
+			return nil, err
+		}
+
+		if p == nil {
+			return nil, ErrPacketDropped
+		}
+		pkt = p
+	}
+	return pkt, nil
+}
@@ -0,0 +1,235 @@
+/*
+ * Copyright Go-IIoT (https://github.com/goiiot)
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package libmqtt
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"testing"
+	"time"
+)
+
+func TestInterceptorChain(t *testing.T) {
+	errReject := errors.New("reject")
+	var called []string
+
+	chain := interceptorChain{}.
+		add(func(server string, pkt Packet) (Packet, error) {
+			called = append(called, "all")
+			return pkt, nil
+		}, nil).
+		add(func(server string, pkt Packet) (Packet, error) {
+			called = append(called, "publish")
+			p := pkt.(*PublishPacket)
+			if p.TopicName == "reject" {
+				return nil, errReject
+			}
+
+			if p.TopicName == "drop" {
+				return nil, nil
+			}
+			return &PublishPacket{TopicName: p.TopicName, Payload: []byte("bar")}, nil
+		}, []CtrlType{CtrlPublish})
+
+	if pkt, err := chain.apply("server", PingReqPacket); pkt != PingReqPacket || err != nil || len(called) != 1 {
+		t.Error("packet type filter failed, called =", called)
+	}
+
+	called = nil
+	pkt, err := chain.apply("server", &PublishPacket{TopicName: "foo", Payload: []byte("foo")})
+	if err != nil || string(pkt.(*PublishPacket).Payload) != "bar" || len(called) != 2 {
+		t.Error("packet not mutated, err =", err)
+	}
+
+	if _, err := chain.apply("server", &PublishPacket{TopicName: "reject"}); err != errReject {
+		t.Error("packet not rejected, err =", err)
+	}
+
+	if _, err := chain.apply("server", &PublishPacket{TopicName: "drop"}); err != ErrPacketDropped {
+		t.Error("packet not dropped, err =", err)
+	}
+}
+
+func TestClientInterceptor(t *testing.T) {
+	errReject := errors.New("reject")
+	received := make(chan Packet, 1)
+
+	l := testBrokerWith(t, func(rw *bufio.ReadWriter) {
+		pkt, err := Decode(V311, rw)
+		if err != nil {
+			t.Error("decode failed, err =", err)
+			return
+		}
+		received <- pkt
+	})
+	defer l.Close()
+
+	inbound := make(chan CtrlType, 1)
+	c, err := NewClient(WithServer(l.Addr().String()),
+		WithOutboundInterceptor(func(server string, pkt Packet) (Packet, error) {
+			p := pkt.(*PublishPacket)
+			if p.TopicName == "reject" {
+				return nil, errReject
+			}
+			return &PublishPacket{TopicName: p.TopicName, Payload: []byte("enriched")}, nil
+		}, CtrlPublish),
+		WithInboundInterceptor(func(server string, pkt Packet) (Packet, error) {
+			inbound <- pkt.Type()
+			return pkt, nil
+		}),
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Destroy(true)
+
+	connected := make(chan struct{})
+	c.Connect(func(server string, code ReasonCode, err error) {
+		close(connected)
+	})
+
+	select {
+	case <-connected:
+	case <-time.After(time.Second):
+		t.Fatal("connect timeout")
+	}
+
+	if typ := <-inbound; typ != CtrlConnAck {
+		t.Error("inbound interceptor not applied, type =", typ)
+	}
+
+	ctx, cancel := context.WithTimeout(context.TODO(), time.Second)
+	defer cancel()
+	if err := c.PublishSync(ctx, &PublishPacket{TopicName: "reject"}); err != errReject {
+		t.Error("publish should be rejected, err =", err)
+	}
+
+	if err := c.PublishSync(ctx, &PublishPacket{TopicName: "foo", Payload: []byte("foo")}); err != nil {
+		t.Error("publish failed, err =", err)
+	}
+
+	select {
+	case pkt := <-received:
+		if p, ok := pkt.(*PublishPacket); !ok || string(p.Payload) != "enriched" {
+			t.Error("publish packet not mutated")
+		}
+	case <-time.After(time.Second):
+		t.Error("publish packet not received")
+	}
+}
+
+func TestClientInterceptor_RejectPubRel(t *testing.T) {
+	errReject := errors.New("reject")
+	closed := make(chan struct{})
+
+	l := testBrokerWith(t, func(rw *bufio.ReadWriter) {
+		defer close(closed)
+
+		(&PublishPacket{TopicName: "foo", Qos: Qos2, PacketID: 1}).WriteTo(rw)
+		rw.Flush()
+		if pkt, err := Decode(V311, rw); err != nil || pkt.Type() != CtrlPubRecv {
+			t.Error("PubRecv not received, err =", err)
+			return
+		}
+
+		(&PubRelPacket{PacketID: 1}).WriteTo(rw)
+		rw.Flush()
+		if pkt, err := Decode(V311, rw); err == nil {
+			t.Error("connection should be closed, received =", ctrlTypeName(pkt.Type()))
+		}
+	})
+	defer l.Close()
+
+	c, err := NewClient(WithServer(l.Addr().String()),
+		WithBackoffStrategy(time.Minute, time.Minute, 1),
+		WithInboundInterceptor(func(server string, pkt Packet) (Packet, error) {
+			return nil, errReject
+		}, CtrlPubRel),
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Destroy(true)
+
+	netErrC := make(chan error, 1)
+	c.HandleNet(func(server string, err error) {
+		netErrC <- err
+	})
+	c.Connect(nil)
+
+	select {
+	case <-closed:
+	case <-time.After(time.Second):
+		t.Fatal("connection not closed")
+	}
+
+	select {
+	case err := <-netErrC:
+		var interceptErr *InterceptError
+		if !errors.As(err, &interceptErr) || interceptErr.PacketType != CtrlPubRel || !errors.Is(err, errReject) {
+			t.Error("net error should be intercept error, err =", err)
+		}
+	case <-time.After(time.Second):
+		t.Error("net handler not called")
+	}
+}
+
+func TestClientInterceptor_RejectConnAck(t *testing.T) {
+	errReject := errors.New("reject")
+
+	l := testBroker(t)
+	defer l.Close()
+
+	server := l.Addr().String()
+	c, err := NewClient(WithServer(server),
+		WithDialTimeout(10),
+		WithAutoReconnect(false),
+		WithInboundInterceptor(func(server string, pkt Packet) (Packet, error) {
+			return nil, errReject
+		}, CtrlConnAck),
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Destroy(true)
+
+	type result struct {
+		code ReasonCode
+		err  error
+	}
+	resultC := make(chan result, 1)
+	c.Connect(func(server string, code ReasonCode, err error) {
+		resultC <- result{code: code, err: err}
+	})
+
+	select {
+	case r := <-resultC:
+		if r.code == CodeSuccess || !errors.Is(r.err, errReject) {
+			t.Error("connect should fail with intercept error, code =", r.code, "err =", r.err)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("connect not failed")
+	}
+
+	for i := 0; c.State(server) != StateDisconnected; i++ {
+		if i == 100 {
+			t.Fatal("client should be disconnected, state =", c.State(server))
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
@@ -19,15 +19,14 @@ package libmqtt
 // UserProps contains user defined properties
 type UserProps map[string][]string
 
-func (u UserProps) encodeTo(result []byte) []byte {
+func (u UserProps) writeTo(w BufferedWriter) {
 	for k, v := range u {
 		for _, val := range v {
-			result = append(result, propKeyUserProps)
-			result = append(result, encodeStringWithLen(k)...)
-			result = append(result, encodeStringWithLen(val)...)
+			w.WriteByte(propKeyUserProps)
+			writeStringData(w, k)
+			writeStringData(w, val)
 		}
 	}
-	return result
 }
 
 // Packet is MQTT control packet
@@ -60,6 +59,15 @@ func (b *BasePacket) Version() ProtoVersion {
 	return V311
 }
 
+func (b *BasePacket) setVersion(version ProtoVersion) {
+	b.ProtoVersion = version
+}
+
+// versionSetter is implemented by packets embedding BasePacket
+type versionSetter interface {
+	setVersion(version ProtoVersion)
+}
+
 // Topic for both topic name and topic qos
 type Topic struct {
 	Name string
@@ -123,54 +131,55 @@ const (
 	SubFail      = 0x80 // SubFail means that subscription is not successful
 )
 
-// reason code
+// ReasonCode is the reason code (or return code in MQTT 3.1.1) in ack packets
+type ReasonCode byte
 
 const (
-	CodeSuccess                             = 0   // Packet: ConnAck, PubAck, PubRecv, PubRel, PubComp, UnSubAck, Auth
-	CodeNormalDisconn                       = 0   // Packet: DisConn
-	CodeGrantedQos0                         = 0   // Packet: SubAck
-	CodeGrantedQos1                         = 1   // Packet: SubAck
-	CodeGrantedQos2                         = 2   // Packet: SubAck
-	CodeDisconnWithWill                     = 4   // Packet: DisConn
-	CodeNoMatchingSubscribers               = 16  // Packet: PubAck, PubRecv
-	CodeNoSubscriptionExisted               = 17  // Packet: UnSubAck
-	CodeContinueAuth                        = 24  // Packet: Auth
-	CodeReAuth                              = 25  // Packet: Auth
-	CodeUnspecifiedError                    = 128 // Packet: ConnAck, PubAck, PubRecv, SubAck, UnSubAck, DisConn
-	CodeMalformedPacket                     = 129 // Packet: ConnAck, DisConn
-	CodeProtoError                          = 130 // Packet: ConnAck, DisConn
-	CodeImplementationSpecificError         = 131 // Packet: ConnAck, PubAck, PubRecv, SubAck, UnSubAck, DisConn
-	CodeUnsupportedProtoVersion             = 132 // Packet: ConnAck
-	CodeClientIdNotValid                    = 133 // Packet: ConnAck
-	CodeBadUserPass                         = 134 // Packet: ConnAck
-	CodeNotAuthorized                       = 135 // Packet: ConnAck, PubAck, PubRecv, SubAck, UnSubAck, DisConn
-	CodeServerUnavail                       = 136 // Packet: ConnAck
-	CodeServerBusy                          = 137 // Packet: ConnAck, DisConn
-	CodeBanned                              = 138 // Packet: ConnAck
-	CodeServerShuttingDown                  = 139 // Packet: DisConn
-	CodeBadAuthenticationMethod             = 140 // Packet: ConnAck, DisConn
-	CodeKeepaliveTimeout                    = 141 // Packet: DisConn
-	CodeSessionTakenOver                    = 142 // Packet: DisConn
-	CodeTopicFilterInvalid                  = 143 // Packet: SubAck, UnSubAck, DisConn
-	CodeTopicNameInvalid                    = 144 // Packet: ConnAck, PubAck, PubRecv, DisConn
-	CodePacketIdentifierInUse               = 145 // Packet: PubAck, PubRecv, PubAck, UnSubAck
-	CodePacketIdentifierNotFound            = 146 // Packet: PubRel, PubComp
-	CodeReceiveMaxExceeded                  = 147 // Packet: DisConn
-	CodeTopicAliasInvalid                   = 148 // Packet: DisConn
-	CodePacketTooLarge                      = 149 // Packet: ConnAck, DisConn
-	CodeMessageRateTooHigh                  = 150 // Packet: DisConn
-	CodeQuotaExceeded                       = 151 // Packet: ConnAck, PubAck, PubRec, SubAck, DisConn
-	CodeAdministrativeAction                = 152 // Packet: DisConn
-	CodePayloadFormatInvalid                = 153 // Packet: ConnAck, PubAck, PubRecv, DisConn
-	CodeRetainNotSupported                  = 154 // Packet: ConnAck, DisConn
-	CodeQosNoSupported                      = 155 // Packet: ConnAck, DisConn
-	CodeUseAnotherServer                    = 156 // Packet: ConnAck, DisConn
-	CodeServerMoved                         = 157 // Packet: ConnAck, DisConn
-	CodeSharedSubscriptionNotSupported      = 158 // Packet: SubAck, DisConn
-	CodeConnectionRateExceeded              = 159 // Packet: ConnAck, DisConn
-	CodeMaxConnectTime                      = 160 // Packet: DisConn
-	CodeSubscriptionIdentifiersNotSupported = 161 // Packet: SubAck, DisConn
-	CodeWildcardSubscriptionNotSupported    = 162 // Packet: SubAck, DisConn
+	CodeSuccess                             ReasonCode = 0   // Packet: ConnAck, PubAck, PubRecv, PubRel, PubComp, UnSubAck, Auth
+	CodeNormalDisconn                       ReasonCode = 0   // Packet: DisConn
+	CodeGrantedQos0                         ReasonCode = 0   // Packet: SubAck
+	CodeGrantedQos1                         ReasonCode = 1   // Packet: SubAck
+	CodeGrantedQos2                         ReasonCode = 2   // Packet: SubAck
+	CodeDisconnWithWill                     ReasonCode = 4   // Packet: DisConn
+	CodeNoMatchingSubscribers               ReasonCode = 16  // Packet: PubAck, PubRecv
+	CodeNoSubscriptionExisted               ReasonCode = 17  // Packet: UnSubAck
+	CodeContinueAuth                        ReasonCode = 24  // Packet: Auth
+	CodeReAuth                              ReasonCode = 25  // Packet: Auth
+	CodeUnspecifiedError                    ReasonCode = 128 // Packet: ConnAck, PubAck, PubRecv, SubAck, UnSubAck, DisConn
+	CodeMalformedPacket                     ReasonCode = 129 // Packet: ConnAck, DisConn
+	CodeProtoError                          ReasonCode = 130 // Packet: ConnAck, DisConn
+	CodeImplementationSpecificError         ReasonCode = 131 // Packet: ConnAck, PubAck, PubRecv, SubAck, UnSubAck, DisConn
+	CodeUnsupportedProtoVersion             ReasonCode = 132 // Packet: ConnAck
+	CodeClientIdNotValid                    ReasonCode = 133 // Packet: ConnAck
+	CodeBadUserPass                         ReasonCode = 134 // Packet: ConnAck
+	CodeNotAuthorized                       ReasonCode = 135 // Packet: ConnAck, PubAck, PubRecv, SubAck, UnSubAck, DisConn
+	CodeServerUnavail                       ReasonCode = 136 // Packet: ConnAck
+	CodeServerBusy                          ReasonCode = 137 // Packet: ConnAck, DisConn
+	CodeBanned                              ReasonCode = 138 // Packet: ConnAck
+	CodeServerShuttingDown                  ReasonCode = 139 // Packet: DisConn
+	CodeBadAuthenticationMethod             ReasonCode = 140 // Packet: ConnAck, DisConn
+	CodeKeepaliveTimeout                    ReasonCode = 141 // Packet: DisConn
+	CodeSessionTakenOver                    ReasonCode = 142 // Packet: DisConn
+	CodeTopicFilterInvalid                  ReasonCode = 143 // Packet: SubAck, UnSubAck, DisConn
+	CodeTopicNameInvalid                    ReasonCode = 144 // Packet: ConnAck, PubAck, PubRecv, DisConn
+	CodePacketIdentifierInUse               ReasonCode = 145 // Packet: PubAck, PubRecv, PubAck, UnSubAck
+	CodePacketIdentifierNotFound            ReasonCode = 146 // Packet: PubRel, PubComp
+	CodeReceiveMaxExceeded                  ReasonCode = 147 // Packet: DisConn
+	CodeTopicAliasInvalid                   ReasonCode = 148 // Packet: DisConn
+	CodePacketTooLarge                      ReasonCode = 149 // Packet: ConnAck, DisConn
+	CodeMessageRateTooHigh                  ReasonCode = 150 // Packet: DisConn
+	CodeQuotaExceeded                       ReasonCode = 151 // Packet: ConnAck, PubAck, PubRec, SubAck, DisConn
+	CodeAdministrativeAction                ReasonCode = 152 // Packet: DisConn
+	CodePayloadFormatInvalid                ReasonCode = 153 // Packet: ConnAck, PubAck, PubRecv, DisConn
+	CodeRetainNotSupported                  ReasonCode = 154 // Packet: ConnAck, DisConn
+	CodeQosNoSupported                      ReasonCode = 155 // Packet: ConnAck, DisConn
+	CodeUseAnotherServer                    ReasonCode = 156 // Packet: ConnAck, DisConn
+	CodeServerMoved                         ReasonCode = 157 // Packet: ConnAck, DisConn
+	CodeSharedSubscriptionNotSupported      ReasonCode = 158 // Packet: SubAck, DisConn
+	CodeConnectionRateExceeded              ReasonCode = 159 // Packet: ConnAck, DisConn
+	CodeMaxConnectTime                      ReasonCode = 160 // Packet: DisConn
+	CodeSubscriptionIdentifiersNotSupported ReasonCode = 161 // Packet: SubAck, DisConn
+	CodeWildcardSubscriptionNotSupported    ReasonCode = 162 // Packet: SubAck, DisConn
 )
 
 // property identifiers
@@ -37,7 +37,7 @@ const (
 	testPubDup         = false
 	testPacketID       = math.MaxUint16 / 2
 	testConnackPresent = true
-	testConnackCode    = byte(CodeSuccess)
+	testConnackCode    = CodeSuccess
 )
 
 var (
@@ -17,8 +17,10 @@
 package libmqtt
 
 import (
+	"fmt"
 	"log"
 	"os"
+	"strings"
 )
 
 // LogLevel is used to set log level in client creation
@@ -39,6 +41,27 @@ const (
 	Error
 )
 
+// Logger is the leveled logger used by client, msg is the log message,
+// keyvals are alternating keys (string) and values attached to the message,
+// e.g. "server", "localhost:1883", "packet_id", 1
+type Logger interface {
+	Verbose(msg string, keyvals ...interface{})
+	Debug(msg string, keyvals ...interface{})
+	Info(msg string, keyvals ...interface{})
+	Warning(msg string, keyvals ...interface{})
+	Error(msg string, keyvals ...interface{})
+}
+
+// NewStdLogger creates a Logger writing to stderr with standard library
+// log package, key-value pairs are formatted as key=value
+func NewStdLogger(l LogLevel) Logger {
+	if lo := newLogger(l); lo != nil {
+		return lo
+	}
+	return nil
+}
+
+// logger is the default Logger implementation
 type logger struct {
 	verbose *log.Logger
 	debug   *log.Logger
@@ -93,42 +116,159 @@ func newLogger(l LogLevel) *logger {
 	return lo
 }
 
+// formatLog formats msg and keyvals as "msg key1=value1 key2=value2"
+func formatLog(msg string, keyvals []interface{}) string {
+	b := &strings.Builder{}
+	b.WriteString(msg)
+
+	for i := 0; i < len(keyvals); i += 2 {
+		b.WriteByte(' ')
+		if i+1 < len(keyvals) {
+			fmt.Fprintf(b, "%v=%v", keyvals[i], keyvals[i+1])
+		} else {
+			fmt.Fprintf(b, "!BADKEY=%v", keyvals[i])
+		}
+	}
+	return b.String()
+}
+
+func logPrint(lo *log.Logger, msg string, keyvals []interface{}) {
+	if lo == nil {
+		return
+	}
+	lo.Println(formatLog(msg, keyvals))
+}
+
+// Verbose log
+func (l *logger) Verbose(msg string, keyvals ...interface{}) {
+	if l != nil {
+		logPrint(l.verbose, msg, keyvals)
+	}
+}
+
+// Debug log
+func (l *logger) Debug(msg string, keyvals ...interface{}) {
+	if l != nil {
+		logPrint(l.debug, msg, keyvals)
+	}
+}
+
+// Info log
+func (l *logger) Info(msg string, keyvals ...interface{}) {
+	if l != nil {
+		logPrint(l.info, msg, keyvals)
+	}
+}
+
+// Warning log
+func (l *logger) Warning(msg string, keyvals ...interface{}) {
+	if l != nil {
+		logPrint(l.warning, msg, keyvals)
+	}
+}
+
+// Error log
+func (l *logger) Error(msg string, keyvals ...interface{}) {
+	if l != nil {
+		logPrint(l.error, msg, keyvals)
+	}
+}
+
+// verbose
+func (l *logger) v(msg string, keyvals ...interface{}) {
+	l.Verbose(msg, keyvals...)
+}
+
+// debug
+func (l *logger) d(msg string, keyvals ...interface{}) {
+	l.Debug(msg, keyvals...)
+}
+
+// info
+func (l *logger) i(msg string, keyvals ...interface{}) {
+	l.Info(msg, keyvals...)
+}
+
+// warning
+func (l *logger) w(msg string, keyvals ...interface{}) {
+	l.Warning(msg, keyvals...)
+}
+
+// error
+func (l *logger) e(msg string, keyvals ...interface{}) {
+	l.Error(msg, keyvals...)
+}
+
+// fieldLogger attaches fields to every log line of the Logger
+type fieldLogger struct {
+	backend Logger
+	fields  []interface{}
+}
+
+func newFieldLogger(backend Logger, fields ...interface{}) *fieldLogger {
+	if backend == nil {
+		return nil
+	}
+	return &fieldLogger{backend: backend, fields: fields}
+}
+
+// with returns a new fieldLogger with more fields attached
+func (l *fieldLogger) with(fields ...interface{}) *fieldLogger {
+	if l == nil {
+		return nil
+	}
+
+	all := make([]interface{}, 0, len(l.fields)+len(fields))
+	all = append(all, l.fields...)
+	return &fieldLogger{backend: l.backend, fields: append(all, fields...)}
+}
+
+func (l *fieldLogger) keyvals(keyvals []interface{}) []interface{} {
+	if len(l.fields) == 0 {
+		return keyvals
+	}
+
+	all := make([]interface{}, 0, len(l.fields)+len(keyvals))
+	all = append(all, l.fields...)
+	return append(all, keyvals...)
+}
+
 // verbose
-func (l *logger) v(data ...interface{}) {
-	if l == nil || l.verbose == nil {
+func (l *fieldLogger) v(msg string, keyvals ...interface{}) {
+	if l == nil {
 		return
 	}
-	l.verbose.Println(data...)
+	l.backend.Verbose(msg, l.keyvals(keyvals)...)
 }
 
 // debug
-func (l *logger) d(data ...interface{}) {
-	if l == nil || l.debug == nil {
+func (l *fieldLogger) d(msg string, keyvals ...interface{}) {
+	if l == nil {
 		return
 	}
-	l.debug.Println(data...)
+	l.backend.Debug(msg, l.keyvals(keyvals)...)
 }
 
 // info
-func (l *logger) i(data ...interface{}) {
-	if l == nil || l.info == nil {
+func (l *fieldLogger) i(msg string, keyvals ...interface{}) {
+	if l == nil {
 		return
 	}
-	l.info.Println(data...)
+	l.backend.Info(msg, l.keyvals(keyvals)...)
 }
 
 // warning
-func (l *logger) w(data ...interface{}) {
-	if l == nil || l.warning == nil {
+func (l *fieldLogger) w(msg string, keyvals ...interface{}) {
+	if l == nil {
 		return
 	}
-	l.warning.Println(data...)
+	l.backend.Warning(msg, l.keyvals(keyvals)...)
 }
 
 // error
-func (l *logger) e(data ...interface{}) {
-	if l == nil || l.error == nil {
+func (l *fieldLogger) e(msg string, keyvals ...interface{}) {
+	if l == nil {
 		return
 	}
-	l.error.Println(data...)
+	l.backend.Error(msg, l.keyvals(keyvals)...)
 }
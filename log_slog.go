@@ -0,0 +1,73 @@
+//go:build go1.21
+// +build go1.21
+
+/*
+ * Copyright Go-IIoT (https://github.com/goiiot)
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package libmqtt
+
+import (
+	"context"
+	"log/slog"
+)
+
+// LevelVerbose is the slog level used for Verbose log
+const LevelVerbose = slog.LevelDebug - 4
+
+// slogLogger adapts slog.Handler to Logger
+type slogLogger struct {
+	l *slog.Logger
+}
+
+// NewSlogLogger creates a Logger logs to the slog.Handler,
+// e.g. slog.NewJSONHandler(os.Stderr, nil)
+//
+// Verbose logs with LevelVerbose, Warning logs with slog.LevelWarn
+func NewSlogLogger(h slog.Handler) Logger {
+	if h == nil {
+		return nil
+	}
+	return &slogLogger{l: slog.New(h)}
+}
+
+func (s *slogLogger) log(level slog.Level, msg string, keyvals []interface{}) {
+	s.l.Log(context.Background(), level, msg, keyvals...)
+}
+
+// Verbose log
+func (s *slogLogger) Verbose(msg string, keyvals ...interface{}) {
+	s.log(LevelVerbose, msg, keyvals)
+}
+
+// Debug log
+func (s *slogLogger) Debug(msg string, keyvals ...interface{}) {
+	s.log(slog.LevelDebug, msg, keyvals)
+}
+
+// Info log
+func (s *slogLogger) Info(msg string, keyvals ...interface{}) {
+	s.log(slog.LevelInfo, msg, keyvals)
+}
+
+// Warning log
+func (s *slogLogger) Warning(msg string, keyvals ...interface{}) {
+	s.log(slog.LevelWarn, msg, keyvals)
+}
+
+// Error log
+func (s *slogLogger) Error(msg string, keyvals ...interface{}) {
+	s.log(slog.LevelError, msg, keyvals)
+}
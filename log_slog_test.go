@@ -0,0 +1,57 @@
+//go:build go1.21
+// +build go1.21
+
+/*
+ * Copyright Go-IIoT (https://github.com/goiiot)
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package libmqtt
+
+import (
+	"bytes"
+	"encoding/json"
+	"log/slog"
+	"testing"
+)
+
+func TestSlogLogger(t *testing.T) {
+	buf := &bytes.Buffer{}
+	l := newFieldLogger(NewSlogLogger(slog.NewJSONHandler(buf, &slog.HandlerOptions{Level: LevelVerbose})),
+		"client_id", "foo").with("server", "localhost:1883")
+
+	l.w("NET received packet", "packet_type", "Publish", "packet_id", 1)
+
+	result := make(map[string]interface{})
+	if err := json.Unmarshal(buf.Bytes(), &result); err != nil {
+		t.Fatal(err)
+	}
+
+	for k, v := range map[string]interface{}{
+		"level":       "WARN",
+		"msg":         "NET received packet",
+		"client_id":   "foo",
+		"server":      "localhost:1883",
+		"packet_type": "Publish",
+		"packet_id":   float64(1),
+	} {
+		if result[k] != v {
+			t.Error("log field mismatch, key =", k, "value =", result[k], "target =", v)
+		}
+	}
+
+	if NewSlogLogger(nil) != nil {
+		t.Error("logger without handler should be nil")
+	}
+}
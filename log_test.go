@@ -16,7 +16,10 @@
 
 package libmqtt
 
-import "testing"
+import (
+	"reflect"
+	"testing"
+)
 
 func Test_SilentLogger(t *testing.T) {
 	if l := newLogger(Silent); l != nil {
@@ -100,3 +103,56 @@ func Test_VerboseLogger(t *testing.T) {
 		l.e("error")
 	}
 }
+
+type testLogger struct {
+	level   string
+	msg     string
+	keyvals []interface{}
+}
+
+func (t *testLogger) log(level, msg string, keyvals []interface{}) {
+	t.level, t.msg, t.keyvals = level, msg, keyvals
+}
+
+func (t *testLogger) Verbose(msg string, keyvals ...interface{}) { t.log("V", msg, keyvals) }
+func (t *testLogger) Debug(msg string, keyvals ...interface{})   { t.log("D", msg, keyvals) }
+func (t *testLogger) Info(msg string, keyvals ...interface{})    { t.log("I", msg, keyvals) }
+func (t *testLogger) Warning(msg string, keyvals ...interface{}) { t.log("W", msg, keyvals) }
+func (t *testLogger) Error(msg string, keyvals ...interface{})   { t.log("E", msg, keyvals) }
+
+func TestFieldLogger(t *testing.T) {
+	var nilLogger *fieldLogger
+	if newFieldLogger(nil) != nil || nilLogger.with("foo", "bar") != nil {
+		t.Error("logger without backend should be nil")
+	}
+	nilLogger.e("error")
+
+	backend := &testLogger{}
+	base := newFieldLogger(backend, "client_id", "foo")
+	l := base.with("server", "localhost:1883")
+
+	for level, fn := range map[string]func(string, ...interface{}){
+		"V": l.v, "D": l.d, "I": l.i, "W": l.w, "E": l.e,
+	} {
+		fn("msg", "packet_id", 1)
+		if backend.level != level || backend.msg != "msg" ||
+			!reflect.DeepEqual(backend.keyvals, []interface{}{"client_id", "foo", "server", "localhost:1883", "packet_id", 1}) {
+			t.Error("log mismatch, level =", backend.level, "keyvals =", backend.keyvals)
+		}
+	}
+
+	base.i("msg")
+	if !reflect.DeepEqual(backend.keyvals, []interface{}{"client_id", "foo"}) {
+		t.Error("fields of base logger changed, keyvals =", backend.keyvals)
+	}
+}
+
+func TestFormatLog(t *testing.T) {
+	if s := formatLog("msg", []interface{}{"server", "localhost:1883", "packet_id", 1, "odd"}); s != "msg server=localhost:1883 packet_id=1 !BADKEY=odd" {
+		t.Error("log format mismatch, log =", s)
+	}
+
+	if NewStdLogger(Silent) != nil || NewStdLogger(Info) == nil {
+		t.Error("std logger level mismatch")
+	}
+}
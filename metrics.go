@@ -0,0 +1,365 @@
+/*
+ * Copyright Go-IIoT (https://github.com/goiiot)
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package libmqtt
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Metrics collects client metrics, all methods should be safe for concurrent use
+type Metrics interface {
+	// PacketSent is called after a packet has been sent to server
+	PacketSent(server string, typ CtrlType, bytes int)
+
+	// PacketReceived is called after a packet has been received from server
+	PacketReceived(server string, typ CtrlType, bytes int)
+
+	// InFlight is called when the count of packets waiting
+	// for acknowledgement changed
+	InFlight(count int)
+
+	// Reconnect is called before reconnecting to server
+	Reconnect(server string)
+
+	// KeepaliveRTT is called when PingRespPacket received
+	KeepaliveRTT(server string, rtt time.Duration)
+
+	// PersistLatency is called after a persist operation (store, load, delete) done
+	PersistLatency(op string, d time.Duration)
+
+	// DispatchLatency is called after a received publish packet dispatched by router
+	DispatchLatency(d time.Duration)
+}
+
+type noneMetrics struct{}
+
+func (noneMetrics) PacketSent(server string, typ CtrlType, bytes int)     {}
+func (noneMetrics) PacketReceived(server string, typ CtrlType, bytes int) {}
+func (noneMetrics) InFlight(count int)                                    {}
+func (noneMetrics) Reconnect(server string)                               {}
+func (noneMetrics) KeepaliveRTT(server string, rtt time.Duration)         {}
+func (noneMetrics) PersistLatency(op string, d time.Duration)             {}
+func (noneMetrics) DispatchLatency(d time.Duration)                       {}
+
+// duration summary without quantiles
+type durationSummary struct {
+	sum   time.Duration
+	count uint64
+}
+
+func (s *durationSummary) observe(d time.Duration) {
+	s.sum += d
+	s.count++
+}
+
+// MetricsRegistry is the in-process Metrics implementation,
+// it serves collected metrics in Prometheus text exposition format
+type MetricsRegistry struct {
+	mu            sync.Mutex
+	packetsSent   map[[2]string]uint64 // [server, type] -> count
+	packetsRecv   map[[2]string]uint64
+	bytesSent     map[string]uint64 // server -> bytes
+	bytesRecv     map[string]uint64
+	reconnects    map[string]uint64
+	keepaliveRTT  map[string]*durationSummary
+	persist       map[string]*durationSummary // op -> latency
+	dispatch      durationSummary
+	inFlight      int
+	lastKeepalive map[string]time.Duration
+}
+
+// NewMetricsRegistry creates an empty MetricsRegistry
+func NewMetricsRegistry() *MetricsRegistry {
+	return &MetricsRegistry{
+		packetsSent:   make(map[[2]string]uint64),
+		packetsRecv:   make(map[[2]string]uint64),
+		bytesSent:     make(map[string]uint64),
+		bytesRecv:     make(map[string]uint64),
+		reconnects:    make(map[string]uint64),
+		keepaliveRTT:  make(map[string]*durationSummary),
+		persist:       make(map[string]*durationSummary),
+		lastKeepalive: make(map[string]time.Duration),
+	}
+}
+
+// PacketSent implements Metrics
+func (r *MetricsRegistry) PacketSent(server string, typ CtrlType, bytes int) {
+	r.mu.Lock()
+	r.packetsSent[[2]string{server, ctrlTypeName(typ)}]++
+	r.bytesSent[server] += uint64(bytes)
+	r.mu.Unlock()
+}
+
+// PacketReceived implements Metrics
+func (r *MetricsRegistry) PacketReceived(server string, typ CtrlType, bytes int) {
+	r.mu.Lock()
+	r.packetsRecv[[2]string{server, ctrlTypeName(typ)}]++
+	r.bytesRecv[server] += uint64(bytes)
+	r.mu.Unlock()
+}
+
+// InFlight implements Metrics
+func (r *MetricsRegistry) InFlight(count int) {
+	r.mu.Lock()
+	r.inFlight = count
+	r.mu.Unlock()
+}
+
+// Reconnect implements Metrics
+func (r *MetricsRegistry) Reconnect(server string) {
+	r.mu.Lock()
+	r.reconnects[server]++
+	r.mu.Unlock()
+}
+
+// KeepaliveRTT implements Metrics
+func (r *MetricsRegistry) KeepaliveRTT(server string, rtt time.Duration) {
+	r.mu.Lock()
+	s, ok := r.keepaliveRTT[server]
+	if !ok {
+		s = &durationSummary{}
+		r.keepaliveRTT[server] = s
+	}
+	s.observe(rtt)
+	r.lastKeepalive[server] = rtt
+	r.mu.Unlock()
+}
+
+// PersistLatency implements Metrics
+func (r *MetricsRegistry) PersistLatency(op string, d time.Duration) {
+	r.mu.Lock()
+	s, ok := r.persist[op]
+	if !ok {
+		s = &durationSummary{}
+		r.persist[op] = s
+	}
+	s.observe(d)
+	r.mu.Unlock()
+}
+
+// DispatchLatency implements Metrics
+func (r *MetricsRegistry) DispatchLatency(d time.Duration) {
+	r.mu.Lock()
+	r.dispatch.observe(d)
+	r.mu.Unlock()
+}
+
+// WriteTo writes all metrics in Prometheus text exposition format
+func (r *MetricsRegistry) WriteTo(w io.Writer) (int64, error) {
+	b := &strings.Builder{}
+
+	r.mu.Lock()
+	writePacketMetric(b, "libmqtt_packets_sent_total", "Count of packets sent to server.", r.packetsSent)
+	writePacketMetric(b, "libmqtt_packets_received_total", "Count of packets received from server.", r.packetsRecv)
+	writeCounterMetric(b, "libmqtt_sent_bytes_total", "Bytes sent to server.", "server", r.bytesSent)
+	writeCounterMetric(b, "libmqtt_received_bytes_total", "Bytes received from server.", "server", r.bytesRecv)
+	writeCounterMetric(b, "libmqtt_reconnects_total", "Count of reconnections to server.", "server", r.reconnects)
+
+	b.WriteString("# HELP libmqtt_inflight_packets Count of packets waiting for acknowledgement.\n")
+	b.WriteString("# TYPE libmqtt_inflight_packets gauge\n")
+	fmt.Fprintf(b, "libmqtt_inflight_packets %d\n", r.inFlight)
+
+	b.WriteString("# HELP libmqtt_keepalive_last_rtt_seconds Round trip time of the last keepalive.\n")
+	b.WriteString("# TYPE libmqtt_keepalive_last_rtt_seconds gauge\n")
+	for _, server := range sortedKeys(r.lastKeepalive) {
+		fmt.Fprintf(b, "libmqtt_keepalive_last_rtt_seconds{server=%q} %g\n", server, r.lastKeepalive[server].Seconds())
+	}
+
+	writeSummaryMetric(b, "libmqtt_keepalive_rtt_seconds", "Round trip time of keepalive.", "server", r.keepaliveRTT)
+	writeSummaryMetric(b, "libmqtt_persist_duration_seconds", "Latency of persist operations.", "op", r.persist)
+	writeSummaryMetric(b, "libmqtt_dispatch_duration_seconds", "Latency of router dispatch.", "",
+		map[string]*durationSummary{"": &r.dispatch})
+	r.mu.Unlock()
+
+	n, err := io.WriteString(w, b.String())
+	return int64(n), err
+}
+
+// ServeHTTP serves metrics in Prometheus text exposition format
+func (r *MetricsRegistry) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+	r.WriteTo(w)
+}
+
+func sortedKeys(m interface{}) []string {
+	keys := make([]string, 0)
+	switch v := m.(type) {
+	case map[string]uint64:
+		for k := range v {
+			keys = append(keys, k)
+		}
+	case map[string]time.Duration:
+		for k := range v {
+			keys = append(keys, k)
+		}
+	case map[string]*durationSummary:
+		for k := range v {
+			keys = append(keys, k)
+		}
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+func writePacketMetric(b *strings.Builder, name, help string, m map[[2]string]uint64) {
+	fmt.Fprintf(b, "# HELP %s %s\n# TYPE %s counter\n", name, help, name)
+
+	keys := make([][2]string, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Slice(keys, func(i, j int) bool {
+		if keys[i][0] != keys[j][0] {
+			return keys[i][0] < keys[j][0]
+		}
+		return keys[i][1] < keys[j][1]
+	})
+
+	for _, k := range keys {
+		fmt.Fprintf(b, "%s{server=%q,type=%q} %d\n", name, k[0], k[1], m[k])
+	}
+}
+
+func writeCounterMetric(b *strings.Builder, name, help, label string, m map[string]uint64) {
+	fmt.Fprintf(b, "# HELP %s %s\n# TYPE %s counter\n", name, help, name)
+	for _, k := range sortedKeys(m) {
+		fmt.Fprintf(b, "%s{%s=%q} %d\n", name, label, k, m[k])
+	}
+}
+
+func writeSummaryMetric(b *strings.Builder, name, help, label string, m map[string]*durationSummary) {
+	fmt.Fprintf(b, "# HELP %s %s\n# TYPE %s summary\n", name, help, name)
+	for _, k := range sortedKeys(m) {
+		labels := ""
+		if label != "" {
+			labels = fmt.Sprintf("{%s=%q}", label, k)
+		}
+		fmt.Fprintf(b, "%s_sum%s %g\n", name, labels, m[k].sum.Seconds())
+		fmt.Fprintf(b, "%s_count%s %d\n", name, labels, m[k].count)
+	}
+}
+
+// countReadWriter counts bytes read and written
+// reading and writing can happen in different goroutines
+type countReadWriter struct {
+	*bufio.ReadWriter
+	read    int
+	written int
+}
+
+func (c *countReadWriter) Read(p []byte) (int, error) {
+	n, err := c.ReadWriter.Read(p)
+	c.read += n
+	return n, err
+}
+
+func (c *countReadWriter) ReadByte() (byte, error) {
+	b, err := c.ReadWriter.ReadByte()
+	if err == nil {
+		c.read++
+	}
+	return b, err
+}
+
+func (c *countReadWriter) Write(p []byte) (int, error) {
+	n, err := c.ReadWriter.Write(p)
+	c.written += n
+	return n, err
+}
+
+func (c *countReadWriter) WriteString(s string) (int, error) {
+	n, err := c.ReadWriter.WriteString(s)
+	c.written += n
+	return n, err
+}
+
+func (c *countReadWriter) WriteByte(b byte) error {
+	err := c.ReadWriter.WriteByte(b)
+	if err == nil {
+		c.written++
+	}
+	return err
+}
+
+// resetRead returns bytes read since last call
+func (c *countReadWriter) resetRead() int {
+	n := c.read
+	c.read = 0
+	return n
+}
+
+// resetWritten returns bytes written since last call
+func (c *countReadWriter) resetWritten() int {
+	n := c.written
+	c.written = 0
+	return n
+}
+
+// metricsPersist records latency of persist operations
+type metricsPersist struct {
+	PersistMethod
+	metrics Metrics
+}
+
+func newMetricsPersist(method PersistMethod, metrics Metrics) PersistMethod {
+	if method == nil || method == NonePersist {
+		return method
+	}
+	return &metricsPersist{PersistMethod: method, metrics: metrics}
+}
+
+func (m *metricsPersist) Store(key string, p Packet) error {
+	start := time.Now()
+	err := m.PersistMethod.Store(key, p)
+	m.metrics.PersistLatency("store", time.Since(start))
+	return err
+}
+
+func (m *metricsPersist) StoreRecord(key string, r *PersistRecord) error {
+	start := time.Now()
+	err := storeRecord(m.PersistMethod, key, r)
+	m.metrics.PersistLatency("store", time.Since(start))
+	return err
+}
+
+func (m *metricsPersist) LoadRecord(key string) (*PersistRecord, bool) {
+	start := time.Now()
+	r, ok := loadRecord(m.PersistMethod, key)
+	m.metrics.PersistLatency("load", time.Since(start))
+	return r, ok
+}
+
+func (m *metricsPersist) Load(key string) (Packet, bool) {
+	start := time.Now()
+	p, ok := m.PersistMethod.Load(key)
+	m.metrics.PersistLatency("load", time.Since(start))
+	return p, ok
+}
+
+func (m *metricsPersist) Delete(key string) error {
+	start := time.Now()
+	err := m.PersistMethod.Delete(key)
+	m.metrics.PersistLatency("delete", time.Since(start))
+	return err
+}
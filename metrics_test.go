@@ -0,0 +1,133 @@
+/*
+ * Copyright Go-IIoT (https://github.com/goiiot)
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package libmqtt
+
+import (
+	"bufio"
+	"bytes"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestMetricsRegistry(t *testing.T) {
+	r := NewMetricsRegistry()
+	r.PacketSent("foo", CtrlPublish, 10)
+	r.PacketSent("foo", CtrlPublish, 5)
+	r.PacketReceived("foo", CtrlPubAck, 4)
+	r.InFlight(3)
+	r.Reconnect("foo")
+	r.KeepaliveRTT("foo", 100*time.Millisecond)
+	r.PersistLatency("store", time.Second)
+	r.DispatchLatency(2 * time.Second)
+
+	w := httptest.NewRecorder()
+	r.ServeHTTP(w, httptest.NewRequest("GET", "/metrics", nil))
+	if !strings.HasPrefix(w.Header().Get("Content-Type"), "text/plain") {
+		t.Error("content type mismatch")
+	}
+
+	body := w.Body.String()
+	for _, line := range []string{
+		`libmqtt_packets_sent_total{server="foo",type="Publish"} 2`,
+		`libmqtt_packets_received_total{server="foo",type="PubAck"} 1`,
+		`libmqtt_sent_bytes_total{server="foo"} 15`,
+		`libmqtt_received_bytes_total{server="foo"} 4`,
+		`libmqtt_reconnects_total{server="foo"} 1`,
+		`libmqtt_inflight_packets 3`,
+		`libmqtt_keepalive_last_rtt_seconds{server="foo"} 0.1`,
+		`libmqtt_keepalive_rtt_seconds_count{server="foo"} 1`,
+		`libmqtt_persist_duration_seconds_sum{op="store"} 1`,
+		`libmqtt_dispatch_duration_seconds_sum 2`,
+		`libmqtt_dispatch_duration_seconds_count 1`,
+		`# TYPE libmqtt_packets_sent_total counter`,
+	} {
+		if !strings.Contains(body, line+"\n") {
+			t.Error("metric not found:", line)
+		}
+	}
+}
+
+func TestCountReadWriter(t *testing.T) {
+	buf := &bytes.Buffer{}
+	rw := &countReadWriter{ReadWriter: bufio.NewReadWriter(bufio.NewReader(buf), bufio.NewWriter(buf))}
+
+	pkt := &PublishPacket{TopicName: "foo", Payload: []byte("bar")}
+	pkt.WriteTo(rw)
+	rw.Flush()
+	if n := rw.resetWritten(); n != len(pkt.Bytes()) || rw.resetWritten() != 0 {
+		t.Error("written bytes mismatch, n =", n)
+	}
+
+	Decode(V311, rw)
+	if n := rw.resetRead(); n != len(pkt.Bytes()) || rw.resetRead() != 0 {
+		t.Error("read bytes mismatch, n =", n)
+	}
+}
+
+func TestMetricsPersist(t *testing.T) {
+	if newMetricsPersist(NonePersist, NewMetricsRegistry()) != NonePersist {
+		t.Error("none persist should not be wrapped")
+	}
+
+	r := NewMetricsRegistry()
+	p := newMetricsPersist(NewMemPersist(nil), r)
+	p.Store("foo", PingReqPacket)
+	p.Load("foo")
+	p.Delete("foo")
+
+	for _, op := range []string{"store", "load", "delete"} {
+		if s, ok := r.persist[op]; !ok || s.count != 1 {
+			t.Error("persist latency not recorded, op =", op)
+		}
+	}
+}
+
+func TestClientMetrics(t *testing.T) {
+	l := testBroker(t)
+	defer l.Close()
+
+	server := l.Addr().String()
+	r := NewMetricsRegistry()
+	c, err := NewClient(WithServer(server), WithMetrics(r))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	connected := make(chan struct{})
+	c.Connect(func(server string, code ReasonCode, err error) {
+		close(connected)
+	})
+
+	select {
+	case <-connected:
+	case <-time.After(time.Second):
+		t.Fatal("connect timeout")
+	}
+	c.Destroy(true)
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.packetsSent[[2]string{server, "Connect"}] != 1 || r.packetsRecv[[2]string{server, "ConnAck"}] != 1 {
+		t.Error("packets not recorded, sent =", r.packetsSent, "recv =", r.packetsRecv)
+	}
+
+	if r.bytesRecv[server] != 4 {
+		t.Error("received bytes mismatch, bytes =", r.bytesRecv[server])
+	}
+}
@@ -23,7 +23,6 @@ const (
 	subMsg
 	unSubMsg
 	netMsg
-	persistMsg
 )
 
 type message struct {
@@ -65,14 +64,3 @@ func notifyNetMsg(ch chan<- *message, server string, err error) {
 		err:  err,
 	}
 }
-
-func notifyPersistMsg(ch chan<- *message, err error) {
-	if err == nil {
-		return
-	}
-
-	ch <- &message{
-		what: persistMsg,
-		err:  err,
-	}
-}
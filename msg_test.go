@@ -26,7 +26,6 @@ func TestNotifyMsg(t *testing.T) {
 	testErr := fmt.Errorf("test error")
 	go func() {
 		notifyNetMsg(msgCh, "test srv", testErr)
-		notifyPersistMsg(msgCh, testErr)
 		notifyPubMsg(msgCh, "test topic", testErr)
 		notifySubMsg(msgCh, []*Topic{}, testErr)
 		notifyUnSubMsg(msgCh, []string{}, testErr)
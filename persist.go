@@ -17,12 +17,10 @@
 package libmqtt
 
 import (
-	"bytes"
 	"errors"
 	"io/ioutil"
 	"os"
 	"path"
-	"path/filepath"
 	"strings"
 	"sync"
 	"sync/atomic"
@@ -58,6 +56,22 @@ type PersistStrategy struct {
 	DuplicateReplace bool
 }
 
+// PersistSyncPolicy defines when file persist methods (e.g. write-ahead log)
+// sync written packets to disk
+type PersistSyncPolicy int
+
+const (
+	// PersistSyncInterval syncs written packets every PersistStrategy.Interval,
+	// or after every write if the Interval is 0
+	PersistSyncInterval PersistSyncPolicy = iota
+
+	// PersistSyncAlways syncs written packets after every write
+	PersistSyncAlways
+
+	// PersistSyncNever leaves syncing to the operating system
+	PersistSyncNever
+)
+
 // defaultPersistStrategy
 // Interval = 1s
 // MaxCount = 0
@@ -71,6 +85,9 @@ var defaultPersistStrategy = &PersistStrategy{
 }
 
 // PersistMethod defines the behavior of persist methods
+//
+// persist methods holding resources should implement io.Closer, Close is
+// called when the client using it exited (see WithPersist)
 type PersistMethod interface {
 	// Name of what persist strategy used
 	Name() string
@@ -135,8 +152,26 @@ func (m *memPersist) Name() string {
 }
 
 // Store a key packet pair, in memory persist always return nil (no error)
+// except for packets dropped by strategy
 func (m *memPersist) Store(key string, p Packet) error {
-	if m == nil {
+	if m == nil || p == nil {
+		return nil
+	}
+
+	return m.StoreRecord(key, NewPersistRecord(p))
+}
+
+// StoreRecord stores a key record pair, in memory persist always return nil
+// (no error) except for records dropped by strategy
+func (m *memPersist) StoreRecord(key string, r *PersistRecord) error {
+	if m == nil || r == nil || r.Packet == nil {
+		return nil
+	}
+
+	if _, ok := m.data.Load(key); ok {
+		if m.strategy.DuplicateReplace {
+			m.data.Store(key, r)
+		}
 		return nil
 	}
 
@@ -147,29 +182,33 @@ func (m *memPersist) Store(key string, p Packet) error {
 		return ErrPacketDroppedByStrategy
 	}
 
-	if _, loaded := m.data.LoadOrStore(key, p); !loaded {
+	if _, loaded := m.data.LoadOrStore(key, r); !loaded {
 		atomic.AddUint32(&m.n, 1)
 	} else if m.strategy.DuplicateReplace {
-		m.data.Store(key, p)
+		m.data.Store(key, r)
 	}
 	return nil
 }
 
 // Load a packet with key, return nil, false when no packet found
 func (m *memPersist) Load(key string) (Packet, bool) {
-	if m == nil {
+	r, ok := m.LoadRecord(key)
+	if !ok {
 		return nil, false
 	}
+	return r.Packet, true
+}
 
-	if p, ok := m.data.Load(key); ok {
-		if p != nil {
-			return p.(Packet), true
-		}
-	} else {
+// LoadRecord loads a record with key, return nil, false when no record found
+func (m *memPersist) LoadRecord(key string) (*PersistRecord, bool) {
+	if m == nil {
 		return nil, false
 	}
 
-	return nil, true
+	if r, ok := m.data.Load(key); ok {
+		return r.(*PersistRecord), true
+	}
+	return nil, false
 }
 
 // Range over all packet persisted
@@ -179,7 +218,7 @@ func (m *memPersist) Range(f func(key string, p Packet) bool) {
 	}
 
 	m.data.Range(func(key, value interface{}) bool {
-		return f(key.(string), value.(Packet))
+		return f(key.(string), value.(*PersistRecord).Packet)
 	})
 }
 
@@ -189,7 +228,9 @@ func (m *memPersist) Delete(key string) error {
 		return nil
 	}
 
-	m.data.Delete(key)
+	if _, loaded := m.data.LoadAndDelete(key); loaded {
+		atomic.AddUint32(&m.n, ^uint32(0))
+	}
 	return nil
 }
 
@@ -199,7 +240,10 @@ func (m *memPersist) Destroy() error {
 		return nil
 	}
 
-	m.data = &sync.Map{}
+	m.data.Range(func(key, value interface{}) bool {
+		m.Delete(key.(string))
+		return true
+	})
 	return nil
 }
 
@@ -213,8 +257,7 @@ const (
 func NewFilePersist(dirPath string, strategy *PersistStrategy) PersistMethod {
 	p := &filePersist{
 		dirPath:  dirPath,
-		inMemBuf: &sync.Map{},
-		bytesBuf: &bytes.Buffer{},
+		inMemBuf: make(map[string]*PersistRecord),
 	}
 
 	if strategy != nil {
@@ -224,28 +267,23 @@ func NewFilePersist(dirPath string, strategy *PersistStrategy) PersistMethod {
 	}
 
 	// init file packet size
-	filepath.Walk(dirPath, func(path string, info os.FileInfo, err error) error {
-		if err != nil || info.IsDir() {
-			return filepath.SkipDir
-		}
-
-		if strings.HasSuffix(info.Name(), fileSuffix) {
-			p.n++
-		}
-		return nil
-	})
+	p.n = uint32(len(p.keys()))
 
+	// rewrite packets persisted by previous versions
+	p.migrate()
 	return p
 }
 
 // filePersist is the file persist method
 type filePersist struct {
-	dirPath   string
-	inMemBuf  *sync.Map
-	inMemSize uint32
-	bytesBuf  *bytes.Buffer
-	strategy  *PersistStrategy
-	n         uint32
+	dirPath  string
+	strategy *PersistStrategy
+
+	mu        sync.Mutex
+	inMemBuf  map[string]*PersistRecord // records waiting for the worker
+	inMemSize uint32                    // count of records in inMemBuf without file
+	n         uint32                    // count of packet files
+	worker    *time.Timer               // nil if no worker scheduled
 }
 
 // Name of filePersist is "FilePersist"
@@ -259,77 +297,105 @@ func (m *filePersist) Name() string {
 
 // Store a key packet pair, error happens when file access failed
 func (m *filePersist) Store(key string, p Packet) error {
-	if m == nil {
+	if m == nil || p == nil {
+		return nil
+	}
+
+	return m.StoreRecord(key, NewPersistRecord(p))
+}
+
+// StoreRecord stores a key record pair, error happens when file access failed
+func (m *filePersist) StoreRecord(key string, r *PersistRecord) error {
+	if m == nil || r == nil || r.Packet == nil {
 		return nil
 	}
 
-	if m.strategy.MaxCount > 0 && m.strategy.DropOnExceed &&
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	_, buffered := m.inMemBuf[key]
+	exists := buffered || m.exists(key)
+	if exists && !m.strategy.DuplicateReplace {
+		return nil
+	}
+
+	if !exists && m.strategy.MaxCount > 0 && m.strategy.DropOnExceed &&
 		atomic.LoadUint32(&m.n)+atomic.LoadUint32(&m.inMemSize) >= m.strategy.MaxCount {
 		// packet dropped
 		return ErrPacketDroppedByStrategy
 	}
 
-	if !m.exists(key) || m.strategy.DuplicateReplace {
-		if m.strategy.Interval > 0 {
-			// has persist interval
-			if atomic.LoadUint32(&m.inMemSize) == 0 {
-				// schedule a file save action according to the strategy
-				defer func() {
-					go m.worker()
-				}()
-			}
-			m.inMemBuf.Store(key, p)
-			atomic.AddUint32(&m.inMemSize, 1)
-		} else {
-			// persist every time
-			return m.store(key, p)
-		}
+	if m.strategy.Interval <= 0 {
+		// persist every time
+		return m.store(key, r)
 	}
 
+	// has persist interval
+	if m.worker == nil {
+		// schedule a file save action according to the strategy
+		m.worker = time.AfterFunc(m.strategy.Interval, m.work)
+	}
+
+	if !exists {
+		atomic.AddUint32(&m.inMemSize, 1)
+	}
+	m.inMemBuf[key] = r
 	return nil
 }
 
 // Load a packet with key, return nil, false when no packet found
 func (m *filePersist) Load(key string) (Packet, bool) {
+	r, ok := m.LoadRecord(key)
+	if !ok {
+		return nil, false
+	}
+	return r.Packet, true
+}
+
+// LoadRecord loads a record with key, return nil, false when no record found
+func (m *filePersist) LoadRecord(key string) (*PersistRecord, bool) {
 	if m == nil {
 		return nil, false
 	}
 
-	packet, err := m.getPacketFromFile(m.getFilename(key))
+	m.mu.Lock()
+	r, ok := m.inMemBuf[key]
+	m.mu.Unlock()
+	if ok {
+		return r, true
+	}
+
+	r, err := m.getRecordFromFile(m.getFilename(key))
 	if err != nil {
 		return nil, false
 	}
 
-	return packet, true
+	return r, true
 }
 
-// Range over all packet persisted
+// Range over all packet persisted, packets waiting for the worker are
+// persisted before ranging
 func (m *filePersist) Range(ranger func(key string, p Packet) bool) {
 	if m == nil || ranger == nil {
 		return
 	}
 
-	filepath.Walk(m.dirPath, func(path string, info os.FileInfo, err error) error {
-		// error happened or is dir
-		if err != nil || info.IsDir() {
-			return filepath.SkipDir
-		}
-
-		// not libmqtt packet file
-		if !strings.HasSuffix(info.Name(), fileSuffix) {
-			return nil
-		}
+	m.mu.Lock()
+	m.flush()
+	keys := m.keys()
+	m.mu.Unlock()
 
+	for _, key := range keys {
 		// decode packet
-		pkt, err := m.getPacketFromFile(path)
+		r, err := m.getRecordFromFile(m.getFilename(key))
 		if err != nil {
-			return nil
+			continue
 		}
 
-		ranger(strings.TrimSuffix(info.Name(), fileSuffix), pkt)
-
-		return nil
-	})
+		if !ranger(key, r.Packet) {
+			return
+		}
+	}
 }
 
 // Delete a persisted packet with key
@@ -338,7 +404,25 @@ func (m *filePersist) Delete(key string) error {
 		return nil
 	}
 
-	return os.Remove(path.Join(m.dirPath, key))
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	_, buffered := m.inMemBuf[key]
+	delete(m.inMemBuf, key)
+
+	err := os.Remove(m.getFilename(key))
+	switch {
+	case err == nil:
+		atomic.AddUint32(&m.n, ^uint32(0))
+	case os.IsNotExist(err):
+		if buffered {
+			atomic.AddUint32(&m.inMemSize, ^uint32(0))
+		}
+	default:
+		return err
+	}
+
+	return nil
 }
 
 // Destroy persist storage
@@ -347,69 +431,118 @@ func (m *filePersist) Destroy() error {
 		return nil
 	}
 
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if m.worker != nil {
+		m.worker.Stop()
+		m.worker = nil
+	}
+
+	m.inMemBuf = make(map[string]*PersistRecord)
+	atomic.StoreUint32(&m.inMemSize, 0)
+	atomic.StoreUint32(&m.n, 0)
 	return os.RemoveAll(m.dirPath)
 }
 
-func (m *filePersist) getPacketFromFile(path string) (Packet, error) {
+func (m *filePersist) getRecordFromFile(path string) (*PersistRecord, error) {
 	content, err := ioutil.ReadFile(path)
 	if err != nil {
 		return nil, err
 	}
 
-	packet, err := Decode(V311, bytes.NewReader(content))
+	return DecodePersistRecord(content)
+}
+
+// migrate packet files written by previous versions to records
+func (m *filePersist) migrate() {
+	for _, key := range m.keys() {
+		filename := m.getFilename(key)
+		content, err := ioutil.ReadFile(filename)
+		if err != nil || !IsLegacyPersistRecord(content) {
+			continue
+		}
+
+		r, err := DecodePersistRecord(content)
+		if err != nil {
+			continue
+		}
+
+		ioutil.WriteFile(filename, r.Bytes(), 0600)
+	}
+}
+
+// keys of packet files
+func (m *filePersist) keys() []string {
+	infos, err := ioutil.ReadDir(m.dirPath)
 	if err != nil {
-		return nil, err
+		return nil
 	}
 
-	return packet, nil
+	keys := make([]string, 0, len(infos))
+	for _, info := range infos {
+		// not libmqtt packet file
+		if info.IsDir() || !strings.HasSuffix(info.Name(), fileSuffix) {
+			continue
+		}
+
+		keys = append(keys, strings.TrimSuffix(info.Name(), fileSuffix))
+	}
+	return keys
 }
 
 func (m *filePersist) exists(key string) bool {
-	_, err := os.Open(m.getFilename(key))
-	if err != nil && os.IsNotExist(err) {
-		// no such packet file
-		return false
-	}
-	return true
+	_, err := os.Stat(m.getFilename(key))
+	return err == nil
 }
 
-func (m *filePersist) store(key string, p Packet) error {
-	if m == nil || p == nil {
-		return nil
+// store record to file, m.mu must be held
+func (m *filePersist) store(key string, r *PersistRecord) error {
+	existed := m.exists(key)
+	if err := os.MkdirAll(m.dirPath, 0755); err != nil {
+		return err
 	}
 
-	err := ioutil.WriteFile(m.getFilename(key), p.Bytes(), 0600)
+	err := ioutil.WriteFile(m.getFilename(key), r.Bytes(), 0600)
 	if err != nil {
 		return err
 	}
 
-	atomic.AddUint32(&m.n, 1)
-	atomic.StoreUint32(&m.inMemSize, atomic.LoadUint32(&m.inMemSize)-1)
+	if !existed {
+		atomic.AddUint32(&m.n, 1)
+	}
 	return nil
 }
 
-func (m *filePersist) worker() {
-	time.Sleep(m.strategy.Interval)
+func (m *filePersist) work() {
+	m.mu.Lock()
+	defer m.mu.Unlock()
 
-	persistedKeys := make([]string, 0)
-	m.inMemBuf.Range(func(key, value interface{}) bool {
-		k := key.(string)
-		p, ok := value.(Packet)
-		if !ok {
-			return true
-		}
+	m.flush()
+}
 
-		m.store(k, p)
-		persistedKeys = append(persistedKeys, k)
-		return true
-	})
+// flush packets waiting for the worker to files, m.mu must be held
+func (m *filePersist) flush() {
+	if m.worker != nil {
+		m.worker.Stop()
+		m.worker = nil
+	}
 
-	for _, k := range persistedKeys {
-		m.inMemBuf.Delete(k)
+	for k, r := range m.inMemBuf {
+		existed := m.exists(k)
+		if err := m.store(k, r); err != nil {
+			continue
+		}
+
+		if !existed {
+			atomic.AddUint32(&m.inMemSize, ^uint32(0))
+		}
+		delete(m.inMemBuf, k)
 	}
 
-	if atomic.LoadUint32(&m.inMemSize) > 0 {
-		m.worker()
+	if len(m.inMemBuf) > 0 {
+		// retry failed packets later
+		m.worker = time.AfterFunc(m.strategy.Interval, m.work)
 	}
 }
 
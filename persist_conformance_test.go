@@ -0,0 +1,85 @@
+/*
+ * Copyright Go-IIoT (https://github.com/goiiot)
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package libmqtt_test
+
+import (
+	"path/filepath"
+	"testing"
+
+	mqtt "github.com/goiiot/libmqtt"
+	"github.com/goiiot/libmqtt/persisttest"
+)
+
+func TestMemPersist_Conformance(t *testing.T) {
+	persisttest.Run(t, func(t *testing.T, strategy *mqtt.PersistStrategy) mqtt.PersistMethod {
+		return mqtt.NewMemPersist(strategy)
+	}, nil)
+}
+
+func TestFilePersist_Conformance(t *testing.T) {
+	persisttest.Run(t, func(t *testing.T, strategy *mqtt.PersistStrategy) mqtt.PersistMethod {
+		return newFilePersist(t, strategy)
+	}, nil)
+}
+
+func TestSessionPersist_Conformance(t *testing.T) {
+	persisttest.Run(t, func(t *testing.T, strategy *mqtt.PersistStrategy) mqtt.PersistMethod {
+		store := mqtt.NewSessionStore(newFilePersist(t, strategy))
+		return store.Persist(mqtt.Session{Server: "localhost:1883", ClientID: "client"})
+	}, nil)
+}
+
+// newFilePersist creates a file persist in a temporary dir, and destroys it
+// before the dir is removed, so pending interval flushes won't race the removal
+func newFilePersist(t *testing.T, strategy *mqtt.PersistStrategy) mqtt.PersistMethod {
+	p := mqtt.NewFilePersist(filepath.Join(t.TempDir(), "persist"), strategy)
+	t.Cleanup(func() { _ = p.Destroy() })
+	return p
+}
+
+func TestWALPersist_Conformance(t *testing.T) {
+	for _, sync := range []mqtt.PersistSyncPolicy{mqtt.PersistSyncInterval, mqtt.PersistSyncAlways, mqtt.PersistSyncNever} {
+		persisttest.Run(t, func(t *testing.T, strategy *mqtt.PersistStrategy) mqtt.PersistMethod {
+			p, err := mqtt.NewWALPersist(t.TempDir(), strategy, &mqtt.WALOptions{SegmentSize: 512, Sync: sync})
+			if err != nil {
+				t.Fatal(err)
+			}
+			return p
+		}, nil)
+	}
+}
+
+func TestKVPersist_Conformance(t *testing.T) {
+	for _, sync := range []mqtt.PersistSyncPolicy{mqtt.PersistSyncInterval, mqtt.PersistSyncAlways, mqtt.PersistSyncNever} {
+		persisttest.Run(t, func(t *testing.T, strategy *mqtt.PersistStrategy) mqtt.PersistMethod {
+			p, err := mqtt.NewKVPersist(filepath.Join(t.TempDir(), "persist.kv"), strategy, &mqtt.KVOptions{Sync: sync})
+			if err != nil {
+				t.Fatal(err)
+			}
+			return p
+		}, nil)
+	}
+}
+
+func TestEncryptedPersist_Conformance(t *testing.T) {
+	key := make([]byte, 32)
+	persisttest.Run(t, func(t *testing.T, strategy *mqtt.PersistStrategy) mqtt.PersistMethod {
+		return mqtt.NewEncryptedPersist(mqtt.NewMemPersist(strategy), func(string) (string, []byte, error) {
+			return "key", key, nil
+		}, nil, nil)
+	}, nil)
+}
@@ -0,0 +1,512 @@
+/*
+ * Copyright Go-IIoT (https://github.com/goiiot)
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package libmqtt
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"errors"
+	"io"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+const (
+	// encryptedTopic is the topic name of publish packets carrying
+	// encrypted records
+	encryptedTopic = "$libmqtt/encrypted"
+
+	encryptedFormatV1 = 1
+)
+
+var (
+	// ErrPersistDecrypt is the error happened when a persisted packet
+	// can not be decrypted, all *PersistDecryptError match it with errors.Is
+	ErrPersistDecrypt = errors.New("decrypt persisted packet failed ")
+
+	// ErrBadEncryptedPacket is the error happened when the encrypted
+	// packet is malformed
+	ErrBadEncryptedPacket = errors.New("bad encrypted packet ")
+
+	// ErrPersistNotEncrypted is the error happened when a persisted packet
+	// is not encrypted (e.g. stored before encryption enabled)
+	ErrPersistNotEncrypted = errors.New("persisted packet not encrypted ")
+)
+
+// PersistKeyProvider provides AES keys (16, 24 or 32 bytes) to encrypt and
+// decrypt persisted packets, keyID is empty when the current key to
+// encrypt is requested, otherwise it's the id of the key used to
+// encrypt the packet (the id returned when it was encrypted)
+//
+// keys are rotated by returning a new id with a new key for the empty
+// keyID, while keeping old keys available by their ids until packets
+// encrypted with them are deleted, the key of an id must not change
+type PersistKeyProvider func(keyID string) (id string, key []byte, err error)
+
+// PersistDecryptError is the error happened when a persisted packet can't be
+// decrypted, reported to the PersistHandler, packets failing to decrypt
+// are treated as not found
+//
+// PersistDecryptError matches ErrPersistDecrypt with errors.Is
+type PersistDecryptError struct {
+	// Key is the persist key of the packet
+	Key string
+
+	// KeyID is the id of the key used to encrypt the packet
+	KeyID string
+
+	// Err is the error happened (e.g. authentication failed)
+	Err error
+}
+
+func (e *PersistDecryptError) Error() string {
+	return "decrypt persisted packet " + strconv.Quote(e.Key) + " with key " +
+		strconv.Quote(e.KeyID) + " failed: " + e.Err.Error()
+}
+
+// Is reports whether the error is ErrPersistDecrypt
+func (e *PersistDecryptError) Is(target error) bool {
+	return target == ErrPersistDecrypt
+}
+
+// Unwrap returns the error happened
+func (e *PersistDecryptError) Unwrap() error {
+	return e.Err
+}
+
+// EncryptOptions is the options of NewEncryptedPersist
+type EncryptOptions struct {
+	// MigratePlaintext encrypts packets stored before encryption enabled,
+	// the migration runs when the encrypted persist method created if
+	// a PersistHandler provided to NewEncryptedPersist, otherwise when a
+	// client started using it, so errors happened are always reported to
+	// the PersistHandler
+	//
+	// the encrypted packet is stored with a temporary key before the one
+	// not encrypted deleted, packets are not lost if interrupted, and the
+	// migration resumes next time
+	//
+	// packets not encrypted are not authenticated, only enable it when
+	// migrating a persist method to encryption
+	MigratePlaintext bool
+}
+
+// persistErrorReporter is implemented by persist methods reporting errors
+// can not be returned by PersistMethod (e.g. in Load and Range)
+type persistErrorReporter interface {
+	// reportErrors to h if no handler set
+	reportErrors(h PersistHandler)
+}
+
+// NewEncryptedPersist creates a persist method encrypting packets with
+// AES-GCM before storing them in method, and decrypting them in Load and
+// Range, the persist key is authenticated with the packet
+//
+// packets failed to decrypt or not encrypted are treated as not found and
+// reported to h, if h is nil, they are reported to the PersistHandler of
+// the client using the persist method
+//
+// metadata of PersistRecord (e.g. store time) are also kept in plain text
+// for inspection, packets stored before encryption enabled are encrypted
+// only if options.MigratePlaintext is set
+//
+// the returned PersistMethod implements io.Closer, Close closes method
+// if it implements io.Closer
+func NewEncryptedPersist(method PersistMethod, keys PersistKeyProvider, h PersistHandler, options *EncryptOptions) PersistMethod {
+	if method == nil || keys == nil {
+		return nil
+	}
+
+	e := &encryptedPersist{
+		method:  method,
+		keys:    keys,
+		handler: h,
+		aeads:   make(map[string]cipher.AEAD),
+	}
+
+	if options != nil && options.MigratePlaintext {
+		e.migratePending = true
+		if h != nil {
+			e.startMigrate()
+		}
+	}
+	return e
+}
+
+// encryptedPersist is the AES-GCM encryption decorator of persist methods
+type encryptedPersist struct {
+	method PersistMethod
+	keys   PersistKeyProvider
+
+	mu             sync.RWMutex
+	handler        PersistHandler
+	aeads          map[string]cipher.AEAD // key id -> aead
+	migratePending bool                   // plaintext migration not started
+}
+
+// Name of encryptedPersist is the name of the persist method encrypted
+func (e *encryptedPersist) Name() string {
+	if e == nil {
+		return "<nil>"
+	}
+
+	return "Encrypted" + e.method.Name()
+}
+
+// Store a key packet pair encrypted with the current key
+func (e *encryptedPersist) Store(key string, p Packet) error {
+	if e == nil || p == nil {
+		return nil
+	}
+
+	return e.StoreRecord(key, NewPersistRecord(p))
+}
+
+// StoreRecord stores a key record pair encrypted with the current key
+func (e *encryptedPersist) StoreRecord(key string, r *PersistRecord) error {
+	if e == nil || r == nil || r.Packet == nil {
+		return nil
+	}
+
+	sealed, err := e.seal(key, r)
+	if err != nil {
+		return err
+	}
+	return storeRecord(e.method, key, sealed)
+}
+
+// seal the record to be stored with key
+func (e *encryptedPersist) seal(key string, r *PersistRecord) (*PersistRecord, error) {
+	data := r.Bytes()
+	if data == nil {
+		return nil, ErrEncodeBadPacket
+	}
+
+	payload, err := e.encrypt(key, data)
+	if err != nil {
+		return nil, err
+	}
+
+	return &PersistRecord{
+		Version:   V311,
+		StoreTime: r.StoreTime,
+		Packet:    &PublishPacket{TopicName: encryptedTopic, Payload: payload},
+	}, nil
+}
+
+// Load a packet with key, return nil, false when no packet found or
+// failed to decrypt
+func (e *encryptedPersist) Load(key string) (Packet, bool) {
+	r, ok := e.LoadRecord(key)
+	if !ok {
+		return nil, false
+	}
+	return r.Packet, true
+}
+
+// LoadRecord loads a record with key, return nil, false when no record
+// found or failed to decrypt
+func (e *encryptedPersist) LoadRecord(key string) (*PersistRecord, bool) {
+	if e == nil {
+		return nil, false
+	}
+
+	r, ok := loadRecord(e.method, key)
+	if !ok {
+		return nil, false
+	}
+
+	pub, ok := r.Packet.(*PublishPacket)
+	if !ok || pub.TopicName != encryptedTopic {
+		e.report(&PersistDecryptError{Key: key, Err: ErrPersistNotEncrypted})
+		return nil, false
+	}
+
+	return e.decrypt(key, pub.Payload)
+}
+
+// Range over all packet persisted, packets failed to decrypt or not
+// encrypted are skipped
+func (e *encryptedPersist) Range(f func(key string, p Packet) bool) {
+	if e == nil || f == nil {
+		return
+	}
+
+	e.method.Range(func(key string, p Packet) bool {
+		if strings.HasSuffix(key, migrateKeySuffix) {
+			// being migrated
+			return true
+		}
+
+		pub, ok := p.(*PublishPacket)
+		if !ok || pub.TopicName != encryptedTopic {
+			e.report(&PersistDecryptError{Key: key, Err: ErrPersistNotEncrypted})
+			return true
+		}
+
+		r, ok := e.decrypt(key, pub.Payload)
+		if !ok {
+			return true
+		}
+		return f(key, r.Packet)
+	})
+}
+
+// Delete a persisted packet with key
+func (e *encryptedPersist) Delete(key string) error {
+	if e == nil {
+		return nil
+	}
+
+	return e.method.Delete(key)
+}
+
+// Destroy all packets persisted
+func (e *encryptedPersist) Destroy() error {
+	if e == nil {
+		return nil
+	}
+
+	return e.method.Destroy()
+}
+
+// Close the persist method encrypted if it implements io.Closer
+func (e *encryptedPersist) Close() error {
+	if c, ok := e.method.(io.Closer); ok {
+		return c.Close()
+	}
+	return nil
+}
+
+// ClientScoped reports whether the persist method encrypted is scoped to
+// one client id (see ClientScopedPersist)
+func (e *encryptedPersist) ClientScoped() bool {
+	return isClientScoped(e.method)
+}
+
+// migrateKeySuffix is the suffix of temporary keys holding packets
+// encrypted in migration
+const migrateKeySuffix = "~migrate"
+
+// startMigrate runs the plaintext migration if not started
+func (e *encryptedPersist) startMigrate() {
+	e.mu.Lock()
+	pending := e.migratePending
+	e.migratePending = false
+	e.mu.Unlock()
+
+	if pending {
+		e.migrate()
+	}
+}
+
+// migrate packets stored before encryption enabled to encrypted ones
+func (e *encryptedPersist) migrate() {
+	var keys, tmpKeys []string
+	e.method.Range(func(key string, p Packet) bool {
+		if strings.HasSuffix(key, migrateKeySuffix) {
+			tmpKeys = append(tmpKeys, key)
+		} else if pub, ok := p.(*PublishPacket); !ok || pub.TopicName != encryptedTopic {
+			keys = append(keys, key)
+		}
+		return true
+	})
+
+	// resume migration interrupted
+	for _, tmpKey := range tmpKeys {
+		key := strings.TrimSuffix(tmpKey, migrateKeySuffix)
+		if _, ok := e.method.Load(key); !ok {
+			if err := e.moveRecord(tmpKey, key); err != nil {
+				e.report(err)
+			}
+			continue
+		}
+
+		// packet not encrypted is still there (migrated again if so)
+		if err := e.method.Delete(tmpKey); err != nil {
+			e.report(&PersistError{Op: "delete", Key: tmpKey, Err: err})
+		}
+	}
+
+	for _, key := range keys {
+		r, ok := loadRecord(e.method, key)
+		if !ok {
+			continue
+		}
+
+		if err := e.migrateRecord(key, r); err != nil {
+			e.report(err)
+		}
+	}
+}
+
+// migrateRecord replaces the record not encrypted with the encrypted one,
+// the encrypted record is stored with a temporary key first, so the
+// persist method is not required to replace duplicate keys
+func (e *encryptedPersist) migrateRecord(key string, r *PersistRecord) error {
+	sealed, err := e.seal(key, r)
+	if err != nil {
+		return &PersistError{Op: "store", Key: key, Packet: r.Packet, Err: err}
+	}
+
+	tmpKey := key + migrateKeySuffix
+	if err := storeRecord(e.method, tmpKey, sealed); err != nil {
+		return &PersistError{Op: "store", Key: tmpKey, Packet: r.Packet, Err: err}
+	}
+
+	if err := e.method.Delete(key); err != nil {
+		e.method.Delete(tmpKey)
+		return &PersistError{Op: "delete", Key: key, Packet: r.Packet, Err: err}
+	}
+
+	return e.moveRecord(tmpKey, key)
+}
+
+// moveRecord moves the record stored with the persist method from
+// one key to another
+func (e *encryptedPersist) moveRecord(from, to string) error {
+	r, ok := loadRecord(e.method, from)
+	if !ok {
+		return nil
+	}
+
+	if err := storeRecord(e.method, to, r); err != nil {
+		return &PersistError{Op: "store", Key: to, Packet: r.Packet, Err: err}
+	}
+
+	if err := e.method.Delete(from); err != nil {
+		return &PersistError{Op: "delete", Key: from, Packet: r.Packet, Err: err}
+	}
+	return nil
+}
+
+// reportPersistErrors reports errors of the persist method to h if supported
+func reportPersistErrors(method PersistMethod, h PersistHandler) {
+	if r, ok := method.(persistErrorReporter); ok {
+		r.reportErrors(h)
+	}
+}
+
+func (e *encryptedPersist) reportErrors(h PersistHandler) {
+	e.mu.Lock()
+	if e.handler == nil {
+		e.handler = h
+	}
+	e.mu.Unlock()
+
+	// errors are reported to h now
+	e.startMigrate()
+}
+
+// encrypt data with the current key, the encrypted payload is
+// format (1) | key id length (1) | key id | nonce | sealed data
+func (e *encryptedPersist) encrypt(key string, data []byte) ([]byte, error) {
+	id, aead, err := e.aead("")
+	if err != nil {
+		return nil, err
+	}
+
+	if len(id) > 255 {
+		return nil, errors.New("key id too long ")
+	}
+
+	payload := make([]byte, 2+len(id)+aead.NonceSize(), 2+len(id)+aead.NonceSize()+len(data)+aead.Overhead())
+	payload[0] = encryptedFormatV1
+	payload[1] = byte(len(id))
+	copy(payload[2:], id)
+
+	nonce := payload[2+len(id):]
+	if _, err := io.ReadFull(rand.Reader, nonce); err != nil {
+		return nil, err
+	}
+
+	return aead.Seal(payload, nonce, data, []byte(key)), nil
+}
+
+// decrypt the encrypted payload of key, errors are reported to the handler
+func (e *encryptedPersist) decrypt(key string, payload []byte) (*PersistRecord, bool) {
+	var id string
+	r, err := func() (*PersistRecord, error) {
+		if len(payload) < 2 || payload[0] != encryptedFormatV1 || len(payload) < 2+int(payload[1]) {
+			return nil, ErrBadEncryptedPacket
+		}
+
+		id = string(payload[2 : 2+int(payload[1])])
+		_, aead, err := e.aead(id)
+		if err != nil {
+			return nil, err
+		}
+
+		sealed := payload[2+len(id):]
+		if len(sealed) < aead.NonceSize() {
+			return nil, ErrBadEncryptedPacket
+		}
+
+		data, err := aead.Open(nil, sealed[:aead.NonceSize()], sealed[aead.NonceSize():], []byte(key))
+		if err != nil {
+			return nil, err
+		}
+		return DecodePersistRecord(data)
+	}()
+
+	if err != nil {
+		e.report(&PersistDecryptError{Key: key, KeyID: id, Err: err})
+		return nil, false
+	}
+	return r, true
+}
+
+func (e *encryptedPersist) report(err error) {
+	e.mu.RLock()
+	h := e.handler
+	e.mu.RUnlock()
+
+	if h != nil {
+		h(err)
+	}
+}
+
+// aead returns the id and AES-GCM aead of the key with keyID
+func (e *encryptedPersist) aead(keyID string) (string, cipher.AEAD, error) {
+	id, key, err := e.keys(keyID)
+	if err != nil {
+		return "", nil, err
+	}
+
+	e.mu.RLock()
+	aead, ok := e.aeads[id]
+	e.mu.RUnlock()
+	if ok {
+		return id, aead, nil
+	}
+
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return "", nil, err
+	}
+
+	if aead, err = cipher.NewGCM(block); err != nil {
+		return "", nil, err
+	}
+
+	e.mu.Lock()
+	e.aeads[id] = aead
+	e.mu.Unlock()
+	return id, aead, nil
+}
@@ -0,0 +1,354 @@
+/*
+ * Copyright Go-IIoT (https://github.com/goiiot)
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package libmqtt
+
+import (
+	"bytes"
+	"errors"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// testKeys is a key provider with rotation
+type testKeys struct {
+	mu      sync.Mutex
+	current string
+	keys    map[string][]byte
+}
+
+func (k *testKeys) rotate(id string) {
+	k.mu.Lock()
+	defer k.mu.Unlock()
+
+	if k.keys == nil {
+		k.keys = make(map[string][]byte)
+	}
+	k.current, k.keys[id] = id, bytes.Repeat([]byte(id), 32)[:32]
+}
+
+func (k *testKeys) provide(keyID string) (string, []byte, error) {
+	k.mu.Lock()
+	defer k.mu.Unlock()
+
+	if keyID == "" {
+		keyID = k.current
+	}
+
+	key, ok := k.keys[keyID]
+	if !ok {
+		return "", nil, errors.New("key not found ")
+	}
+	return keyID, key, nil
+}
+
+func testEncryptedPersist() (*encryptedPersist, PersistMethod, *testKeys, *[]error) {
+	keys := &testKeys{}
+	keys.rotate("k1")
+
+	var errs []error
+	method := NewMemPersist(nil)
+	p := NewEncryptedPersist(method, keys.provide, func(err error) {
+		errs = append(errs, err)
+	}, nil).(*encryptedPersist)
+	return p, method, keys, &errs
+}
+
+func TestEncryptedPersist(t *testing.T) {
+	p, method, keys, errs := testEncryptedPersist()
+	secret := &PublishPacket{TopicName: "secret/topic", Qos: Qos1, PacketID: 1, Payload: []byte("secret payload")}
+	if err := p.Store(sendKey(1), secret); err != nil {
+		t.Fatal(err)
+	}
+
+	// rotated key
+	keys.rotate("k2")
+	if err := p.Store(sendKey(2), secret); err != nil {
+		t.Fatal(err)
+	}
+
+	method.Range(func(key string, pkt Packet) bool {
+		if bytes.Contains(pkt.Bytes(), []byte("secret")) {
+			t.Error("packet stored in plain text, key =", key)
+		}
+		return true
+	})
+
+	for _, key := range []string{sendKey(1), sendKey(2)} {
+		pkt, ok := p.Load(key)
+		if !ok || !bytes.Equal(pkt.Bytes(), secret.Bytes()) {
+			t.Error("decrypted packet mismatch, key =", key, "packet =", pkt)
+		}
+	}
+
+	// metadata in plain text
+	r, ok := loadRecord(method, sendKey(1))
+	if !ok || r.StoreTime.IsZero() || time.Since(r.StoreTime) > time.Minute {
+		t.Error("record metadata mismatch, record =", r)
+	}
+
+	if len(*errs) != 0 {
+		t.Error("unexpected errors reported, errs =", *errs)
+	}
+}
+
+func TestEncryptedPersist_Plaintext(t *testing.T) {
+	p, method, _, errs := testEncryptedPersist()
+
+	// stored before encryption enabled, or forged
+	method.Store(sendKey(1), &PubRelPacket{PacketID: 1})
+	if pkt, ok := p.Load(sendKey(1)); ok {
+		t.Error("packet not encrypted loaded, packet =", pkt)
+	}
+
+	p.Range(func(key string, _ Packet) bool {
+		t.Error("packet not encrypted ranged, key =", key)
+		return true
+	})
+
+	// 1 in Load, 1 in Range
+	if len(*errs) != 2 {
+		t.Fatal("errors not reported, errs =", *errs)
+	}
+
+	var decryptErr *PersistDecryptError
+	for _, err := range *errs {
+		if !errors.Is(err, ErrPersistNotEncrypted) || !errors.As(err, &decryptErr) || decryptErr.Key != sendKey(1) {
+			t.Error("not encrypted error mismatch, err =", err)
+		}
+	}
+}
+
+func TestEncryptedPersist_MigratePlaintext(t *testing.T) {
+	method := NewMemPersist(&PersistStrategy{})
+	plain := &PublishPacket{TopicName: "foo", Qos: Qos1, PacketID: 1, Payload: []byte("secret")}
+	method.Store(sendKey(1), plain)
+
+	keys := &testKeys{}
+	keys.rotate("k1")
+
+	var errs []error
+	p := NewEncryptedPersist(method, keys.provide, func(err error) {
+		errs = append(errs, err)
+	}, &EncryptOptions{MigratePlaintext: true})
+
+	if pkt, ok := method.Load(sendKey(1)); !ok || bytes.Contains(pkt.Bytes(), []byte("secret")) {
+		t.Error("packet not migrated, packet =", pkt)
+	}
+
+	if pkt, ok := p.Load(sendKey(1)); !ok || !bytes.Equal(pkt.Bytes(), plain.Bytes()) {
+		t.Error("migrated packet mismatch, packet =", pkt)
+	}
+
+	if len(errs) != 0 {
+		t.Error("unexpected errors reported, errs =", errs)
+	}
+}
+
+// failStorePersist is a PersistMethod failing every Store
+type failStorePersist struct {
+	PersistMethod
+}
+
+func (failStorePersist) Store(string, Packet) error {
+	return errors.New("store failed ")
+}
+
+func TestEncryptedPersist_MigrateDeferred(t *testing.T) {
+	method := NewMemPersist(&PersistStrategy{})
+	plain := &PublishPacket{TopicName: "foo", Qos: Qos1, PacketID: 1, Payload: []byte("secret")}
+	method.Store(sendKey(1), plain)
+
+	keys := &testKeys{}
+	keys.rotate("k1")
+	p := NewEncryptedPersist(failStorePersist{method}, keys.provide, nil, &EncryptOptions{MigratePlaintext: true})
+
+	// migrated when a client started using it
+	if pkt, ok := method.Load(sendKey(1)); !ok || !bytes.Equal(pkt.Bytes(), plain.Bytes()) {
+		t.Error("packet migrated without PersistHandler, packet =", pkt)
+	}
+
+	c, err := NewClient(WithServer("localhost:1883"), WithPersist(p))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Destroy(true)
+
+	select {
+	case err := <-c.persistErrC:
+		var persistErr *PersistError
+		if !errors.As(err, &persistErr) || persistErr.Op != "store" {
+			t.Error("persist error mismatch, err =", err)
+		}
+	case <-time.After(time.Second):
+		t.Error("migration error not reported to client")
+	}
+
+	// packet not encrypted is kept when failed to store the encrypted one
+	if pkt, ok := method.Load(sendKey(1)); !ok || !bytes.Equal(pkt.Bytes(), plain.Bytes()) {
+		t.Error("packet lost in migration, packet =", pkt)
+	}
+}
+
+func TestEncryptedPersist_MigrateResume(t *testing.T) {
+	method := NewMemPersist(&PersistStrategy{})
+	keys := &testKeys{}
+	keys.rotate("k1")
+
+	// interrupted after the packet not encrypted deleted
+	pkt := &PubRelPacket{PacketID: 1}
+	sealed, err := NewEncryptedPersist(method, keys.provide, nil, nil).(*encryptedPersist).seal(sendKey(1), NewPersistRecord(pkt))
+	if err != nil {
+		t.Fatal(err)
+	}
+	storeRecord(method, sendKey(1)+migrateKeySuffix, sealed)
+
+	// interrupted before the packet not encrypted deleted
+	method.Store(sendKey(2), &PubRelPacket{PacketID: 2})
+	storeRecord(method, sendKey(2)+migrateKeySuffix, sealed)
+
+	var errs []error
+	p := NewEncryptedPersist(method, keys.provide, func(err error) {
+		errs = append(errs, err)
+	}, &EncryptOptions{MigratePlaintext: true})
+
+	for i := uint16(1); i <= 2; i++ {
+		if loaded, ok := p.Load(sendKey(i)); !ok || loaded.(*PubRelPacket).PacketID != i {
+			t.Error("packet not migrated, key =", sendKey(i), "packet =", loaded)
+		}
+	}
+
+	method.Range(func(key string, p Packet) bool {
+		if strings.HasSuffix(key, migrateKeySuffix) {
+			t.Error("temporary key not deleted, key =", key)
+		}
+		return true
+	})
+
+	if len(errs) != 0 {
+		t.Error("unexpected errors reported, errs =", errs)
+	}
+}
+
+func TestEncryptedPersist_AuthFailed(t *testing.T) {
+	p, method, keys, errs := testEncryptedPersist()
+	pkt := &PublishPacket{TopicName: "foo", Qos: Qos1, PacketID: 1, Payload: []byte("bar")}
+	for i := 1; i <= 3; i++ {
+		if err := p.Store(sendKey(uint16(i)), pkt); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// tampered
+	r, _ := loadRecord(method, sendKey(1))
+	r.Packet.(*PublishPacket).Payload[len(r.Packet.(*PublishPacket).Payload)-1] ^= 0xFF
+	storeRecord(method, sendKey(1), r)
+
+	// swapped
+	r, _ = loadRecord(method, sendKey(3))
+	storeRecord(method, sendKey(2), r)
+
+	// key removed
+	keys.rotate("k2")
+	delete(keys.keys, "k1")
+	p.Store(sendKey(4), pkt)
+	keys.keys["k1"] = bytes.Repeat([]byte("k1"), 32)[:32]
+
+	for _, key := range []string{sendKey(1), sendKey(2)} {
+		if _, ok := p.Load(key); ok {
+			t.Error("packet failed authentication loaded, key =", key)
+		}
+	}
+
+	keys.rotate("k3")
+	delete(keys.keys, "k2")
+
+	var ranged []string
+	p.Range(func(key string, _ Packet) bool {
+		ranged = append(ranged, key)
+		return true
+	})
+
+	if strings.Join(ranged, ",") != sendKey(3) {
+		t.Error("packets failed authentication ranged, keys =", ranged)
+	}
+
+	// 2 in Load, 3 in Range
+	if len(*errs) != 5 {
+		t.Fatal("errors not reported, errs =", *errs)
+	}
+
+	var decryptErr *PersistDecryptError
+	if !errors.Is((*errs)[0], ErrPersistDecrypt) || !errors.As((*errs)[0], &decryptErr) ||
+		decryptErr.Key != sendKey(1) || decryptErr.KeyID != "k1" {
+		t.Error("decrypt error mismatch, err =", (*errs)[0])
+	}
+
+	// removed key, reported in Range
+	var removed bool
+	for _, err := range (*errs)[2:] {
+		if errors.As(err, &decryptErr) && decryptErr.Key == sendKey(4) {
+			removed = decryptErr.KeyID == "k2"
+		}
+	}
+
+	if !removed {
+		t.Error("removed key not reported, errs =", *errs)
+	}
+}
+
+func TestClientEncryptedPersist(t *testing.T) {
+	method := NewMemPersist(nil)
+	p := NewEncryptedPersist(method, func(string) (string, []byte, error) {
+		return "key", make([]byte, 16), nil
+	}, nil, nil)
+
+	c, err := NewClient(WithServer("localhost:1883"), WithPersist(p))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err := c.persist.Store(sendKey(1), &PubRelPacket{PacketID: 1}); err != nil {
+		t.Fatal(err)
+	}
+
+	// stored in background
+	var key string
+	for start := time.Now(); key == "" && time.Since(start) < time.Second; time.Sleep(time.Millisecond) {
+		method.Range(func(k string, _ Packet) bool {
+			key = k
+			return false
+		})
+	}
+	r, _ := loadRecord(method, key)
+	r.Packet.(*PublishPacket).Payload[0] = 0
+	storeRecord(method, key, r)
+
+	if _, ok := c.persist.Load(sendKey(1)); ok {
+		t.Fatal("packet failed authentication loaded")
+	}
+
+	select {
+	case err := <-c.persistErrC:
+		if !errors.Is(err, ErrPersistDecrypt) {
+			t.Error("persist error mismatch, err =", err)
+		}
+	case <-time.After(time.Second):
+		t.Error("persist error not reported to client")
+	}
+}
@@ -0,0 +1,723 @@
+/*
+ * Copyright Go-IIoT (https://github.com/goiiot)
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package libmqtt
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"hash/crc32"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+	"time"
+)
+
+// file layout of kv persist:
+//
+//	header: magic (4) | format (2) | reserved (6) | crc (4)
+//	extents following the header, aligned to kvAlign:
+//	  state (1) | capacity (4) | seq (8) | key len (2) | value len (4) | crc (4) | key | value
+//
+// free extents only have valid state and capacity, extents with bad crc
+// are free extents
+const (
+	kvHeaderSize       = 16
+	kvRecordHeaderSize = 23
+	kvFormatV1         = 1
+	kvAlign            = 16
+
+	kvStateFree = 0
+	kvStateUsed = 1
+
+	// kvMinExtentSize is the min size of extents split from free extents
+	kvMinExtentSize = (kvRecordHeaderSize + kvAlign - 1) / kvAlign * kvAlign
+)
+
+var kvMagic = []byte("LMKV")
+
+var (
+	// ErrBadKVFile is the error happened when the file is not a kv persist file
+	ErrBadKVFile = errors.New("bad kv persist file ")
+
+	// ErrKVFileFull is the error happened when the kv persist file has
+	// no space for the packet within KVOptions.MaxSize
+	ErrKVFileFull = errors.New("kv persist file full ")
+)
+
+// KVOptions defines the options of kv persist
+type KVOptions struct {
+	// MaxSize is the max size of the file in bytes, packets exceeding it
+	// are rejected with ErrKVFileFull, 0 means no limit, default value is 0
+	MaxSize int64
+
+	// Sync is the policy to sync the file to disk,
+	// default value is PersistSyncInterval
+	Sync PersistSyncPolicy
+}
+
+// NewKVPersist creates a key-value persist method storing all packets in
+// a single file with provided path, strategy and options, the index of
+// packets is rebuilt when the file is opened
+//
+// space of deleted packets is reused by later packets, the file is
+// truncated when trailing packets deleted, and compacted when no space
+// left within KVOptions.MaxSize
+//
+// if no strategy provided (nil), then the default strategy will be used,
+// if no options provided (nil), then the default options will be used
+//
+// the returned PersistMethod implements io.Closer, Close syncs and closes
+// the file
+func NewKVPersist(path string, strategy *PersistStrategy, options *KVOptions) (PersistMethod, error) {
+	kv := &kvPersist{
+		path:     path,
+		strategy: strategy,
+	}
+
+	if kv.strategy == nil {
+		kv.strategy = defaultPersistStrategy
+	}
+
+	if options != nil {
+		kv.options = *options
+	}
+
+	if err := kv.open(); err != nil {
+		return nil, err
+	}
+	return kv, nil
+}
+
+// kvPersist is the single file key-value persist method
+type kvPersist struct {
+	path     string
+	strategy *PersistStrategy
+	options  KVOptions
+
+	mu        sync.Mutex
+	file      *os.File
+	size      int64 // size of header and all extents
+	seq       uint64
+	index     map[string]kvExtent
+	free      []kvExtent  // free extents in order of offset
+	syncTimer *time.Timer // nil if no sync scheduled
+	err       error       // error of the last scheduled sync
+}
+
+// kvExtent is a continuous space in the file
+type kvExtent struct {
+	off  int64
+	size int64
+	seq  uint64 // seq of the record, not used by free extents
+}
+
+// Name of kvPersist is "KVPersist"
+func (kv *kvPersist) Name() string {
+	if kv == nil {
+		return "<nil>"
+	}
+
+	return "KVPersist"
+}
+
+// Store a key packet pair, error happens when file access failed or
+// no space left
+func (kv *kvPersist) Store(key string, p Packet) error {
+	if kv == nil || p == nil {
+		return nil
+	}
+
+	return kv.StoreRecord(key, NewPersistRecord(p))
+}
+
+// StoreRecord stores a key record pair, error happens when file access
+// failed or no space left
+func (kv *kvPersist) StoreRecord(key string, r *PersistRecord) error {
+	if kv == nil || r == nil || r.Packet == nil {
+		return nil
+	}
+
+	value := r.Bytes()
+	if value == nil {
+		return ErrEncodeBadPacket
+	}
+
+	kv.mu.Lock()
+	defer kv.mu.Unlock()
+
+	if kv.file == nil {
+		return os.ErrClosed
+	}
+
+	_, exists := kv.index[key]
+	if exists && !kv.strategy.DuplicateReplace {
+		return nil
+	}
+
+	if !exists && kv.strategy.MaxCount > 0 && kv.strategy.DropOnExceed &&
+		uint32(len(kv.index)) >= kv.strategy.MaxCount {
+		// packet dropped
+		return ErrPacketDroppedByStrategy
+	}
+
+	if err := kv.reportErr(); err != nil {
+		return err
+	}
+
+	if err := kv.put(key, value); err != nil {
+		return err
+	}
+	return kv.sync()
+}
+
+// Load a packet with key, return nil, false when no packet found
+func (kv *kvPersist) Load(key string) (Packet, bool) {
+	r, ok := kv.LoadRecord(key)
+	if !ok {
+		return nil, false
+	}
+	return r.Packet, true
+}
+
+// LoadRecord loads a record with key, return nil, false when no record found
+func (kv *kvPersist) LoadRecord(key string) (*PersistRecord, bool) {
+	if kv == nil {
+		return nil, false
+	}
+
+	kv.mu.Lock()
+	value, ok := kv.load(key)
+	kv.mu.Unlock()
+	if !ok {
+		return nil, false
+	}
+
+	r, err := DecodePersistRecord(value)
+	if err != nil {
+		return nil, false
+	}
+	return r, true
+}
+
+// Range over all packet persisted in key order
+func (kv *kvPersist) Range(f func(key string, p Packet) bool) {
+	if kv == nil || f == nil {
+		return
+	}
+
+	kv.mu.Lock()
+	keys := make([]string, 0, len(kv.index))
+	for k := range kv.index {
+		keys = append(keys, k)
+	}
+	kv.mu.Unlock()
+
+	sort.Strings(keys)
+	for _, k := range keys {
+		// packets deleted while ranging are skipped
+		if p, ok := kv.Load(k); ok && !f(k, p) {
+			return
+		}
+	}
+}
+
+// Delete a persisted packet with key
+func (kv *kvPersist) Delete(key string) error {
+	if kv == nil {
+		return nil
+	}
+
+	kv.mu.Lock()
+	defer kv.mu.Unlock()
+
+	e, ok := kv.index[key]
+	if !ok || kv.file == nil {
+		return nil
+	}
+
+	if err := kv.reportErr(); err != nil {
+		return err
+	}
+
+	delete(kv.index, key)
+	if err := kv.release(e); err != nil {
+		return err
+	}
+	return kv.sync()
+}
+
+// Destroy all packets persisted by truncating the file, the persist
+// method is still usable after destroyed
+func (kv *kvPersist) Destroy() error {
+	if kv == nil {
+		return nil
+	}
+
+	kv.mu.Lock()
+	defer kv.mu.Unlock()
+
+	if kv.file == nil {
+		return os.ErrClosed
+	}
+
+	kv.stopSync()
+	kv.index = make(map[string]kvExtent)
+	kv.free = nil
+	kv.err = nil
+	if err := kv.truncate(kvHeaderSize); err != nil {
+		return err
+	}
+	return kv.file.Sync()
+}
+
+// Close syncs and closes the file, the persist method should not be
+// used after closed
+func (kv *kvPersist) Close() error {
+	if kv == nil {
+		return nil
+	}
+
+	kv.mu.Lock()
+	defer kv.mu.Unlock()
+
+	kv.stopSync()
+	if kv.file == nil {
+		return nil
+	}
+
+	err := kv.file.Sync()
+	if cErr := kv.file.Close(); err == nil {
+		err = cErr
+	}
+	kv.file = nil
+	return err
+}
+
+// put writes the record to an allocated extent and indexes it, the previous
+// record of key is released, kv.mu must be held
+func (kv *kvPersist) put(key string, value []byte) error {
+	size := kvAlignSize(int64(kvRecordHeaderSize + len(key) + len(value)))
+	e, err := kv.alloc(size)
+	if err == ErrKVFileFull && kv.compactable(size) {
+		if err = kv.compact(); err == nil {
+			e, err = kv.alloc(size)
+		}
+	}
+
+	if err != nil {
+		return err
+	}
+
+	kv.seq++
+	e.seq = kv.seq
+	if err := kv.writeAt(encodeKVRecord(e, key, value), e.off); err != nil {
+		// the extent is invalid (bad crc) in rebuild
+		kv.release(e)
+		return err
+	}
+
+	old, exists := kv.index[key]
+	kv.index[key] = e
+	if exists {
+		// the new record has larger seq, so the old one is
+		// discarded in rebuild even if not released
+		return kv.release(old)
+	}
+	return nil
+}
+
+// load reads the value of key from file, kv.mu must be held
+func (kv *kvPersist) load(key string) ([]byte, bool) {
+	e, ok := kv.index[key]
+	if !ok || kv.file == nil {
+		return nil, false
+	}
+
+	buf := make([]byte, e.size)
+	if _, err := kv.file.ReadAt(buf, e.off); err != nil {
+		return nil, false
+	}
+
+	_, _, value, ok := decodeKVRecord(buf)
+	return value, ok
+}
+
+// alloc allocates an extent of size from free extents (first fit) or
+// the end of file, kv.mu must be held
+func (kv *kvPersist) alloc(size int64) (kvExtent, error) {
+	for i, f := range kv.free {
+		if f.size < size {
+			continue
+		}
+
+		if f.size-size < kvMinExtentSize {
+			// use the whole extent
+			kv.free = append(kv.free[:i], kv.free[i+1:]...)
+			return f, nil
+		}
+
+		// the remainder is marked free before the record is written
+		rest := kvExtent{off: f.off + size, size: f.size - size}
+		if err := kv.writeAt(encodeKVFree(rest.size), rest.off); err != nil {
+			return kvExtent{}, err
+		}
+
+		kv.free[i] = rest
+		return kvExtent{off: f.off, size: size}, nil
+	}
+
+	if kv.options.MaxSize > 0 && kv.size+size > kv.options.MaxSize {
+		return kvExtent{}, ErrKVFileFull
+	}
+
+	// records are written in full size, so the capacity of extents
+	// at the end of file is valid in rebuild
+	e := kvExtent{off: kv.size, size: size}
+	kv.size += size
+	return e, nil
+}
+
+// release marks the extent free, merges it with adjacent free extents, and
+// truncates the file if it's at the end of file, kv.mu must be held
+func (kv *kvPersist) release(e kvExtent) error {
+	i := sort.Search(len(kv.free), func(i int) bool { return kv.free[i].off > e.off })
+	f := kvExtent{off: e.off, size: e.size}
+
+	if i < len(kv.free) && f.off+f.size == kv.free[i].off {
+		f.size += kv.free[i].size
+		kv.free = append(kv.free[:i], kv.free[i+1:]...)
+	}
+
+	if i > 0 && kv.free[i-1].off+kv.free[i-1].size == f.off {
+		i--
+		f.off, f.size = kv.free[i].off, kv.free[i].size+f.size
+		kv.free = append(kv.free[:i], kv.free[i+1:]...)
+	}
+
+	if f.off+f.size == kv.size {
+		return kv.truncate(f.off)
+	}
+
+	// both state and capacity are written at once
+	if err := kv.writeAt(encodeKVFree(f.size), f.off); err != nil {
+		return err
+	}
+
+	kv.free = append(kv.free, kvExtent{})
+	copy(kv.free[i+1:], kv.free[i:])
+	kv.free[i] = f
+	return nil
+}
+
+// truncate the file to size, free extents beyond size are removed,
+// kv.mu must be held
+func (kv *kvPersist) truncate(size int64) error {
+	if err := kv.file.Truncate(size); err != nil {
+		return err
+	}
+	kv.size = size
+
+	for len(kv.free) > 0 && kv.free[len(kv.free)-1].off >= size {
+		kv.free = kv.free[:len(kv.free)-1]
+	}
+	return nil
+}
+
+// compactable checks whether compaction makes space for an extent of size
+func (kv *kvPersist) compactable(size int64) bool {
+	var free int64
+	for _, f := range kv.free {
+		free += f.size
+	}
+	return kv.options.MaxSize <= 0 || kv.size-free+size <= kv.options.MaxSize
+}
+
+// compact writes all records to a new file and replaces the file with it
+// atomically, kv.mu must be held
+func (kv *kvPersist) compact() error {
+	tmpPath := kv.path + ".tmp"
+	tmp, err := os.OpenFile(tmpPath, os.O_CREATE|os.O_RDWR|os.O_TRUNC, 0600)
+	if err != nil {
+		return err
+	}
+
+	err = kv.copyTo(tmp)
+	if err == nil {
+		err = tmp.Sync()
+	}
+	tmp.Close()
+
+	if err == nil {
+		err = os.Rename(tmpPath, kv.path)
+	}
+
+	if err != nil {
+		os.Remove(tmpPath)
+		return err
+	}
+
+	if err := syncDir(filepath.Dir(kv.path)); err != nil {
+		return err
+	}
+
+	kv.file.Close()
+	kv.file = nil
+	return kv.open()
+}
+
+// copyTo copies header and all records to w in order of seq
+func (kv *kvPersist) copyTo(w io.Writer) error {
+	if _, err := w.Write(encodeKVHeader()); err != nil {
+		return err
+	}
+
+	keys := make([]string, 0, len(kv.index))
+	for k := range kv.index {
+		keys = append(keys, k)
+	}
+	sort.Slice(keys, func(i, j int) bool { return kv.index[keys[i]].seq < kv.index[keys[j]].seq })
+
+	for _, k := range keys {
+		value, ok := kv.load(k)
+		if !ok {
+			return ErrBadKVFile
+		}
+
+		e := kv.index[k]
+		e.size = kvAlignSize(int64(kvRecordHeaderSize + len(k) + len(value)))
+		if _, err := w.Write(encodeKVRecord(e, k, value)); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// open the file and rebuild the index, kv.mu must be held if opened before
+func (kv *kvPersist) open() error {
+	if err := os.MkdirAll(filepath.Dir(kv.path), 0755); err != nil {
+		return err
+	}
+
+	f, err := os.OpenFile(kv.path, os.O_CREATE|os.O_RDWR, 0600)
+	if err != nil {
+		return err
+	}
+
+	kv.file, kv.index, kv.free, kv.seq = f, make(map[string]kvExtent), nil, 0
+	if err := kv.rebuild(); err != nil {
+		f.Close()
+		kv.file = nil
+		return err
+	}
+	return nil
+}
+
+// rebuild the index and free extents by scanning the file, torn extents
+// at the end of file are truncated
+func (kv *kvPersist) rebuild() error {
+	info, err := kv.file.Stat()
+	if err != nil {
+		return err
+	}
+
+	fileSize := info.Size()
+	if fileSize < kvHeaderSize {
+		// new file or torn header
+		if err := kv.writeAt(encodeKVHeader(), 0); err != nil {
+			return err
+		}
+		kv.size = kvHeaderSize
+		return kv.truncate(kvHeaderSize)
+	}
+
+	header := make([]byte, kvHeaderSize)
+	if _, err := kv.file.ReadAt(header, 0); err != nil {
+		return err
+	}
+
+	if !bytes.Equal(header, encodeKVHeader()) {
+		return ErrBadKVFile
+	}
+
+	var free []kvExtent
+	off := int64(kvHeaderSize)
+	buf := make([]byte, kvRecordHeaderSize)
+	for off < fileSize {
+		n, _ := kv.file.ReadAt(buf, off)
+		if n < 5 {
+			break
+		}
+
+		size := int64(binary.BigEndian.Uint32(buf[1:]))
+		if size < kvAlign || size%kvAlign != 0 || off+size > fileSize {
+			// torn extent
+			break
+		}
+
+		e := kvExtent{off: off, size: size}
+		off += size
+
+		if buf[0] != kvStateUsed {
+			free = append(free, e)
+			continue
+		}
+
+		record := make([]byte, size)
+		if _, err := kv.file.ReadAt(record, e.off); err != nil {
+			return err
+		}
+
+		seq, key, _, ok := decodeKVRecord(record)
+		if !ok {
+			free = append(free, e)
+			continue
+		}
+
+		e.seq = seq
+		if seq > kv.seq {
+			kv.seq = seq
+		}
+
+		if old, ok := kv.index[key]; ok {
+			// record not freed when replaced
+			if old.seq > seq {
+				free = append(free, e)
+				continue
+			}
+			free = append(free, kvExtent{off: old.off, size: old.size})
+		}
+		kv.index[key] = e
+	}
+
+	kv.size = off
+	if off < fileSize {
+		if err := kv.file.Truncate(off); err != nil {
+			return err
+		}
+	}
+
+	sort.Slice(free, func(i, j int) bool { return free[i].off < free[j].off })
+	for _, f := range free {
+		if err := kv.release(f); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (kv *kvPersist) writeAt(data []byte, off int64) error {
+	_, err := kv.file.WriteAt(data, off)
+	return err
+}
+
+// reportErr returns and clears error of the scheduled sync, kv.mu must be held
+func (kv *kvPersist) reportErr() error {
+	err := kv.err
+	kv.err = nil
+	return err
+}
+
+// sync the file according to the policy, kv.mu must be held
+func (kv *kvPersist) sync() error {
+	switch {
+	case kv.options.Sync == PersistSyncNever:
+		return nil
+	case kv.options.Sync == PersistSyncAlways || kv.strategy.Interval <= 0:
+		return kv.file.Sync()
+	case kv.syncTimer == nil:
+		kv.syncTimer = time.AfterFunc(kv.strategy.Interval, kv.scheduledSync)
+	}
+	return nil
+}
+
+func (kv *kvPersist) scheduledSync() {
+	kv.mu.Lock()
+	defer kv.mu.Unlock()
+
+	kv.syncTimer = nil
+	if kv.file != nil {
+		kv.err = kv.file.Sync()
+	}
+}
+
+func (kv *kvPersist) stopSync() {
+	if kv.syncTimer != nil {
+		kv.syncTimer.Stop()
+		kv.syncTimer = nil
+	}
+}
+
+func kvAlignSize(size int64) int64 {
+	return (size + kvAlign - 1) / kvAlign * kvAlign
+}
+
+func encodeKVHeader() []byte {
+	header := make([]byte, kvHeaderSize)
+	copy(header, kvMagic)
+	binary.BigEndian.PutUint16(header[4:], kvFormatV1)
+	binary.BigEndian.PutUint32(header[12:], crc32.Checksum(header[:12], castagnoliTable))
+	return header
+}
+
+// encodeKVFree encodes state and capacity of a free extent
+func encodeKVFree(size int64) []byte {
+	buf := make([]byte, 5)
+	buf[0] = kvStateFree
+	binary.BigEndian.PutUint32(buf[1:], uint32(size))
+	return buf
+}
+
+// encodeKVRecord encodes the record with the size of extent e
+func encodeKVRecord(e kvExtent, key string, value []byte) []byte {
+	buf := make([]byte, e.size)
+	buf[0] = kvStateUsed
+	binary.BigEndian.PutUint32(buf[1:], uint32(e.size))
+	binary.BigEndian.PutUint64(buf[5:], e.seq)
+	binary.BigEndian.PutUint16(buf[13:], uint16(len(key)))
+	binary.BigEndian.PutUint32(buf[15:], uint32(len(value)))
+	copy(buf[kvRecordHeaderSize:], key)
+	copy(buf[kvRecordHeaderSize+len(key):], value)
+
+	end := kvRecordHeaderSize + len(key) + len(value)
+	binary.BigEndian.PutUint32(buf[19:], kvRecordCRC(buf[:end]))
+	return buf
+}
+
+// decodeKVRecord decodes the record in the extent, returns false if
+// the record is torn or corrupted
+func decodeKVRecord(buf []byte) (seq uint64, key string, value []byte, ok bool) {
+	if len(buf) < kvRecordHeaderSize || buf[0] != kvStateUsed {
+		return 0, "", nil, false
+	}
+
+	keyEnd := kvRecordHeaderSize + int(binary.BigEndian.Uint16(buf[13:]))
+	end := keyEnd + int(binary.BigEndian.Uint32(buf[15:]))
+	if end < keyEnd || end > len(buf) || kvRecordCRC(buf[:end]) != binary.BigEndian.Uint32(buf[19:]) {
+		return 0, "", nil, false
+	}
+
+	return binary.BigEndian.Uint64(buf[5:]), string(buf[kvRecordHeaderSize:keyEnd]), buf[keyEnd:end], true
+}
+
+// kvRecordCRC calculates crc of seq, lengths, key and value
+func kvRecordCRC(record []byte) uint32 {
+	crc := crc32.Checksum(record[5:19], castagnoliTable)
+	return crc32.Update(crc, castagnoliTable, record[kvRecordHeaderSize:])
+}
@@ -0,0 +1,263 @@
+/*
+ * Copyright Go-IIoT (https://github.com/goiiot)
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package libmqtt
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+func testKVPersist(t *testing.T, path string, maxSize int64) *kvPersist {
+	p, err := NewKVPersist(path, &PersistStrategy{DuplicateReplace: true}, &KVOptions{MaxSize: maxSize})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return p.(*kvPersist)
+}
+
+func testKVSize(t *testing.T, path string) int64 {
+	info, err := os.Stat(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return info.Size()
+}
+
+func TestKVPersist_Reopen(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "persist.kv")
+	p := testKVPersist(t, path, 0)
+
+	pkts := make(map[string]Packet)
+	for i := 0; i < 10; i++ {
+		key := sendKey(uint16(i))
+		pkts[key] = &PublishPacket{TopicName: "foo", Qos: Qos1, PacketID: uint16(i), Payload: []byte(strings.Repeat("a", i*10))}
+		if err := p.Store(key, pkts[key]); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	for i := 0; i < 10; i += 3 {
+		key := sendKey(uint16(i))
+		delete(pkts, key)
+		if err := p.Delete(key); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// replaced packet
+	pkts[sendKey(1)] = &PublishPacket{TopicName: "bar", Qos: Qos1, PacketID: 1}
+	if err := p.Store(sendKey(1), pkts[sendKey(1)]); err != nil {
+		t.Fatal(err)
+	}
+
+	p.Close()
+	p = testKVPersist(t, path, 0)
+	testPersistCheck(t, p, pkts)
+
+	// seq is restored, replaced packets are not recovered
+	if err := p.Store(sendKey(1), &PublishPacket{TopicName: "baz", Qos: Qos1, PacketID: 1}); err != nil {
+		t.Fatal(err)
+	}
+	p.Close()
+
+	if pkt, ok := testKVPersist(t, path, 0).Load(sendKey(1)); !ok || pkt.(*PublishPacket).TopicName != "baz" {
+		t.Error("replaced packet recovered, packet =", pkt)
+	}
+}
+
+func TestKVPersist_TornWrite(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "persist.kv")
+	p := testKVPersist(t, path, 0)
+	pkt := &PublishPacket{TopicName: "foo", Qos: Qos1, PacketID: 1, Payload: []byte("bar")}
+	for i := 1; i <= 2; i++ {
+		if err := p.Store(sendKey(uint16(i)), pkt); err != nil {
+			t.Fatal(err)
+		}
+	}
+	p.Close()
+
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// the second record is torn
+	if err := ioutil.WriteFile(path, data[:len(data)-10], 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	p = testKVPersist(t, path, 0)
+	testPersistCheck(t, p, map[string]Packet{sendKey(1): pkt})
+
+	// corrupted record is reused
+	if err := p.Store(sendKey(3), pkt); err != nil {
+		t.Fatal(err)
+	}
+	p.Close()
+
+	if size := testKVSize(t, path); size != int64(len(data)) {
+		t.Error("file size mismatch, size =", size, "target =", len(data))
+	}
+	testPersistCheck(t, testKVPersist(t, path, 0), map[string]Packet{sendKey(1): pkt, sendKey(3): pkt})
+}
+
+func TestKVPersist_Corrupted(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "persist.kv")
+	p := testKVPersist(t, path, 0)
+	pkt := &PublishPacket{TopicName: "foo", Qos: Qos1, PacketID: 1, Payload: []byte("bar")}
+	for i := 1; i <= 3; i++ {
+		if err := p.Store(sendKey(uint16(i)), pkt); err != nil {
+			t.Fatal(err)
+		}
+	}
+	off := p.index[sendKey(2)].off
+	p.Close()
+
+	f, err := os.OpenFile(path, os.O_WRONLY, 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+	f.WriteAt([]byte{0xFF}, off+kvRecordHeaderSize)
+	f.Close()
+
+	testPersistCheck(t, testKVPersist(t, path, 0), map[string]Packet{sendKey(1): pkt, sendKey(3): pkt})
+
+	if err := ioutil.WriteFile(path, []byte("not a kv persist file"), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := NewKVPersist(path, nil, nil); err != ErrBadKVFile {
+		t.Error("bad file opened, err =", err)
+	}
+}
+
+func TestKVPersist_Growth(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "persist.kv")
+	p := testKVPersist(t, path, 0)
+
+	// packets acknowledged out of order
+	var max int64
+	pkts := make(map[string]Packet)
+	for i := 0; i < 2000; i++ {
+		key := sendKey(uint16(i))
+		pkts[key] = &PublishPacket{TopicName: "foo/" + strconv.Itoa(i), Qos: Qos1, PacketID: uint16(i), Payload: []byte(strings.Repeat("a", i%50))}
+		if err := p.Store(key, pkts[key]); err != nil {
+			t.Fatal(err)
+		}
+
+		if i >= 10 {
+			ackKey := sendKey(uint16(i - 10 + (i % 7)))
+			if _, ok := pkts[ackKey]; ok {
+				delete(pkts, ackKey)
+				if err := p.Delete(ackKey); err != nil {
+					t.Fatal(err)
+				}
+			}
+		}
+
+		if size := testKVSize(t, path); size > max {
+			max = size
+		}
+	}
+
+	if max > 4<<10 {
+		t.Error("free extents not reused, max size =", max)
+	}
+
+	for key := range pkts {
+		if err := p.Delete(key); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if size := testKVSize(t, path); size != kvHeaderSize || len(p.free) != 0 {
+		t.Error("file not truncated, size =", size, "free =", p.free)
+	}
+}
+
+func TestKVPersist_MaxSize(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "persist.kv")
+	p := testKVPersist(t, path, 512)
+
+	small := &PublishPacket{TopicName: "foo", Qos: Qos1, PacketID: 1}
+	large := &PublishPacket{TopicName: "foo", Qos: Qos1, PacketID: 1, Payload: []byte(strings.Repeat("a", 100))}
+
+	// fragment the file with small packets
+	var i int
+	for ; ; i++ {
+		err := p.Store(sendKey(uint16(i)), small)
+		if err == ErrKVFileFull {
+			break
+		}
+
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	pkts := make(map[string]Packet)
+	for j := 0; j < i; j++ {
+		if j%2 == 0 {
+			pkts[sendKey(uint16(j))] = small
+		} else if err := p.Delete(sendKey(uint16(j))); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// no free extent large enough, compacted
+	pkts[recvKey(1)] = large
+	if err := p.Store(recvKey(1), large); err != nil {
+		t.Fatal(err)
+	}
+
+	if size := testKVSize(t, path); size > 512 {
+		t.Error("file exceeds max size, size =", size)
+	}
+
+	if err := p.Store(recvKey(2), &PublishPacket{TopicName: "foo", Payload: make([]byte, 512)}); err != ErrKVFileFull {
+		t.Error("packet exceeding max size stored, err =", err)
+	}
+
+	p.Close()
+	testPersistCheck(t, testKVPersist(t, path, 512), pkts)
+}
+
+func TestKVPersist_ClosedWithClient(t *testing.T) {
+	p := testKVPersist(t, filepath.Join(t.TempDir(), "persist.kv"), 0)
+	c, err := NewClient(WithServer("localhost:1883"), WithClientID("foo"), WithPersist(p))
+	if err != nil {
+		t.Fatal(err)
+	}
+	c.Destroy(true)
+
+	for deadline := time.Now().Add(5 * time.Second); ; time.Sleep(10 * time.Millisecond) {
+		p.mu.Lock()
+		closed := p.file == nil
+		p.mu.Unlock()
+
+		if closed {
+			break
+		} else if time.Now().After(deadline) {
+			t.Fatal("kv persist not closed with client")
+		}
+	}
+}
@@ -0,0 +1,480 @@
+/*
+ * Copyright Go-IIoT (https://github.com/goiiot)
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package libmqtt
+
+import (
+	"context"
+	"errors"
+	"strconv"
+	"sync"
+	"time"
+)
+
+const (
+	defaultPersistQueueSize = 64
+
+	persistRetryFirstDelay  = 100 * time.Millisecond
+	persistRetryMaxDelay    = 30 * time.Second
+	persistRetryMaxAttempts = 10
+)
+
+// ErrPersistQueueFull is the error happened when a persist operation
+// can not be queued without blocking
+var ErrPersistQueueFull = errors.New("persist queue is full ")
+
+// PersistPolicy defines how to tackle with failed persist operations and
+// persist operations can not be queued when the persist queue is full
+type PersistPolicy byte
+
+const (
+	// PersistReport reports failed operations and discards them,
+	// operations are reported with ErrPersistQueueFull and discarded when
+	// the queue is full, publish packets are not failed by persist errors
+	PersistReport PersistPolicy = iota
+
+	// PersistFailPublish waits for publish packets (qos 1 and 2) being
+	// persisted, and fails the publish if failed or the queue is full,
+	// other failed operations are reported and discarded
+	PersistFailPublish
+
+	// PersistRetry retries failed operations with exponential backoff until
+	// succeeded, the client destroyed or tried 10 times (reported and
+	// discarded then), operations wait for room when the queue is full,
+	// which blocks the client
+	PersistRetry
+
+	// PersistDegrade switches to memory persist when an operation failed
+	// or the queue is full, the client keeps using memory persist until
+	// destroyed, there is no switching back, packets persisted in memory
+	// are lost when the process exits (deletions are still applied to the
+	// persist method, so packets done are not restored in the next run)
+	PersistDegrade
+)
+
+// PersistError is the error happened when a persist operation failed,
+// reported to the PersistHandler
+type PersistError struct {
+	// Op is the persist operation, "store" or "delete"
+	Op string
+
+	// Key is the persist key of the operation
+	Key string
+
+	// Packet is the packet to store, nil for deletion
+	Packet Packet
+
+	// Err is the error happened
+	Err error
+}
+
+func (e *PersistError) Error() string {
+	return "persist " + e.Op + " " + strconv.Quote(e.Key) + " failed: " + e.Err.Error()
+}
+
+// Unwrap returns the error happened
+func (e *PersistError) Unwrap() error {
+	return e.Err
+}
+
+// newPersistError returns the *PersistError of the operation, err is
+// returned as is if it's already a *PersistError
+func newPersistError(op, key string, p Packet, err error) error {
+	if _, ok := err.(*PersistError); ok {
+		return err
+	}
+	return &PersistError{Op: op, Key: key, Packet: p, Err: err}
+}
+
+// persistOp is a store or delete operation in persistQueue
+type persistOp struct {
+	key      string
+	record   *PersistRecord // nil for deletion
+	gen      uint64         // generation of persistQueue when queued
+	done     chan error     // nil if result not waited
+	finished bool
+}
+
+func (op *persistOp) error(err error) error {
+	if err == nil {
+		return nil
+	}
+
+	if op.record == nil {
+		return &PersistError{Op: "delete", Key: op.key, Err: err}
+	}
+	return &PersistError{Op: "store", Key: op.key, Packet: op.record.Packet, Err: err}
+}
+
+// persistQueue runs persist operations of the client in order in a
+// bounded queue, so the client isn't blocked by slow persist methods
+type persistQueue struct {
+	ctx    context.Context
+	method PersistMethod
+	policy PersistPolicy
+	report func(err error)
+	opC    chan *persistOp
+	done   chan struct{} // closed when run returned
+
+	// held when applying operations and destroying
+	applyMu sync.Mutex
+
+	mu       sync.Mutex
+	gen      uint64                // increased when destroyed
+	pending  map[string]*persistOp // the latest pending operation of keys
+	degraded bool
+	mem      PersistMethod // persist method when degraded
+	deferred []*persistOp  // deletions not queued when degraded and the queue is full
+}
+
+func newPersistQueue(ctx context.Context, method PersistMethod, size int, policy PersistPolicy, report func(err error)) *persistQueue {
+	if size < 1 {
+		size = defaultPersistQueueSize
+	}
+
+	return &persistQueue{
+		ctx:     ctx,
+		method:  method,
+		policy:  policy,
+		report:  report,
+		opC:     make(chan *persistOp, size),
+		done:    make(chan struct{}),
+		pending: make(map[string]*persistOp),
+		mem:     NewMemPersist(nil),
+	}
+}
+
+// Name of persistQueue is the name of the underlying PersistMethod
+func (q *persistQueue) Name() string {
+	return q.method.Name()
+}
+
+// Store queues the store operation
+func (q *persistQueue) Store(key string, p Packet) error {
+	if p == nil {
+		return nil
+	}
+
+	return q.StoreRecord(key, NewPersistRecord(p))
+}
+
+// StoreRecord queues the store operation
+func (q *persistQueue) StoreRecord(key string, r *PersistRecord) error {
+	if r == nil || r.Packet == nil {
+		return nil
+	}
+
+	return q.enqueue(&persistOp{key: key, record: r})
+}
+
+// storePub stores the publish packet, and waits for the result if the
+// policy is PersistFailPublish
+func (q *persistQueue) storePub(key string, p *PublishPacket) error {
+	if q.policy != PersistFailPublish {
+		return q.Store(key, p)
+	}
+
+	op := &persistOp{key: key, record: NewPersistRecord(p), done: make(chan error, 1)}
+	if err := q.enqueue(op); err != nil {
+		return err
+	}
+
+	select {
+	case <-q.ctx.Done():
+		return op.error(ErrClientClosed)
+	case err := <-op.done:
+		return op.error(err)
+	}
+}
+
+// Delete queues the delete operation
+func (q *persistQueue) Delete(key string) error {
+	return q.enqueue(&persistOp{key: key})
+}
+
+// Load the packet with key, pending operations are applied
+func (q *persistQueue) Load(key string) (Packet, bool) {
+	r, ok := q.LoadRecord(key)
+	if !ok {
+		return nil, false
+	}
+	return r.Packet, true
+}
+
+// LoadRecord loads the record with key, pending operations are applied
+func (q *persistQueue) LoadRecord(key string) (*PersistRecord, bool) {
+	q.mu.Lock()
+	op, ok := q.pending[key]
+	q.mu.Unlock()
+
+	if ok {
+		return op.record, op.record != nil
+	}
+
+	if r, ok := loadRecord(q.mem, key); ok {
+		return r, true
+	}
+	return loadRecord(q.method, key)
+}
+
+// Range over all packets persisted, pending operations are applied
+func (q *persistQueue) Range(f func(key string, p Packet) bool) {
+	if f == nil {
+		return
+	}
+
+	q.mu.Lock()
+	pending := make(map[string]*persistOp, len(q.pending))
+	for k, op := range q.pending {
+		pending[k] = op
+	}
+	q.mu.Unlock()
+
+	inMem := make(map[string]bool)
+	q.mem.Range(func(key string, p Packet) bool {
+		inMem[key] = true
+		return true
+	})
+
+	more := true
+	q.method.Range(func(key string, p Packet) bool {
+		if _, ok := pending[key]; ok || inMem[key] {
+			return true
+		}
+		more = f(key, p)
+		return more
+	})
+
+	if more {
+		q.mem.Range(func(key string, p Packet) bool {
+			if _, ok := pending[key]; ok {
+				return true
+			}
+			more = f(key, p)
+			return more
+		})
+	}
+
+	for key, op := range pending {
+		if !more {
+			return
+		}
+
+		if op.record != nil {
+			more = f(key, op.record.Packet)
+		}
+	}
+}
+
+// Destroy discards pending operations and destroys the persist method,
+// the operation being applied is done before destroyed
+func (q *persistQueue) Destroy() error {
+	q.applyMu.Lock()
+	defer q.applyMu.Unlock()
+
+	q.mu.Lock()
+	q.gen++
+	q.pending = make(map[string]*persistOp)
+	q.deferred = nil
+	q.mu.Unlock()
+
+	q.mem.Destroy()
+	return q.method.Destroy()
+}
+
+// enqueue the operation according to the policy
+func (q *persistQueue) enqueue(op *persistOp) error {
+	q.mu.Lock()
+	if q.degraded {
+		q.mu.Unlock()
+		return q.applyDegraded(op)
+	}
+
+	op.gen = q.gen
+	prev := q.pending[op.key]
+	q.pending[op.key] = op
+	q.mu.Unlock()
+
+	if q.policy == PersistRetry {
+		select {
+		case <-q.ctx.Done():
+		case q.opC <- op:
+			return nil
+		}
+	} else {
+		select {
+		case q.opC <- op:
+			return nil
+		default:
+		}
+	}
+
+	q.mu.Lock()
+	if q.pending[op.key] == op {
+		if prev != nil && !prev.finished {
+			q.pending[op.key] = prev
+		} else {
+			delete(q.pending, op.key)
+		}
+	}
+	q.mu.Unlock()
+
+	switch {
+	case q.ctx.Err() != nil:
+		return op.error(ErrClientClosed)
+	case q.policy == PersistReport:
+		q.report(op.error(ErrPersistQueueFull))
+		return nil
+	case q.policy == PersistDegrade:
+		q.degrade()
+		q.report(op.error(ErrPersistQueueFull))
+		return q.applyDegraded(op)
+	}
+	return op.error(ErrPersistQueueFull)
+}
+
+// run operations in queue until the client destroyed, operations left
+// are tried once when destroyed
+func (q *persistQueue) run() {
+	defer close(q.done)
+
+	for {
+		select {
+		case <-q.ctx.Done():
+			for {
+				select {
+				case op := <-q.opC:
+					q.finish(op, q.apply(op))
+				default:
+					for _, op := range q.takeDeferred() {
+						q.finish(op, q.apply(op))
+					}
+					return
+				}
+			}
+		case op := <-q.opC:
+			q.exec(op)
+
+			for _, op := range q.takeDeferred() {
+				q.exec(op)
+			}
+		}
+	}
+}
+
+// takeDeferred takes deletions deferred by applyDegraded, they are
+// executed after operations queued before them
+func (q *persistQueue) takeDeferred() []*persistOp {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	ops := q.deferred
+	q.deferred = nil
+	return ops
+}
+
+// exec the operation according to the policy
+func (q *persistQueue) exec(op *persistOp) {
+	err := q.apply(op)
+	delay := persistRetryFirstDelay
+	for i := 1; err != nil && q.policy == PersistRetry && i < persistRetryMaxAttempts; i++ {
+		q.report(op.error(err))
+
+		select {
+		case <-q.ctx.Done():
+			q.finish(op, err)
+			return
+		case <-time.After(delay):
+		}
+
+		if delay *= 2; delay > persistRetryMaxDelay {
+			delay = persistRetryMaxDelay
+		}
+		err = q.apply(op)
+	}
+
+	if err != nil {
+		q.report(op.error(err))
+		if q.policy == PersistDegrade && op.record != nil {
+			q.degrade()
+			err = q.applyDegraded(op)
+		}
+	}
+	q.finish(op, err)
+}
+
+// apply the operation to the persist method, operations queued
+// before destroyed are discarded
+func (q *persistQueue) apply(op *persistOp) error {
+	q.applyMu.Lock()
+	defer q.applyMu.Unlock()
+
+	q.mu.Lock()
+	discarded := op.gen != q.gen
+	q.mu.Unlock()
+
+	switch {
+	case discarded:
+		return nil
+	case op.record == nil:
+		return q.method.Delete(op.key)
+	default:
+		return storeRecord(q.method, op.key, op.record)
+	}
+}
+
+func (q *persistQueue) finish(op *persistOp, err error) {
+	q.mu.Lock()
+	op.finished = true
+	if q.pending[op.key] == op {
+		delete(q.pending, op.key)
+	}
+	q.mu.Unlock()
+
+	if op.done != nil {
+		op.done <- err
+	}
+}
+
+func (q *persistQueue) degrade() {
+	q.mu.Lock()
+	q.degraded = true
+	q.mu.Unlock()
+}
+
+// applyDegraded applies the operation to the memory persist, deletions
+// are also applied to the persist method, they are deferred until the
+// queue has room if it's full
+func (q *persistQueue) applyDegraded(op *persistOp) error {
+	if op.record != nil {
+		return op.error(storeRecord(q.mem, op.key, op.record))
+	}
+
+	q.mem.Delete(op.key)
+
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	del := &persistOp{key: op.key, gen: q.gen}
+	q.pending[op.key] = del
+
+	select {
+	case q.opC <- del:
+	default:
+		q.deferred = append(q.deferred, del)
+	}
+	return nil
+}
@@ -0,0 +1,385 @@
+/*
+ * Copyright Go-IIoT (https://github.com/goiiot)
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package libmqtt
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"testing"
+	"time"
+)
+
+var errTestPersist = errors.New("test persist error ")
+
+// testFailPersist is a memory persist failing the first fails operations,
+// operations wait while blocked
+type testFailPersist struct {
+	PersistMethod
+
+	mu      sync.Mutex
+	fails   int
+	blocked chan struct{}
+}
+
+func newTestFailPersist(fails int) *testFailPersist {
+	return &testFailPersist{PersistMethod: NewMemPersist(nil), fails: fails}
+}
+
+func (p *testFailPersist) block() {
+	p.mu.Lock()
+	p.blocked = make(chan struct{})
+	p.mu.Unlock()
+}
+
+func (p *testFailPersist) unblock() {
+	p.mu.Lock()
+	close(p.blocked)
+	p.blocked = nil
+	p.mu.Unlock()
+}
+
+func (p *testFailPersist) check() error {
+	p.mu.Lock()
+	blocked := p.blocked
+	p.mu.Unlock()
+	if blocked != nil {
+		<-blocked
+	}
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.fails != 0 {
+		p.fails--
+		return errTestPersist
+	}
+	return nil
+}
+
+func (p *testFailPersist) Store(key string, pkt Packet) error {
+	if err := p.check(); err != nil {
+		return err
+	}
+	return p.PersistMethod.Store(key, pkt)
+}
+
+func (p *testFailPersist) Delete(key string) error {
+	if err := p.check(); err != nil {
+		return err
+	}
+	return p.PersistMethod.Delete(key)
+}
+
+func testPersistQueue(method PersistMethod, size int, policy PersistPolicy) (*persistQueue, chan error, context.CancelFunc) {
+	errs := make(chan error, 100)
+	ctx, cancel := context.WithCancel(context.Background())
+	q := newPersistQueue(ctx, method, size, policy, func(err error) { errs <- err })
+	go q.run()
+	return q, errs, cancel
+}
+
+// testPersistWait waits until the key is (or isn't) persisted in method
+func testPersistWait(t *testing.T, method PersistMethod, key string, persisted bool) {
+	for start := time.Now(); time.Since(start) < 5*time.Second; time.Sleep(time.Millisecond) {
+		if _, ok := method.Load(key); ok == persisted {
+			return
+		}
+	}
+	t.Fatal("persist operation not applied, key =", key)
+}
+
+func testPersistErr(t *testing.T, errs chan error, op, key string) *PersistError {
+	select {
+	case err := <-errs:
+		var persistErr *PersistError
+		if !errors.As(err, &persistErr) || persistErr.Op != op || persistErr.Key != key ||
+			(op == "store" && persistErr.Packet == nil) {
+			t.Fatal("persist error mismatch, err =", err)
+		}
+		return persistErr
+	case <-time.After(5 * time.Second):
+		t.Fatal("persist error not reported")
+	}
+	return nil
+}
+
+func TestPersistQueue_Pending(t *testing.T) {
+	method := newTestFailPersist(0)
+	q, errs, cancel := testPersistQueue(method, 10, PersistFailPublish)
+	defer cancel()
+
+	pkt := &PublishPacket{TopicName: "foo", Qos: Qos1, PacketID: 1}
+	method.PersistMethod.Store(sendKey(1), pkt)
+	method.block()
+
+	q.Store(sendKey(2), pkt)
+	q.Store(sendKey(3), pkt)
+	q.Delete(sendKey(1))
+	q.Delete(sendKey(3))
+
+	if _, ok := q.Load(sendKey(1)); ok {
+		t.Error("pending deletion not applied")
+	}
+
+	if _, ok := q.Load(sendKey(2)); !ok {
+		t.Error("pending store not applied")
+	}
+
+	var keys []string
+	q.Range(func(key string, _ Packet) bool {
+		keys = append(keys, key)
+		return true
+	})
+
+	if len(keys) != 1 || keys[0] != sendKey(2) {
+		t.Error("pending operations not applied in range, keys =", keys)
+	}
+
+	method.unblock()
+	testPersistWait(t, method, sendKey(1), false)
+	testPersistWait(t, method, sendKey(2), true)
+	testPersistWait(t, method, sendKey(3), false)
+
+	select {
+	case err := <-errs:
+		t.Error("unexpected error reported, err =", err)
+	default:
+	}
+}
+
+func TestPersistQueue_FailPublish(t *testing.T) {
+	method := newTestFailPersist(1)
+	q, errs, cancel := testPersistQueue(method, 1, PersistFailPublish)
+	defer cancel()
+
+	pkt := &PublishPacket{TopicName: "foo", Qos: Qos1, PacketID: 1}
+	err := q.storePub(sendKey(1), pkt)
+
+	var persistErr *PersistError
+	if !errors.As(err, &persistErr) || persistErr.Packet != pkt || !errors.Is(err, errTestPersist) {
+		t.Fatal("publish not failed, err =", err)
+	}
+	testPersistErr(t, errs, "store", sendKey(1))
+
+	method.block()
+	q.Store(sendKey(2), pkt)
+	for len(q.opC) != 0 {
+		time.Sleep(time.Millisecond)
+	}
+	q.Store(sendKey(3), pkt)
+
+	if err := q.storePub(sendKey(4), pkt); !errors.Is(err, ErrPersistQueueFull) {
+		t.Error("publish not failed when queue full, err =", err)
+	}
+
+	if err := q.Delete(sendKey(3)); !errors.Is(err, ErrPersistQueueFull) {
+		t.Error("deletion queued when queue full, err =", err)
+	}
+
+	// failed deletion not applied
+	if _, ok := q.Load(sendKey(3)); !ok {
+		t.Error("pending store lost")
+	}
+	method.unblock()
+}
+
+func TestPersistQueue_Retry(t *testing.T) {
+	method := newTestFailPersist(2)
+	q, errs, cancel := testPersistQueue(method, 10, PersistRetry)
+	defer cancel()
+
+	pkt := &PublishPacket{TopicName: "foo", Qos: Qos1, PacketID: 1}
+	if err := q.storePub(sendKey(1), pkt); err != nil {
+		t.Fatal(err)
+	}
+	q.Delete(sendKey(2))
+
+	testPersistErr(t, errs, "store", sendKey(1))
+	testPersistErr(t, errs, "store", sendKey(1))
+	testPersistWait(t, method, sendKey(1), true)
+}
+
+func TestPersistQueue_Degrade(t *testing.T) {
+	method := newTestFailPersist(1)
+	q, errs, cancel := testPersistQueue(method, 10, PersistDegrade)
+	defer cancel()
+
+	pkt := &PublishPacket{TopicName: "foo", Qos: Qos1, PacketID: 1}
+	q.Store(sendKey(1), pkt)
+	testPersistErr(t, errs, "store", sendKey(1))
+
+	// stored in memory
+	testPersistWait(t, q, sendKey(1), true)
+	q.Store(sendKey(2), pkt)
+	if _, ok := q.Load(sendKey(2)); !ok {
+		t.Error("packet not stored in memory")
+	}
+
+	if _, ok := method.Load(sendKey(2)); ok {
+		t.Error("packet stored in degraded persist method")
+	}
+
+	q.Delete(sendKey(2))
+	if _, ok := q.Load(sendKey(2)); ok {
+		t.Error("packet not deleted in memory")
+	}
+}
+
+func TestPersistQueue_Destroy(t *testing.T) {
+	method := newTestFailPersist(0)
+	q, _, cancel := testPersistQueue(method, 10, PersistFailPublish)
+	defer cancel()
+
+	pkt := &PublishPacket{TopicName: "foo", Qos: Qos1, PacketID: 1}
+	method.block()
+	q.Store(sendKey(1), pkt)
+	q.Store(sendKey(2), pkt)
+
+	go method.unblock()
+	if err := q.Destroy(); err != nil {
+		t.Fatal(err)
+	}
+
+	q.Store(sendKey(3), pkt)
+	testPersistWait(t, method, sendKey(3), true)
+
+	// the operation being applied is done before destroyed
+	for _, key := range []string{sendKey(1), sendKey(2)} {
+		if _, ok := method.Load(key); ok {
+			t.Error("pending operation applied after destroyed, key =", key)
+		}
+	}
+}
+
+func TestClientPersistQueue(t *testing.T) {
+	method := newTestFailPersist(1)
+	c, err := NewClient(WithServer("localhost:1883"), WithPersist(method), WithPersistQueue(0, PersistFailPublish))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	pkt := &PublishPacket{TopicName: "foo", Qos: Qos1}
+	if err := c.TryPublish(pkt); !errors.Is(err, errTestPersist) {
+		t.Fatal("publish not failed, err =", err)
+	}
+
+	// packet id released
+	if _, ok := c.idGen.getExtra(pkt.PacketID); ok {
+		t.Error("packet id not released")
+	}
+
+	select {
+	case err := <-c.persistErrC:
+		var persistErr *PersistError
+		if !errors.As(err, &persistErr) || persistErr.Packet != pkt {
+			t.Error("persist error mismatch, err =", err)
+		}
+	case <-time.After(time.Second):
+		t.Error("persist error not reported")
+	}
+	c.Destroy(true)
+}
+
+func TestPersistQueue_Report(t *testing.T) {
+	method := newTestFailPersist(1)
+	q, errs, cancel := testPersistQueue(method, 1, PersistReport)
+	defer cancel()
+
+	pkt := &PublishPacket{TopicName: "foo", Qos: Qos1, PacketID: 1}
+	if err := q.storePub(sendKey(1), pkt); err != nil {
+		t.Fatal("publish failed, err =", err)
+	}
+	testPersistErr(t, errs, "store", sendKey(1))
+
+	// operations are reported and discarded when the queue is full
+	method.block()
+	q.Store(sendKey(2), pkt)
+	for len(q.opC) != 0 {
+		time.Sleep(time.Millisecond)
+	}
+
+	for i := uint16(3); i <= 4; i++ {
+		if err := q.Store(sendKey(i), pkt); err != nil {
+			t.Fatal("operation failed when the queue is full, err =", err)
+		}
+	}
+
+	if err := testPersistErr(t, errs, "store", sendKey(4)); err.Err != ErrPersistQueueFull {
+		t.Error("queue full not reported, err =", err)
+	}
+	method.unblock()
+
+	for i := uint16(2); i <= 3; i++ {
+		testPersistWait(t, method, sendKey(i), true)
+	}
+	if _, ok := method.Load(sendKey(4)); ok {
+		t.Error("operation not discarded when the queue is full")
+	}
+}
+
+func TestClientPersistQueue_Report(t *testing.T) {
+	method := newTestFailPersist(1)
+	c, err := NewClient(WithServer("localhost:1883"), WithPersist(method))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Destroy(true)
+
+	// publish not failed by default
+	pkt := &PublishPacket{TopicName: "foo", Qos: Qos1}
+	if err := c.TryPublish(pkt); err != nil {
+		t.Fatal("publish failed, err =", err)
+	}
+
+	select {
+	case err := <-c.persistErrC:
+		var persistErr *PersistError
+		if !errors.As(err, &persistErr) || persistErr.Packet != pkt {
+			t.Error("persist error mismatch, err =", err)
+		}
+	case <-time.After(time.Second):
+		t.Error("persist error not reported")
+	}
+}
+
+func TestPersistQueue_DegradeDelete(t *testing.T) {
+	method := newTestFailPersist(0)
+	method.PersistMethod.Store(sendKey(1), &PublishPacket{TopicName: "foo", Qos: Qos1, PacketID: 1})
+	q, errs, cancel := testPersistQueue(method, 1, PersistDegrade)
+	defer cancel()
+
+	pkt := &PublishPacket{TopicName: "foo", Qos: Qos1, PacketID: 2}
+	method.block()
+	q.Store(sendKey(2), pkt)
+	for len(q.opC) != 0 {
+		time.Sleep(time.Millisecond)
+	}
+
+	// fill the queue and degrade
+	q.Store(sendKey(3), pkt)
+	q.Store(sendKey(4), pkt)
+	testPersistErr(t, errs, "store", sendKey(4))
+
+	// deletion deferred while the queue is full
+	q.Delete(sendKey(1))
+	if _, ok := q.Load(sendKey(1)); ok {
+		t.Error("deleted packet loaded")
+	}
+
+	method.unblock()
+	testPersistWait(t, method, sendKey(1), false)
+}
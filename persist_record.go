@@ -0,0 +1,163 @@
+/*
+ * Copyright Go-IIoT (https://github.com/goiiot)
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package libmqtt
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"time"
+)
+
+const (
+	// recordMarker is the first byte of encoded PersistRecord, packet type 0
+	// is reserved, so packets persisted without record never start with it
+	recordMarker = 0x00
+
+	// recordFormatV1 is the current format of encoded PersistRecord
+	recordFormatV1 = 0x01
+
+	// marker, format, protocol version, store time
+	recordHeaderSize = 1 + 1 + 1 + 8
+)
+
+// ErrBadPersistRecord is the error happened when decoding malformed
+// or unsupported persist record
+var ErrBadPersistRecord = errors.New("bad persist record ")
+
+// PersistRecord is the packet persisted with its metadata
+type PersistRecord struct {
+	// Version is the MQTT version used to encode and decode the packet
+	Version ProtoVersion
+
+	// StoreTime is the time when the packet was stored
+	StoreTime time.Time
+
+	// Packet persisted
+	Packet Packet
+}
+
+// NewPersistRecord creates a record of the packet stored now
+func NewPersistRecord(p Packet) *PersistRecord {
+	return &PersistRecord{
+		Version:   p.Version(),
+		StoreTime: time.Now(),
+		Packet:    p,
+	}
+}
+
+// Bytes encodes the record to bytes, returns nil if the packet
+// could not be encoded
+func (r *PersistRecord) Bytes() []byte {
+	if r == nil || r.Packet == nil {
+		return nil
+	}
+
+	pkt := r.Packet.Bytes()
+	if pkt == nil {
+		return nil
+	}
+
+	var storeTime int64
+	if !r.StoreTime.IsZero() {
+		storeTime = r.StoreTime.UnixNano()
+	}
+
+	buf := make([]byte, recordHeaderSize, recordHeaderSize+len(pkt))
+	buf[0], buf[1], buf[2] = recordMarker, recordFormatV1, byte(r.Version)
+	binary.BigEndian.PutUint64(buf[3:], uint64(storeTime))
+	return append(buf, pkt...)
+}
+
+// DecodePersistRecord decodes the record encoded by PersistRecord.Bytes,
+// packets persisted without record (see IsLegacyPersistRecord) are decoded
+// as MQTT 3.1.1 packets with no metadata
+func DecodePersistRecord(data []byte) (*PersistRecord, error) {
+	if IsLegacyPersistRecord(data) {
+		pkt, err := Decode(V311, bytes.NewReader(data))
+		if err != nil {
+			return nil, err
+		}
+		return &PersistRecord{Version: V311, Packet: pkt}, nil
+	}
+
+	if len(data) < recordHeaderSize || data[1] != recordFormatV1 {
+		return nil, ErrBadPersistRecord
+	}
+
+	r := &PersistRecord{Version: ProtoVersion(data[2])}
+
+	if storeTime := int64(binary.BigEndian.Uint64(data[3:])); storeTime != 0 {
+		r.StoreTime = time.Unix(0, storeTime)
+	}
+
+	pkt, err := Decode(r.Version, bytes.NewReader(data[recordHeaderSize:]))
+	if err != nil {
+		return nil, err
+	}
+
+	// decoded packets are not bound to the version, ping packets are
+	// shared instances encoded the same in all versions
+	if v, ok := pkt.(versionSetter); ok && pkt != PingReqPacket && pkt != PingRespPacket {
+		v.setVersion(r.Version)
+	}
+	r.Packet = pkt
+	return r, nil
+}
+
+// IsLegacyPersistRecord reports whether the data is a packet persisted
+// without record by previous versions of libmqtt, persist methods should
+// migrate them to records
+func IsLegacyPersistRecord(data []byte) bool {
+	return len(data) > 0 && data[0] != recordMarker
+}
+
+// RecordPersistMethod is the PersistMethod storing packets with metadata,
+// Store and Load of it should be equivalent to StoreRecord and LoadRecord
+// with records created by NewPersistRecord
+type RecordPersistMethod interface {
+	PersistMethod
+
+	// StoreRecord stores the record with key
+	StoreRecord(key string, r *PersistRecord) error
+
+	// LoadRecord loads the record with key
+	LoadRecord(key string) (*PersistRecord, bool)
+}
+
+// storeRecord stores the record with method, metadata is discarded
+// if the method is not a RecordPersistMethod
+func storeRecord(method PersistMethod, key string, r *PersistRecord) error {
+	if rm, ok := method.(RecordPersistMethod); ok {
+		return rm.StoreRecord(key, r)
+	}
+	return method.Store(key, r.Packet)
+}
+
+// loadRecord loads the record with method, only version of the record
+// is available if the method is not a RecordPersistMethod
+func loadRecord(method PersistMethod, key string) (*PersistRecord, bool) {
+	if rm, ok := method.(RecordPersistMethod); ok {
+		return rm.LoadRecord(key)
+	}
+
+	p, ok := method.Load(key)
+	if !ok {
+		return nil, false
+	}
+	return &PersistRecord{Version: p.Version(), Packet: p}, true
+}
@@ -0,0 +1,97 @@
+/*
+ * Copyright Go-IIoT (https://github.com/goiiot)
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package libmqtt
+
+import (
+	"bytes"
+	"io/ioutil"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestPersistRecord(t *testing.T) {
+	for _, p := range append(testV5Packets(), &PublishPacket{TopicName: "foo", Payload: []byte("bar")}) {
+		r := &PersistRecord{
+			Version:   p.Version(),
+			StoreTime: time.Unix(1600000000, 1),
+			Packet:    p,
+		}
+
+		decoded, err := DecodePersistRecord(r.Bytes())
+		if err != nil {
+			t.Fatal("decode record failed, packet =", p, "err =", err)
+		}
+
+		if decoded.Version != r.Version || !decoded.StoreTime.Equal(r.StoreTime) {
+			t.Errorf("record mismatch\nDecoded: %+v\nTarget: %+v", decoded, r)
+		}
+
+		if decoded.Packet.Version() != p.Version() || !bytes.Equal(decoded.Packet.Bytes(), p.Bytes()) {
+			t.Error("record packet mismatch, packet =", p)
+		}
+	}
+}
+
+func TestPersistRecord_Legacy(t *testing.T) {
+	p := &PublishPacket{TopicName: "foo", Qos: Qos1, PacketID: 1, Payload: []byte("bar")}
+	if !IsLegacyPersistRecord(p.Bytes()) || IsLegacyPersistRecord(NewPersistRecord(p).Bytes()) {
+		t.Fatal("legacy record not detected")
+	}
+
+	r, err := DecodePersistRecord(p.Bytes())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if r.Version != V311 || !r.StoreTime.IsZero() || !bytes.Equal(r.Packet.Bytes(), p.Bytes()) {
+		t.Error("legacy record mismatch, record =", r)
+	}
+
+	for _, data := range [][]byte{
+		{recordMarker},
+		{recordMarker, recordFormatV1 + 1, byte(V311), 0, 0, 0, 0, 0, 0, 0, 0},
+		{recordMarker, recordFormatV1, byte(V311), 0, 0, 0, 0, 0, 0, 0},
+	} {
+		if _, err := DecodePersistRecord(data); err != ErrBadPersistRecord {
+			t.Error("bad record decoded, data =", data, "err =", err)
+		}
+	}
+}
+
+func TestFilePersist_Migrate(t *testing.T) {
+	dirPath := t.TempDir()
+	p := &PublishPacket{TopicName: "foo", Qos: Qos1, PacketID: 1, Payload: []byte("bar")}
+	filename := filepath.Join(dirPath, "legacy"+fileSuffix)
+	if err := ioutil.WriteFile(filename, p.Bytes(), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	persist := NewFilePersist(dirPath, nil)
+	content, err := ioutil.ReadFile(filename)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if IsLegacyPersistRecord(content) {
+		t.Error("legacy packet file not migrated")
+	}
+
+	if loaded, ok := persist.Load("legacy"); !ok || !bytes.Equal(loaded.Bytes(), p.Bytes()) {
+		t.Error("migrated packet mismatch, packet =", loaded)
+	}
+}
@@ -0,0 +1,310 @@
+/*
+ * Copyright Go-IIoT (https://github.com/goiiot)
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package libmqtt
+
+import (
+	"encoding/base64"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// sessionKeyPrefix is the prefix of keys persisted in session namespaces,
+// a session key is "s.{base64(server)}.{base64(clientID)}.{key}"
+const sessionKeyPrefix = "s."
+
+var sessionEncoding = base64.RawURLEncoding
+
+// Session identifies the session state persisted by a client
+type Session struct {
+	// Server is the address of the server, for clients connecting to
+	// multiple servers, it's the sorted addresses joined with comma
+	Server string
+
+	// ClientID is the client id used in ConnPacket
+	ClientID string
+}
+
+// prefix of keys in the session namespace
+func (s Session) prefix() string {
+	return sessionKeyPrefix + sessionEncoding.EncodeToString([]byte(s.Server)) +
+		"." + sessionEncoding.EncodeToString([]byte(s.ClientID)) + "."
+}
+
+// parseSessionKey splits the persisted key into session and key in session
+func parseSessionKey(persistKey string) (Session, string, bool) {
+	if !strings.HasPrefix(persistKey, sessionKeyPrefix) {
+		return Session{}, "", false
+	}
+
+	parts := strings.SplitN(persistKey[len(sessionKeyPrefix):], ".", 3)
+	if len(parts) != 3 {
+		return Session{}, "", false
+	}
+
+	server, err := sessionEncoding.DecodeString(parts[0])
+	if err != nil {
+		return Session{}, "", false
+	}
+
+	clientID, err := sessionEncoding.DecodeString(parts[1])
+	if err != nil {
+		return Session{}, "", false
+	}
+
+	return Session{Server: string(server), ClientID: string(clientID)}, parts[2], true
+}
+
+// SessionStore manages sessions persisted by clients sharing the same
+// PersistMethod (e.g. the same directory of FilePersist)
+type SessionStore struct {
+	method PersistMethod
+}
+
+// NewSessionStore creates a SessionStore of sessions persisted with method
+func NewSessionStore(method PersistMethod) *SessionStore {
+	if method == nil {
+		method = NonePersist
+	}
+	return &SessionStore{method: method}
+}
+
+// Sessions lists sessions with packets persisted, sorted by
+// server and client id
+func (s *SessionStore) Sessions() []Session {
+	seen := make(map[Session]struct{})
+	s.method.Range(func(key string, p Packet) bool {
+		if session, _, ok := parseSessionKey(key); ok {
+			seen[session] = struct{}{}
+		}
+		return true
+	})
+
+	sessions := make([]Session, 0, len(seen))
+	for session := range seen {
+		sessions = append(sessions, session)
+	}
+
+	sort.Slice(sessions, func(i, j int) bool {
+		if sessions[i].Server != sessions[j].Server {
+			return sessions[i].Server < sessions[j].Server
+		}
+		return sessions[i].ClientID < sessions[j].ClientID
+	})
+	return sessions
+}
+
+// Persist returns the PersistMethod scoped to the session, keys stored
+// with it are invisible to other sessions, and destroying it only purges
+// the session
+func (s *SessionStore) Persist(session Session) PersistMethod {
+	return newSessionPersist(s.method, session)
+}
+
+// Range over records persisted in the session with keys in the session,
+// only versions of records are available if the PersistMethod is not
+// a RecordPersistMethod
+func (s *SessionStore) Range(session Session, f func(key string, r *PersistRecord) bool) {
+	if f == nil {
+		return
+	}
+
+	prefix := session.prefix()
+	s.method.Range(func(key string, p Packet) bool {
+		if !strings.HasPrefix(key, prefix) {
+			return true
+		}
+
+		r, ok := loadRecord(s.method, key)
+		if !ok {
+			// deleted while ranging
+			return true
+		}
+		return f(key[len(prefix):], r)
+	})
+}
+
+// Purge deletes all packets persisted in the session
+func (s *SessionStore) Purge(session Session) error {
+	return s.Persist(session).Destroy()
+}
+
+// ClientScopedPersist is the PersistMethod storing packets of one client
+// id only (e.g. EtcdPersist in the extension package), the client stores
+// packets in it without session namespace, so the session is shared by
+// clients with the same client id whatever servers they connect to
+type ClientScopedPersist interface {
+	PersistMethod
+
+	// ClientScoped reports whether packets are stored for one client id only
+	ClientScoped() bool
+}
+
+// isClientScoped checks whether the method is a ClientScopedPersist
+// scoped to one client id
+func isClientScoped(method PersistMethod) bool {
+	m, ok := method.(ClientScopedPersist)
+	return ok && m.ClientScoped()
+}
+
+// sessionPersist is the PersistMethod scoped to a session namespace
+type sessionPersist struct {
+	method PersistMethod
+	prefix string
+}
+
+// newSessionPersist scopes method to the session, methods already scoped
+// to the client id are returned as is
+func newSessionPersist(method PersistMethod, session Session) PersistMethod {
+	if method == nil || method == NonePersist || isClientScoped(method) {
+		return method
+	}
+	return &sessionPersist{method: method, prefix: session.prefix()}
+}
+
+// Name of sessionPersist is the name of the underlying PersistMethod
+func (s *sessionPersist) Name() string {
+	return s.method.Name()
+}
+
+// Store a packet with key in session
+func (s *sessionPersist) Store(key string, p Packet) error {
+	return s.method.Store(s.prefix+key, p)
+}
+
+// StoreRecord stores a record with key in session
+func (s *sessionPersist) StoreRecord(key string, r *PersistRecord) error {
+	return storeRecord(s.method, s.prefix+key, r)
+}
+
+// Load a packet with key in session
+func (s *sessionPersist) Load(key string) (Packet, bool) {
+	return s.method.Load(s.prefix + key)
+}
+
+// LoadRecord loads a record with key in session
+func (s *sessionPersist) LoadRecord(key string) (*PersistRecord, bool) {
+	return loadRecord(s.method, s.prefix+key)
+}
+
+// Range over packets persisted in session with keys in session
+func (s *sessionPersist) Range(f func(key string, p Packet) bool) {
+	if f == nil {
+		return
+	}
+
+	s.method.Range(func(key string, p Packet) bool {
+		if !strings.HasPrefix(key, s.prefix) {
+			return true
+		}
+		return f(key[len(s.prefix):], p)
+	})
+}
+
+// Delete a packet with key in session
+func (s *sessionPersist) Delete(key string) error {
+	return s.method.Delete(s.prefix + key)
+}
+
+// Destroy deletes all packets persisted in session, packets of other
+// sessions are not affected
+func (s *sessionPersist) Destroy() error {
+	return s.deleteKeys(func(string) bool { return true })
+}
+
+// deleteKeys deletes packets with keys in session matching the filter
+func (s *sessionPersist) deleteKeys(filter func(key string) bool) error {
+	return deleteKeys(s, filter)
+}
+
+// deleteKeys deletes packets persisted with method with keys matching
+// the filter
+func deleteKeys(method PersistMethod, filter func(key string) bool) error {
+	var keys []string
+	method.Range(func(key string, p Packet) bool {
+		if filter(key) {
+			keys = append(keys, key)
+		}
+		return true
+	})
+
+	for _, key := range keys {
+		if err := method.Delete(key); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// cleanSessionState deletes packets of in-flight messages in the session,
+// packets in offline queue are kept
+func cleanSessionState(method PersistMethod) error {
+	if method == nil || method == NonePersist {
+		return nil
+	}
+
+	return deleteKeys(method, func(key string) bool {
+		return strings.HasPrefix(key, sendKeyPrefix) || strings.HasPrefix(key, recvKeyPrefix)
+	})
+}
+
+// adoptUnscoped moves in-flight and queued packets persisted without
+// session namespace by previous versions (e.g. "S1", "Q0") into the
+// session, the first session opened with the PersistMethod takes them
+func adoptUnscoped(method PersistMethod) error {
+	s, ok := method.(*sessionPersist)
+	if !ok {
+		return nil
+	}
+
+	var keys []string
+	s.method.Range(func(key string, p Packet) bool {
+		if isUnscopedKey(key) {
+			keys = append(keys, key)
+		}
+		return true
+	})
+
+	for _, key := range keys {
+		r, ok := loadRecord(s.method, key)
+		if !ok {
+			// deleted while ranging
+			continue
+		}
+
+		if err := storeRecord(s.method, s.prefix+key, r); err != nil {
+			return err
+		}
+
+		if err := s.method.Delete(key); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// isUnscopedKey checks whether the key is a send, recv or queue key
+// persisted without session namespace
+func isUnscopedKey(key string) bool {
+	for _, prefix := range []string{sendKeyPrefix, recvKeyPrefix, queueKeyPrefix} {
+		if strings.HasPrefix(key, prefix) {
+			_, err := strconv.ParseUint(key[len(prefix):], 10, 64)
+			return err == nil
+		}
+	}
+	return false
+}
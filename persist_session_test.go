@@ -0,0 +1,244 @@
+/*
+ * Copyright Go-IIoT (https://github.com/goiiot)
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package libmqtt
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestSessionStore(t *testing.T) {
+	method := NewMemPersist(nil)
+	store := NewSessionStore(method)
+	sessions := []Session{
+		{Server: "a.example.com:1883", ClientID: "client.1/a:b"},
+		{Server: "a.example.com:1883", ClientID: "client.2"},
+		{Server: "b.example.com:8883", ClientID: "client.1/a:b"},
+	}
+
+	for i, s := range sessions {
+		p := store.Persist(s)
+		if err := p.Store(sendKey(1), &PubRelPacket{PacketID: uint16(i + 1)}); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// keys stored without session are ignored
+	method.Store(sendKey(1), &PubRelPacket{PacketID: 1})
+
+	if listed := store.Sessions(); !reflect.DeepEqual(listed, sessions) {
+		t.Error("sessions mismatch, sessions =", listed)
+	}
+
+	for i, s := range sessions {
+		pkt, ok := store.Persist(s).Load(sendKey(1))
+		if !ok || pkt.(*PubRelPacket).PacketID != uint16(i+1) {
+			t.Error("packet of session mismatch, session =", s, "packet =", pkt)
+		}
+
+		n := 0
+		store.Range(s, func(key string, r *PersistRecord) bool {
+			n++
+			if key != sendKey(1) || r.Packet.(*PubRelPacket).PacketID != uint16(i+1) || r.StoreTime.IsZero() {
+				t.Error("record of session mismatch, key =", key, "record =", r)
+			}
+			return true
+		})
+
+		if n != 1 {
+			t.Error("ranged records of other sessions, count =", n)
+		}
+	}
+
+	if err := store.Purge(sessions[0]); err != nil {
+		t.Fatal(err)
+	}
+
+	if listed := store.Sessions(); !reflect.DeepEqual(listed, sessions[1:]) {
+		t.Error("sessions mismatch after purge, sessions =", listed)
+	}
+
+	if _, ok := method.Load(sendKey(1)); !ok {
+		t.Error("packet without session purged")
+	}
+}
+
+func TestClientSessionPersist(t *testing.T) {
+	method := NewMemPersist(nil)
+	store := NewSessionStore(method)
+	session := Session{Server: "localhost:1883,localhost:8883", ClientID: "foo"}
+	other := Session{Server: "localhost:1883,localhost:8883", ClientID: "bar"}
+
+	for _, s := range []Session{session, other} {
+		p := store.Persist(s)
+		p.Store(sendKey(1), &PubRelPacket{PacketID: 1})
+		p.Store(recvKey(1), &PubRelPacket{PacketID: 1})
+		p.Store(queueKey(0), &PublishPacket{TopicName: "foo", Qos: Qos1, PacketID: 1})
+	}
+
+	c, err := NewClient(
+		WithServer("localhost:1883"),
+		WithSecureServer("localhost:8883"),
+		WithClientID(session.ClientID),
+		WithCleanSession(true),
+		WithPersist(method),
+		WithOfflineQueue(10, OfflineError, method),
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if c.session() != session {
+		t.Fatal("client session mismatch, session =", c.session())
+	}
+
+	keys := make(map[string]bool)
+	store.Range(session, func(key string, r *PersistRecord) bool {
+		keys[key] = true
+		return true
+	})
+
+	// in-flight packets cleaned, queued packets kept
+	if !reflect.DeepEqual(keys, map[string]bool{queueKey(0): true}) {
+		t.Error("session state not cleaned, keys =", keys)
+	}
+
+	if len(c.offline.pkts) != 1 {
+		t.Error("offline queue not restored from session, count =", len(c.offline.pkts))
+	}
+
+	n := 0
+	store.Range(other, func(string, *PersistRecord) bool {
+		n++
+		return true
+	})
+
+	if n != 3 {
+		t.Error("session of other client cleaned, count =", n)
+	}
+}
+
+func TestClientSessionPersist_Unscoped(t *testing.T) {
+	method := NewMemPersist(nil)
+	store := NewSessionStore(method)
+
+	// packets persisted by previous versions
+	method.Store(sendKey(1), &PubRelPacket{PacketID: 1})
+	method.Store(queueKey(0), &PublishPacket{TopicName: "foo", Qos: Qos1, PacketID: 1})
+	method.Store("foo", &PubRelPacket{PacketID: 2})
+
+	c, err := NewClient(
+		WithServer("localhost:8883", "localhost:1883"),
+		WithClientID("foo"),
+		WithPersist(method),
+		WithOfflineQueue(10, OfflineError, method),
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// session is not changed by order of servers
+	session := Session{Server: "localhost:1883,localhost:8883", ClientID: "foo"}
+	if c.session() != session {
+		t.Fatal("client session mismatch, session =", c.session())
+	}
+
+	keys := make(map[string]bool)
+	store.Range(session, func(key string, r *PersistRecord) bool {
+		keys[key] = true
+		return true
+	})
+
+	if !reflect.DeepEqual(keys, map[string]bool{sendKey(1): true, queueKey(0): true}) {
+		t.Error("unscoped packets not moved into session, keys =", keys)
+	}
+
+	for key, moved := range map[string]bool{sendKey(1): true, queueKey(0): true, "foo": false} {
+		if _, ok := method.Load(key); ok == moved {
+			t.Error("unscoped key mismatch, key =", key)
+		}
+	}
+
+	if len(c.offline.pkts) != 1 {
+		t.Error("offline queue not restored from session, count =", len(c.offline.pkts))
+	}
+}
+
+func TestClientSessionPersist_EmptyClientID(t *testing.T) {
+	for _, persist := range []bool{false, true} {
+		backend := &testLogger{}
+		options := []Option{WithServer("localhost:1883"), WithLogger(backend)}
+		if persist {
+			options = append(options, WithPersist(NewMemPersist(nil)))
+		}
+
+		if _, err := NewClient(options...); err != nil {
+			t.Fatal(err)
+		}
+
+		if warned := backend.level == "W"; warned != persist {
+			t.Error("empty client id warning mismatch, persist =", persist, "log =", backend.msg)
+		}
+	}
+}
+
+// clientScopedPersist is a PersistMethod scoped to one client id
+type clientScopedPersist struct {
+	PersistMethod
+}
+
+func (clientScopedPersist) ClientScoped() bool { return true }
+
+func TestClientSessionPersist_ClientScoped(t *testing.T) {
+	method := clientScopedPersist{NewMemPersist(nil)}
+	method.Store(sendKey(1), &PubRelPacket{PacketID: 1})
+	method.Store(queueKey(0), &PublishPacket{TopicName: "foo", Qos: Qos1, PacketID: 1})
+
+	for _, servers := range [][]string{{"localhost:1883"}, {"localhost:8883", "localhost:1884"}} {
+		c, err := NewClient(
+			WithServer(servers...),
+			WithClientID("foo"),
+			WithCleanSession(true),
+			WithPersist(method),
+			WithOfflineQueue(10, OfflineError, method),
+		)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if len(c.offline.pkts) != 1 {
+			t.Error("offline queue not restored, servers =", servers, "count =", len(c.offline.pkts))
+		}
+	}
+
+	keys := make(map[string]bool)
+	method.Range(func(key string, p Packet) bool {
+		keys[key] = true
+		return true
+	})
+
+	// keys are not namespaced, in-flight packets cleaned
+	if !reflect.DeepEqual(keys, map[string]bool{queueKey(0): true}) {
+		t.Error("client scoped keys mismatch, keys =", keys)
+	}
+
+	keyProvider := &testKeys{}
+	keyProvider.rotate("k1")
+	if !isClientScoped(NewEncryptedPersist(method, keyProvider.provide, nil, nil)) {
+		t.Error("encrypted persist not client scoped")
+	}
+}
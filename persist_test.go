@@ -120,3 +120,60 @@ func TestFilePersist(t *testing.T) {
 		t.Error(err)
 	}
 }
+
+// closablePersist records persisted packets when closed
+type closablePersist struct {
+	PersistMethod
+	closed chan int
+}
+
+func (c *closablePersist) Close() error {
+	n := 0
+	c.Range(func(string, Packet) bool {
+		n++
+		return true
+	})
+	c.closed <- n
+	return nil
+}
+
+func TestClientClosePersist(t *testing.T) {
+	method := &closablePersist{PersistMethod: NewMemPersist(nil), closed: make(chan int, 2)}
+	retained := &closablePersist{PersistMethod: NewMemPersist(nil), closed: make(chan int, 2)}
+	keys := &testKeys{}
+	keys.rotate("k1")
+
+	c, err := NewClient(
+		WithServer("localhost:1883"),
+		WithClientID("foo"),
+		WithPersist(method),
+		WithOfflineQueue(10, OfflineError, method),
+		WithRetainedCache(10, NewEncryptedPersist(retained, keys.provide, nil, nil)),
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err := c.persist.Store(sendKey(1), &PubRelPacket{PacketID: 1}); err != nil {
+		t.Fatal(err)
+	}
+	c.Destroy(true)
+
+	for _, p := range []*closablePersist{method, retained} {
+		select {
+		case n := <-p.closed:
+			if p == method && n != 1 {
+				t.Error("persist method closed before pending packets stored, count =", n)
+			}
+		case <-time.After(5 * time.Second):
+			t.Fatal("persist method not closed")
+		}
+	}
+
+	// closed only once
+	select {
+	case <-method.closed:
+		t.Error("persist method closed twice")
+	case <-time.After(100 * time.Millisecond):
+	}
+}
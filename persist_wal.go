@@ -0,0 +1,612 @@
+/*
+ * Copyright Go-IIoT (https://github.com/goiiot)
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package libmqtt
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	walSuffix = ".wal"
+
+	// frame header is the length and the crc of frame payload
+	walFrameHeaderSize = 8
+
+	// frame payload is the op, key length, key and value
+	walOpPut    = 1
+	walOpDelete = 2
+
+	// walMaxFrameSize is the max size of frame payload accepted in recovery
+	walMaxFrameSize = 1 << 28
+
+	defaultWALSegmentSize = 1 << 20
+)
+
+// castagnoliTable is the crc table of records in file persist methods
+var castagnoliTable = crc32.MakeTable(crc32.Castagnoli)
+
+// WALOptions defines the options of write-ahead log persist
+type WALOptions struct {
+	// SegmentSize is the size of a segment file in bytes, a new segment
+	// is started when the current one exceeds it, default value is 1MB
+	SegmentSize int64
+
+	// Sync is the policy to sync the log to disk,
+	// default value is PersistSyncInterval
+	Sync PersistSyncPolicy
+}
+
+// NewWALPersist creates a write-ahead log persist method with provided
+// dirPath, strategy and options, packets persisted in dirPath are
+// recovered before returning
+//
+// every Store and Delete is appended to segment files as a frame with
+// crc, torn frames at the end of log (e.g. caused by power loss)
+// are discarded in recovery, segments of deleted packets are compacted
+// when starting a new segment
+//
+// if no strategy provided (nil), then the default strategy will be used,
+// if no options provided (nil), then the default options will be used
+//
+// the returned PersistMethod implements io.Closer, Close syncs and closes
+// the log
+func NewWALPersist(dirPath string, strategy *PersistStrategy, options *WALOptions) (PersistMethod, error) {
+	w := &walPersist{
+		dirPath:  dirPath,
+		strategy: strategy,
+		entries:  make(map[string]*walEntry),
+	}
+
+	if w.strategy == nil {
+		w.strategy = defaultPersistStrategy
+	}
+
+	if options != nil {
+		w.options = *options
+	}
+
+	if w.options.SegmentSize <= 0 {
+		w.options.SegmentSize = defaultWALSegmentSize
+	}
+
+	if err := w.recover(); err != nil {
+		return nil, err
+	}
+	return w, nil
+}
+
+// walPersist is the write-ahead log persist method
+type walPersist struct {
+	dirPath  string
+	strategy *PersistStrategy
+	options  WALOptions
+
+	mu        sync.Mutex
+	entries   map[string]*walEntry
+	segments  []*walSegment // in order of id, the last one is active
+	syncTimer *time.Timer   // nil if no sync scheduled
+	err       error         // error of the last scheduled sync
+}
+
+// walEntry is the value of a key and the segment it's written in
+type walEntry struct {
+	value []byte
+	seg   *walSegment
+	size  int64 // frame size
+}
+
+type walSegment struct {
+	id   uint64
+	file *os.File // nil if segment sealed
+	size int64    // size of valid frames
+	live int64    // size of frames of live entries
+}
+
+// Name of walPersist is "WALPersist"
+func (w *walPersist) Name() string {
+	if w == nil {
+		return "<nil>"
+	}
+
+	return "WALPersist"
+}
+
+// Store a key packet pair, error happens when log access failed
+func (w *walPersist) Store(key string, p Packet) error {
+	if w == nil || p == nil {
+		return nil
+	}
+
+	return w.StoreRecord(key, NewPersistRecord(p))
+}
+
+// StoreRecord stores a key record pair, error happens when log access failed
+func (w *walPersist) StoreRecord(key string, r *PersistRecord) error {
+	if w == nil || r == nil || r.Packet == nil {
+		return nil
+	}
+
+	value := r.Bytes()
+	if value == nil {
+		return ErrEncodeBadPacket
+	}
+
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	_, exists := w.entries[key]
+	if exists && !w.strategy.DuplicateReplace {
+		return nil
+	}
+
+	if !exists && w.strategy.MaxCount > 0 && w.strategy.DropOnExceed &&
+		uint32(len(w.entries)) >= w.strategy.MaxCount {
+		// packet dropped
+		return ErrPacketDroppedByStrategy
+	}
+
+	return w.append(walOpPut, key, value)
+}
+
+// Load a packet with key, return nil, false when no packet found
+func (w *walPersist) Load(key string) (Packet, bool) {
+	r, ok := w.LoadRecord(key)
+	if !ok {
+		return nil, false
+	}
+	return r.Packet, true
+}
+
+// LoadRecord loads a record with key, return nil, false when no record found
+func (w *walPersist) LoadRecord(key string) (*PersistRecord, bool) {
+	if w == nil {
+		return nil, false
+	}
+
+	w.mu.Lock()
+	e, ok := w.entries[key]
+	w.mu.Unlock()
+	if !ok {
+		return nil, false
+	}
+
+	r, err := DecodePersistRecord(e.value)
+	if err != nil {
+		return nil, false
+	}
+	return r, true
+}
+
+// Range over all packet persisted in key order
+func (w *walPersist) Range(f func(key string, p Packet) bool) {
+	if w == nil || f == nil {
+		return
+	}
+
+	w.mu.Lock()
+	keys := make([]string, 0, len(w.entries))
+	values := make(map[string][]byte, len(w.entries))
+	for k, e := range w.entries {
+		keys = append(keys, k)
+		values[k] = e.value
+	}
+	w.mu.Unlock()
+
+	sort.Strings(keys)
+	for _, k := range keys {
+		r, err := DecodePersistRecord(values[k])
+		if err != nil {
+			continue
+		}
+
+		if !f(k, r.Packet) {
+			return
+		}
+	}
+}
+
+// Delete a persisted packet with key
+func (w *walPersist) Delete(key string) error {
+	if w == nil {
+		return nil
+	}
+
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	if _, ok := w.entries[key]; !ok {
+		return nil
+	}
+
+	return w.append(walOpDelete, key, nil)
+}
+
+// Destroy all packets persisted by removing segment files, the log
+// is still usable after destroyed
+func (w *walPersist) Destroy() error {
+	if w == nil {
+		return nil
+	}
+
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	w.stopSync()
+	for _, seg := range w.segments {
+		if seg.file != nil {
+			seg.file.Close()
+		}
+
+		if err := os.Remove(w.segmentPath(seg.id)); err != nil && !os.IsNotExist(err) {
+			return err
+		}
+	}
+
+	w.entries = make(map[string]*walEntry)
+	w.segments = nil
+	return w.createSegment(1)
+}
+
+// Close syncs and closes the log, the log should not be used after closed
+func (w *walPersist) Close() error {
+	if w == nil {
+		return nil
+	}
+
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	w.stopSync()
+	active := w.active()
+	if active == nil || active.file == nil {
+		return nil
+	}
+
+	err := active.file.Sync()
+	if cErr := active.file.Close(); err == nil {
+		err = cErr
+	}
+	active.file = nil
+	return err
+}
+
+func (w *walPersist) active() *walSegment {
+	if len(w.segments) == 0 {
+		return nil
+	}
+	return w.segments[len(w.segments)-1]
+}
+
+func (w *walPersist) segmentPath(id uint64) string {
+	return filepath.Join(w.dirPath, fmt.Sprintf("%016x%s", id, walSuffix))
+}
+
+// append the frame to the log and apply it to entries, w.mu must be held
+func (w *walPersist) append(op byte, key string, value []byte) error {
+	if err := w.err; err != nil {
+		// report error of the scheduled sync
+		w.err = nil
+		return err
+	}
+
+	active := w.active()
+	if active == nil || active.file == nil {
+		return os.ErrClosed
+	}
+
+	frame := encodeWALFrame(op, key, value)
+	if active.size > 0 && active.size+int64(len(frame)) > w.options.SegmentSize {
+		if err := w.roll(); err != nil {
+			return err
+		}
+		active = w.active()
+	}
+
+	if err := w.write(active, frame); err != nil {
+		return err
+	}
+
+	w.apply(op, key, value, active, int64(len(frame)))
+	return w.sync(active)
+}
+
+// write the frame to the segment, partially written frame is truncated
+func (w *walPersist) write(seg *walSegment, frame []byte) error {
+	if _, err := seg.file.Write(frame); err != nil {
+		// keep the log valid for frames appended later
+		seg.file.Truncate(seg.size)
+		return err
+	}
+
+	seg.size += int64(len(frame))
+	return nil
+}
+
+// apply the frame written in the segment to entries
+func (w *walPersist) apply(op byte, key string, value []byte, seg *walSegment, size int64) {
+	if old, ok := w.entries[key]; ok {
+		old.seg.live -= old.size
+		delete(w.entries, key)
+	}
+
+	if op == walOpPut {
+		w.entries[key] = &walEntry{value: value, seg: seg, size: size}
+		seg.live += size
+	}
+}
+
+// sync the segment according to the policy, w.mu must be held
+func (w *walPersist) sync(seg *walSegment) error {
+	switch {
+	case w.options.Sync == PersistSyncNever:
+		return nil
+	case w.options.Sync == PersistSyncAlways || w.strategy.Interval <= 0:
+		return seg.file.Sync()
+	case w.syncTimer == nil:
+		w.syncTimer = time.AfterFunc(w.strategy.Interval, w.scheduledSync)
+	}
+	return nil
+}
+
+func (w *walPersist) scheduledSync() {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	w.syncTimer = nil
+	if active := w.active(); active != nil && active.file != nil {
+		w.err = active.file.Sync()
+	}
+}
+
+func (w *walPersist) stopSync() {
+	if w.syncTimer != nil {
+		w.syncTimer.Stop()
+		w.syncTimer = nil
+	}
+}
+
+// roll seals the active segment, starts a new one and compacts
+// sealed segments, w.mu must be held
+func (w *walPersist) roll() error {
+	active := w.active()
+	w.stopSync()
+	if err := active.file.Sync(); err != nil {
+		return err
+	}
+	active.file.Close()
+	active.file = nil
+
+	if err := w.createSegment(active.id + 1); err != nil {
+		return err
+	}
+	return w.compact()
+}
+
+// compact sealed segments, only the oldest segments are removed, so
+// deletions in segments kept never refer to packets in removed ones
+func (w *walPersist) compact() error {
+	// segments without live entries
+	for len(w.segments) > 1 && w.segments[0].live == 0 {
+		if err := w.removeSegment(w.segments[0]); err != nil {
+			return err
+		}
+		w.segments = w.segments[1:]
+	}
+
+	sealed := w.segments[:len(w.segments)-1]
+	var size, live int64
+	for _, seg := range sealed {
+		size += seg.size
+		live += seg.live
+	}
+
+	if len(sealed) == 0 || live*2 > size {
+		return nil
+	}
+
+	// rewrite live entries of sealed segments to the active segment
+	active := w.active()
+	isSealed := make(map[*walSegment]bool, len(sealed))
+	for _, seg := range sealed {
+		isSealed[seg] = true
+	}
+
+	for key, e := range w.entries {
+		if !isSealed[e.seg] {
+			continue
+		}
+
+		frame := encodeWALFrame(walOpPut, key, e.value)
+		if err := w.write(active, frame); err != nil {
+			return err
+		}
+		w.apply(walOpPut, key, e.value, active, int64(len(frame)))
+	}
+
+	if err := active.file.Sync(); err != nil {
+		return err
+	}
+
+	for _, seg := range sealed {
+		if err := w.removeSegment(seg); err != nil {
+			return err
+		}
+	}
+	w.segments = []*walSegment{active}
+	return nil
+}
+
+func (w *walPersist) createSegment(id uint64) error {
+	if err := os.MkdirAll(w.dirPath, 0755); err != nil {
+		return err
+	}
+
+	f, err := os.OpenFile(w.segmentPath(id), os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0600)
+	if err != nil {
+		return err
+	}
+
+	w.segments = append(w.segments, &walSegment{id: id, file: f})
+	return syncDir(w.dirPath)
+}
+
+// removeSegment removes the segment file, segments are removed from the
+// oldest one, and the removal is synced before removing the next one, so
+// no deletion is lost when removed segments reappear after power loss
+func (w *walPersist) removeSegment(seg *walSegment) error {
+	if err := os.Remove(w.segmentPath(seg.id)); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	return syncDir(w.dirPath)
+}
+
+// recover entries from segment files
+func (w *walPersist) recover() error {
+	if err := os.MkdirAll(w.dirPath, 0755); err != nil {
+		return err
+	}
+
+	infos, err := ioutil.ReadDir(w.dirPath)
+	if err != nil {
+		return err
+	}
+
+	var ids []uint64
+	for _, info := range infos {
+		name := info.Name()
+		if info.IsDir() || !strings.HasSuffix(name, walSuffix) {
+			continue
+		}
+
+		id, err := strconv.ParseUint(strings.TrimSuffix(name, walSuffix), 16, 64)
+		if err != nil {
+			continue
+		}
+		ids = append(ids, id)
+	}
+	sort.Slice(ids, func(i, j int) bool { return ids[i] < ids[j] })
+
+	for _, id := range ids {
+		data, err := ioutil.ReadFile(w.segmentPath(id))
+		if err != nil {
+			return err
+		}
+
+		seg := &walSegment{id: id}
+		w.segments = append(w.segments, seg)
+
+		// frames after the first invalid one are discarded
+		for seg.size < int64(len(data)) {
+			op, key, value, n, err := decodeWALFrame(data[seg.size:])
+			if err != nil {
+				break
+			}
+
+			w.apply(op, key, value, seg, int64(n))
+			seg.size += int64(n)
+		}
+	}
+
+	if len(w.segments) == 0 {
+		return w.createSegment(1)
+	}
+
+	// reopen the last segment for appending, torn frames are truncated
+	active := w.active()
+	f, err := os.OpenFile(w.segmentPath(active.id), os.O_WRONLY|os.O_APPEND, 0600)
+	if err != nil {
+		return err
+	}
+
+	if err := f.Truncate(active.size); err != nil {
+		f.Close()
+		return err
+	}
+	active.file = f
+
+	return w.compact()
+}
+
+// encodeWALFrame encodes the frame with header
+func encodeWALFrame(op byte, key string, value []byte) []byte {
+	payloadSize := 1 + 2 + len(key) + len(value)
+	frame := make([]byte, walFrameHeaderSize+payloadSize)
+	payload := frame[walFrameHeaderSize:]
+	payload[0] = op
+	binary.BigEndian.PutUint16(payload[1:], uint16(len(key)))
+	copy(payload[3:], key)
+	copy(payload[3+len(key):], value)
+
+	binary.BigEndian.PutUint32(frame, uint32(payloadSize))
+	binary.BigEndian.PutUint32(frame[4:], crc32.Checksum(payload, castagnoliTable))
+	return frame
+}
+
+var errWALBadFrame = errors.New("bad wal frame ")
+
+// decodeWALFrame decodes the frame at the beginning of data, returns the
+// size of the frame
+func decodeWALFrame(data []byte) (op byte, key string, value []byte, n int, err error) {
+	if len(data) < walFrameHeaderSize {
+		return 0, "", nil, 0, errWALBadFrame
+	}
+
+	payloadSize := int(binary.BigEndian.Uint32(data))
+	if payloadSize < 3 || payloadSize > walMaxFrameSize || len(data)-walFrameHeaderSize < payloadSize {
+		return 0, "", nil, 0, errWALBadFrame
+	}
+
+	payload := data[walFrameHeaderSize : walFrameHeaderSize+payloadSize]
+	if crc32.Checksum(payload, castagnoliTable) != binary.BigEndian.Uint32(data[4:]) {
+		return 0, "", nil, 0, errWALBadFrame
+	}
+
+	op = payload[0]
+	keyEnd := 3 + int(binary.BigEndian.Uint16(payload[1:]))
+	if (op != walOpPut && op != walOpDelete) || keyEnd > len(payload) {
+		return 0, "", nil, 0, errWALBadFrame
+	}
+
+	if op == walOpPut {
+		value = append([]byte(nil), payload[keyEnd:]...)
+	}
+	return op, string(payload[3:keyEnd]), value, walFrameHeaderSize + payloadSize, nil
+}
+
+// syncDir syncs the directory to persist created and removed files
+func syncDir(dirPath string) error {
+	d, err := os.Open(dirPath)
+	if err != nil {
+		return err
+	}
+	defer d.Close()
+
+	// not supported on some platforms
+	d.Sync()
+	return nil
+}
@@ -0,0 +1,190 @@
+/*
+ * Copyright Go-IIoT (https://github.com/goiiot)
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package libmqtt
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strconv"
+	"testing"
+)
+
+func testWALPersist(t *testing.T, dirPath string, segmentSize int64) *walPersist {
+	p, err := NewWALPersist(dirPath, &PersistStrategy{DuplicateReplace: true}, &WALOptions{SegmentSize: segmentSize})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return p.(*walPersist)
+}
+
+func testWALSegments(t *testing.T, dirPath string) []string {
+	files, err := filepath.Glob(filepath.Join(dirPath, "*"+walSuffix))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return files
+}
+
+func testPersistCheck(t *testing.T, p PersistMethod, pkts map[string]Packet) {
+	n := 0
+	p.Range(func(key string, pkt Packet) bool {
+		n++
+		if target, ok := pkts[key]; !ok || !bytes.Equal(pkt.Bytes(), target.Bytes()) {
+			t.Error("packet mismatch, key =", key)
+		}
+		return true
+	})
+
+	if n != len(pkts) {
+		t.Error("packet count mismatch, count =", n, "target =", len(pkts))
+	}
+}
+
+func TestWALPersist_Recover(t *testing.T) {
+	dirPath := t.TempDir()
+	p := testWALPersist(t, dirPath, 0)
+
+	pkts := make(map[string]Packet)
+	for i := 0; i < 10; i++ {
+		key := sendKey(uint16(i))
+		pkts[key] = &PublishPacket{TopicName: "foo", Qos: Qos1, PacketID: uint16(i), Payload: []byte("bar")}
+		if err := p.Store(key, pkts[key]); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	for i := 0; i < 5; i++ {
+		key := sendKey(uint16(i))
+		delete(pkts, key)
+		if err := p.Delete(key); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// simulate power loss
+	p.Close()
+	testPersistCheck(t, testWALPersist(t, dirPath, 0), pkts)
+}
+
+func TestWALPersist_TornWrite(t *testing.T) {
+	pkt := &PublishPacket{TopicName: "foo", Qos: Qos1, PacketID: 1, Payload: []byte("bar")}
+	frame := encodeWALFrame(walOpPut, "S1", NewPersistRecord(pkt).Bytes())
+
+	corrupted := append([]byte(nil), frame...)
+	corrupted[len(corrupted)-1] ^= 0xFF
+
+	for name, tail := range map[string][]byte{
+		"Truncated": frame[:len(frame)-3],
+		"Header":    frame[:walFrameHeaderSize-1],
+		"CRC":       corrupted,
+	} {
+		t.Run(name, func(t *testing.T) {
+			dirPath := t.TempDir()
+			p := testWALPersist(t, dirPath, 0)
+			if err := p.Store(sendKey(2), pkt); err != nil {
+				t.Fatal(err)
+			}
+			p.Close()
+
+			segments := testWALSegments(t, dirPath)
+			f, err := os.OpenFile(segments[len(segments)-1], os.O_WRONLY|os.O_APPEND, 0600)
+			if err != nil {
+				t.Fatal(err)
+			}
+			f.Write(tail)
+			f.Close()
+
+			p = testWALPersist(t, dirPath, 0)
+			testPersistCheck(t, p, map[string]Packet{sendKey(2): pkt})
+
+			// frames appended after recovery must survive the next recovery
+			if err := p.Store(sendKey(3), pkt); err != nil {
+				t.Fatal(err)
+			}
+			p.Close()
+			testPersistCheck(t, testWALPersist(t, dirPath, 0), map[string]Packet{sendKey(2): pkt, sendKey(3): pkt})
+		})
+	}
+}
+
+func TestWALPersist_Compact(t *testing.T) {
+	dirPath := t.TempDir()
+	p := testWALPersist(t, dirPath, 256)
+
+	pkts := make(map[string]Packet)
+	kept := &PublishPacket{TopicName: "kept", Qos: Qos1, PacketID: 1, Payload: []byte("bar")}
+	pkts[sendKey(1)] = kept
+	if err := p.Store(sendKey(1), kept); err != nil {
+		t.Fatal(err)
+	}
+
+	// acknowledged packets
+	for i := 2; i < 1000; i++ {
+		key := sendKey(uint16(i))
+		pkt := &PublishPacket{TopicName: "foo/" + strconv.Itoa(i), Qos: Qos1, PacketID: uint16(i)}
+		if err := p.Store(key, pkt); err != nil {
+			t.Fatal(err)
+		}
+
+		if i%10 == 0 {
+			pkts[key] = pkt
+			continue
+		}
+
+		if err := p.Delete(key); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	var size int64
+	for _, file := range testWALSegments(t, dirPath) {
+		info, err := os.Stat(file)
+		if err != nil {
+			t.Fatal(err)
+		}
+		size += info.Size()
+	}
+
+	// live packets take less than 4KB
+	if size > 16<<10 {
+		t.Error("segments not compacted, size =", size)
+	}
+
+	p.Close()
+	testPersistCheck(t, testWALPersist(t, dirPath, 256), pkts)
+}
+
+func TestWALPersist_CorruptedSegment(t *testing.T) {
+	dirPath := t.TempDir()
+	pkt := &PublishPacket{TopicName: "foo", Qos: Qos1, PacketID: 1}
+
+	// sealed segment with a corrupted frame, frames after it are discarded
+	first := append(encodeWALFrame(walOpPut, "S1", NewPersistRecord(pkt).Bytes()), 0xFF, 0xFF, 0xFF, 0xFF, 0, 0, 0, 0)
+	first = append(first, encodeWALFrame(walOpPut, "S2", NewPersistRecord(pkt).Bytes())...)
+	second := encodeWALFrame(walOpPut, "S3", NewPersistRecord(pkt).Bytes())
+
+	if err := ioutil.WriteFile(filepath.Join(dirPath, "0000000000000001.wal"), first, 0600); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(filepath.Join(dirPath, "0000000000000002.wal"), second, 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	testPersistCheck(t, testWALPersist(t, dirPath, 0), map[string]Packet{"S1": pkt, "S3": pkt})
+}
@@ -0,0 +1,480 @@
+/*
+ * Copyright Go-IIoT (https://github.com/goiiot)
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+// Package persisttest implements conformance tests of libmqtt.PersistMethod,
+// persist methods in and out of libmqtt are expected to pass them
+//
+//	func TestMyPersist(t *testing.T) {
+//		persisttest.Run(t, func(t *testing.T, strategy *mqtt.PersistStrategy) mqtt.PersistMethod {
+//			return NewMyPersist(strategy)
+//		}, nil)
+//	}
+package persisttest
+
+import (
+	"bytes"
+	"fmt"
+	"strconv"
+	"sync"
+	"testing"
+	"time"
+
+	mqtt "github.com/goiiot/libmqtt"
+)
+
+// NewFunc creates an empty PersistMethod with the strategy, it's called
+// once per test
+type NewFunc func(t *testing.T, strategy *mqtt.PersistStrategy) mqtt.PersistMethod
+
+// Options of conformance tests
+type Options struct {
+	// Versions of packets the PersistMethod is able to persist
+	// default is MQTT 3.1.1 and MQTT 5
+	Versions []mqtt.ProtoVersion
+
+	// Intervals of PersistStrategy tested with
+	// default is 0 (persist per action) and 50ms
+	Intervals []time.Duration
+}
+
+var defaultOptions = &Options{
+	Versions:  []mqtt.ProtoVersion{mqtt.V311, mqtt.V5},
+	Intervals: []time.Duration{0, 50 * time.Millisecond},
+}
+
+// Run runs all conformance tests of the PersistMethod as subtests of t
+//
+// if no options provided (nil), then the default options will be used
+func Run(t *testing.T, newPersist NewFunc, opts *Options) {
+	if opts == nil {
+		opts = defaultOptions
+	}
+
+	versions, intervals := opts.Versions, opts.Intervals
+	if len(versions) == 0 {
+		versions = defaultOptions.Versions
+	}
+	if len(intervals) == 0 {
+		intervals = defaultOptions.Intervals
+	}
+
+	for _, interval := range intervals {
+		s := &suite{newPersist: newPersist, interval: interval, versions: versions}
+		t.Run("Interval-"+interval.String(), func(t *testing.T) {
+			t.Run("StoreLoad", s.testStoreLoad)
+			t.Run("Versions", s.testVersions)
+			t.Run("Records", s.testRecords)
+			t.Run("DuplicateReplace", s.testDuplicateReplace)
+			t.Run("Delete", s.testDelete)
+			t.Run("Range", s.testRange)
+			t.Run("MaxCount", s.testMaxCount)
+			t.Run("DropOnExceed", s.testDropOnExceed)
+			t.Run("Destroy", s.testDestroy)
+			t.Run("Concurrent", s.testConcurrent)
+		})
+	}
+}
+
+// Store stores the packet with key and fails the test on error
+func Store(t *testing.T, p mqtt.PersistMethod, key string, pkt mqtt.Packet) {
+	t.Helper()
+	if err := p.Store(key, pkt); err != nil {
+		t.Fatal("store packet failed, key =", key, "err =", err)
+	}
+}
+
+// Load loads the packet with key and fails the test if not loaded
+// or not equal to pkt
+func Load(t *testing.T, p mqtt.PersistMethod, key string, pkt mqtt.Packet) {
+	t.Helper()
+	loaded, ok := p.Load(key)
+	if !ok {
+		t.Fatal("load packet failed, key =", key)
+	}
+
+	if err := equal(loaded, pkt); err != nil {
+		t.Error("loaded packet mismatch, key =", key, "err =", err)
+	}
+}
+
+type suite struct {
+	newPersist NewFunc
+	interval   time.Duration
+	versions   []mqtt.ProtoVersion
+}
+
+func (s *suite) persist(t *testing.T, maxCount uint32, drop, replace bool) mqtt.PersistMethod {
+	p := s.newPersist(t, &mqtt.PersistStrategy{
+		Interval:         s.interval,
+		MaxCount:         maxCount,
+		DropOnExceed:     drop,
+		DuplicateReplace: replace,
+	})
+	if p == nil {
+		t.Fatal("no persist method created")
+	}
+	return p
+}
+
+// wait until packets stored with interval are persisted
+func (s *suite) wait() {
+	time.Sleep(2 * s.interval)
+}
+
+func (s *suite) testStoreLoad(t *testing.T) {
+	p := s.persist(t, 0, false, true)
+	pub := &mqtt.PublishPacket{TopicName: "foo", Qos: mqtt.Qos1, PacketID: 1, Payload: []byte("bar")}
+	sub := &mqtt.SubscribePacket{PacketID: 2, Topics: []*mqtt.Topic{{Name: "foo/#", Qos: mqtt.Qos1}}}
+	Store(t, p, "pub", pub)
+	Store(t, p, "sub", sub)
+
+	// packets are loadable before persisted
+	Load(t, p, "pub", pub)
+	Load(t, p, "sub", sub)
+	if _, ok := p.Load("none"); ok {
+		t.Error("loaded packet not stored")
+	}
+
+	s.wait()
+	Load(t, p, "pub", pub)
+	Load(t, p, "sub", sub)
+}
+
+func (s *suite) testVersions(t *testing.T) {
+	for _, version := range s.versions {
+		p := s.persist(t, 0, false, true)
+		pkts := versionPackets(version)
+		for i, pkt := range pkts {
+			Store(t, p, strconv.Itoa(i), pkt)
+		}
+
+		s.wait()
+		for i, pkt := range pkts {
+			Load(t, p, strconv.Itoa(i), pkt)
+		}
+
+		p.Range(func(key string, pkt mqtt.Packet) bool {
+			i, _ := strconv.Atoi(key)
+			if err := equal(pkt, pkts[i]); err != nil {
+				t.Error("ranged packet mismatch, key =", key, "err =", err)
+			}
+			return true
+		})
+	}
+}
+
+func (s *suite) testRecords(t *testing.T) {
+	p, ok := s.persist(t, 0, false, true).(mqtt.RecordPersistMethod)
+	if !ok {
+		t.Skip("not a RecordPersistMethod")
+	}
+
+	for _, version := range s.versions {
+		pkt := versionPackets(version)[0]
+		r := &mqtt.PersistRecord{
+			Version:   version,
+			StoreTime: time.Unix(1600000000, 1),
+			Packet:    pkt,
+		}
+		if err := p.StoreRecord("record", r); err != nil {
+			t.Fatal(err)
+		}
+
+		for i := 0; i < 2; i++ {
+			loaded, ok := p.LoadRecord("record")
+			if !ok {
+				t.Fatal("load record failed")
+			}
+
+			if loaded.Version != r.Version || !loaded.StoreTime.Equal(r.StoreTime) {
+				t.Errorf("loaded record mismatch\nLoaded: %+v\nTarget: %+v", loaded, r)
+			}
+
+			if err := equal(loaded.Packet, pkt); err != nil {
+				t.Error("loaded record packet mismatch, err =", err)
+			}
+			s.wait()
+		}
+	}
+
+	// packets stored are loaded as records
+	pkt := versionPackets(s.versions[0])[1]
+	before := time.Now()
+	Store(t, p, "packet", pkt)
+	loaded, ok := p.LoadRecord("packet")
+	if !ok {
+		t.Fatal("load record of packet failed")
+	}
+
+	if loaded.Version != pkt.Version() || loaded.StoreTime.Before(before.Add(-time.Second)) {
+		t.Errorf("record of packet mismatch, record = %+v", loaded)
+	}
+}
+
+func (s *suite) testDuplicateReplace(t *testing.T) {
+	for _, replace := range []bool{true, false} {
+		p := s.persist(t, 0, false, replace)
+		first := &mqtt.PubRelPacket{PacketID: 1}
+		second := &mqtt.PubRelPacket{PacketID: 2}
+		Store(t, p, "key", first)
+		Store(t, p, "key", second)
+
+		target := mqtt.Packet(first)
+		if replace {
+			target = second
+		}
+
+		Load(t, p, "key", target)
+		s.wait()
+		Load(t, p, "key", target)
+
+		if n := count(p); n != 1 {
+			t.Error("duplicated packet ranged, count =", n)
+		}
+	}
+}
+
+func (s *suite) testDelete(t *testing.T) {
+	p := s.persist(t, 0, false, true)
+	Store(t, p, "key", &mqtt.PubRelPacket{PacketID: 1})
+	Store(t, p, "persisted", &mqtt.PubRelPacket{PacketID: 2})
+	s.wait()
+
+	for _, key := range []string{"key", "persisted"} {
+		if err := p.Delete(key); err != nil {
+			t.Fatal(err)
+		}
+
+		if _, ok := p.Load(key); ok {
+			t.Error("loaded deleted packet, key =", key)
+		}
+	}
+
+	if err := p.Delete("none"); err != nil {
+		t.Error("delete packet not stored, err =", err)
+	}
+
+	s.wait()
+	if n := count(p); n != 0 {
+		t.Error("ranged deleted packets, count =", n)
+	}
+}
+
+func (s *suite) testRange(t *testing.T) {
+	p := s.persist(t, 0, false, true)
+	pkts := map[string]mqtt.Packet{
+		"1": &mqtt.PubRelPacket{PacketID: 1},
+		"2": &mqtt.PubRelPacket{PacketID: 2},
+		"3": &mqtt.PubRelPacket{PacketID: 3},
+	}
+	for k, pkt := range pkts {
+		Store(t, p, k, pkt)
+	}
+
+	ranged := make(map[string]mqtt.Packet)
+	p.Range(func(key string, pkt mqtt.Packet) bool {
+		ranged[key] = pkt
+		return true
+	})
+
+	if len(ranged) != len(pkts) {
+		t.Fatal("range count mismatch, count =", len(ranged))
+	}
+
+	for k, pkt := range pkts {
+		if err := equal(ranged[k], pkt); err != nil {
+			t.Error("ranged packet mismatch, key =", k, "err =", err)
+		}
+	}
+
+	n := 0
+	p.Range(func(key string, pkt mqtt.Packet) bool {
+		n++
+		return false
+	})
+
+	if n != 1 {
+		t.Error("range not stopped, count =", n)
+	}
+}
+
+func (s *suite) testMaxCount(t *testing.T) {
+	// packets are not dropped without DropOnExceed
+	p := s.persist(t, 1, false, true)
+	Store(t, p, "1", &mqtt.PubRelPacket{PacketID: 1})
+	Store(t, p, "2", &mqtt.PubRelPacket{PacketID: 2})
+	Load(t, p, "2", &mqtt.PubRelPacket{PacketID: 2})
+}
+
+func (s *suite) testDropOnExceed(t *testing.T) {
+	p := s.persist(t, 2, true, true)
+	Store(t, p, "1", &mqtt.PubRelPacket{PacketID: 1})
+	Store(t, p, "2", &mqtt.PubRelPacket{PacketID: 2})
+	if err := p.Store("3", &mqtt.PubRelPacket{PacketID: 3}); err != mqtt.ErrPacketDroppedByStrategy {
+		t.Error("packet not dropped when max count reached, err =", err)
+	}
+
+	if _, ok := p.Load("3"); ok {
+		t.Error("loaded dropped packet")
+	}
+
+	// stored packets are still replaceable
+	Store(t, p, "2", &mqtt.PubRelPacket{PacketID: 4})
+	Load(t, p, "2", &mqtt.PubRelPacket{PacketID: 4})
+
+	// deleted packets are not counted
+	s.wait()
+	for i := 0; i < 3; i++ {
+		if err := p.Delete("1"); err != nil {
+			t.Fatal(err)
+		}
+		Store(t, p, "1", &mqtt.PubRelPacket{PacketID: 1})
+	}
+	if err := p.Store("3", &mqtt.PubRelPacket{PacketID: 3}); err != mqtt.ErrPacketDroppedByStrategy {
+		t.Error("packet not dropped after delete, err =", err)
+	}
+}
+
+func (s *suite) testDestroy(t *testing.T) {
+	p := s.persist(t, 1, true, true)
+	Store(t, p, "persisted", &mqtt.PubRelPacket{PacketID: 1})
+	s.wait()
+	if err := p.Delete("persisted"); err != nil {
+		t.Fatal(err)
+	}
+	Store(t, p, "key", &mqtt.PubRelPacket{PacketID: 2})
+
+	if err := p.Destroy(); err != nil {
+		t.Fatal(err)
+	}
+
+	if n := count(p); n != 0 {
+		t.Error("ranged packets after destroy, count =", n)
+	}
+
+	s.wait()
+	if _, ok := p.Load("key"); ok {
+		t.Error("loaded packet after destroy")
+	}
+
+	// still usable with count reset after destroy
+	Store(t, p, "key", &mqtt.PubRelPacket{PacketID: 1})
+	Load(t, p, "key", &mqtt.PubRelPacket{PacketID: 1})
+}
+
+func (s *suite) testConcurrent(t *testing.T) {
+	const (
+		workers = 8
+		keys    = 16
+	)
+
+	p := s.persist(t, 0, false, true)
+	wg := &sync.WaitGroup{}
+	for w := 0; w < workers; w++ {
+		wg.Add(1)
+		go func(w int) {
+			defer wg.Done()
+
+			for i := 0; i < keys; i++ {
+				key := fmt.Sprintf("%d-%d", w, i)
+				pkt := &mqtt.PubRelPacket{PacketID: uint16(w*keys + i + 1)}
+				if err := p.Store(key, pkt); err != nil {
+					t.Error("store packet failed, key =", key, "err =", err)
+					return
+				}
+
+				if loaded, ok := p.Load(key); !ok || equal(loaded, pkt) != nil {
+					t.Error("load packet failed, key =", key)
+				}
+
+				p.Range(func(string, mqtt.Packet) bool { return true })
+
+				// delete half of packets
+				if i%2 == 1 {
+					if err := p.Delete(key); err != nil {
+						t.Error("delete packet failed, key =", key, "err =", err)
+					}
+				}
+			}
+		}(w)
+	}
+	wg.Wait()
+
+	s.wait()
+	if n := count(p); n != workers*keys/2 {
+		t.Error("range count mismatch, count =", n)
+	}
+}
+
+func count(p mqtt.PersistMethod) int {
+	n := 0
+	p.Range(func(string, mqtt.Packet) bool {
+		n++
+		return true
+	})
+	return n
+}
+
+// equal compares type, version and encoded bytes of packets
+func equal(a, b mqtt.Packet) error {
+	switch {
+	case a == nil || b == nil:
+		return fmt.Errorf("packet missing, %v != %v", a, b)
+	case a.Type() != b.Type():
+		return fmt.Errorf("type mismatch, %v != %v", a, b)
+	case a.Version() != b.Version():
+		return fmt.Errorf("version mismatch, %v != %v", a.Version(), b.Version())
+	case !bytes.Equal(a.Bytes(), b.Bytes()):
+		return fmt.Errorf("bytes mismatch, %v != %v", a, b)
+	}
+	return nil
+}
+
+// versionPackets returns packets persisted by client in the version
+func versionPackets(version mqtt.ProtoVersion) []mqtt.Packet {
+	base := mqtt.BasePacket{ProtoVersion: version}
+	pub := &mqtt.PublishPacket{
+		BasePacket: base,
+		TopicName:  "foo",
+		Qos:        mqtt.Qos2,
+		PacketID:   1,
+		Payload:    []byte("bar"),
+	}
+	pubRel := &mqtt.PubRelPacket{BasePacket: base, PacketID: 2}
+	sub := &mqtt.SubscribePacket{
+		BasePacket: base,
+		PacketID:   3,
+		Topics:     []*mqtt.Topic{{Name: "foo/#", Qos: mqtt.Qos1}},
+	}
+	unsub := &mqtt.UnSubPacket{BasePacket: base, PacketID: 4, TopicNames: []string{"foo/#"}}
+
+	if version == mqtt.V5 {
+		userProps := mqtt.UserProps{"foo": []string{"bar"}}
+		pub.Props = &mqtt.PublishProps{
+			PayloadFormat:         1,
+			MessageExpiryInterval: 60,
+			RespTopic:             "resp",
+			CorrelationData:       []byte("id"),
+			UserProps:             userProps,
+		}
+		pubRel.Code = mqtt.CodePacketIdentifierNotFound
+		pubRel.Props = &mqtt.PubRelProps{Reason: "reason", UserProps: userProps}
+		sub.Props = &mqtt.SubscribeProps{SubID: 1, UserProps: userProps}
+		unsub.Props = &mqtt.UnSubProps{UserProps: userProps}
+	}
+
+	return []mqtt.Packet{pub, pubRel, sub, unsub}
+}
@@ -16,7 +16,7 @@
 
 package libmqtt
 
-import "bytes"
+import "fmt"
 
 // AuthPacket Client <-> Server
 // as part of an extended authentication exchange,
@@ -27,7 +27,7 @@ import "bytes"
 // same Authentication Method
 type AuthPacket struct {
 	BasePacket
-	Code  byte       // the authentication result code
+	Code  ReasonCode // the authentication result code
 	Props *AuthProps // authentication properties
 }
 
@@ -36,14 +36,21 @@ func (a *AuthPacket) Type() CtrlType {
 	return CtrlAuth
 }
 
+// String is the concise summary of the packet
+func (a *AuthPacket) String() string {
+	if a == nil {
+		return "<nil>"
+	}
+
+	return fmt.Sprintf("Auth{Code: %v}", a.Code)
+}
+
 func (a *AuthPacket) Bytes() []byte {
 	if a == nil {
 		return nil
 	}
 
-	w := &bytes.Buffer{}
-	a.WriteTo(w)
-	return w.Bytes()
+	return encodeBytes(a)
 }
 
 func (a *AuthPacket) WriteTo(w BufferedWriter) error {
@@ -51,20 +58,16 @@ func (a *AuthPacket) WriteTo(w BufferedWriter) error {
 		return ErrEncodeBadPacket
 	}
 
-	w.WriteByte(byte(CtrlAuth << 4))
-	props := a.Props.props()
+	props := encodeProps(a.Props)
+	defer putEncodeBuf(props)
 
-	tmpBuf := &bytes.Buffer{}
-	writeVarInt(len(props), tmpBuf)
-
-	if err := writeVarInt(len(props)+1+tmpBuf.Len(), w); err != nil {
+	w.WriteByte(byte(CtrlAuth << 4))
+	if err := writeVarInt(propsLen(props)+1, w); err != nil {
 		return err
 	}
 
-	w.WriteByte(a.Code)
-	tmpBuf.WriteTo(w)
-	_, err := w.Write(props)
-	return err
+	w.WriteByte(byte(a.Code))
+	return writeProps(w, props)
 }
 
 // AuthProps properties of AuthPacket
@@ -75,52 +78,40 @@ type AuthProps struct {
 	UserProps  UserProps
 }
 
-func (a *AuthProps) props() []byte {
+func (a *AuthProps) writeProps(w BufferedWriter) {
 	if a == nil {
-		return nil
+		return
 	}
 
-	result := make([]byte, 0)
 	if a.AuthMethod != "" {
-		result = append(result, propKeyAuthMethod)
-		result = append(result, encodeStringWithLen(a.AuthMethod)...)
+		w.WriteByte(propKeyAuthMethod)
+		writeStringData(w, a.AuthMethod)
 	}
 
 	if a.AuthData != nil {
-		result = append(result, propKeyAuthData)
-		result = append(result, encodeBytesWithLen(a.AuthData)...)
+		w.WriteByte(propKeyAuthData)
+		writeBinaryData(w, a.AuthData)
 	}
 
 	if a.Reason != "" {
-		result = append(result, propKeyReasonString)
-		result = append(result, encodeStringWithLen(a.Reason)...)
+		w.WriteByte(propKeyReasonString)
+		writeStringData(w, a.Reason)
 	}
 
 	if a.UserProps != nil {
-		result = a.UserProps.encodeTo(result)
+		a.UserProps.writeTo(w)
 	}
-
-	return result
 }
 
-func (a *AuthProps) setProps(props map[byte][]byte) {
-	if a == nil {
-		return
-	}
-
-	if v, ok := props[propKeyAuthMethod]; ok {
+func (a *AuthProps) setProp(key byte, v []byte) {
+	switch key {
+	case propKeyAuthMethod:
 		a.AuthMethod, _, _ = getStringData(v)
-	}
-
-	if v, ok := props[propKeyAuthData]; ok {
-		a.AuthData, _, _ = getBinaryData(v)
-	}
-
-	if v, ok := props[propKeyReasonString]; ok {
+	case propKeyAuthData:
+		a.AuthData = copyBinaryData(v)
+	case propKeyReasonString:
 		a.Reason, _, _ = getStringData(v)
-	}
-
-	if v, ok := props[propKeyUserProps]; ok {
-		a.UserProps = getUserProps(v)
+	case propKeyUserProps:
+		a.UserProps = appendUserProps(a.UserProps, v)
 	}
 }
@@ -56,7 +56,7 @@ var (
 func initTestData_Auth() {
 	buf := &bytes.Buffer{}
 	buf.Write([]byte{0xF0}) // fixed header
-	varHeader := []byte{CodeContinueAuth}
+	varHeader := []byte{byte(CodeContinueAuth)}
 
 	tmpBuf := &bytes.Buffer{}
 	writeVarInt(len(testAuthPropsBytes), tmpBuf)
@@ -73,7 +73,10 @@ func TestAuthPacket_Bytes(t *testing.T) {
 }
 
 func TestAuthProps_Props(t *testing.T) {
-	propsBytes := testAuthMsg.Props.props()
+	buf := encodeProps(testAuthMsg.Props)
+	defer putEncodeBuf(buf)
+
+	propsBytes := buf.Bytes()
 	if bytes.Compare(propsBytes, testAuthPropsBytes) != 0 {
 		t.Errorf("auth props bytes not math:\ntarget: %v\ngenerated: %v", testAuthPropsBytes, propsBytes)
 	}
@@ -81,7 +84,9 @@ func TestAuthProps_Props(t *testing.T) {
 
 func TestAuthProps_SetProps(t *testing.T) {
 	emptyProps := &AuthProps{}
-	emptyProps.setProps(testProps)
+	for k, v := range testProps {
+		emptyProps.setProp(k, v)
+	}
 
 	if emptyProps.AuthMethod != testAuthMsg.Props.AuthMethod {
 		t.Error("auth method set failed")
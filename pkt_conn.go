@@ -16,7 +16,7 @@
 
 package libmqtt
 
-import "bytes"
+import "fmt"
 
 // ConnPacket is the first packet sent by Client to Server
 type ConnPacket struct {
@@ -47,14 +47,30 @@ func (c *ConnPacket) Type() CtrlType {
 	return CtrlConn
 }
 
+// String is the concise summary of the packet
+func (c *ConnPacket) String() string {
+	if c == nil {
+		return "<nil>"
+	}
+
+	s := fmt.Sprintf("Connect{Version: %d, ClientID: %q, CleanSession: %v, Keepalive: %d",
+		c.Version(), c.ClientID, c.CleanSession, c.Keepalive)
+	if c.IsWill {
+		s += fmt.Sprintf(", Will: %q (Qos: %d, Retain: %v, %d bytes)", c.WillTopic, c.WillQos, c.WillRetain, len(c.WillMessage))
+	}
+
+	if c.Username != "" {
+		s += fmt.Sprintf(", Username: %q", c.Username)
+	}
+	return s + "}"
+}
+
 func (c *ConnPacket) Bytes() []byte {
 	if c == nil {
 		return nil
 	}
 
-	w := &bytes.Buffer{}
-	c.WriteTo(w)
-	return w.Bytes()
+	return encodeBytes(c)
 }
 
 func (c *ConnPacket) WriteTo(w BufferedWriter) error {
@@ -65,43 +81,36 @@ func (c *ConnPacket) WriteTo(w BufferedWriter) error {
 	switch c.ProtoVersion {
 	case 0, V311:
 		w.WriteByte(byte(CtrlConn << 4))
-		payload := c.payload()
-		if err := writeVarInt(len(payload)+10, w); err != nil {
+		if err := writeVarInt(c.payloadLen()+10, w); err != nil {
 			return err
 		}
-		w.Write(mqtt)
-		w.WriteByte(byte(V311))
-		w.WriteByte(c.flags())
-		w.WriteByte(byte(c.Keepalive >> 8))
-		w.WriteByte(byte(c.Keepalive))
-		_, err := w.Write(payload)
-		return err
-	case V5:
-		w.WriteByte(byte(CtrlConn << 4))
 
-		props := c.Props.props()
-		propLen := len(props)
-		payload := c.payload()
+		c.writeVarHeader(w, V311)
+		return c.writePayload(w)
+	case V5:
+		props := encodeProps(c.Props)
+		defer putEncodeBuf(props)
 
-		if err := writeVarInt(len(payload)+propLen+10, w); err != nil {
+		w.WriteByte(byte(CtrlConn << 4))
+		if err := writeVarInt(c.payloadLen()+propsLen(props)+10, w); err != nil {
 			return err
 		}
-		w.Write(mqtt)
-		w.WriteByte(byte(V5))
-		w.WriteByte(c.flags())
-		w.WriteByte(byte(c.Keepalive >> 8))
-		w.WriteByte(byte(c.Keepalive))
-
-		writeVarInt(propLen, w)
-		w.Write(props)
 
-		_, err := w.Write(payload)
-		return err
+		c.writeVarHeader(w, V5)
+		writeProps(w, props)
+		return c.writePayload(w)
 	default:
 		return ErrUnsupportedVersion
 	}
 }
 
+func (c *ConnPacket) writeVarHeader(w BufferedWriter, version ProtoVersion) {
+	w.Write(mqtt)
+	w.WriteByte(byte(version))
+	w.WriteByte(c.flags())
+	writeUint16(w, c.Keepalive)
+}
+
 func (c *ConnPacket) flags() byte {
 	var flag byte
 	if c.ClientID == "" {
@@ -132,25 +141,45 @@ func (c *ConnPacket) flags() byte {
 	return flag
 }
 
-func (c *ConnPacket) payload() []byte {
+func (c *ConnPacket) payloadLen() int {
+	// client id
+	n := 2 + len(c.ClientID)
+
+	// will topic and message
+	if c.IsWill {
+		n += 4 + len(c.WillTopic) + len(c.WillMessage)
+	}
+
+	if c.Username != "" {
+		n += 2 + len(c.Username)
+	}
+
+	if c.Password != "" {
+		n += 2 + len(c.Password)
+	}
+
+	return n
+}
+
+func (c *ConnPacket) writePayload(w BufferedWriter) error {
 	// client id
-	result := encodeStringWithLen(c.ClientID)
+	err := writeStringData(w, c.ClientID)
 
 	// will topic and message
 	if c.IsWill {
-		result = append(result, encodeStringWithLen(c.WillTopic)...)
-		result = append(result, encodeBytesWithLen(c.WillMessage)...)
+		writeStringData(w, c.WillTopic)
+		err = writeBinaryData(w, c.WillMessage)
 	}
 
 	if c.Username != "" {
-		result = append(result, encodeStringWithLen(c.Username)...)
+		err = writeStringData(w, c.Username)
 	}
 
 	if c.Password != "" {
-		result = append(result, encodeStringWithLen(c.Password)...)
+		err = writeStringData(w, c.Password)
 	}
 
-	return result
+	return err
 }
 
 // ConnProps defines connect packet properties
@@ -204,100 +233,80 @@ type ConnProps struct {
 	AuthData []byte
 }
 
-func (c *ConnProps) props() []byte {
+func (c *ConnProps) writeProps(w BufferedWriter) {
 	if c == nil {
-		return nil
+		return
 	}
 
-	result := make([]byte, 0)
 	if c.SessionExpiryInterval != 0 {
-		data := []byte{propKeySessionExpiryInterval, 0, 0, 0, 0}
-		putUint32(data[1:], c.SessionExpiryInterval)
-		result = append(result, data...)
+		w.WriteByte(propKeySessionExpiryInterval)
+		writeUint32(w, c.SessionExpiryInterval)
 	}
 
 	if c.MaxRecv != 0 {
-		data := []byte{propKeyMaxRecv, 0, 0}
-		putUint16(data[1:], c.MaxRecv)
-		result = append(result, data...)
+		w.WriteByte(propKeyMaxRecv)
+		writeUint16(w, c.MaxRecv)
 	}
 
 	if c.MaxPacketSize != 0 {
-		data := []byte{propKeyMaxPacketSize, 0, 0, 0, 0}
-		putUint32(data[1:], c.MaxPacketSize)
-		result = append(result, data...)
+		w.WriteByte(propKeyMaxPacketSize)
+		writeUint32(w, c.MaxPacketSize)
 	}
 
 	if c.MaxTopicAlias != 0 {
-		data := []byte{propKeyMaxTopicAlias, 0, 0}
-		putUint16(data[1:], c.MaxTopicAlias)
-		result = append(result, data...)
+		w.WriteByte(propKeyMaxTopicAlias)
+		writeUint16(w, c.MaxTopicAlias)
 	}
 
 	if c.ReqRespInfo {
-		result = append(result, propKeyReqRespInfo, 1)
+		w.WriteByte(propKeyReqRespInfo)
+		w.WriteByte(1)
 	}
 
 	if c.ReqProblemInfo {
-		result = append(result, propKeyReqProblemInfo, 1)
+		w.WriteByte(propKeyReqProblemInfo)
+		w.WriteByte(1)
 	}
 
 	if c.UserProps != nil {
-		c.UserProps.encodeTo(result)
+		c.UserProps.writeTo(w)
 	}
 
 	if c.AuthMethod != "" {
-		result = append(result, propKeyAuthMethod)
-		result = append(result, encodeStringWithLen(c.AuthMethod)...)
+		w.WriteByte(propKeyAuthMethod)
+		writeStringData(w, c.AuthMethod)
 	}
 
 	if c.AuthData != nil {
-		result = append(result, propKeyAuthData)
-		result = append(result, encodeBytesWithLen(c.AuthData)...)
+		w.WriteByte(propKeyAuthData)
+		writeBinaryData(w, c.AuthData)
 	}
-
-	return result
 }
 
-func (c *ConnProps) setProps(props map[byte][]byte) {
-	if c == nil {
-		return
-	}
-
-	if v, ok := props[propKeySessionExpiryInterval]; ok {
+func (c *ConnProps) setProp(key byte, v []byte) {
+	switch key {
+	case propKeySessionExpiryInterval:
 		c.SessionExpiryInterval = getUint32(v)
-	}
-
-	if v, ok := props[propKeyMaxRecv]; ok {
+	case propKeyMaxRecv:
 		c.MaxRecv = getUint16(v)
-	}
-
-	if v, ok := props[propKeyMaxPacketSize]; ok {
+	case propKeyMaxPacketSize:
 		c.MaxPacketSize = getUint32(v)
-	}
-
-	if v, ok := props[propKeyMaxTopicAlias]; ok {
+	case propKeyMaxTopicAlias:
 		c.MaxTopicAlias = getUint16(v)
-	}
-
-	if v, ok := props[propKeyReqRespInfo]; ok && len(v) == 1 {
-		c.ReqRespInfo = v[0] == 1
-	}
-
-	if v, ok := props[propKeyReqProblemInfo]; ok && len(v) == 1 {
-		c.ReqProblemInfo = v[0] == 1
-	}
-
-	if v, ok := props[propKeyUserProps]; ok {
-		c.UserProps = getUserProps(v)
-	}
-
-	if v, ok := props[propKeyAuthMethod]; ok {
+	case propKeyReqRespInfo:
+		if len(v) == 1 {
+			c.ReqRespInfo = v[0] == 1
+		}
+	case propKeyReqProblemInfo:
+		if len(v) == 1 {
+			c.ReqProblemInfo = v[0] == 1
+		}
+	case propKeyUserProps:
+		c.UserProps = appendUserProps(c.UserProps, v)
+	case propKeyAuthMethod:
 		c.AuthMethod, _, _ = getStringData(v)
-	}
-
-	if v, ok := props[propKeyAuthData]; ok {
-		c.AuthData, _, _ = getBinaryData(v)
+	case propKeyAuthData:
+		c.AuthData = copyBinaryData(v)
 	}
 }
 
@@ -308,7 +317,7 @@ func (c *ConnProps) setProps(props map[byte][]byte) {
 type ConnAckPacket struct {
 	BasePacket
 	Present bool
-	Code    byte
+	Code    ReasonCode
 	Props   *ConnAckProps
 }
 
@@ -317,14 +326,21 @@ func (c *ConnAckPacket) Type() CtrlType {
 	return CtrlConnAck
 }
 
+// String is the concise summary of the packet
+func (c *ConnAckPacket) String() string {
+	if c == nil {
+		return "<nil>"
+	}
+
+	return fmt.Sprintf("ConnAck{Present: %v, Code: %v}", c.Present, c.Code)
+}
+
 func (c *ConnAckPacket) Bytes() []byte {
 	if c == nil {
 		return nil
 	}
 
-	w := &bytes.Buffer{}
-	c.WriteTo(w)
-	return w.Bytes()
+	return encodeBytes(c)
 }
 
 func (c *ConnAckPacket) WriteTo(w BufferedWriter) error {
@@ -337,23 +353,19 @@ func (c *ConnAckPacket) WriteTo(w BufferedWriter) error {
 		w.WriteByte(byte(CtrlConnAck << 4))
 		w.WriteByte(2)
 		w.WriteByte(boolToByte(c.Present))
-		return w.WriteByte(c.Code)
+		return w.WriteByte(byte(c.Code))
 	case V5:
-		w.WriteByte(byte(CtrlConnAck << 4))
+		props := encodeProps(c.Props)
+		defer putEncodeBuf(props)
 
-		props := c.Props.props()
-		propLen := len(props)
-
-		if err := writeVarInt(propLen+2, w); err != nil {
+		w.WriteByte(byte(CtrlConnAck << 4))
+		if err := writeVarInt(propsLen(props)+2, w); err != nil {
 			return err
 		}
 
 		w.WriteByte(boolToByte(c.Present))
-		w.WriteByte(c.Code)
-
-		writeVarInt(propLen, w)
-		_, err := w.Write(props)
-		return err
+		w.WriteByte(byte(c.Code))
+		return writeProps(w, props)
 	default:
 		return ErrUnsupportedVersion
 	}
@@ -440,158 +452,134 @@ type ConnAckProps struct {
 	AuthData []byte
 }
 
-func (c *ConnAckProps) props() []byte {
+func (c *ConnAckProps) writeProps(w BufferedWriter) {
 	if c == nil {
-		return nil
+		return
 	}
 
-	result := make([]byte, 0)
 	if c.SessionExpiryInterval != 0 {
-		data := []byte{propKeySessionExpiryInterval, 0, 0, 0, 0}
-		putUint32(data[1:], c.SessionExpiryInterval)
-		result = append(result, data...)
+		w.WriteByte(propKeySessionExpiryInterval)
+		writeUint32(w, c.SessionExpiryInterval)
 	}
 
 	if c.MaxRecv != 0 {
-		data := []byte{propKeyMaxRecv, 0, 0}
-		putUint16(data[1:], c.MaxRecv)
-		result = append(result, data...)
+		w.WriteByte(propKeyMaxRecv)
+		writeUint16(w, c.MaxRecv)
 	}
 
 	if c.MaxQos != Qos2 {
-		result = append(result, propKeyMaxQos, c.MaxQos)
+		w.WriteByte(propKeyMaxQos)
+		w.WriteByte(c.MaxQos)
 	}
 
 	if c.RetainAvail {
-		result = append(result, propKeyRetainAvail, 1)
+		w.WriteByte(propKeyRetainAvail)
+		w.WriteByte(1)
 	}
 
 	if c.MaxPacketSize != 0 {
-		data := []byte{propKeyMaxPacketSize, 0, 0, 0, 0}
-		putUint32(data[1:], c.MaxPacketSize)
-		result = append(result, data...)
+		w.WriteByte(propKeyMaxPacketSize)
+		writeUint32(w, c.MaxPacketSize)
 	}
 
 	if c.AssignedClientID != "" {
-		result = append(result, propKeyAssignedClientID)
-		result = append(result, encodeStringWithLen(c.AssignedClientID)...)
+		w.WriteByte(propKeyAssignedClientID)
+		writeStringData(w, c.AssignedClientID)
 	}
 
 	if c.MaxTopicAlias != 0 {
-		data := []byte{propKeyMaxTopicAlias, 0, 0}
-		putUint16(data[1:], c.MaxTopicAlias)
-		result = append(result, data...)
+		w.WriteByte(propKeyMaxTopicAlias)
+		writeUint16(w, c.MaxTopicAlias)
 	}
 
 	if c.Reason != "" {
-		result = append(result, propKeyReasonString)
-		result = append(result, encodeStringWithLen(c.Reason)...)
+		w.WriteByte(propKeyReasonString)
+		writeStringData(w, c.Reason)
 	}
 
 	if c.UserProps != nil {
-		c.UserProps.encodeTo(result)
+		c.UserProps.writeTo(w)
 	}
 
 	if c.WildcardSubAvail {
-		result = append(result, propKeyWildcardSubAvail, 1)
+		w.WriteByte(propKeyWildcardSubAvail)
+		w.WriteByte(1)
 	}
 
 	if c.SubIDAvail {
-		result = append(result, propKeySubIDAvail, 1)
+		w.WriteByte(propKeySubIDAvail)
+		w.WriteByte(1)
 	}
 
 	if c.SharedSubAvail {
-		result = append(result, propKeySharedSubAvail, 1)
+		w.WriteByte(propKeySharedSubAvail)
+		w.WriteByte(1)
 	}
 
 	if c.ServerKeepalive != 0 {
-		data := []byte{propKeyServerKeepalive, 0, 0}
-		putUint16(data[1:], c.ServerKeepalive)
-		result = append(result, data...)
+		w.WriteByte(propKeyServerKeepalive)
+		writeUint16(w, c.ServerKeepalive)
 	}
 
 	if c.RespInfo != "" {
-		result = append(result, propKeyRespInfo)
-		result = append(result, encodeStringWithLen(c.RespInfo)...)
+		w.WriteByte(propKeyRespInfo)
+		writeStringData(w, c.RespInfo)
 	}
 
 	if c.ServerRef != "" {
-		result = append(result, propKeyServerRef)
-		result = append(result, encodeStringWithLen(c.ServerRef)...)
+		w.WriteByte(propKeyServerRef)
+		writeStringData(w, c.ServerRef)
 	}
 
 	if c.AuthMethod != "" {
-		result = append(result, propKeyAuthMethod)
-		result = append(result, encodeStringWithLen(c.AuthMethod)...)
+		w.WriteByte(propKeyAuthMethod)
+		writeStringData(w, c.AuthMethod)
 	}
 
 	if c.AuthData != nil {
-		result = append(result, propKeyAuthData)
-		result = append(result, encodeBytesWithLen(c.AuthData)...)
+		w.WriteByte(propKeyAuthData)
+		writeBinaryData(w, c.AuthData)
 	}
-
-	return result
 }
 
-func (c *ConnAckProps) setProps(props map[byte][]byte) {
-	if v, ok := props[propKeySessionExpiryInterval]; ok {
+func (c *ConnAckProps) setProp(key byte, v []byte) {
+	switch key {
+	case propKeySessionExpiryInterval:
 		c.SessionExpiryInterval = getUint32(v)
-	}
-
-	if v, ok := props[propKeyMaxRecv]; ok {
+	case propKeyMaxRecv:
 		c.MaxRecv = getUint16(v)
-	}
-
-	if v, ok := props[propKeyMaxQos]; ok && len(v) == 1 {
-		c.MaxQos = v[0]
-	}
-
-	if v, ok := props[propKeyRetainAvail]; ok && len(v) == 1 {
-		c.RetainAvail = v[0] == 1
-	}
-
-	if v, ok := props[propKeyMaxPacketSize]; ok {
+	case propKeyMaxQos:
+		if len(v) == 1 {
+			c.MaxQos = v[0]
+		}
+	case propKeyRetainAvail:
+		if len(v) == 1 {
+			c.RetainAvail = v[0] == 1
+		}
+	case propKeyMaxPacketSize:
 		c.MaxPacketSize = getUint32(v)
-	}
-
-	if v, ok := props[propKeyAssignedClientID]; ok {
+	case propKeyAssignedClientID:
 		c.AssignedClientID, _, _ = getStringData(v)
-	}
-
-	if v, ok := props[propKeyMaxTopicAlias]; ok {
+	case propKeyMaxTopicAlias:
 		c.MaxTopicAlias = getUint16(v)
-	}
-
-	if v, ok := props[propKeyReasonString]; ok {
+	case propKeyReasonString:
 		c.Reason, _, _ = getStringData(v)
-	}
-
-	if v, ok := props[propKeyUserProps]; ok {
-		c.UserProps = getUserProps(v)
-	}
-
-	if v, ok := props[propKeyWildcardSubAvail]; ok && len(v) == 1 {
-		c.WildcardSubAvail = v[0] == 1
-	}
-
-	if v, ok := props[propKeyServerKeepalive]; ok {
+	case propKeyUserProps:
+		c.UserProps = appendUserProps(c.UserProps, v)
+	case propKeyWildcardSubAvail:
+		if len(v) == 1 {
+			c.WildcardSubAvail = v[0] == 1
+		}
+	case propKeyServerKeepalive:
 		c.ServerKeepalive = getUint16(v)
-	}
-
-	if v, ok := props[propKeyRespInfo]; ok {
+	case propKeyRespInfo:
 		c.RespInfo, _, _ = getStringData(v)
-	}
-
-	if v, ok := props[propKeyServerRef]; ok {
+	case propKeyServerRef:
 		c.ServerRef, _, _ = getStringData(v)
-	}
-
-	if v, ok := props[propKeyAuthMethod]; ok {
+	case propKeyAuthMethod:
 		c.AuthMethod, _, _ = getStringData(v)
-	}
-
-	if v, ok := props[propKeyAuthData]; ok {
-		c.AuthData, _, _ = getBinaryData(v)
+	case propKeyAuthData:
+		c.AuthData = copyBinaryData(v)
 	}
 }
 
@@ -599,7 +587,7 @@ func (c *ConnAckProps) setProps(props map[byte][]byte) {
 // It indicates that the Client is disconnecting cleanly.
 type DisConnPacket struct {
 	BasePacket
-	Code  byte
+	Code  ReasonCode
 	Props *DisConnProps
 }
 
@@ -608,14 +596,21 @@ func (d *DisConnPacket) Type() CtrlType {
 	return CtrlDisConn
 }
 
+// String is the concise summary of the packet
+func (d *DisConnPacket) String() string {
+	if d == nil {
+		return "<nil>"
+	}
+
+	return fmt.Sprintf("DisConn{Code: %v}", d.Code)
+}
+
 func (d *DisConnPacket) Bytes() []byte {
 	if d == nil {
 		return nil
 	}
 
-	w := &bytes.Buffer{}
-	d.WriteTo(w)
-	return w.Bytes()
+	return encodeBytes(d)
 }
 
 func (d *DisConnPacket) WriteTo(w BufferedWriter) error {
@@ -628,20 +623,16 @@ func (d *DisConnPacket) WriteTo(w BufferedWriter) error {
 		w.WriteByte(byte(CtrlDisConn << 4))
 		return w.WriteByte(0x00)
 	case V5:
-		w.WriteByte(byte(CtrlDisConn << 4))
-		props := d.Props.props()
+		props := encodeProps(d.Props)
+		defer putEncodeBuf(props)
 
-		tmpBuf := &bytes.Buffer{}
-		writeVarInt(len(props), tmpBuf)
-
-		if err := writeVarInt(len(props)+1+tmpBuf.Len(), w); err != nil {
+		w.WriteByte(byte(CtrlDisConn << 4))
+		if err := writeVarInt(propsLen(props)+1, w); err != nil {
 			return err
 		}
 
-		w.WriteByte(d.Code)
-		tmpBuf.WriteTo(w)
-		_, err := w.Write(props)
-		return err
+		w.WriteByte(byte(d.Code))
+		return writeProps(w, props)
 	default:
 		return ErrUnsupportedVersion
 	}
@@ -665,53 +656,40 @@ type DisConnProps struct {
 	ServerRef string
 }
 
-func (d *DisConnProps) props() []byte {
+func (d *DisConnProps) writeProps(w BufferedWriter) {
 	if d == nil {
-		return nil
+		return
 	}
 
-	result := make([]byte, 0)
 	if d.SessionExpiryInterval != 0 {
-		data := []byte{propKeySessionExpiryInterval, 0, 0, 0, 0}
-		putUint32(data[1:], d.SessionExpiryInterval)
-		result = append(result, data...)
+		w.WriteByte(propKeySessionExpiryInterval)
+		writeUint32(w, d.SessionExpiryInterval)
 	}
 
 	if d.Reason != "" {
-		result = append(result, propKeyReasonString)
-		result = append(result, encodeStringWithLen(d.Reason)...)
+		w.WriteByte(propKeyReasonString)
+		writeStringData(w, d.Reason)
 	}
 
 	if d.UserProps != nil {
-		d.UserProps.encodeTo(result)
+		d.UserProps.writeTo(w)
 	}
 
 	if d.ServerRef != "" {
-		result = append(result, propKeyServerRef)
-		result = append(result, encodeStringWithLen(d.ServerRef)...)
+		w.WriteByte(propKeyServerRef)
+		writeStringData(w, d.ServerRef)
 	}
-
-	return result
 }
 
-func (d *DisConnProps) setProps(props map[byte][]byte) {
-	if d == nil {
-		return
-	}
-
-	if v, ok := props[propKeySessionExpiryInterval]; ok {
+func (d *DisConnProps) setProp(key byte, v []byte) {
+	switch key {
+	case propKeySessionExpiryInterval:
 		d.SessionExpiryInterval = getUint32(v)
-	}
-
-	if v, ok := props[propKeyReasonString]; ok {
+	case propKeyReasonString:
 		d.Reason, _, _ = getStringData(v)
-	}
-
-	if v, ok := props[propKeyUserProps]; ok {
-		d.UserProps = getUserProps(v)
-	}
-
-	if v, ok := props[propKeyServerRef]; ok {
+	case propKeyUserProps:
+		d.UserProps = appendUserProps(d.UserProps, v)
+	case propKeyServerRef:
 		d.ServerRef, _, _ = getStringData(v)
 	}
 }
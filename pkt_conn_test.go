@@ -107,7 +107,7 @@ func initTestData_Conn() {
 	// connack
 	connackPkt := std.NewControlPacket(std.Connack).(*std.ConnackPacket)
 	connackPkt.SessionPresent = testConnackPresent
-	connackPkt.ReturnCode = testConnackCode
+	connackPkt.ReturnCode = byte(testConnackCode)
 	connAckBuf := &bytes.Buffer{}
 	connackPkt.Write(connAckBuf)
 	testConnAckMsgBytesV311 = connAckBuf.Bytes()
@@ -0,0 +1,242 @@
+/*
+ * Copyright Go-IIoT (https://github.com/goiiot)
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package libmqtt
+
+import (
+	"encoding/json"
+)
+
+// packets are encoded to JSON objects with their type names in the "Type"
+// field, properties and other fields are encoded with encoding/json defaults,
+// binary data (e.g. Payload, CorrelationData) are encoded as base64 strings,
+// secrets of ConnPacket (Password and Props.AuthData) are not encoded
+//
+// use UnmarshalPacketJSON to decode packets of unknown type
+
+// UnmarshalPacketJSON decodes the packet encoded by json.Marshal,
+// the packet type is determined by the "Type" field
+func UnmarshalPacketJSON(data []byte) (Packet, error) {
+	var t struct {
+		Type string
+	}
+	if err := json.Unmarshal(data, &t); err != nil {
+		return nil, err
+	}
+
+	var pkt Packet
+	switch t.Type {
+	case ctrlTypeName(CtrlConn):
+		pkt = &ConnPacket{}
+	case ctrlTypeName(CtrlConnAck):
+		pkt = &ConnAckPacket{}
+	case ctrlTypeName(CtrlPublish):
+		pkt = &PublishPacket{}
+	case ctrlTypeName(CtrlPubAck):
+		pkt = &PubAckPacket{}
+	case ctrlTypeName(CtrlPubRecv):
+		pkt = &PubRecvPacket{}
+	case ctrlTypeName(CtrlPubRel):
+		pkt = &PubRelPacket{}
+	case ctrlTypeName(CtrlPubComp):
+		pkt = &PubCompPacket{}
+	case ctrlTypeName(CtrlSubscribe):
+		pkt = &SubscribePacket{}
+	case ctrlTypeName(CtrlSubAck):
+		pkt = &SubAckPacket{}
+	case ctrlTypeName(CtrlUnSub):
+		pkt = &UnSubPacket{}
+	case ctrlTypeName(CtrlUnSubAck):
+		pkt = &UnSubAckPacket{}
+	case ctrlTypeName(CtrlDisConn):
+		pkt = &DisConnPacket{}
+	case ctrlTypeName(CtrlAuth):
+		pkt = &AuthPacket{}
+	case ctrlTypeName(CtrlPingReq):
+		return PingReqPacket, nil
+	case ctrlTypeName(CtrlPingResp):
+		return PingRespPacket, nil
+	default:
+		return nil, ErrDecodeBadPacket
+	}
+
+	if err := json.Unmarshal(data, pkt); err != nil {
+		return nil, err
+	}
+	return pkt, nil
+}
+
+// marshalPacketJSON encodes v (the packet in type without MarshalJSON method)
+// with the type name
+func marshalPacketJSON(t CtrlType, v interface{}) ([]byte, error) {
+	data, err := json.Marshal(v)
+	if err != nil {
+		return nil, err
+	}
+
+	typeField := `{"Type":"` + ctrlTypeName(t) + `"`
+	if len(data) == 2 {
+		// empty object
+		return []byte(typeField + "}"), nil
+	}
+	return append([]byte(typeField+","), data[1:]...), nil
+}
+
+// MarshalJSON encodes the packet with the type name,
+// Password and Props.AuthData are omitted as String does
+func (c *ConnPacket) MarshalJSON() ([]byte, error) {
+	if c == nil {
+		return []byte("null"), nil
+	}
+
+	type packet ConnPacket
+	redacted := *c
+	redacted.Password = ""
+	if c.Props != nil && c.Props.AuthData != nil {
+		props := *c.Props
+		props.AuthData = nil
+		redacted.Props = &props
+	}
+	return marshalPacketJSON(CtrlConn, (*packet)(&redacted))
+}
+
+// MarshalJSON encodes the packet with the type name
+func (c *ConnAckPacket) MarshalJSON() ([]byte, error) {
+	if c == nil {
+		return []byte("null"), nil
+	}
+
+	type packet ConnAckPacket
+	return marshalPacketJSON(CtrlConnAck, (*packet)(c))
+}
+
+// MarshalJSON encodes the packet with the type name
+func (p *PublishPacket) MarshalJSON() ([]byte, error) {
+	if p == nil {
+		return []byte("null"), nil
+	}
+
+	type packet PublishPacket
+	return marshalPacketJSON(CtrlPublish, (*packet)(p))
+}
+
+// MarshalJSON encodes the packet with the type name
+func (p *PubAckPacket) MarshalJSON() ([]byte, error) {
+	if p == nil {
+		return []byte("null"), nil
+	}
+
+	type packet PubAckPacket
+	return marshalPacketJSON(CtrlPubAck, (*packet)(p))
+}
+
+// MarshalJSON encodes the packet with the type name
+func (p *PubRecvPacket) MarshalJSON() ([]byte, error) {
+	if p == nil {
+		return []byte("null"), nil
+	}
+
+	type packet PubRecvPacket
+	return marshalPacketJSON(CtrlPubRecv, (*packet)(p))
+}
+
+// MarshalJSON encodes the packet with the type name
+func (p *PubRelPacket) MarshalJSON() ([]byte, error) {
+	if p == nil {
+		return []byte("null"), nil
+	}
+
+	type packet PubRelPacket
+	return marshalPacketJSON(CtrlPubRel, (*packet)(p))
+}
+
+// MarshalJSON encodes the packet with the type name
+func (p *PubCompPacket) MarshalJSON() ([]byte, error) {
+	if p == nil {
+		return []byte("null"), nil
+	}
+
+	type packet PubCompPacket
+	return marshalPacketJSON(CtrlPubComp, (*packet)(p))
+}
+
+// MarshalJSON encodes the packet with the type name
+func (s *SubscribePacket) MarshalJSON() ([]byte, error) {
+	if s == nil {
+		return []byte("null"), nil
+	}
+
+	type packet SubscribePacket
+	return marshalPacketJSON(CtrlSubscribe, (*packet)(s))
+}
+
+// MarshalJSON encodes the packet with the type name
+func (s *SubAckPacket) MarshalJSON() ([]byte, error) {
+	if s == nil {
+		return []byte("null"), nil
+	}
+
+	type packet SubAckPacket
+	return marshalPacketJSON(CtrlSubAck, (*packet)(s))
+}
+
+// MarshalJSON encodes the packet with the type name
+func (s *UnSubPacket) MarshalJSON() ([]byte, error) {
+	if s == nil {
+		return []byte("null"), nil
+	}
+
+	type packet UnSubPacket
+	return marshalPacketJSON(CtrlUnSub, (*packet)(s))
+}
+
+// MarshalJSON encodes the packet with the type name
+func (s *UnSubAckPacket) MarshalJSON() ([]byte, error) {
+	if s == nil {
+		return []byte("null"), nil
+	}
+
+	type packet UnSubAckPacket
+	return marshalPacketJSON(CtrlUnSubAck, (*packet)(s))
+}
+
+// MarshalJSON encodes the packet with the type name
+func (d *DisConnPacket) MarshalJSON() ([]byte, error) {
+	if d == nil {
+		return []byte("null"), nil
+	}
+
+	type packet DisConnPacket
+	return marshalPacketJSON(CtrlDisConn, (*packet)(d))
+}
+
+// MarshalJSON encodes the packet with the type name
+func (a *AuthPacket) MarshalJSON() ([]byte, error) {
+	if a == nil {
+		return []byte("null"), nil
+	}
+
+	type packet AuthPacket
+	return marshalPacketJSON(CtrlAuth, (*packet)(a))
+}
+
+func (p *pingReqPacket) MarshalJSON() ([]byte, error) {
+	return marshalPacketJSON(CtrlPingReq, struct{}{})
+}
+
+func (p *pingRespPacket) MarshalJSON() ([]byte, error) {
+	return marshalPacketJSON(CtrlPingResp, struct{}{})
+}
@@ -0,0 +1,158 @@
+/*
+ * Copyright Go-IIoT (https://github.com/goiiot)
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package libmqtt
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestPacketJSON(t *testing.T) {
+	pkts := append(testV5Packets(), PingReqPacket, PingRespPacket,
+		&ConnPacket{ClientID: "client"}, &DisConnPacket{})
+
+	for _, p := range pkts {
+		data, err := json.Marshal(p)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if !bytes.HasPrefix(data, []byte(`{"Type":"`+ctrlTypeName(p.Type())+`"`)) {
+			t.Error("packet type not encoded, json =", string(data))
+		}
+
+		pkt, err := UnmarshalPacketJSON(data)
+		if err != nil {
+			t.Error("unmarshal failed, packet =", ctrlTypeName(p.Type()), "err =", err)
+			continue
+		}
+
+		if c, ok := p.(*ConnPacket); ok {
+			// secrets are not encoded
+			redacted := *c
+			redacted.Password = ""
+			if c.Props != nil {
+				props := *c.Props
+				props.AuthData = nil
+				redacted.Props = &props
+			}
+			p = &redacted
+		}
+
+		if !reflect.DeepEqual(pkt, p) {
+			t.Errorf("packet mismatch after unmarshal, packet = %s\nGenerated: %+v\nTarget: %+v",
+				ctrlTypeName(p.Type()), pkt, p)
+		}
+	}
+}
+
+func TestPacketJSON_Fields(t *testing.T) {
+	data, err := json.Marshal(&PublishPacket{
+		TopicName: "foo",
+		Payload:   []byte("bar"),
+		Props: &PublishProps{
+			CorrelationData: []byte("id"),
+			UserProps:       UserProps{"k": {"v1", "v2"}},
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, field := range []string{
+		`"TopicName":"foo"`,
+		`"Payload":"YmFy"`,
+		`"CorrelationData":"aWQ="`,
+		`"UserProps":{"k":["v1","v2"]}`,
+	} {
+		if !strings.Contains(string(data), field) {
+			t.Error("field not encoded as expected, field =", field, "json =", string(data))
+		}
+	}
+
+	for _, data := range []string{`{"Type":"Unknown"}`, `[]`} {
+		if _, err := UnmarshalPacketJSON([]byte(data)); err == nil {
+			t.Error("invalid packet json unmarshalled, json =", data)
+		}
+	}
+}
+
+func TestPacketJSON_Redacted(t *testing.T) {
+	p := &ConnPacket{
+		ClientID: "client",
+		Username: "user",
+		Password: "secret",
+		Props:    &ConnProps{AuthMethod: "method", AuthData: []byte("secret")},
+	}
+
+	data, err := json.Marshal(p)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if strings.Contains(string(data), "secret") || strings.Contains(string(data), "c2VjcmV0") {
+		t.Error("secrets encoded, json =", string(data))
+	}
+
+	if !strings.Contains(string(data), `"Username":"user"`) || !strings.Contains(string(data), `"AuthMethod":"method"`) {
+		t.Error("fields not encoded, json =", string(data))
+	}
+
+	if p.Password != "secret" || string(p.Props.AuthData) != "secret" {
+		t.Error("packet modified by encoding")
+	}
+}
+
+func TestPacket_String(t *testing.T) {
+	cases := []struct {
+		pkt fmt.Stringer
+		str string
+	}{
+		{&ConnPacket{ClientID: "client", Keepalive: 60, Username: "user", Password: "pass"},
+			`Connect{Version: 4, ClientID: "client", CleanSession: false, Keepalive: 60, Username: "user"}`},
+		{&ConnPacket{ClientID: "c", CleanSession: true, IsWill: true, WillTopic: "will", WillQos: Qos1, WillMessage: []byte("bye")},
+			`Connect{Version: 4, ClientID: "c", CleanSession: true, Keepalive: 0, Will: "will" (Qos: 1, Retain: false, 3 bytes)}`},
+		{&ConnAckPacket{Present: true, Code: CodeBanned}, `ConnAck{Present: true, Code: Banned}`},
+		{&PublishPacket{PacketID: 1, Qos: Qos1, IsRetain: true, TopicName: "foo", Payload: []byte("bar")},
+			`Publish{ID: 1, Qos: 1, Dup: false, Retain: true, Topic: "foo", Payload: 3 bytes}`},
+		{&PubAckPacket{PacketID: 1}, `PubAck{ID: 1}`},
+		{&PubRecvPacket{PacketID: 2, Code: CodeQuotaExceeded}, `PubRecv{ID: 2, Code: QuotaExceeded}`},
+		{&PubRelPacket{PacketID: 3}, `PubRel{ID: 3}`},
+		{&PubCompPacket{PacketID: 4}, `PubComp{ID: 4}`},
+		{&SubscribePacket{PacketID: 5, Topics: []*Topic{{Name: "foo", Qos: Qos1}, {Name: "bar/#"}}},
+			`Subscribe{ID: 5, Topics: [foo:1 bar/#:0]}`},
+		{&SubAckPacket{PacketID: 5, Codes: []byte{SubOkMaxQos1, SubFail}}, `SubAck{ID: 5, Codes: [1 128]}`},
+		{&UnSubPacket{PacketID: 6, TopicNames: []string{"foo", "bar"}}, `UnSub{ID: 6, Topics: [foo bar]}`},
+		{&UnSubAckPacket{PacketID: 6}, `UnSubAck{ID: 6}`},
+		{&UnSubAckPacket{PacketID: 6, Codes: []byte{0, 17}}, `UnSubAck{ID: 6, Codes: [0 17]}`},
+		{PingReqPacket, `PingReq{}`},
+		{PingRespPacket, `PingResp{}`},
+		{&DisConnPacket{Code: CodeServerBusy}, `DisConn{Code: ServerBusy}`},
+		{&AuthPacket{Code: CodeContinueAuth}, `Auth{Code: ContinueAuth}`},
+		{(*PublishPacket)(nil), `<nil>`},
+	}
+
+	for _, c := range cases {
+		if s := c.pkt.String(); s != c.str {
+			t.Errorf("string mismatch\nGenerated: %s\nTarget:    %s", s, c.str)
+		}
+	}
+}
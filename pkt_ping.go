@@ -16,8 +16,6 @@
 
 package libmqtt
 
-import "bytes"
-
 var (
 	// PingReqPacket is the final instance of pingReqPacket
 	PingReqPacket = &pingReqPacket{}
@@ -41,14 +39,16 @@ func (p *pingReqPacket) Type() CtrlType {
 	return CtrlPingReq
 }
 
+func (p *pingReqPacket) String() string {
+	return "PingReq{}"
+}
+
 func (p *pingReqPacket) Bytes() []byte {
 	if p == nil {
 		return nil
 	}
 
-	w := &bytes.Buffer{}
-	p.WriteTo(w)
-	return w.Bytes()
+	return encodeBytes(p)
 }
 
 func (p *pingReqPacket) WriteTo(w BufferedWriter) error {
@@ -75,14 +75,16 @@ func (p *pingRespPacket) Type() CtrlType {
 	return CtrlPingResp
 }
 
+func (p *pingRespPacket) String() string {
+	return "PingResp{}"
+}
+
 func (p *pingRespPacket) Bytes() []byte {
 	if p == nil {
 		return nil
 	}
 
-	w := &bytes.Buffer{}
-	p.WriteTo(w)
-	return w.Bytes()
+	return encodeBytes(p)
 }
 
 func (p *pingRespPacket) WriteTo(w BufferedWriter) error {
@@ -16,7 +16,7 @@
 
 package libmqtt
 
-import "bytes"
+import "fmt"
 
 // PublishPacket is sent from a Client to a Server or from Server to a Client
 // to transport an Application Message.
@@ -36,14 +36,22 @@ func (p *PublishPacket) Type() CtrlType {
 	return CtrlPublish
 }
 
+// String is the concise summary of the packet
+func (p *PublishPacket) String() string {
+	if p == nil {
+		return "<nil>"
+	}
+
+	return fmt.Sprintf("Publish{ID: %d, Qos: %d, Dup: %v, Retain: %v, Topic: %q, Payload: %d bytes}",
+		p.PacketID, p.Qos, p.IsDup, p.IsRetain, p.TopicName, len(p.Payload))
+}
+
 func (p *PublishPacket) Bytes() []byte {
 	if p == nil {
 		return nil
 	}
 
-	w := &bytes.Buffer{}
-	p.WriteTo(w)
-	return w.Bytes()
+	return encodeBytes(p)
 }
 
 func (p *PublishPacket) WriteTo(w BufferedWriter) error {
@@ -51,40 +59,49 @@ func (p *PublishPacket) WriteTo(w BufferedWriter) error {
 		return ErrEncodeBadPacket
 	}
 
+	header := byte(CtrlPublish<<4) | boolToByte(p.IsDup)<<3 | boolToByte(p.IsRetain) | p.Qos<<1
 	switch p.ProtoVersion {
 	case 0, V311:
-		w.WriteByte(byte(CtrlPublish<<4) | boolToByte(p.IsDup)<<3 | boolToByte(p.IsRetain) | p.Qos<<1)
-		payload := p.payload()
-		writeVarInt(len(payload), w)
-		_, err := w.Write(payload)
+		w.WriteByte(header)
+		if err := writeVarInt(p.varHeaderLen()+len(p.Payload), w); err != nil {
+			return err
+		}
+
+		p.writeVarHeader(w)
+		_, err := w.Write(p.Payload)
 		return err
 	case V5:
-		w.WriteByte(byte(CtrlPublish<<4) | boolToByte(p.IsDup)<<3 | boolToByte(p.IsRetain) | p.Qos<<1)
-
-		props := p.Props.props()
-		propLen := len(props)
-		payload := p.payload()
+		props := encodeProps(p.Props)
+		defer putEncodeBuf(props)
 
-		if err := writeVarInt(len(payload)+propLen, w); err != nil {
+		w.WriteByte(header)
+		if err := writeVarInt(p.varHeaderLen()+propsLen(props)+len(p.Payload), w); err != nil {
 			return err
 		}
 
-		writeVarInt(propLen, w)
-		w.Write(props)
+		// properties are placed between variable header and payload
+		p.writeVarHeader(w)
+		writeProps(w, props)
 
-		_, err := w.Write(payload)
+		_, err := w.Write(p.Payload)
 		return err
 	default:
 		return ErrUnsupportedVersion
 	}
 }
 
-func (p *PublishPacket) payload() []byte {
-	data := encodeStringWithLen(p.TopicName)
+func (p *PublishPacket) varHeaderLen() int {
 	if p.Qos > Qos0 {
-		data = append(data, byte(p.PacketID>>8), byte(p.PacketID))
+		return 4 + len(p.TopicName)
+	}
+	return 2 + len(p.TopicName)
+}
+
+func (p *PublishPacket) writeVarHeader(w BufferedWriter) {
+	writeStringData(w, p.TopicName)
+	if p.Qos > Qos0 {
+		writeUint16(w, p.PacketID)
 	}
-	return append(data, p.Payload...)
 }
 
 // PublishProps properties for PublishPacket
@@ -127,108 +144,84 @@ type PublishProps struct {
 	ContentType string
 }
 
-func (p *PublishProps) props() []byte {
+func (p *PublishProps) writeProps(w BufferedWriter) {
 	if p == nil {
-		return nil
+		return
 	}
 
-	result := make([]byte, 2)
-	result[0] = propKeyPayloadFormatIndicator
-	result[1] = p.PayloadFormat
+	w.WriteByte(propKeyPayloadFormatIndicator)
+	w.WriteByte(p.PayloadFormat)
 
 	if p.MessageExpiryInterval != 0 {
-		data := []byte{propKeyMessageExpiryInterval, 0, 0, 0, 0}
-		putUint32(data[1:], p.MessageExpiryInterval)
-		result = append(result, data...)
+		w.WriteByte(propKeyMessageExpiryInterval)
+		writeUint32(w, p.MessageExpiryInterval)
 	}
 
 	if p.TopicAlias != 0 {
-		data := []byte{propKeyTopicAlias, 0, 0, 0, 0}
-		putUint16(data[1:], p.TopicAlias)
-		result = append(result, data...)
+		w.WriteByte(propKeyTopicAlias)
+		writeUint16(w, p.TopicAlias)
 	}
 
 	if p.RespTopic != "" {
-		result = append(result, propKeyRespTopic)
-		result = append(result, encodeStringWithLen(p.RespTopic)...)
+		w.WriteByte(propKeyRespTopic)
+		writeStringData(w, p.RespTopic)
 	}
 
 	if p.CorrelationData != nil {
-		result = append(result, propKeyCorrelationData)
-		result = append(result, encodeBytesWithLen(p.CorrelationData)...)
+		w.WriteByte(propKeyCorrelationData)
+		writeBinaryData(w, p.CorrelationData)
 	}
 
 	if p.UserProps != nil {
-		p.UserProps.encodeTo(result)
+		p.UserProps.writeTo(w)
 	}
 
-	if p.SubIDs != nil {
-		buf := &bytes.Buffer{}
-		for _, v := range p.SubIDs {
-			result = append(result, propKeySubID)
-			writeVarInt(v, buf)
-			result = append(result, buf.Bytes()...)
-			buf.Reset()
-		}
+	for _, v := range p.SubIDs {
+		w.WriteByte(propKeySubID)
+		writeVarInt(v, w)
 	}
 
 	if p.ContentType != "" {
-		result = append(result, propKeyContentType)
-		result = append(result, encodeStringWithLen(p.ContentType)...)
+		w.WriteByte(propKeyContentType)
+		writeStringData(w, p.ContentType)
 	}
-
-	return result
 }
 
-func (p *PublishProps) setProps(props map[byte][]byte) {
-	if p == nil || props == nil {
-		return
-	}
-
-	if v, ok := props[propKeyPayloadFormatIndicator]; ok && len(v) == 1 {
-		p.PayloadFormat = v[0]
-	}
-
-	if v, ok := props[propKeyMessageExpiryInterval]; ok {
+func (p *PublishProps) setProp(key byte, v []byte) {
+	switch key {
+	case propKeyPayloadFormatIndicator:
+		if len(v) == 1 {
+			p.PayloadFormat = v[0]
+		}
+	case propKeyMessageExpiryInterval:
 		p.MessageExpiryInterval = getUint32(v)
-	}
-
-	if v, ok := props[propKeyTopicAlias]; ok {
+	case propKeyTopicAlias:
 		p.TopicAlias = getUint16(v)
-	}
-
-	if v, ok := props[propKeyRespTopic]; ok {
+	case propKeyRespTopic:
 		p.RespTopic, _, _ = getStringData(v)
-	}
-
-	if v, ok := props[propKeyCorrelationData]; ok {
-		p.CorrelationData, _, _ = getBinaryData(v)
-	}
-
-	if v, ok := props[propKeyUserProps]; ok {
-		p.UserProps = getUserProps(v)
-	}
-
-	if v, ok := props[propKeySubID]; ok {
-		p.SubIDs = make([]int, 0)
-		for i := 0; i < len(v); {
-			d, n := getRemainLength(bytes.NewReader(v[i:]))
-			p.SubIDs = append(p.SubIDs, d)
-			i += n
+	case propKeyCorrelationData:
+		p.CorrelationData = copyBinaryData(v)
+	case propKeyUserProps:
+		p.UserProps = appendUserProps(p.UserProps, v)
+	case propKeySubID:
+		for len(v) > 0 {
+			id, n, err := getVarInt(v)
+			if err != nil {
+				break
+			}
+			p.SubIDs = append(p.SubIDs, id)
+			v = v[n:]
 		}
-	}
-
-	if v, ok := props[propKeyContentType]; ok {
+	case propKeyContentType:
 		p.ContentType, _, _ = getStringData(v)
 	}
-
 }
 
 // PubAckPacket is the response to a PublishPacket with QoS level 1.
 type PubAckPacket struct {
 	BasePacket
 	PacketID uint16
-	Code     byte
+	Code     ReasonCode
 	Props    *PubAckProps
 }
 
@@ -237,14 +230,21 @@ func (p *PubAckPacket) Type() CtrlType {
 	return CtrlPubAck
 }
 
+// String is the concise summary of the packet
+func (p *PubAckPacket) String() string {
+	if p == nil {
+		return "<nil>"
+	}
+
+	return ackString(CtrlPubAck, p.PacketID, p.Code)
+}
+
 func (p *PubAckPacket) Bytes() []byte {
 	if p == nil {
 		return nil
 	}
 
-	w := &bytes.Buffer{}
-	p.WriteTo(w)
-	return w.Bytes()
+	return encodeBytes(p)
 }
 
 func (p *PubAckPacket) WriteTo(w BufferedWriter) error {
@@ -252,31 +252,7 @@ func (p *PubAckPacket) WriteTo(w BufferedWriter) error {
 		return ErrEncodeBadPacket
 	}
 
-	switch p.ProtoVersion {
-	case 0, V311:
-		w.WriteByte(byte(CtrlPubAck << 4))
-		w.WriteByte(2)
-		w.WriteByte(byte(p.PacketID >> 8))
-		return w.WriteByte(byte(p.PacketID))
-	case V5:
-		w.WriteByte(byte(CtrlPubAck << 4))
-
-		props := p.Props.props()
-		propLen := len(props)
-		if err := writeVarInt(propLen+2, w); err != nil {
-			return err
-		}
-
-		w.WriteByte(byte(p.PacketID >> 8))
-		w.WriteByte(byte(p.PacketID))
-
-		writeVarInt(propLen, w)
-		_, err := w.Write(props)
-
-		return err
-	default:
-		return ErrUnsupportedVersion
-	}
+	return writeAck(w, p.ProtoVersion, byte(CtrlPubAck<<4), p.PacketID, p.Code, p.Props)
 }
 
 // PubAckProps properties for PubAckPacket
@@ -288,34 +264,27 @@ type PubAckProps struct {
 	UserProps UserProps
 }
 
-func (p *PubAckProps) props() []byte {
+func (p *PubAckProps) writeProps(w BufferedWriter) {
 	if p == nil {
-		return nil
+		return
 	}
 
-	result := make([]byte, 0)
 	if p.Reason != "" {
-		result = append(result, propKeyReasonString)
-		result = append(result, encodeStringWithLen(p.Reason)...)
+		w.WriteByte(propKeyReasonString)
+		writeStringData(w, p.Reason)
 	}
 
 	if p.UserProps != nil {
-		p.UserProps.encodeTo(result)
+		p.UserProps.writeTo(w)
 	}
-	return result
 }
 
-func (p *PubAckProps) setProps(props map[byte][]byte) {
-	if p == nil || props == nil {
-		return
-	}
-
-	if v, ok := props[propKeyReasonString]; ok {
+func (p *PubAckProps) setProp(key byte, v []byte) {
+	switch key {
+	case propKeyReasonString:
 		p.Reason, _, _ = getStringData(v)
-	}
-
-	if v, ok := props[propKeyUserProps]; ok {
-		p.UserProps = getUserProps(v)
+	case propKeyUserProps:
+		p.UserProps = appendUserProps(p.UserProps, v)
 	}
 }
 
@@ -324,7 +293,7 @@ func (p *PubAckProps) setProps(props map[byte][]byte) {
 type PubRecvPacket struct {
 	BasePacket
 	PacketID uint16
-	Code     byte
+	Code     ReasonCode
 	Props    *PubRecvProps
 }
 
@@ -333,14 +302,21 @@ func (p *PubRecvPacket) Type() CtrlType {
 	return CtrlPubRecv
 }
 
+// String is the concise summary of the packet
+func (p *PubRecvPacket) String() string {
+	if p == nil {
+		return "<nil>"
+	}
+
+	return ackString(CtrlPubRecv, p.PacketID, p.Code)
+}
+
 func (p *PubRecvPacket) Bytes() []byte {
 	if p == nil {
 		return nil
 	}
 
-	w := &bytes.Buffer{}
-	p.WriteTo(w)
-	return w.Bytes()
+	return encodeBytes(p)
 }
 
 func (p *PubRecvPacket) WriteTo(w BufferedWriter) error {
@@ -348,31 +324,7 @@ func (p *PubRecvPacket) WriteTo(w BufferedWriter) error {
 		return ErrEncodeBadPacket
 	}
 
-	switch p.ProtoVersion {
-	case 0, V311:
-		w.WriteByte(byte(CtrlPubRecv << 4))
-		w.WriteByte(2)
-		w.WriteByte(byte(p.PacketID >> 8))
-		return w.WriteByte(byte(p.PacketID))
-	case V5:
-		w.WriteByte(byte(CtrlPubRecv << 4))
-
-		props := p.Props.props()
-		propLen := len(props)
-		if err := writeVarInt(propLen+2, w); err != nil {
-			return err
-		}
-
-		w.WriteByte(byte(p.PacketID >> 8))
-		w.WriteByte(byte(p.PacketID))
-
-		writeVarInt(propLen, w)
-		_, err := w.Write(props)
-
-		return err
-	default:
-		return ErrUnsupportedVersion
-	}
+	return writeAck(w, p.ProtoVersion, byte(CtrlPubRecv<<4), p.PacketID, p.Code, p.Props)
 }
 
 // PubRecvProps properties for PubRecvPacket
@@ -384,33 +336,27 @@ type PubRecvProps struct {
 	UserProps UserProps
 }
 
-func (p *PubRecvProps) props() []byte {
+func (p *PubRecvProps) writeProps(w BufferedWriter) {
 	if p == nil {
-		return nil
+		return
 	}
-	result := make([]byte, 0)
+
 	if p.Reason != "" {
-		result = append(result, propKeyReasonString)
-		result = append(result, encodeStringWithLen(p.Reason)...)
+		w.WriteByte(propKeyReasonString)
+		writeStringData(w, p.Reason)
 	}
 
 	if p.UserProps != nil {
-		p.UserProps.encodeTo(result)
+		p.UserProps.writeTo(w)
 	}
-	return result
 }
 
-func (p *PubRecvProps) setProps(props map[byte][]byte) {
-	if p == nil || props == nil {
-		return
-	}
-
-	if v, ok := props[propKeyReasonString]; ok {
+func (p *PubRecvProps) setProp(key byte, v []byte) {
+	switch key {
+	case propKeyReasonString:
 		p.Reason, _, _ = getStringData(v)
-	}
-
-	if v, ok := props[propKeyUserProps]; ok {
-		p.UserProps = getUserProps(v)
+	case propKeyUserProps:
+		p.UserProps = appendUserProps(p.UserProps, v)
 	}
 }
 
@@ -419,7 +365,7 @@ func (p *PubRecvProps) setProps(props map[byte][]byte) {
 type PubRelPacket struct {
 	BasePacket
 	PacketID uint16
-	Code     byte
+	Code     ReasonCode
 	Props    *PubRelProps
 }
 
@@ -428,14 +374,21 @@ func (p *PubRelPacket) Type() CtrlType {
 	return CtrlPubRel
 }
 
+// String is the concise summary of the packet
+func (p *PubRelPacket) String() string {
+	if p == nil {
+		return "<nil>"
+	}
+
+	return ackString(CtrlPubRel, p.PacketID, p.Code)
+}
+
 func (p *PubRelPacket) Bytes() []byte {
 	if p == nil {
 		return nil
 	}
 
-	w := &bytes.Buffer{}
-	p.WriteTo(w)
-	return w.Bytes()
+	return encodeBytes(p)
 }
 
 func (p *PubRelPacket) WriteTo(w BufferedWriter) error {
@@ -443,31 +396,7 @@ func (p *PubRelPacket) WriteTo(w BufferedWriter) error {
 		return ErrEncodeBadPacket
 	}
 
-	switch p.ProtoVersion {
-	case 0, V311:
-		w.WriteByte(byte(CtrlPubRel<<4 | 0x02))
-		w.WriteByte(2)
-		w.WriteByte(byte(p.PacketID >> 8))
-		return w.WriteByte(byte(p.PacketID))
-	case V5:
-		w.WriteByte(byte(CtrlPubRel<<4 | 0x02))
-
-		props := p.Props.props()
-		propLen := len(props)
-		if err := writeVarInt(propLen+2, w); err != nil {
-			return err
-		}
-
-		w.WriteByte(byte(p.PacketID >> 8))
-		w.WriteByte(byte(p.PacketID))
-
-		writeVarInt(propLen, w)
-		_, err := w.Write(props)
-
-		return err
-	default:
-		return ErrUnsupportedVersion
-	}
+	return writeAck(w, p.ProtoVersion, byte(CtrlPubRel<<4|0x02), p.PacketID, p.Code, p.Props)
 }
 
 // PubRelProps properties for PubRelPacket
@@ -479,34 +408,27 @@ type PubRelProps struct {
 	UserProps UserProps
 }
 
-func (p *PubRelProps) props() []byte {
+func (p *PubRelProps) writeProps(w BufferedWriter) {
 	if p == nil {
-		return nil
+		return
 	}
 
-	result := make([]byte, 0)
 	if p.Reason != "" {
-		result = append(result, propKeyReasonString)
-		result = append(result, encodeStringWithLen(p.Reason)...)
+		w.WriteByte(propKeyReasonString)
+		writeStringData(w, p.Reason)
 	}
 
 	if p.UserProps != nil {
-		p.UserProps.encodeTo(result)
+		p.UserProps.writeTo(w)
 	}
-	return result
 }
 
-func (p *PubRelProps) setProps(props map[byte][]byte) {
-	if p == nil || props == nil {
-		return
-	}
-
-	if v, ok := props[propKeyReasonString]; ok {
+func (p *PubRelProps) setProp(key byte, v []byte) {
+	switch key {
+	case propKeyReasonString:
 		p.Reason, _, _ = getStringData(v)
-	}
-
-	if v, ok := props[propKeyUserProps]; ok {
-		p.UserProps = getUserProps(v)
+	case propKeyUserProps:
+		p.UserProps = appendUserProps(p.UserProps, v)
 	}
 }
 
@@ -515,7 +437,7 @@ func (p *PubRelProps) setProps(props map[byte][]byte) {
 type PubCompPacket struct {
 	BasePacket
 	PacketID uint16
-	Code     byte
+	Code     ReasonCode
 	Props    *PubCompProps
 }
 
@@ -524,14 +446,21 @@ func (p *PubCompPacket) Type() CtrlType {
 	return CtrlPubComp
 }
 
+// String is the concise summary of the packet
+func (p *PubCompPacket) String() string {
+	if p == nil {
+		return "<nil>"
+	}
+
+	return ackString(CtrlPubComp, p.PacketID, p.Code)
+}
+
 func (p *PubCompPacket) Bytes() []byte {
 	if p == nil {
 		return nil
 	}
 
-	w := &bytes.Buffer{}
-	p.WriteTo(w)
-	return w.Bytes()
+	return encodeBytes(p)
 }
 
 func (p *PubCompPacket) WriteTo(w BufferedWriter) error {
@@ -539,31 +468,7 @@ func (p *PubCompPacket) WriteTo(w BufferedWriter) error {
 		return ErrEncodeBadPacket
 	}
 
-	switch p.ProtoVersion {
-	case 0, V311:
-		w.WriteByte(byte(CtrlPubComp << 4))
-		w.WriteByte(2)
-		w.WriteByte(byte(p.PacketID >> 8))
-		return w.WriteByte(byte(p.PacketID))
-	case V5:
-		w.WriteByte(byte(CtrlPubComp << 4))
-
-		props := p.Props.props()
-		propLen := len(props)
-		if err := writeVarInt(propLen+2, w); err != nil {
-			return err
-		}
-
-		w.WriteByte(byte(p.PacketID >> 8))
-		w.WriteByte(byte(p.PacketID))
-
-		writeVarInt(propLen, w)
-		_, err := w.Write(props)
-
-		return err
-	default:
-		return ErrUnsupportedVersion
-	}
+	return writeAck(w, p.ProtoVersion, byte(CtrlPubComp<<4), p.PacketID, p.Code, p.Props)
 }
 
 // PubCompProps properties for PubCompPacket
@@ -575,32 +480,35 @@ type PubCompProps struct {
 	UserProps UserProps
 }
 
-func (p *PubCompProps) props() []byte {
+func (p *PubCompProps) writeProps(w BufferedWriter) {
 	if p == nil {
-		return nil
+		return
 	}
-	result := make([]byte, 0)
+
 	if p.Reason != "" {
-		result = append(result, propKeyReasonString)
-		result = append(result, encodeStringWithLen(p.Reason)...)
+		w.WriteByte(propKeyReasonString)
+		writeStringData(w, p.Reason)
 	}
 
 	if p.UserProps != nil {
-		p.UserProps.encodeTo(result)
+		p.UserProps.writeTo(w)
 	}
-	return result
 }
 
-func (p *PubCompProps) setProps(props map[byte][]byte) {
-	if p == nil || props == nil {
-		return
-	}
-
-	if v, ok := props[propKeyReasonString]; ok {
+func (p *PubCompProps) setProp(key byte, v []byte) {
+	switch key {
+	case propKeyReasonString:
 		p.Reason, _, _ = getStringData(v)
+	case propKeyUserProps:
+		p.UserProps = appendUserProps(p.UserProps, v)
 	}
+}
 
-	if v, ok := props[propKeyUserProps]; ok {
-		p.UserProps = getUserProps(v)
+// ackString is the concise summary of publish ack packets,
+// reason code is omitted when succeeded
+func ackString(t CtrlType, id uint16, code ReasonCode) string {
+	if code == CodeSuccess {
+		return fmt.Sprintf("%s{ID: %d}", ctrlTypeName(t), id)
 	}
+	return fmt.Sprintf("%s{ID: %d, Code: %v}", ctrlTypeName(t), id, code)
 }
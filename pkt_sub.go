@@ -16,7 +16,7 @@
 
 package libmqtt
 
-import "bytes"
+import "fmt"
 
 // SubscribePacket is sent from the Client to the Server
 // to create one or more Subscriptions.
@@ -38,14 +38,25 @@ func (s *SubscribePacket) Type() CtrlType {
 	return CtrlSubscribe
 }
 
+// String is the concise summary of the packet
+func (s *SubscribePacket) String() string {
+	if s == nil {
+		return "<nil>"
+	}
+
+	topics := make([]string, len(s.Topics))
+	for i, t := range s.Topics {
+		topics[i] = fmt.Sprintf("%s:%d", t.Name, t.Qos)
+	}
+	return fmt.Sprintf("Subscribe{ID: %d, Topics: %v}", s.PacketID, topics)
+}
+
 func (s *SubscribePacket) Bytes() []byte {
 	if s == nil {
 		return nil
 	}
 
-	w := &bytes.Buffer{}
-	s.WriteTo(w)
-	return w.Bytes()
+	return encodeBytes(s)
 }
 
 func (s *SubscribePacket) WriteTo(w BufferedWriter) error {
@@ -56,47 +67,44 @@ func (s *SubscribePacket) WriteTo(w BufferedWriter) error {
 	switch s.ProtoVersion {
 	case 0, V311:
 		w.WriteByte(byte(CtrlSubscribe<<4 | 0x02))
-		payload := s.payload()
-		if err := writeVarInt(len(payload)+2, w); err != nil {
+		if err := writeVarInt(s.payloadLen()+2, w); err != nil {
 			return err
 		}
-		w.WriteByte(byte(s.PacketID >> 8))
-		w.WriteByte(byte(s.PacketID))
-		_, err := w.Write(payload)
-		return err
-	case V5:
-		w.WriteByte(byte(CtrlSubscribe<<4 | 0x02))
 
-		props := s.Props.props()
-		payload := s.payload()
-		propLen := len(props)
+		writeUint16(w, s.PacketID)
+		return s.writePayload(w)
+	case V5:
+		props := encodeProps(s.Props)
+		defer putEncodeBuf(props)
 
-		if err := writeVarInt(len(payload)+propLen+2, w); err != nil {
+		w.WriteByte(byte(CtrlSubscribe<<4 | 0x02))
+		if err := writeVarInt(s.payloadLen()+propsLen(props)+2, w); err != nil {
 			return err
 		}
 
-		w.WriteByte(byte(s.PacketID >> 8))
-		w.WriteByte(byte(s.PacketID))
-
-		writeVarInt(propLen, w)
-		w.Write(props)
-
-		_, err := w.Write(payload)
-		return err
+		writeUint16(w, s.PacketID)
+		writeProps(w, props)
+		return s.writePayload(w)
 	default:
 		return ErrUnsupportedVersion
 	}
 }
 
-func (s *SubscribePacket) payload() []byte {
-	var result []byte
-	if s.Topics != nil {
-		for _, t := range s.Topics {
-			result = append(result, encodeStringWithLen(t.Name)...)
-			result = append(result, t.Qos)
-		}
+func (s *SubscribePacket) payloadLen() int {
+	n := 0
+	for _, t := range s.Topics {
+		n += 3 + len(t.Name)
+	}
+	return n
+}
+
+func (s *SubscribePacket) writePayload(w BufferedWriter) error {
+	var err error
+	for _, t := range s.Topics {
+		writeStringData(w, t.Name)
+		err = w.WriteByte(t.Qos)
 	}
-	return result
+	return err
 }
 
 // SubscribeProps properties for SubscribePacket
@@ -107,38 +115,28 @@ type SubscribeProps struct {
 	UserProps UserProps
 }
 
-func (s *SubscribeProps) props() []byte {
+func (s *SubscribeProps) writeProps(w BufferedWriter) {
 	if s == nil {
-		return nil
+		return
 	}
 
-	result := make([]byte, 0)
-
 	if s.SubID != 0 {
-		buf := &bytes.Buffer{}
-		writeVarInt(int(s.SubID), buf)
-		result = append(result, propKeySubID)
-		result = append(result, buf.Bytes()...)
+		w.WriteByte(propKeySubID)
+		writeVarInt(int(s.SubID), w)
 	}
 
 	if s.UserProps != nil {
-		s.UserProps.encodeTo(result)
+		s.UserProps.writeTo(w)
 	}
-	return result
 }
 
-func (s *SubscribeProps) setProps(props map[byte][]byte) {
-	if s == nil || props == nil {
-		return
-	}
-
-	if v, ok := props[propKeySubID]; ok {
-		id, _ := getRemainLength(bytes.NewReader(v))
+func (s *SubscribeProps) setProp(key byte, v []byte) {
+	switch key {
+	case propKeySubID:
+		id, _, _ := getVarInt(v)
 		s.SubID = uint32(id)
-	}
-
-	if v, ok := props[propKeyUserProps]; ok {
-		s.UserProps = getUserProps(v)
+	case propKeyUserProps:
+		s.UserProps = appendUserProps(s.UserProps, v)
 	}
 }
 
@@ -160,14 +158,21 @@ func (s *SubAckPacket) Type() CtrlType {
 	return CtrlSubAck
 }
 
+// String is the concise summary of the packet
+func (s *SubAckPacket) String() string {
+	if s == nil {
+		return "<nil>"
+	}
+
+	return fmt.Sprintf("SubAck{ID: %d, Codes: %v}", s.PacketID, s.Codes)
+}
+
 func (s *SubAckPacket) Bytes() []byte {
 	if s == nil {
 		return nil
 	}
 
-	w := &bytes.Buffer{}
-	s.WriteTo(w)
-	return w.Bytes()
+	return encodeBytes(s)
 }
 
 func (s *SubAckPacket) WriteTo(w BufferedWriter) error {
@@ -178,40 +183,36 @@ func (s *SubAckPacket) WriteTo(w BufferedWriter) error {
 	switch s.ProtoVersion {
 	case 0, V311:
 		w.WriteByte(byte(CtrlSubAck << 4))
-		payload := s.payload()
-		if err := writeVarInt(len(payload)+2, w); err != nil {
+		if err := writeVarInt(s.payloadLen()+2, w); err != nil {
 			return err
 		}
-		w.WriteByte(byte(s.PacketID >> 8))
-		w.WriteByte(byte(s.PacketID))
-		_, err := w.Write(payload)
-		return err
-	case V5:
-		w.WriteByte(byte(CtrlSubAck << 4))
 
-		props := s.Props.props()
-		payload := s.payload()
-		propLen := len(props)
+		writeUint16(w, s.PacketID)
+		return s.writePayload(w)
+	case V5:
+		props := encodeProps(s.Props)
+		defer putEncodeBuf(props)
 
-		if err := writeVarInt(len(payload)+propLen+2, w); err != nil {
+		w.WriteByte(byte(CtrlSubAck << 4))
+		if err := writeVarInt(s.payloadLen()+propsLen(props)+2, w); err != nil {
 			return err
 		}
 
-		w.WriteByte(byte(s.PacketID >> 8))
-		w.WriteByte(byte(s.PacketID))
-
-		writeVarInt(propLen, w)
-		w.Write(props)
-
-		_, err := w.Write(payload)
-		return err
+		writeUint16(w, s.PacketID)
+		writeProps(w, props)
+		return s.writePayload(w)
 	default:
 		return ErrUnsupportedVersion
 	}
 }
 
-func (s *SubAckPacket) payload() []byte {
-	return s.Codes
+func (s *SubAckPacket) payloadLen() int {
+	return len(s.Codes)
+}
+
+func (s *SubAckPacket) writePayload(w BufferedWriter) error {
+	_, err := w.Write(s.Codes)
+	return err
 }
 
 // SubAckProps properties for SubAckPacket
@@ -223,34 +224,27 @@ type SubAckProps struct {
 	UserProps UserProps
 }
 
-func (p *SubAckProps) props() []byte {
+func (p *SubAckProps) writeProps(w BufferedWriter) {
 	if p == nil {
-		return nil
+		return
 	}
 
-	result := make([]byte, 0)
 	if p.Reason != "" {
-		result = append(result, propKeyReasonString)
-		result = append(result, encodeStringWithLen(p.Reason)...)
+		w.WriteByte(propKeyReasonString)
+		writeStringData(w, p.Reason)
 	}
 
 	if p.UserProps != nil {
-		p.UserProps.encodeTo(result)
+		p.UserProps.writeTo(w)
 	}
-	return result
 }
 
-func (p *SubAckProps) setProps(props map[byte][]byte) {
-	if p == nil || props == nil {
-		return
-	}
-
-	if v, ok := props[propKeyReasonString]; ok {
+func (p *SubAckProps) setProp(key byte, v []byte) {
+	switch key {
+	case propKeyReasonString:
 		p.Reason, _, _ = getStringData(v)
-	}
-
-	if v, ok := props[propKeyUserProps]; ok {
-		p.UserProps = getUserProps(v)
+	case propKeyUserProps:
+		p.UserProps = appendUserProps(p.UserProps, v)
 	}
 }
 
@@ -268,14 +262,21 @@ func (s *UnSubPacket) Type() CtrlType {
 	return CtrlUnSub
 }
 
+// String is the concise summary of the packet
+func (s *UnSubPacket) String() string {
+	if s == nil {
+		return "<nil>"
+	}
+
+	return fmt.Sprintf("UnSub{ID: %d, Topics: %v}", s.PacketID, s.TopicNames)
+}
+
 func (s *UnSubPacket) Bytes() []byte {
 	if s == nil {
 		return nil
 	}
 
-	w := &bytes.Buffer{}
-	s.WriteTo(w)
-	return w.Bytes()
+	return encodeBytes(s)
 }
 
 func (s *UnSubPacket) WriteTo(w BufferedWriter) error {
@@ -286,45 +287,43 @@ func (s *UnSubPacket) WriteTo(w BufferedWriter) error {
 	switch s.ProtoVersion {
 	case 0, V311:
 		w.WriteByte(byte(CtrlUnSub<<4 | 0x02))
-		payload := s.payload()
-		if err := writeVarInt(len(payload)+2, w); err != nil {
+		if err := writeVarInt(s.payloadLen()+2, w); err != nil {
 			return err
 		}
-		w.WriteByte(byte(s.PacketID >> 8))
-		w.WriteByte(byte(s.PacketID))
-		_, err := w.Write(payload)
-		return err
+
+		writeUint16(w, s.PacketID)
+		return s.writePayload(w)
 	case V5:
-		w.WriteByte(byte(CtrlUnSub<<4 | 0x02))
-		props := s.Props.props()
-		payload := s.payload()
-		propLen := len(props)
+		props := encodeProps(s.Props)
+		defer putEncodeBuf(props)
 
-		if err := writeVarInt(len(payload)+propLen+2, w); err != nil {
+		w.WriteByte(byte(CtrlUnSub<<4 | 0x02))
+		if err := writeVarInt(s.payloadLen()+propsLen(props)+2, w); err != nil {
 			return err
 		}
 
-		w.WriteByte(byte(s.PacketID >> 8))
-		w.WriteByte(byte(s.PacketID))
-
-		writeVarInt(propLen, w)
-		w.Write(props)
-
-		_, err := w.Write(payload)
-		return err
+		writeUint16(w, s.PacketID)
+		writeProps(w, props)
+		return s.writePayload(w)
 	default:
 		return ErrUnsupportedVersion
 	}
 }
 
-func (s *UnSubPacket) payload() []byte {
-	result := make([]byte, 0)
-	if s.TopicNames != nil {
-		for _, t := range s.TopicNames {
-			result = append(result, encodeStringWithLen(t)...)
-		}
+func (s *UnSubPacket) payloadLen() int {
+	n := 0
+	for _, t := range s.TopicNames {
+		n += 2 + len(t)
+	}
+	return n
+}
+
+func (s *UnSubPacket) writePayload(w BufferedWriter) error {
+	var err error
+	for _, t := range s.TopicNames {
+		err = writeStringData(w, t)
 	}
-	return result
+	return err
 }
 
 // UnSubProps properties for UnSubPacket
@@ -333,24 +332,20 @@ type UnSubProps struct {
 	UserProps UserProps
 }
 
-func (p *UnSubProps) props() []byte {
+func (p *UnSubProps) writeProps(w BufferedWriter) {
 	if p == nil {
-		return nil
+		return
 	}
-	result := make([]byte, 0)
+
 	if p.UserProps != nil {
-		p.UserProps.encodeTo(result)
+		p.UserProps.writeTo(w)
 	}
-	return result
 }
 
-func (p *UnSubProps) setProps(props map[byte][]byte) {
-	if p == nil || props == nil {
-		return
-	}
-
-	if v, ok := props[propKeyUserProps]; ok {
-		p.UserProps = getUserProps(v)
+func (p *UnSubProps) setProp(key byte, v []byte) {
+	switch key {
+	case propKeyUserProps:
+		p.UserProps = appendUserProps(p.UserProps, v)
 	}
 }
 
@@ -359,7 +354,9 @@ func (p *UnSubProps) setProps(props map[byte][]byte) {
 type UnSubAckPacket struct {
 	BasePacket
 	PacketID uint16
-	Props    *UnSubAckProps
+	// Codes is the reason code of each topic in the UnSubPacket (MQTT 5 only)
+	Codes []byte
+	Props *UnSubAckProps
 }
 
 // Type of UnSubAckPacket is CtrlUnSubAck
@@ -367,14 +364,25 @@ func (s *UnSubAckPacket) Type() CtrlType {
 	return CtrlUnSubAck
 }
 
+// String is the concise summary of the packet
+func (s *UnSubAckPacket) String() string {
+	if s == nil {
+		return "<nil>"
+	}
+
+	if len(s.Codes) > 0 {
+		return fmt.Sprintf("UnSubAck{ID: %d, Codes: %v}", s.PacketID, s.Codes)
+	}
+
+	return fmt.Sprintf("UnSubAck{ID: %d}", s.PacketID)
+}
+
 func (s *UnSubAckPacket) Bytes() []byte {
 	if s == nil {
 		return nil
 	}
 
-	w := &bytes.Buffer{}
-	s.WriteTo(w)
-	return w.Bytes()
+	return encodeBytes(s)
 }
 
 func (s *UnSubAckPacket) WriteTo(w BufferedWriter) error {
@@ -389,20 +397,31 @@ func (s *UnSubAckPacket) WriteTo(w BufferedWriter) error {
 		w.WriteByte(byte(s.PacketID >> 8))
 		return w.WriteByte(byte(s.PacketID))
 	case V5:
+		props := encodeProps(s.Props)
+		defer putEncodeBuf(props)
+
 		w.WriteByte(byte(CtrlUnSubAck << 4))
-		w.WriteByte(0x02)
-		w.WriteByte(byte(s.PacketID >> 8))
-		w.WriteByte(byte(s.PacketID))
+		if err := writeVarInt(s.payloadLen()+propsLen(props)+2, w); err != nil {
+			return err
+		}
 
-		props := s.Props.props()
-		writeVarInt(len(props), w)
-		_, err := w.Write(props)
-		return err
+		writeUint16(w, s.PacketID)
+		writeProps(w, props)
+		return s.writePayload(w)
 	default:
 		return ErrUnsupportedVersion
 	}
 }
 
+func (s *UnSubAckPacket) payloadLen() int {
+	return len(s.Codes)
+}
+
+func (s *UnSubAckPacket) writePayload(w BufferedWriter) error {
+	_, err := w.Write(s.Codes)
+	return err
+}
+
 // UnSubAckProps properties for UnSubAckPacket
 type UnSubAckProps struct {
 	// Human readable string designed for diagnostics
@@ -412,32 +431,26 @@ type UnSubAckProps struct {
 	UserProps UserProps
 }
 
-func (p *UnSubAckProps) props() []byte {
+func (p *UnSubAckProps) writeProps(w BufferedWriter) {
 	if p == nil {
-		return nil
+		return
 	}
-	result := make([]byte, 0)
+
 	if p.Reason != "" {
-		result = append(result, propKeyReasonString)
-		result = append(result, encodeStringWithLen(p.Reason)...)
+		w.WriteByte(propKeyReasonString)
+		writeStringData(w, p.Reason)
 	}
 
 	if p.UserProps != nil {
-		p.UserProps.encodeTo(result)
+		p.UserProps.writeTo(w)
 	}
-	return result
 }
 
-func (p *UnSubAckProps) setProps(props map[byte][]byte) {
-	if p == nil || props == nil {
-		return
-	}
-
-	if v, ok := props[propKeyReasonString]; ok {
+func (p *UnSubAckProps) setProp(key byte, v []byte) {
+	switch key {
+	case propKeyReasonString:
 		p.Reason, _, _ = getStringData(v)
-	}
-
-	if v, ok := props[propKeyUserProps]; ok {
-		p.UserProps = getUserProps(v)
+	case propKeyUserProps:
+		p.UserProps = appendUserProps(p.UserProps, v)
 	}
 }
@@ -49,14 +49,29 @@ func (s *StandardRouter) Name() string {
 	return "StandardRouter"
 }
 
-// Handle defines how to register topic with handler
+// Handle defines how to register topic with handler,
+// topic not a valid topic filter (see ValidateTopicFilter) is ignored
 func (s *StandardRouter) Handle(topic string, h TopicHandler) {
+	if s == nil || s.m == nil || ValidateTopicFilter(topic) != nil {
+		return
+	}
 
+	s.m.Store(topic, h)
 }
 
 // Dispatch defines the action to dispatch published packet
 func (s *StandardRouter) Dispatch(p *PublishPacket) {
+	if s == nil || s.m == nil {
+		return
+	}
 
+	s.m.Range(func(k, v interface{}) bool {
+		if MatchTopic(k.(string), p.TopicName) {
+			handler := v.(TopicHandler)
+			handler(p.TopicName, p.Qos, p.Payload)
+		}
+		return true
+	})
 }
 
 // NewRegexRouter will create a regex router
@@ -104,3 +104,92 @@ func TestRegexRouter_Dispatch(t *testing.T) {
 func TestRestRouter_Dispatch(t *testing.T) {
 
 }
+
+func TestStandardRouter_Dispatch(t *testing.T) {
+	r := NewStandardRouter()
+	allCount, fooCount, levelCount := 0, 0, 0
+
+	r.Handle("#", func(topic string, code byte, msg []byte) {
+		allCount++
+	})
+
+	r.Handle("foo/#", func(topic string, code byte, msg []byte) {
+		fooCount++
+	})
+
+	r.Handle("+/bar", func(topic string, code byte, msg []byte) {
+		levelCount++
+	})
+
+	pkts := []*PublishPacket{
+		{TopicName: "foo"},
+		{TopicName: "foo/bar"},
+		{TopicName: "baz/bar"},
+		{TopicName: "$SYS/bar"},
+	}
+
+	for _, v := range pkts {
+		r.Dispatch(v)
+	}
+
+	if allCount != 3 || fooCount != 2 || levelCount != 2 {
+		t.Error("dispatch count mismatch, all =", allCount, "foo =", fooCount, "level =", levelCount)
+	}
+}
+
+func TestStandardRouter_Handle(t *testing.T) {
+	r := NewStandardRouter()
+	count := 0
+	for _, topic := range []string{"foo/#/bar", "foo+", ""} {
+		r.Handle(topic, func(topic string, code byte, msg []byte) {
+			count++
+		})
+	}
+
+	r.Dispatch(&PublishPacket{TopicName: "foo/bar"})
+	if count != 0 {
+		t.Error("invalid topic filter should be ignored, count =", count)
+	}
+}
+
+type testRouter struct {
+	topics []string
+}
+
+func (r *testRouter) Name() string                        { return "testRouter" }
+func (r *testRouter) Handle(topic string, h TopicHandler) { r.topics = append(r.topics, topic) }
+func (r *testRouter) Dispatch(p *PublishPacket)           {}
+
+func TestClientHandle_CustomRouter(t *testing.T) {
+	r := &testRouter{}
+	c, err := NewClient(WithServer("localhost:1883"), WithRouter(r))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Destroy(true)
+
+	// patterns are left to the router
+	c.Handle("^foo/.*$", func(topic string, qos QosLevel, msg []byte) {})
+	if len(r.topics) != 1 || r.topics[0] != "^foo/.*$" {
+		t.Error("topic not registered to custom router, topics =", r.topics)
+	}
+}
+
+func TestClientHandle_StandardRouter(t *testing.T) {
+	l := &testLogger{}
+	c, err := NewClient(WithServer("localhost:1883"), WithRouter(NewStandardRouter()), WithLogger(l))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Destroy(true)
+
+	c.Handle("foo/#/bar", func(topic string, qos QosLevel, msg []byte) {})
+	if l.level != "E" || l.msg != "HDL topic handler rejected" {
+		t.Error("invalid topic filter should be logged as error, log =", l.level, l.msg)
+	}
+
+	c.Handle("foo/#", func(topic string, qos QosLevel, msg []byte) {})
+	if l.level != "D" || l.msg != "HDL registered topic handler" {
+		t.Error("valid topic filter should be registered, log =", l.level, l.msg)
+	}
+}
@@ -0,0 +1,340 @@
+/*
+ * Copyright Go-IIoT (https://github.com/goiiot)
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package libmqtt
+
+import (
+	"bytes"
+	"errors"
+	"strings"
+	"unicode/utf8"
+)
+
+// rules checked by Decoder in strict mode, errors returned are *ProtocolError
+// wrapping one of them
+var (
+	// ErrReservedFlags is the rule violated when reserved bits are set
+	// in fixed header, connect flags or subscription options
+	ErrReservedFlags = errors.New("reserved flags set ")
+
+	// ErrInvalidUTF8 is the rule violated when a string is not valid UTF-8
+	ErrInvalidUTF8 = errors.New("invalid UTF-8 string ")
+
+	// ErrNulCharacter is the rule violated when a string contains U+0000
+	ErrNulCharacter = errors.New("string contains NUL character ")
+
+	// ErrWildcardTopicName is the rule violated when the topic name
+	// of a PublishPacket contains wildcards
+	ErrWildcardTopicName = errors.New("wildcard in topic name ")
+
+	// ErrInvalidQos is the rule violated when qos level 3 is used
+	ErrInvalidQos = errors.New("invalid qos level ")
+
+	// ErrInvalidDup is the rule violated when the DUP flag is set
+	// for a qos level 0 PublishPacket
+	ErrInvalidDup = errors.New("dup flag set for qos 0 ")
+
+	// ErrDuplicateProp is the rule violated when a property appears
+	// more than once where it's allowed only once
+	ErrDuplicateProp = errors.New("duplicate property ")
+
+	// ErrPropNotAllowed is the rule violated when a property is not
+	// allowed in the packet type
+	ErrPropNotAllowed = errors.New("property not allowed ")
+
+	// ErrVarIntTooLong is the rule violated when the remaining length
+	// takes more than 4 bytes
+	ErrVarIntTooLong = errors.New("variable byte integer too long ")
+)
+
+// ProtocolError is the error returned by Decoder in strict mode when the
+// packet violates the MQTT specification
+//
+// ProtocolError matches ErrProtocol and the rule violated (e.g. ErrInvalidQos)
+// with errors.Is
+type ProtocolError struct {
+	// Code is CodeMalformedPacket or CodeProtoError according to the rule
+	Code ReasonCode
+
+	// PacketType is the type of the packet violating the rule
+	PacketType CtrlType
+
+	// Err is the rule violated
+	Err error
+}
+
+func (e *ProtocolError) Error() string {
+	return ctrlTypeName(e.PacketType) + " packet: " + e.Err.Error() + "(" + e.Code.String() + ")"
+}
+
+// Is reports whether the error belongs to the target error category
+func (e *ProtocolError) Is(target error) bool {
+	return target == ErrProtocol
+}
+
+// Unwrap returns the rule violated
+func (e *ProtocolError) Unwrap() error {
+	return e.Err
+}
+
+func newProtocolError(ctrl CtrlType, rule error) error {
+	code := CodeMalformedPacket
+	switch rule {
+	case ErrDuplicateProp, ErrWildcardTopicName:
+		code = CodeProtoError
+	}
+
+	return &ProtocolError{Code: code, PacketType: ctrl, Err: rule}
+}
+
+// SetStrict set whether to validate decoded packets strictly according to
+// the MQTT specification, packets violating it are rejected with *ProtocolError
+//
+// the packet body is consumed before the rejection except for violations
+// in fixed header
+func (d *Decoder) SetStrict(strict bool) {
+	d.strict = strict
+}
+
+// checkFixedHeader validates flags in fixed header and the length
+// of remaining length
+func checkFixedHeader(header byte, lenBytes int) error {
+	ctrl, flags := header>>4, header&0x0F
+	if lenBytes > 4 {
+		return newProtocolError(ctrl, ErrVarIntTooLong)
+	}
+
+	switch ctrl {
+	case CtrlPublish:
+		if flags&0x06 == 0x06 {
+			return newProtocolError(ctrl, ErrInvalidQos)
+		}
+
+		if flags&0x0E == 0x08 {
+			return newProtocolError(ctrl, ErrInvalidDup)
+		}
+	case CtrlPubRel, CtrlSubscribe, CtrlUnSub:
+		if flags != 0x02 {
+			return newProtocolError(ctrl, ErrReservedFlags)
+		}
+	default:
+		if flags != 0 {
+			return newProtocolError(ctrl, ErrReservedFlags)
+		}
+	}
+
+	return nil
+}
+
+// checkString validates the UTF-8 encoded string
+func checkString(s string) error {
+	if !utf8.ValidString(s) {
+		return ErrInvalidUTF8
+	}
+
+	if strings.IndexByte(s, 0) >= 0 {
+		return ErrNulCharacter
+	}
+	return nil
+}
+
+// checkStringData validates the UTF-8 encoded string in bytes
+func checkStringData(b []byte) error {
+	if !utf8.Valid(b) {
+		return ErrInvalidUTF8
+	}
+
+	if bytes.IndexByte(b, 0) >= 0 {
+		return ErrNulCharacter
+	}
+	return nil
+}
+
+// checkPacket validates fields of the decoded packet, body is the
+// variable header and payload of the packet
+func checkPacket(version ProtoVersion, pkt Packet, body []byte) error {
+	var rule error
+	switch p := pkt.(type) {
+	case *ConnPacket:
+		// connect flags follow the protocol name and level
+		if body[2+len(p.ProtoName)+1]&0x01 != 0 {
+			rule = ErrReservedFlags
+		} else if p.WillQos > Qos2 {
+			rule = ErrInvalidQos
+		} else {
+			rule = checkStrings(p.ProtoName, p.ClientID, p.WillTopic, p.Username)
+		}
+	case *PublishPacket:
+		if rule = checkString(p.TopicName); rule == nil && strings.ContainsAny(p.TopicName, "+#") {
+			rule = ErrWildcardTopicName
+		}
+	case *SubscribePacket:
+		for _, t := range p.Topics {
+			if rule = checkSubOptions(version, t.Qos); rule == nil {
+				rule = checkString(t.Name)
+			}
+
+			if rule != nil {
+				break
+			}
+		}
+	case *UnSubPacket:
+		rule = checkStrings(p.TopicNames...)
+	}
+
+	if rule != nil {
+		return newProtocolError(pkt.Type(), rule)
+	}
+	return nil
+}
+
+func checkStrings(strs ...string) error {
+	for _, s := range strs {
+		if err := checkString(s); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// checkSubOptions validates the subscription options (requested qos in MQTT 3.1.1)
+func checkSubOptions(version ProtoVersion, options byte) error {
+	reserved := byte(0xFC)
+	if version == V5 {
+		// bits of no local, retain as published and retain handling
+		reserved = 0xC0
+		if options>>4&0x03 == 0x03 {
+			return ErrReservedFlags
+		}
+	}
+
+	if options&reserved != 0 {
+		return ErrReservedFlags
+	}
+
+	if options&0x03 == 0x03 {
+		return ErrInvalidQos
+	}
+	return nil
+}
+
+// propMask returns the bit mask of property keys
+func propMask(keys ...byte) uint64 {
+	var mask uint64
+	for _, k := range keys {
+		mask |= 1 << k
+	}
+	return mask
+}
+
+var (
+	// properties allowed in reason string and user properties only packets
+	reasonPropMask = propMask(propKeyReasonString, propKeyUserProps)
+
+	// allowedProps are properties allowed in each packet type
+	allowedProps = [...]uint64{
+		CtrlConn: propMask(propKeySessionExpiryInterval, propKeyAuthMethod, propKeyAuthData,
+			propKeyReqProblemInfo, propKeyReqRespInfo, propKeyMaxRecv, propKeyMaxTopicAlias,
+			propKeyUserProps, propKeyMaxPacketSize),
+		CtrlConnAck: propMask(propKeySessionExpiryInterval, propKeyAssignedClientID,
+			propKeyServerKeepalive, propKeyAuthMethod, propKeyAuthData, propKeyRespInfo,
+			propKeyServerRef, propKeyReasonString, propKeyMaxRecv, propKeyMaxTopicAlias,
+			propKeyMaxQos, propKeyRetainAvail, propKeyUserProps, propKeyMaxPacketSize,
+			propKeyWildcardSubAvail, propKeySubIDAvail, propKeySharedSubAvail),
+		CtrlPublish: propMask(propKeyPayloadFormatIndicator, propKeyMessageExpiryInterval,
+			propKeyContentType, propKeyRespTopic, propKeyCorrelationData, propKeySubID,
+			propKeyTopicAlias, propKeyUserProps),
+		CtrlPubAck:    reasonPropMask,
+		CtrlPubRecv:   reasonPropMask,
+		CtrlPubRel:    reasonPropMask,
+		CtrlPubComp:   reasonPropMask,
+		CtrlSubscribe: propMask(propKeySubID, propKeyUserProps),
+		CtrlSubAck:    reasonPropMask,
+		CtrlUnSub:     propMask(propKeyUserProps),
+		CtrlUnSubAck:  reasonPropMask,
+		CtrlDisConn: propMask(propKeySessionExpiryInterval, propKeyServerRef,
+			propKeyReasonString, propKeyUserProps),
+		CtrlAuth: propMask(propKeyAuthMethod, propKeyAuthData,
+			propKeyReasonString, propKeyUserProps),
+	}
+)
+
+// strictProps validates properties before setting them
+type strictProps struct {
+	ctrl  CtrlType
+	props propsSetter
+	seen  uint64
+	err   error
+}
+
+func (s *strictProps) setProp(key byte, v []byte) {
+	if s.err != nil {
+		return
+	}
+
+	// unknown keys are rejected by rangeProps, all known keys are less than 64
+	bit := uint64(1) << key
+	switch {
+	case int(s.ctrl) >= len(allowedProps) || allowedProps[s.ctrl]&bit == 0:
+		s.err = ErrPropNotAllowed
+	case s.seen&bit != 0 && key != propKeyUserProps && !(key == propKeySubID && s.ctrl == CtrlPublish):
+		s.err = ErrDuplicateProp
+	default:
+		s.err = checkPropStrings(key, v)
+	}
+
+	if s.err != nil {
+		return
+	}
+
+	s.seen |= bit
+	s.props.setProp(key, v)
+}
+
+// checkPropStrings validates strings in the property value
+func checkPropStrings(key byte, v []byte) error {
+	switch key {
+	case propKeyContentType, propKeyRespTopic, propKeyAssignedClientID,
+		propKeyAuthMethod, propKeyRespInfo, propKeyServerRef, propKeyReasonString:
+		return checkStringData(v[2:])
+	case propKeyUserProps:
+		keyEnd := 2 + int(getUint16(v))
+		if err := checkStringData(v[2:keyEnd]); err != nil {
+			return err
+		}
+		return checkStringData(v[keyEnd+2:])
+	}
+	return nil
+}
+
+// rangeProps ranges properties of the packet, properties are validated
+// in strict mode
+func (d *Decoder) rangeProps(ctrl CtrlType, data []byte, props propsSetter) ([]byte, error) {
+	if !d.strict {
+		return rangeProps(data, props)
+	}
+
+	s := &strictProps{ctrl: ctrl, props: props}
+	next, err := rangeProps(data, s)
+	if err != nil {
+		return nil, err
+	}
+
+	if s.err != nil {
+		return nil, newProtocolError(ctrl, s.err)
+	}
+	return next, nil
+}
@@ -0,0 +1,168 @@
+/*
+ * Copyright Go-IIoT (https://github.com/goiiot)
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package libmqtt
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"testing"
+	"time"
+)
+
+func testStrictDecode(version ProtoVersion, data []byte) (Packet, error) {
+	d := NewDecoder(version, bytes.NewBuffer(data))
+	d.SetStrict(true)
+	return d.Decode()
+}
+
+func TestDecoder_StrictValid(t *testing.T) {
+	pkts := []Packet{
+		&ConnPacket{ClientID: "client", IsWill: true, WillTopic: "will", WillQos: Qos2, Username: "user"},
+		&PublishPacket{TopicName: "foo/bar", Qos: Qos2, PacketID: testPacketID},
+		&PubRelPacket{PacketID: testPacketID},
+		&SubscribePacket{PacketID: testPacketID, Topics: []*Topic{{Name: "foo/+/#", Qos: Qos2}}},
+		&UnSubPacket{PacketID: testPacketID, TopicNames: []string{"foo/#"}},
+		PingReqPacket,
+		&DisConnPacket{},
+	}
+
+	for _, p := range pkts {
+		if _, err := testStrictDecode(V311, p.Bytes()); err != nil {
+			t.Error("valid MQTT 3.1.1 packet rejected, packet =", ctrlTypeName(p.Type()), "err =", err)
+		}
+	}
+
+	for _, p := range testV5Packets() {
+		if _, err := testStrictDecode(V5, p.Bytes()); err != nil {
+			t.Error("valid MQTT 5 packet rejected, packet =", ctrlTypeName(p.Type()), "err =", err)
+		}
+	}
+}
+
+func TestDecoder_Strict(t *testing.T) {
+	connFlags := func(flags byte) []byte {
+		data := (&ConnPacket{ClientID: "a"}).Bytes()
+		// fixed header (2), protocol name (6), protocol level (1)
+		data[9] |= flags
+		return data
+	}
+
+	cases := []struct {
+		name    string
+		version ProtoVersion
+		data    []byte
+		rule    error
+		code    ReasonCode
+	}{
+		{"PubAckFlags", V311, []byte{0x41, 2, 0, 1}, ErrReservedFlags, CodeMalformedPacket},
+		{"PingReqFlags", V311, []byte{0xC8, 0}, ErrReservedFlags, CodeMalformedPacket},
+		{"PubRelFlags", V311, []byte{0x60, 2, 0, 1}, ErrReservedFlags, CodeMalformedPacket},
+		{"SubscribeFlags", V311, []byte{0x80, 6, 0, 1, 0, 1, 'a', 0}, ErrReservedFlags, CodeMalformedPacket},
+		{"UnSubFlags", V311, []byte{0xA0, 5, 0, 1, 0, 1, 'a'}, ErrReservedFlags, CodeMalformedPacket},
+		{"ConnFlags", V311, connFlags(0x01), ErrReservedFlags, CodeMalformedPacket},
+		{"SubOptions", V311, []byte{0x82, 6, 0, 1, 0, 1, 'a', 0x04}, ErrReservedFlags, CodeMalformedPacket},
+		{"SubOptionsV5", V5, []byte{0x82, 7, 0, 1, 0, 0, 1, 'a', 0x40}, ErrReservedFlags, CodeMalformedPacket},
+		{"RetainHandlingV5", V5, []byte{0x82, 7, 0, 1, 0, 0, 1, 'a', 0x30}, ErrReservedFlags, CodeMalformedPacket},
+		{"PublishQos3", V311, []byte{0x36, 5, 0, 1, 'a', 0, 1}, ErrInvalidQos, CodeMalformedPacket},
+		{"PublishDupQos0", V311, []byte{0x38, 3, 0, 1, 'a'}, ErrInvalidDup, CodeMalformedPacket},
+		{"WillQos3", V311, connFlags(0x18), ErrInvalidQos, CodeMalformedPacket},
+		{"SubscribeQos3", V311, []byte{0x82, 6, 0, 1, 0, 1, 'a', 3}, ErrInvalidQos, CodeMalformedPacket},
+		{"PublishTopicUTF8", V311, []byte{0x30, 3, 0, 1, 0xFF}, ErrInvalidUTF8, CodeMalformedPacket},
+		{"PublishTopicNul", V311, []byte{0x30, 3, 0, 1, 0}, ErrNulCharacter, CodeMalformedPacket},
+		{"SubscribeTopicUTF8", V311, []byte{0x82, 6, 0, 1, 0, 1, 0xC0, 0}, ErrInvalidUTF8, CodeMalformedPacket},
+		{"UnSubTopicNul", V311, []byte{0xA2, 6, 0, 1, 0, 2, 'a', 0}, ErrNulCharacter, CodeMalformedPacket},
+		{"ClientIDUTF8", V311, append([]byte{0x10, 13}, append((&ConnPacket{}).Bytes()[2:12], 0, 1, 0xFF)...), ErrInvalidUTF8, CodeMalformedPacket},
+		{"ReasonStringUTF8", V5, []byte{0x40, 8, 0, 1, 0, 4, 0x1F, 0, 1, 0xFF}, ErrInvalidUTF8, CodeMalformedPacket},
+		{"UserPropsNul", V5, []byte{0x40, 11, 0, 1, 0, 7, 0x26, 0, 1, 'k', 0, 1, 0}, ErrNulCharacter, CodeMalformedPacket},
+		{"PublishWildcard", V311, []byte{0x30, 5, 0, 3, 'a', '/', '#'}, ErrWildcardTopicName, CodeProtoError},
+		{"PublishSingleWildcard", V5, []byte{0x30, 6, 0, 3, '+', '/', 'a', 0}, ErrWildcardTopicName, CodeProtoError},
+		{"DuplicateReason", V5, []byte{0x40, 12, 0, 1, 0, 8, 0x1F, 0, 1, 'a', 0x1F, 0, 1, 'b'}, ErrDuplicateProp, CodeProtoError},
+		{"DuplicateSubID", V5, []byte{0x82, 11, 0, 1, 4, 0x0B, 1, 0x0B, 2, 0, 1, 'a', 0}, ErrDuplicateProp, CodeProtoError},
+		{"DuplicateTopicAlias", V5, []byte{0x30, 10, 0, 1, 'a', 6, 0x23, 0, 1, 0x23, 0, 2}, ErrDuplicateProp, CodeProtoError},
+		{"PubAckTopicAlias", V5, []byte{0x40, 7, 0, 1, 0, 3, 0x23, 0, 1}, ErrPropNotAllowed, CodeMalformedPacket},
+		{"ConnAckSubID", V5, []byte{0x20, 5, 0, 0, 2, 0x0B, 1}, ErrPropNotAllowed, CodeMalformedPacket},
+		{"RemainLengthTooLong", V311, []byte{0x30, 0xFF, 0xFF, 0xFF, 0xFF, 0x01}, ErrVarIntTooLong, CodeMalformedPacket},
+	}
+
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			_, err := testStrictDecode(c.version, c.data)
+			if !errors.Is(err, c.rule) || !errors.Is(err, ErrProtocol) {
+				t.Fatal("rule violation not detected, err =", err)
+			}
+
+			var protoErr *ProtocolError
+			if !errors.As(err, &protoErr) || protoErr.Code != c.code || protoErr.PacketType != c.data[0]>>4 {
+				t.Error("protocol error mismatch, err =", err)
+			}
+		})
+	}
+}
+
+func TestDecoder_StrictMultipleProps(t *testing.T) {
+	// user properties and subscription identifiers in publish can appear more than once
+	data := []byte{0x30, 0, 0, 1, 'a', 18, 0x0B, 1, 0x0B, 2, 0x26, 0, 1, 'k', 0, 1, 'v', 0x26, 0, 1, 'k', 0, 1, 'w'}
+	data[1] = byte(len(data) - 2)
+	pkt, err := testStrictDecode(V5, data)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	props := pkt.(*PublishPacket).Props
+	if len(props.SubIDs) != 2 || len(props.UserProps["k"]) != 2 {
+		t.Error("properties mismatch, props =", props)
+	}
+}
+
+func TestClientStrictDecoding(t *testing.T) {
+	l := testBrokerWith(t, func(rw *bufio.ReadWriter) {
+		// qos 0 publish with DUP flag
+		rw.Write([]byte{0x38, 3, 0, 1, 'a'})
+		rw.Flush()
+		time.Sleep(100 * time.Millisecond)
+	})
+	defer l.Close()
+
+	c, err := NewClient(WithServer(l.Addr().String()),
+		WithBackoffStrategy(time.Minute, time.Minute, 1),
+		WithStrictDecoding(true),
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Destroy(true)
+
+	c.Handle("a", func(topic string, qos QosLevel, msg []byte) {
+		t.Error("invalid packet dispatched")
+	})
+
+	netErrC := make(chan error, 1)
+	c.HandleNet(func(server string, err error) {
+		netErrC <- err
+	})
+	c.Connect(nil)
+
+	select {
+	case err := <-netErrC:
+		if !errors.Is(err, ErrInvalidDup) {
+			t.Error("net error should be protocol error, err =", err)
+		}
+	case <-time.After(time.Second):
+		t.Error("connection not closed")
+	}
+}
@@ -0,0 +1,166 @@
+/*
+ * Copyright Go-IIoT (https://github.com/goiiot)
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package libmqtt
+
+import (
+	"context"
+	"sync"
+)
+
+// Token is the completion token of one publish, subscribe or unsubscribe
+// packet, it's done when the packet is acknowledged by the server
+// (or sent to server for QoS 0 publish packet), or failed to send
+type Token struct {
+	ctx    context.Context // client context
+	done   chan struct{}
+	once   *sync.Once
+	err    error
+	code   ReasonCode
+	codes  []byte
+	reason string
+}
+
+func newToken(ctx context.Context) *Token {
+	return &Token{
+		ctx:  ctx,
+		done: make(chan struct{}),
+		once: &sync.Once{},
+	}
+}
+
+// Done returns a channel closed when the token is done
+func (t *Token) Done() <-chan struct{} {
+	return t.done
+}
+
+// Wait until the token is done or the ctx is done,
+// returns the error of the token or the ctx error
+//
+// packet rejected by server results in a *ReasonError
+func (t *Token) Wait(ctx context.Context) error {
+	select {
+	case <-t.done:
+		return t.err
+	default:
+	}
+
+	select {
+	case <-t.done:
+		return t.err
+	case <-ctx.Done():
+		return ctx.Err()
+	case <-t.ctx.Done():
+		return ErrClientClosed
+	}
+}
+
+// Err returns the error of the packet, nil if not done or succeeded
+func (t *Token) Err() error {
+	select {
+	case <-t.done:
+		return t.err
+	default:
+		return nil
+	}
+}
+
+// Code is the reason code in PubAckPacket, PubRecvPacket (if failed)
+// or PubCompPacket for publish packet,
+// for subscribe and unsubscribe, it's the first code in Codes
+func (t *Token) Code() ReasonCode {
+	select {
+	case <-t.done:
+		return t.code
+	default:
+		return CodeSuccess
+	}
+}
+
+// Codes is the reason codes in SubAckPacket or UnSubAckPacket (MQTT 5 only)
+// one code per topic, in the same order of the topics
+func (t *Token) Codes() []byte {
+	select {
+	case <-t.done:
+		return t.codes
+	default:
+		return nil
+	}
+}
+
+// Reason is the reason string in ack packet (MQTT 5 only)
+func (t *Token) Reason() string {
+	select {
+	case <-t.done:
+		return t.reason
+	default:
+		return ""
+	}
+}
+
+// finish the token with ack packet or error, the failure reason of ack
+// should be passed in as err (see reasonErrorOf)
+func (t *Token) finish(ack Packet, err error) {
+	t.once.Do(func() {
+		switch p := ack.(type) {
+		case *PubAckPacket:
+			t.code = p.Code
+			if p.Props != nil {
+				t.reason = p.Props.Reason
+			}
+		case *PubRecvPacket:
+			t.code = p.Code
+			if p.Props != nil {
+				t.reason = p.Props.Reason
+			}
+		case *PubCompPacket:
+			t.code = p.Code
+			if p.Props != nil {
+				t.reason = p.Props.Reason
+			}
+		case *SubAckPacket:
+			t.codes = p.Codes
+			if len(p.Codes) > 0 {
+				t.code = ReasonCode(p.Codes[0])
+			}
+			if p.Props != nil {
+				t.reason = p.Props.Reason
+			}
+		case *UnSubAckPacket:
+			t.codes = p.Codes
+			if len(p.Codes) > 0 {
+				t.code = ReasonCode(p.Codes[0])
+			}
+			if p.Props != nil {
+				t.reason = p.Props.Reason
+			}
+		}
+
+		t.err = err
+		close(t.done)
+	})
+}
+
+// waitTokens wait all tokens done, returns the first error occurred
+func waitTokens(ctx context.Context, tokens []*Token) error {
+	var result error
+	for _, t := range tokens {
+		if err := t.Wait(ctx); err != nil && result == nil {
+			result = err
+		}
+	}
+	return result
+}
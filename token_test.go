@@ -0,0 +1,195 @@
+/*
+ * Copyright Go-IIoT (https://github.com/goiiot)
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package libmqtt
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+)
+
+func TestToken_Finish(t *testing.T) {
+	ctx := context.TODO()
+	testErr := errors.New("test error")
+
+	for _, c := range []struct {
+		version ProtoVersion
+		ack     Packet
+		err     error
+		code    ReasonCode
+		reason  string
+		result  error
+	}{
+		{ack: nil, err: nil, code: CodeSuccess},
+		{ack: nil, err: testErr, code: CodeSuccess, result: testErr},
+		{ack: &PubAckPacket{Code: CodeNoMatchingSubscribers}, code: CodeNoMatchingSubscribers},
+		{ack: &PubAckPacket{Code: CodeQuotaExceeded, Props: &PubAckProps{Reason: "quota"}},
+			code: CodeQuotaExceeded, reason: "quota", result: ErrQuota},
+		{ack: &PubRecvPacket{Code: CodeNotAuthorized}, code: CodeNotAuthorized, result: ErrAuth},
+		{ack: &PubCompPacket{Code: CodeSuccess, Props: &PubCompProps{Reason: "ok"}}, code: CodeSuccess, reason: "ok"},
+		{ack: &SubAckPacket{Codes: []byte{SubOkMaxQos1, SubFail}}, code: SubOkMaxQos1, result: ErrRejectedByServer},
+		{ack: &UnSubAckPacket{Props: &UnSubAckProps{Reason: "ok"}}, code: CodeSuccess, reason: "ok"},
+		{version: V5, ack: &UnSubAckPacket{Codes: []byte{byte(CodeNoSubscriptionExisted), byte(CodeNotAuthorized)}},
+			code: CodeNoSubscriptionExisted, result: ErrAuth},
+		{version: V311, ack: &UnSubAckPacket{}, code: CodeSuccess},
+	} {
+		tk := newToken(ctx)
+		if tk.Err() != nil || tk.Code() != CodeSuccess || tk.Reason() != "" {
+			t.Error("token not done should have no result")
+		}
+
+		err := c.err
+		if err == nil {
+			if c.version == 0 {
+				c.version = V5
+			}
+			err = reasonErrorOf(c.version, c.ack)
+		}
+
+		tk.finish(c.ack, err)
+		// finish only once
+		tk.finish(nil, testErr)
+
+		select {
+		case <-tk.Done():
+		default:
+			t.Error("token not done")
+		}
+
+		if err := tk.Wait(ctx); (c.result == nil && err != nil) || !errors.Is(err, c.result) {
+			t.Error("token error mismatch, err =", err, "target =", c.result)
+		}
+
+		if tk.Code() != c.code || tk.Reason() != c.reason {
+			t.Error("token result mismatch, code =", tk.Code(), "reason =", tk.Reason())
+		}
+	}
+}
+
+func TestToken_Wait(t *testing.T) {
+	clientCtx, exit := context.WithCancel(context.TODO())
+	tk := newToken(clientCtx)
+
+	ctx, cancel := context.WithTimeout(context.TODO(), 10*time.Millisecond)
+	defer cancel()
+	if err := tk.Wait(ctx); err != context.DeadlineExceeded {
+		t.Error("wait should time out, err =", err)
+	}
+
+	exit()
+	if err := tk.Wait(context.TODO()); err != ErrClientClosed {
+		t.Error("wait should fail when client closed, err =", err)
+	}
+}
+
+func TestToken_InFlight(t *testing.T) {
+	c, err := NewClient(WithServer("localhost:1883"), WithOfflineQueue(4, OfflineError, nil))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Destroy(true)
+
+	for _, qos := range []QosLevel{Qos0, Qos1} {
+		p := &PublishPacket{TopicName: "foo", Qos: qos}
+		tokens := c.PublishAsync(context.TODO(), p, p)
+		if tokens[0].Err() != nil {
+			t.Error("queued packet should not be done, qos =", qos)
+		}
+
+		if tokens[1].Err() != ErrPacketInFlight {
+			t.Error("packet in flight should fail, qos =", qos, "err =", tokens[1].Err())
+		}
+
+		c.finishToken(p, nil, nil)
+		select {
+		case <-tokens[0].Done():
+		default:
+			t.Error("token of packet in flight not finished, qos =", qos)
+		}
+	}
+
+	p := &PublishPacket{TopicName: "bar", Qos: Qos1}
+	if err := c.TryPublish(p); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := c.TryPublish(p); err != ErrPacketInFlight {
+		t.Error("packet in flight should fail, err =", err)
+	}
+
+	if tk := c.PublishAsync(context.TODO(), p)[0]; tk.Err() != ErrPacketInFlight {
+		t.Error("packet in flight should fail, err =", tk.Err())
+	}
+
+	// flushed and acknowledged
+	flushed := make(chan struct{})
+	c.workers.Add(1)
+	go func() {
+		c.flushOffline(c.ctx)
+		close(flushed)
+	}()
+	for pkt := range c.sendC {
+		if pkt == p {
+			break
+		}
+	}
+	<-flushed
+	if originPkt, ok := c.idGen.getExtra(p.PacketID); !ok || originPkt != p {
+		t.Error("packet id not reserved, id =", p.PacketID)
+	}
+
+	c.idGen.free(p.PacketID)
+	if err := c.TryPublish(p); err != nil {
+		t.Error("published packet should be published again, err =", err)
+	}
+
+	if !c.offline.contains(p) {
+		t.Error("published packet not queued again")
+	}
+}
+
+func TestClient_Token(t *testing.T) {
+	c, err := NewClient(WithServer("localhost:1883"), WithOfflineQueue(1, OfflineError, nil))
+	if err != nil {
+		t.Error(err)
+		return
+	}
+
+	tokens := c.PublishAsync(context.TODO(), &PublishPacket{TopicName: "foo", Qos: Qos1}, nil, &PublishPacket{TopicName: "bar"})
+	if len(tokens) != 3 {
+		t.Error("token count mismatch")
+		return
+	}
+
+	if tokens[0].Err() != nil {
+		t.Error("queued packet should not be done")
+	}
+
+	if tokens[1].Err() != ErrEncodeBadPacket || tokens[2].Err() != ErrQueueFull {
+		t.Error("packet should fail, err =", tokens[1].Err(), tokens[2].Err())
+	}
+
+	c.Destroy(true)
+	if err := c.SubscribeSync(context.TODO(), &Topic{Name: "foo"}); err != ErrClientClosed {
+		t.Error("subscribe should fail when client closed, err =", err)
+	}
+
+	if err := c.UnSubscribeSync(context.TODO(), "foo"); err != ErrClientClosed {
+		t.Error("unsubscribe should fail when client closed, err =", err)
+	}
+}
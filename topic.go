@@ -0,0 +1,201 @@
+/*
+ * Copyright Go-IIoT (https://github.com/goiiot)
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package libmqtt
+
+import (
+	"errors"
+	"strconv"
+	"strings"
+)
+
+const (
+	// maxTopicLen is the max length of topic names and topic filters in bytes
+	maxTopicLen = 65535
+
+	// sharePrefix is the prefix of shared subscription topic filters
+	sharePrefix = "$share/"
+)
+
+var (
+	// ErrInvalidTopic is the error happened when the topic name or topic filter
+	// is invalid, all *TopicError match it with errors.Is
+	ErrInvalidTopic = newKindError(ErrProtocol, "invalid topic ")
+
+	// ErrTopicEmpty is the rule violated when the topic is empty
+	ErrTopicEmpty = errors.New("empty topic ")
+
+	// ErrTopicTooLong is the rule violated when the topic is longer than 65535 bytes
+	ErrTopicTooLong = errors.New("topic too long ")
+
+	// ErrInvalidWildcard is the rule violated when wildcards in topic filter
+	// do not occupy an entire topic level, or the multi-level wildcard is
+	// not the last level
+	ErrInvalidWildcard = errors.New("invalid wildcard placement ")
+
+	// ErrInvalidShareName is the rule violated when the shared subscription
+	// has no share name, no topic filter, or wildcards in share name
+	ErrInvalidShareName = errors.New("invalid shared subscription ")
+)
+
+// TopicError is the error happened when the topic name or topic filter
+// violates the MQTT specification
+//
+// TopicError matches ErrInvalidTopic, ErrProtocol and the rule violated
+// (e.g. ErrWildcardTopicName, ErrNulCharacter) with errors.Is
+type TopicError struct {
+	// Topic is the invalid topic name or topic filter
+	Topic string
+
+	// Err is the rule violated
+	Err error
+}
+
+func (e *TopicError) Error() string {
+	return "invalid topic " + strconv.Quote(e.Topic) + ": " + e.Err.Error()
+}
+
+// Is reports whether the error is ErrInvalidTopic or belongs to the
+// target error category
+func (e *TopicError) Is(target error) bool {
+	return target == ErrInvalidTopic || target == ErrProtocol
+}
+
+// Unwrap returns the rule violated
+func (e *TopicError) Unwrap() error {
+	return e.Err
+}
+
+// ValidateTopicName checks the topic name used to publish messages,
+// returns *TopicError if invalid
+func ValidateTopicName(name string) error {
+	if err := checkTopic(name); err != nil {
+		return &TopicError{Topic: name, Err: err}
+	}
+
+	if strings.ContainsAny(name, "+#") {
+		return &TopicError{Topic: name, Err: ErrWildcardTopicName}
+	}
+	return nil
+}
+
+// ValidateTopicFilter checks the topic filter used to subscribe and
+// unsubscribe, shared subscriptions ($share/{ShareName}/{filter}) are
+// supported, returns *TopicError if invalid
+func ValidateTopicFilter(filter string) error {
+	if err := checkTopic(filter); err != nil {
+		return &TopicError{Topic: filter, Err: err}
+	}
+
+	f := filter
+	if strings.HasPrefix(f, sharePrefix) {
+		shareName, rest, ok := splitShare(f)
+		if !ok || shareName == "" || rest == "" || strings.ContainsAny(shareName, "+#") {
+			return &TopicError{Topic: filter, Err: ErrInvalidShareName}
+		}
+		f = rest
+	}
+
+	for i := 0; i < len(f); i++ {
+		switch f[i] {
+		case '#':
+			if i != len(f)-1 || (i > 0 && f[i-1] != '/') {
+				return &TopicError{Topic: filter, Err: ErrInvalidWildcard}
+			}
+		case '+':
+			if (i > 0 && f[i-1] != '/') || (i < len(f)-1 && f[i+1] != '/') {
+				return &TopicError{Topic: filter, Err: ErrInvalidWildcard}
+			}
+		}
+	}
+
+	return nil
+}
+
+// MatchTopic reports whether the topic name matches the topic filter,
+// the topic filter is expected to be valid (see ValidateTopicFilter)
+//
+// topic names starting with '$' are not matched by topic filters
+// starting with wildcards, shared subscriptions match the same topic names
+// as their topic filters
+func MatchTopic(filter, name string) bool {
+	if strings.HasPrefix(filter, sharePrefix) {
+		_, rest, ok := splitShare(filter)
+		if !ok {
+			return false
+		}
+		filter = rest
+	}
+
+	if strings.HasPrefix(name, "$") && (strings.HasPrefix(filter, "+") || strings.HasPrefix(filter, "#")) {
+		return false
+	}
+
+	for {
+		fLevel, fRest, fMore := nextTopicLevel(filter)
+		if fLevel == "#" {
+			return true
+		}
+
+		nLevel, nRest, nMore := nextTopicLevel(name)
+		if fLevel != "+" && fLevel != nLevel {
+			return false
+		}
+
+		switch {
+		case !fMore:
+			return !nMore
+		case !nMore:
+			// multi-level wildcard matches the parent level
+			return fRest == "#"
+		}
+
+		filter, name = fRest, nRest
+	}
+}
+
+// checkTopic checks rules shared by topic names and topic filters
+func checkTopic(topic string) error {
+	if topic == "" {
+		return ErrTopicEmpty
+	}
+
+	if len(topic) > maxTopicLen {
+		return ErrTopicTooLong
+	}
+
+	return checkString(topic)
+}
+
+// splitShare splits the shared subscription into share name and topic filter
+func splitShare(filter string) (shareName, rest string, ok bool) {
+	s := filter[len(sharePrefix):]
+	i := strings.IndexByte(s, '/')
+	if i < 0 {
+		return "", "", false
+	}
+	return s[:i], s[i+1:], true
+}
+
+// nextTopicLevel returns the first level of the topic, the rest levels
+// and whether there are more levels
+func nextTopicLevel(topic string) (level, rest string, more bool) {
+	i := strings.IndexByte(topic, '/')
+	if i < 0 {
+		return topic, "", false
+	}
+	return topic[:i], topic[i+1:], true
+}
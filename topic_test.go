@@ -0,0 +1,170 @@
+/*
+ * Copyright Go-IIoT (https://github.com/goiiot)
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package libmqtt
+
+import (
+	"context"
+	"errors"
+	"strings"
+	"testing"
+)
+
+func TestValidateTopicName(t *testing.T) {
+	cases := []struct {
+		name string
+		rule error
+	}{
+		{"foo/bar", nil},
+		{"/", nil},
+		{"foo//bar", nil},
+		{"$SYS/broker", nil},
+		{"中文/topic", nil},
+		{"", ErrTopicEmpty},
+		{strings.Repeat("a", maxTopicLen+1), ErrTopicTooLong},
+		{"foo/+", ErrWildcardTopicName},
+		{"foo/#", ErrWildcardTopicName},
+		{"foo\x00bar", ErrNulCharacter},
+		{"foo\xffbar", ErrInvalidUTF8},
+	}
+
+	for _, c := range cases {
+		err := ValidateTopicName(c.name)
+		if c.rule == nil {
+			if err != nil {
+				t.Errorf("valid topic name %q rejected, err = %v", c.name, err)
+			}
+			continue
+		}
+
+		var topicErr *TopicError
+		if !errors.Is(err, c.rule) || !errors.Is(err, ErrInvalidTopic) ||
+			!errors.As(err, &topicErr) || topicErr.Topic != c.name {
+			t.Errorf("invalid topic name %q not rejected, err = %v", c.name, err)
+		}
+	}
+}
+
+func TestValidateTopicFilter(t *testing.T) {
+	cases := []struct {
+		filter string
+		rule   error
+	}{
+		{"foo/bar", nil},
+		{"#", nil},
+		{"+", nil},
+		{"foo/#", nil},
+		{"+/+/#", nil},
+		{"foo/+/bar", nil},
+		{"/+", nil},
+		{"$share/group/foo/#", nil},
+		{"$share/group/#", nil},
+		{"", ErrTopicEmpty},
+		{strings.Repeat("a", maxTopicLen+1), ErrTopicTooLong},
+		{"foo\x00", ErrNulCharacter},
+		{"\xc0", ErrInvalidUTF8},
+		{"foo#", ErrInvalidWildcard},
+		{"foo/#/bar", ErrInvalidWildcard},
+		{"foo+", ErrInvalidWildcard},
+		{"foo/+bar", ErrInvalidWildcard},
+		{"##", ErrInvalidWildcard},
+		{"$share/group", ErrInvalidShareName},
+		{"$share//foo", ErrInvalidShareName},
+		{"$share/group/", ErrInvalidShareName},
+		{"$share/gr+oup/foo", ErrInvalidShareName},
+		{"$share/group/foo#", ErrInvalidWildcard},
+	}
+
+	for _, c := range cases {
+		err := ValidateTopicFilter(c.filter)
+		if c.rule == nil {
+			if err != nil {
+				t.Errorf("valid topic filter %q rejected, err = %v", c.filter, err)
+			}
+			continue
+		}
+
+		if !errors.Is(err, c.rule) || !errors.Is(err, ErrProtocol) {
+			t.Errorf("invalid topic filter %q not rejected, err = %v", c.filter, err)
+		}
+	}
+}
+
+func TestMatchTopic(t *testing.T) {
+	cases := []struct {
+		filter, name string
+		match        bool
+	}{
+		{"foo/bar", "foo/bar", true},
+		{"foo/bar", "foo/baz", false},
+		{"foo/bar", "foo/bar/baz", false},
+		{"foo/+", "foo/bar", true},
+		{"foo/+", "foo/", true},
+		{"foo/+", "foo", false},
+		{"foo/+", "foo/bar/baz", false},
+		{"+/+", "/foo", true},
+		{"+", "foo", true},
+		{"+", "/foo", false},
+		{"foo/#", "foo", true},
+		{"foo/#", "foo/bar/baz", true},
+		{"foo/#", "bar", false},
+		{"#", "foo/bar", true},
+		{"#", "$SYS/broker", false},
+		{"+/broker", "$SYS/broker", false},
+		{"$SYS/#", "$SYS/broker", true},
+		{"$share/group/foo/+", "foo/bar", true},
+		{"$share/group/foo/+", "bar/foo", false},
+	}
+
+	for _, c := range cases {
+		if MatchTopic(c.filter, c.name) != c.match {
+			t.Errorf("match %q with %q, expected %v", c.filter, c.name, c.match)
+		}
+	}
+}
+
+func TestClientTopicValidation(t *testing.T) {
+	c, err := NewClient(WithServer("127.0.0.1:0"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Destroy(true)
+
+	if err := c.TryPublish(&PublishPacket{TopicName: "foo/#", Qos: Qos1}); !errors.Is(err, ErrWildcardTopicName) {
+		t.Error("publish to invalid topic not rejected, err =", err)
+	}
+
+	// empty topic name with topic alias
+	if err := checkPubTopic(&PublishPacket{Props: &PublishProps{TopicAlias: 1}}); err != nil {
+		t.Error("publish with topic alias rejected, err =", err)
+	}
+
+	// invalid inputs are rejected synchronously, no waiting required
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+
+	if err := c.PublishSync(ctx, &PublishPacket{TopicName: ""}); !errors.Is(err, ErrTopicEmpty) {
+		t.Error("publish to empty topic not rejected, err =", err)
+	}
+
+	if err := c.SubscribeSync(ctx, &Topic{Name: "foo"}, &Topic{Name: "foo/#/bar"}); !errors.Is(err, ErrInvalidWildcard) {
+		t.Error("subscribe invalid topic filter not rejected, err =", err)
+	}
+
+	if err := c.UnSubscribeSync(ctx, "$share/foo"); !errors.Is(err, ErrInvalidShareName) {
+		t.Error("unsubscribe invalid topic filter not rejected, err =", err)
+	}
+}
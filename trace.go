@@ -0,0 +1,165 @@
+/*
+ * Copyright Go-IIoT (https://github.com/goiiot)
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package libmqtt
+
+import "context"
+
+// user property keys of W3C trace context
+const (
+	TraceParentKey = "traceparent"
+	TraceStateKey  = "tracestate"
+)
+
+// TraceContext is the W3C trace context propagated with
+// user properties of publish packet (MQTT 5 only)
+type TraceContext struct {
+	// TraceParent in form of "version-traceid-parentid-flags",
+	// e.g. "00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01"
+	TraceParent string
+
+	// TraceState is the vendor specific trace info
+	TraceState string
+}
+
+// IsValid reports whether the TraceParent is well formed
+func (t TraceContext) IsValid() bool {
+	const (
+		// 2 + 1 + 32 + 1 + 16 + 1 + 2
+		traceParentLen = 55
+	)
+
+	s := t.TraceParent
+	if len(s) < traceParentLen || s[2] != '-' || s[35] != '-' || s[52] != '-' {
+		return false
+	}
+
+	// version ff is invalid, version 00 has fixed length
+	if s[:2] == "ff" || (s[:2] == "00" && len(s) != traceParentLen) {
+		return false
+	}
+
+	for _, part := range []string{s[:2], s[3:35], s[36:52], s[53:55]} {
+		if !isLowerHex(part) {
+			return false
+		}
+	}
+
+	// all zero trace id or parent id is invalid
+	return s[3:35] != "00000000000000000000000000000000" && s[36:52] != "0000000000000000"
+}
+
+func isLowerHex(s string) bool {
+	for i := 0; i < len(s); i++ {
+		if !(s[i] >= '0' && s[i] <= '9' || s[i] >= 'a' && s[i] <= 'f') {
+			return false
+		}
+	}
+	return true
+}
+
+// InjectTrace sets the trace context to the user properties of the
+// publish packet, replacing the one present (if any), invalid trace
+// context is ignored
+//
+// the client never replaces trace context set by user, it only injects
+// the one returned by Tracer.StartPublish into the copy of packets without
+// it when sending, packets published are not modified
+func InjectTrace(p *PublishPacket, t TraceContext) {
+	if p == nil || !t.IsValid() {
+		return
+	}
+
+	props := &PublishProps{}
+	if p.Props != nil {
+		*props = *p.Props
+	}
+
+	// copy user props to avoid modifying the map shared with others
+	userProps := make(UserProps, len(props.UserProps)+2)
+	for k, v := range props.UserProps {
+		userProps[k] = v
+	}
+
+	userProps[TraceParentKey] = []string{t.TraceParent}
+	if t.TraceState != "" {
+		userProps[TraceStateKey] = []string{t.TraceState}
+	} else {
+		delete(userProps, TraceStateKey)
+	}
+
+	props.UserProps = userProps
+	p.Props = props
+}
+
+// ExtractTrace gets the trace context from the user properties of the
+// publish packet, empty TraceContext returned if not present or invalid
+func ExtractTrace(p *PublishPacket) TraceContext {
+	if p == nil || p.Props == nil {
+		return TraceContext{}
+	}
+
+	t := TraceContext{}
+	if v := p.Props.UserProps[TraceParentKey]; len(v) == 1 {
+		t.TraceParent = v[0]
+	}
+
+	if !t.IsValid() {
+		return TraceContext{}
+	}
+
+	if v := p.Props.UserProps[TraceStateKey]; len(v) > 0 {
+		t.TraceState = v[0]
+	}
+	return t
+}
+
+// pubSpan is the span of publishing a packet and its trace context
+type pubSpan struct {
+	span  Span
+	trace TraceContext
+}
+
+// Span is the span started by Tracer
+type Span interface {
+	// End the span, err is the error happened in the span (if any)
+	End(err error)
+}
+
+// Tracer starts spans for publish and receive, implement it with
+// the tracing SDK in use
+type Tracer interface {
+	// StartPublish starts the span of publishing a packet to topic,
+	// the span ends when the packet acknowledged (or sent for QoS 0)
+	// or failed
+	//
+	// ctx is the one passed to PublishAsync or PublishSync (or
+	// context.Background for Publish and TryPublish), parent is the trace
+	// context set in user properties of the packet (see InjectTrace),
+	// which is empty if not present, the span should be a child of either
+	//
+	// the returned TraceContext is propagated to subscribers with the packet
+	// (MQTT 5 only) if the packet has no trace context set, no propagation
+	// if it's not valid
+	StartPublish(ctx context.Context, topic string, parent TraceContext) (Span, TraceContext)
+
+	// StartReceive starts the span of handling a received packet,
+	// the span ends after the topic handler returned
+	//
+	// parent is the trace context extracted from the packet,
+	// which is empty if not present
+	StartReceive(topic string, parent TraceContext) Span
+}
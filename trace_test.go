@@ -0,0 +1,254 @@
+/*
+ * Copyright Go-IIoT (https://github.com/goiiot)
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package libmqtt
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"testing"
+	"time"
+)
+
+const testTraceParent = "00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01"
+
+func TestTraceContext_IsValid(t *testing.T) {
+	for _, c := range []struct {
+		parent string
+		valid  bool
+	}{
+		{testTraceParent, true},
+		{"01-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01-foo", true},
+		{"", false},
+		{"00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01-foo", false},
+		{"ff-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01", false},
+		{"00-4BF92F3577B34DA6A3CE929D0E0E4736-00f067aa0ba902b7-01", false},
+		{"00-00000000000000000000000000000000-00f067aa0ba902b7-01", false},
+		{"00-4bf92f3577b34da6a3ce929d0e0e4736-0000000000000000-01", false},
+		{"00_4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01", false},
+	} {
+		if (TraceContext{TraceParent: c.parent}).IsValid() != c.valid {
+			t.Error("trace parent validation mismatch, parent =", c.parent)
+		}
+	}
+}
+
+func TestInjectExtractTrace(t *testing.T) {
+	origin := UserProps{"foo": []string{"bar"}}
+	p := &PublishPacket{
+		BasePacket: BasePacket{ProtoVersion: V5},
+		TopicName:  "foo",
+		Props:      &PublishProps{UserProps: origin},
+	}
+
+	InjectTrace(p, TraceContext{TraceParent: "invalid"})
+	if _, ok := p.Props.UserProps[TraceParentKey]; ok {
+		t.Error("invalid trace context injected")
+	}
+
+	tc := TraceContext{TraceParent: testTraceParent, TraceState: "foo=bar"}
+	InjectTrace(p, tc)
+	if _, ok := origin[TraceParentKey]; ok {
+		t.Error("user props of the original packet modified")
+	}
+
+	// round trip with the wire format
+	buf := &bytes.Buffer{}
+	if err := p.WriteTo(buf); err != nil {
+		t.Fatal(err)
+	}
+
+	pkt, err := Decode(V5, buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	pub, ok := pkt.(*PublishPacket)
+	if !ok {
+		t.Fatal("not a publish packet")
+	}
+
+	if got := ExtractTrace(pub); got != tc {
+		t.Error("trace context mismatch, got =", got)
+	}
+
+	if v := pub.Props.UserProps["foo"]; len(v) != 1 || v[0] != "bar" {
+		t.Error("user props lost, props =", pub.Props.UserProps)
+	}
+
+	if ExtractTrace(&PublishPacket{}) != (TraceContext{}) {
+		t.Error("trace context extracted from packet without props")
+	}
+}
+
+type testSpan struct {
+	name   string
+	err    error
+	ctx    context.Context
+	parent TraceContext
+}
+
+type testTracer struct {
+	ended chan *testSpan
+}
+
+func (t *testTracer) StartPublish(ctx context.Context, topic string, parent TraceContext) (Span, TraceContext) {
+	return &testTracerSpan{t: t, span: &testSpan{name: "publish " + topic, ctx: ctx, parent: parent}},
+		TraceContext{TraceParent: testTraceParent}
+}
+
+func (t *testTracer) StartReceive(topic string, parent TraceContext) Span {
+	return &testTracerSpan{t: t, span: &testSpan{name: "receive " + topic}}
+}
+
+type testTracerSpan struct {
+	t    *testTracer
+	span *testSpan
+}
+
+func (s *testTracerSpan) End(err error) {
+	s.span.err = err
+	s.t.ended <- s.span
+}
+
+func TestClientTracer(t *testing.T) {
+	l := testBrokerWith(t, func(rw *bufio.ReadWriter) {
+		pkt, err := Decode(V311, rw)
+		if err != nil {
+			t.Error("decode publish packet failed, err =", err)
+			return
+		}
+
+		// echo the publish packet back
+		pkt.WriteTo(rw)
+		rw.Flush()
+		time.Sleep(100 * time.Millisecond)
+	})
+	defer l.Close()
+
+	tracer := &testTracer{ended: make(chan *testSpan, 2)}
+	c, err := NewClient(WithServer(l.Addr().String()), WithTracer(tracer))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Destroy(true)
+
+	connected := make(chan struct{})
+	c.Connect(func(server string, code ReasonCode, err error) {
+		close(connected)
+	})
+
+	select {
+	case <-connected:
+	case <-time.After(time.Second):
+		t.Fatal("connect timeout")
+	}
+
+	type ctxKey struct{}
+	ctx := context.WithValue(context.Background(), ctxKey{}, "caller")
+	c.PublishAsync(ctx, &PublishPacket{TopicName: "foo", Payload: []byte("bar")})
+
+	names := make(map[string]bool)
+	for i := 0; i < 2; i++ {
+		select {
+		case s := <-tracer.ended:
+			if s.err != nil {
+				t.Error("span ended with error, name =", s.name, "err =", s.err)
+			}
+			if s.name == "publish foo" && s.ctx.Value(ctxKey{}) != "caller" {
+				t.Error("publish span not started with the context of caller")
+			}
+			names[s.name] = true
+		case <-time.After(time.Second):
+			t.Fatal("span not ended, ended =", names)
+		}
+	}
+
+	if !names["publish foo"] || !names["receive foo"] {
+		t.Error("span mismatch, ended =", names)
+	}
+}
+
+func TestClientConn_InjectTrace(t *testing.T) {
+	c, err := NewClient(WithServer("localhost:1883"), WithVersion(V5, true), WithTracer(&testTracer{}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Destroy(true)
+
+	for _, v := range []ProtoVersion{V311, V5} {
+		p := &PublishPacket{TopicName: "foo"}
+		c.spans.Store(p, &pubSpan{trace: TraceContext{TraceParent: testTraceParent}})
+
+		// negotiated version, not the version in options
+		conn := &clientConn{parent: c, protoVersion: v}
+		sent := conn.injectTrace(p)
+		if injected := ExtractTrace(sent).IsValid(); injected != (v == V5) {
+			t.Error("trace injection mismatch, version =", v, "injected =", injected)
+		}
+
+		// packet of user not modified
+		if p.Props != nil {
+			t.Error("trace context injected into packet of user, version =", v)
+		}
+	}
+
+	// published again with another span
+	p := &PublishPacket{TopicName: "foo"}
+	conn := &clientConn{parent: c, protoVersion: V5}
+	for _, parent := range []string{testTraceParent, "00-0af7651916cd43dd8448eb211c80319c-00f067aa0ba902b7-01"} {
+		c.spans.Store(p, &pubSpan{trace: TraceContext{TraceParent: parent}})
+		if got := ExtractTrace(conn.injectTrace(p)); got.TraceParent != parent {
+			t.Error("trace context of previous publish sent, got =", got)
+		}
+	}
+
+	// trace context set by user is kept
+	userTrace := TraceContext{TraceParent: "00-0af7651916cd43dd8448eb211c80319c-b7ad6b7169203331-01", TraceState: "user=1"}
+	p = &PublishPacket{TopicName: "foo"}
+	InjectTrace(p, userTrace)
+	c.spans.Store(p, &pubSpan{trace: TraceContext{TraceParent: testTraceParent}})
+
+	if got := ExtractTrace(conn.injectTrace(p)); got != userTrace {
+		t.Error("trace context of user replaced, got =", got)
+	}
+}
+
+func TestClientTracer_Parent(t *testing.T) {
+	tracer := &testTracer{ended: make(chan *testSpan, 1)}
+	c, err := NewClient(WithServer("localhost:1883"), WithTracer(tracer), WithOfflineQueue(1, OfflineError, nil))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Destroy(true)
+
+	parent := TraceContext{TraceParent: testTraceParent}
+	p := &PublishPacket{TopicName: "foo"}
+	InjectTrace(p, parent)
+	if err := c.TryPublish(p); err != nil {
+		t.Fatal(err)
+	}
+
+	s, ok := c.spans.Load(p)
+	if !ok {
+		t.Fatal("publish span not started")
+	}
+
+	if span := s.(*pubSpan).span.(*testTracerSpan).span; span.parent != parent || span.ctx == nil {
+		t.Error("parent of publish span mismatch, parent =", span.parent)
+	}
+}
@@ -17,12 +17,12 @@
 package libmqtt
 
 import (
-	"bytes"
 	"encoding/binary"
 	"fmt"
 	"io"
 	"math"
 	"sync"
+	"sync/atomic"
 )
 
 // BufferedWriter buffered writer, e.g. bufio.Writer, bytes.Buffer
@@ -44,16 +44,37 @@ func boolToByte(flag bool) byte {
 	return 0
 }
 
+const (
+	recvKeyPrefix = "R"
+	sendKeyPrefix = "S"
+)
+
 func recvKey(packetID uint16) string {
-	return fmt.Sprintf("%s%d", "R", packetID)
+	return fmt.Sprintf("%s%d", recvKeyPrefix, packetID)
 }
 
 func sendKey(packetID uint16) string {
-	return fmt.Sprintf("%s%d", "S", packetID)
+	return fmt.Sprintf("%s%d", sendKeyPrefix, packetID)
+}
+
+const queueKeyPrefix = "Q"
+
+func queueKey(seq uint64) string {
+	return fmt.Sprintf("%s%d", queueKeyPrefix, seq)
+}
+
+const retainedKeyPrefix = "T"
+
+// retainedKey is the key of the retained message, the topic is encoded
+// to be a valid file name
+func retainedKey(topic string) string {
+	return retainedKeyPrefix + sessionEncoding.EncodeToString([]byte(topic))
 }
 
 type idGenerator struct {
-	usedIds *sync.Map
+	usedIds  *sync.Map
+	count    int64           // count of ids in use
+	onChange func(count int) // called when count of ids in use changed
 }
 
 func newIDGenerator() *idGenerator {
@@ -65,8 +86,8 @@ func newIDGenerator() *idGenerator {
 func (g *idGenerator) next(extra interface{}) uint16 {
 	var i uint16
 	for i = 1; i < math.MaxUint16; i++ {
-		if _, ok := g.usedIds.Load(i); !ok {
-			g.usedIds.Store(i, extra)
+		if _, loaded := g.usedIds.LoadOrStore(i, extra); !loaded {
+			g.changed(1)
 			return i
 		}
 	}
@@ -74,7 +95,16 @@ func (g *idGenerator) next(extra interface{}) uint16 {
 }
 
 func (g *idGenerator) free(id uint16) {
-	g.usedIds.Delete(id)
+	if _, loaded := g.usedIds.LoadAndDelete(id); loaded {
+		g.changed(-1)
+	}
+}
+
+func (g *idGenerator) changed(delta int64) {
+	count := atomic.AddInt64(&g.count, delta)
+	if g.onChange != nil {
+		g.onChange(int(count))
+	}
 }
 
 func (g *idGenerator) getExtra(id uint16) (interface{}, bool) {
@@ -89,14 +119,46 @@ func putUint32(d []byte, v uint32) {
 	binary.BigEndian.PutUint32(d[:], v)
 }
 
-func encodeStringWithLen(str string) []byte {
-	return encodeBytesWithLen([]byte(str))
+func writeUint16(w BufferedWriter, v uint16) {
+	w.WriteByte(byte(v >> 8))
+	w.WriteByte(byte(v))
+}
+
+func writeUint32(w BufferedWriter, v uint32) {
+	w.WriteByte(byte(v >> 24))
+	w.WriteByte(byte(v >> 16))
+	w.WriteByte(byte(v >> 8))
+	w.WriteByte(byte(v))
+}
+
+// writeStringData writes string with 2 bytes length prefix,
+// without converting it to bytes if possible
+func writeStringData(w BufferedWriter, str string) error {
+	writeUint16(w, uint16(len(str)))
+	if sw, ok := w.(io.StringWriter); ok {
+		_, err := sw.WriteString(str)
+		return err
+	}
+
+	_, err := w.Write([]byte(str))
+	return err
+}
+
+// writeBinaryData writes data with 2 bytes length prefix
+func writeBinaryData(w BufferedWriter, data []byte) error {
+	writeUint16(w, uint16(len(data)))
+	_, err := w.Write(data)
+	return err
 }
 
-func encodeBytesWithLen(data []byte) []byte {
-	l := len(data)
-	result := []byte{byte(l >> 8), byte(l)}
-	return append(result, data...)
+// varIntLen is the count of bytes n takes as variable byte integer
+func varIntLen(n int) int {
+	l := 1
+	for n >= 128 {
+		n /= 128
+		l++
+	}
+	return l
 }
 
 func writeVarInt(n int, w BufferedWriter) error {
@@ -173,97 +235,134 @@ func getUint32(d []byte) uint32 {
 // | prop body.. |
 // |   payload   |
 func getRawProps(data []byte) (props map[byte][]byte, next []byte, err error) {
-	defer func() {
-		e := recover()
-		if e != nil {
-			err = ErrDecodeBadPacket
+	raw := make(rawProps)
+	if next, err = rangeProps(data, raw); err != nil {
+		return nil, nil, err
+	}
+	return raw, next, nil
+}
+
+// propsSetter sets property value to props struct
+type propsSetter interface {
+	setProp(key byte, v []byte)
+}
+
+// rawProps collects raw property values by property key,
+// values of the same key are concatenated
+type rawProps map[byte][]byte
+
+func (r rawProps) setProp(key byte, v []byte) {
+	r[key] = append(r[key], v...)
+}
+
+// rangeProps parses properties at the beginning of data and sets them to props
+// one by one, returns data after the properties
+func rangeProps(data []byte, props propsSetter) ([]byte, error) {
+	if len(data) == 0 {
+		// properties absent
+		return data, nil
+	}
+
+	propsLen, n, err := getVarInt(data)
+	if err != nil || n+propsLen > len(data) {
+		return nil, ErrDecodeBadPacket
+	}
+
+	propsBytes, next := data[n:n+propsLen], data[n+propsLen:]
+	for len(propsBytes) > 0 {
+		key := propsBytes[0]
+		valueLen, err := propValueLen(key, propsBytes[1:])
+		if err != nil || 1+valueLen > len(propsBytes) {
+			return nil, ErrDecodeBadPacket
 		}
-	}()
-
-	propsLen, byteLen := getRemainLength(bytes.NewReader(data))
-	propsBytes := data[byteLen : propsLen+byteLen]
-	next = data[propsLen+byteLen:]
-	props = make(map[byte][]byte)
-
-	for i := 0; i < propsLen; {
-		var p []byte
-		switch propsBytes[0] {
-		case propKeyPayloadFormatIndicator:
-			p = propsBytes[1:2]
-		case propKeyMessageExpiryInterval:
-			p = propsBytes[1:5]
-		case propKeyContentType:
-			p = propsBytes[1 : 3+getUint16(propsBytes[1:3])]
-		case propKeyRespTopic:
-			p = propsBytes[1 : 3+getUint16(propsBytes[1:3])]
-		case propKeyCorrelationData:
-			p = propsBytes[1 : 3+getUint16(propsBytes[1:3])]
-		case propKeySubID:
-			_, byteLen := getRemainLength(bytes.NewReader(propsBytes[1:]))
-			p = propsBytes[1 : 1+byteLen]
-		case propKeySessionExpiryInterval:
-			p = propsBytes[1:5]
-		case propKeyAssignedClientID:
-			p = propsBytes[1 : 3+getUint16(propsBytes[1:3])]
-		case propKeyServerKeepalive:
-			p = propsBytes[1:3]
-		case propKeyAuthMethod:
-			p = propsBytes[1 : 3+getUint16(propsBytes[1:3])]
-		case propKeyAuthData:
-			p = propsBytes[1 : 3+getUint16(propsBytes[1:3])]
-		case propKeyReqProblemInfo:
-			p = propsBytes[1:2]
-		case propKeyWillDelayInterval:
-			p = propsBytes[1:5]
-		case propKeyReqRespInfo:
-			p = propsBytes[1:2]
-		case propKeyRespInfo:
-			p = propsBytes[1 : 3+getUint16(propsBytes[1:3])]
-		case propKeyServerRef:
-			p = propsBytes[1 : 3+getUint16(propsBytes[1:3])]
-		case propKeyReasonString:
-			p = propsBytes[1 : 3+getUint16(propsBytes[1:3])]
-		case propKeyMaxRecv:
-			p = propsBytes[1:3]
-		case propKeyMaxTopicAlias:
-			p = propsBytes[1:3]
-		case propKeyTopicAlias:
-			p = propsBytes[1:3]
-		case propKeyMaxQos:
-			p = propsBytes[1:2]
-		case propKeyRetainAvail:
-			p = propsBytes[1:2]
-		case propKeyUserProps:
-			keyEnd := 2 + getUint16(propsBytes[1:3])
-			valEnd := 2 + keyEnd + getUint16(propsBytes[keyEnd+1:keyEnd+3])
-			p = propsBytes[1 : valEnd+1]
-		case propKeyMaxPacketSize:
-			p = propsBytes[1:5]
-		case propKeyWildcardSubAvail:
-			p = propsBytes[1:2]
-		case propKeySubIDAvail:
-			p = propsBytes[1:2]
-		case propKeySharedSubAvail:
-			p = propsBytes[1:2]
-		default:
-			err = ErrDecodeBadPacket
-			return
+
+		props.setProp(key, propsBytes[1:1+valueLen])
+		propsBytes = propsBytes[1+valueLen:]
+	}
+
+	return next, nil
+}
+
+// propValueLen returns length of the property value at the beginning of data
+func propValueLen(key byte, data []byte) (int, error) {
+	switch key {
+	case propKeyPayloadFormatIndicator, propKeyReqProblemInfo, propKeyReqRespInfo,
+		propKeyMaxQos, propKeyRetainAvail, propKeyWildcardSubAvail,
+		propKeySubIDAvail, propKeySharedSubAvail:
+		return 1, nil
+	case propKeyServerKeepalive, propKeyMaxRecv, propKeyMaxTopicAlias, propKeyTopicAlias:
+		return 2, nil
+	case propKeyMessageExpiryInterval, propKeySessionExpiryInterval,
+		propKeyWillDelayInterval, propKeyMaxPacketSize:
+		return 4, nil
+	case propKeySubID:
+		_, n, err := getVarInt(data)
+		return n, err
+	case propKeyContentType, propKeyRespTopic, propKeyCorrelationData,
+		propKeyAssignedClientID, propKeyAuthMethod, propKeyAuthData,
+		propKeyRespInfo, propKeyServerRef, propKeyReasonString:
+		if len(data) < 2 {
+			return 0, ErrDecodeBadPacket
+		}
+		return 2 + int(getUint16(data)), nil
+	case propKeyUserProps:
+		if len(data) < 2 {
+			return 0, ErrDecodeBadPacket
+		}
+
+		keyEnd := 2 + int(getUint16(data))
+		if keyEnd+2 > len(data) {
+			return 0, ErrDecodeBadPacket
 		}
-		props[propsBytes[0]] = append(props[propsBytes[0]], p...)
-		propsBytes = propsBytes[1+len(p):]
-		i += 1 + len(p)
+		return keyEnd + 2 + int(getUint16(data[keyEnd:])), nil
+	default:
+		return 0, ErrDecodeBadPacket
 	}
+}
 
-	return
+// getVarInt decodes variable byte integer at the beginning of data,
+// returns the value and count of bytes it takes
+func getVarInt(data []byte) (int, int, error) {
+	n := 0
+	for i := 0; i < 4 && i < len(data); i++ {
+		n |= int(data[i]&127) << (7 * uint(i))
+		if data[i]&128 == 0 {
+			return n, i + 1, nil
+		}
+	}
+	return 0, 0, ErrDecodeBadPacket
+}
+
+// copyBinaryData copies binary data with length prefix
+func copyBinaryData(data []byte) []byte {
+	b, _, err := getBinaryData(data)
+	if err != nil {
+		return nil
+	}
+	return append(make([]byte, 0, len(b)), b...)
 }
 
 func getUserProps(data []byte) UserProps {
-	props := make(UserProps)
-	strKey, next, _ := getStringData(data)
-	for ; next != nil; strKey, next, _ = getStringData(next) {
+	return appendUserProps(make(UserProps), data)
+}
+
+// appendUserProps parses user properties in data and add them to props
+func appendUserProps(props UserProps, data []byte) UserProps {
+	if props == nil {
+		props = make(UserProps)
+	}
+
+	for len(data) > 0 {
+		key, next, err := getStringData(data)
+		if err != nil {
+			break
+		}
+
 		var val string
-		val, next, _ = getStringData(next)
-		props[strKey] = append(props[strKey], val)
+		if val, data, err = getStringData(next); err != nil {
+			break
+		}
+		props[key] = append(props[key], val)
 	}
 	return props
 }